@@ -5,18 +5,40 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/auth"
 	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/ratelimit"
 	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/stream"
+	"github.com/levenlabs/order-up/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// DefaultIdempotencyLockTimeout is how long a request holds its
+	// Idempotency-Key before another request with the same key can take it over
+	DefaultIdempotencyLockTimeout = time.Minute
+	// DefaultIdempotencyKeyTTL is how long a response is replayed to requests
+	// with the same Idempotency-Key
+	DefaultIdempotencyKeyTTL = 24 * time.Hour
 )
 
 // instance represents an API instance. Typically this is exported but for our
@@ -27,14 +49,198 @@ type instance struct {
 	router             *gin.Engine
 	fulfillmentService *http.Client
 	chargeService      *http.Client
+
+	// chargeLock ensures we only ever have a single outstanding request to the
+	// charge service at a time since it can't handle concurrent requests
+	chargeLock sync.Mutex
+
+	// chargeSlots has room for as many requests as can be calling, or waiting to
+	// call, the charge service at once and if it's nil there's no limit
+	chargeSlots chan struct{}
+
+	// charging counts the requests to this instance that are in the middle of
+	// charging each order so that a retry never looks up the charge for an order
+	// whose charge is still in flight
+	chargingLock sync.Mutex
+	charging     map[string]int
+	// chargeRetryAfter is how long an order has to have been charging before a
+	// retry looks up its charge, which covers charges in flight on other
+	// instances sharing the storage
+	chargeRetryAfter time.Duration
+
+	// idem stores the responses for requests made with an Idempotency-Key header
+	// and if it's nil then the header is ignored
+	idem mocks.IdempotencyStorage
+	// idemLockTimeout is how long a request with an Idempotency-Key holds it,
+	// in case it never finishes, and idemTTL is how long its response is kept
+	idemLockTimeout time.Duration
+	idemTTL         time.Duration
+
+	// events is where the audit trail of every change made to an order is read
+	// from and if it's nil then GET /orders/:id/events isn't exposed. The events
+	// themselves are always recorded in stor along with the changes.
+	events mocks.EventStorage
+
+	// webhooks stores the webhook subscriptions and deliveries and if it's nil
+	// then the /webhooks endpoints aren't exposed
+	webhooks mocks.WebhookStorage
+
+	// broker is sent every order creation and status change for GET
+	// /orders/stream and if it's nil then the stream isn't exposed
+	broker *stream.Broker
+
+	// authn identifies the caller of every request other than GET /healthz and
+	// if it's nil then callers aren't authenticated
+	authn auth.Authenticator
+
+	// limiters limit how often each caller can call the routes in each group and
+	// routes in groups without a limiter aren't limited
+	limiters map[RateLimitGroup]*ratelimit.Limiter
+	// trustedProxies are the proxies whose forwarding headers are trusted for the
+	// caller's IP address
+	trustedProxies []string
+
+	// metrics are recorded in registry
+	registry *prometheus.Registry
+	metrics  *instanceMetrics
+
+	// now returns the current time for the timestamps the handlers set like when a
+	// payment or refund was made
+	now func() time.Time
+}
+
+// Option configures optional functionality on the http.Handler returned by
+// Handler
+type Option func(*instance)
+
+// WithIdempotencyStorage enables support for the Idempotency-Key header on the
+// POST endpoints that create orders or charges by storing responses in idem.
+func WithIdempotencyStorage(idem mocks.IdempotencyStorage) Option {
+	return func(i *instance) {
+		i.idem = idem
+	}
+}
+
+// WithIdempotencyLockTimeout lets another request with the same Idempotency-Key
+// take it over once the request holding it has been running for d, which should
+// be longer than any request can take, so a key isn't stuck forever if the
+// request holding it never finished because the service crashed.
+func WithIdempotencyLockTimeout(d time.Duration) Option {
+	return func(i *instance) {
+		i.idemLockTimeout = d
+	}
+}
+
+// WithIdempotencyKeyTTL replays a response to requests with the same
+// Idempotency-Key for d after it was made. The key can be used again afterwards
+// and storage can delete it with DeleteExpiredIdempotencyKeys.
+func WithIdempotencyKeyTTL(d time.Duration) Option {
+	return func(i *instance) {
+		i.idemTTL = d
+	}
+}
+
+// WithEventStorage exposes the events recorded for every change made to an
+// order, which are read from events, at GET /orders/:id/events.
+func WithEventStorage(events mocks.EventStorage) Option {
+	return func(i *instance) {
+		i.events = events
+	}
+}
+
+// WithWebhookStorage exposes the /webhooks endpoints for managing webhook
+// subscriptions and dead-lettered deliveries in webhooks. The webhooks
+// themselves are sent by a webhooks.Dispatcher.
+func WithWebhookStorage(webhooks mocks.WebhookStorage) Option {
+	return func(i *instance) {
+		i.webhooks = webhooks
+	}
+}
+
+// WithStream publishes every order creation and status change to broker and
+// streams them to clients as Server-Sent Events at GET /orders/stream.
+func WithStream(broker *stream.Broker) Option {
+	return func(i *instance) {
+		i.broker = broker
+	}
+}
+
+// WithAuthenticator requires every request, other than GET /healthz, to be
+// authenticated by authn. The caller's identity is logged and recorded as the
+// actor of the order events for their changes, and their roles limit the routes
+// and orders they can access.
+func WithAuthenticator(authn auth.Authenticator) Option {
+	return func(i *instance) {
+		i.authn = authn
+	}
+}
+
+// WithRateLimit limits how often each caller can call the routes in group with
+// limiter. Callers are told apart by their identity if they're authenticated
+// and otherwise by their IP address. RateLimitIP is always by IP address since
+// it's checked before the caller is authenticated.
+func WithRateLimit(group RateLimitGroup, limiter *ratelimit.Limiter) Option {
+	return func(i *instance) {
+		if i.limiters == nil {
+			i.limiters = map[RateLimitGroup]*ratelimit.Limiter{}
+		}
+		i.limiters[group] = limiter
+	}
+}
+
+// WithTrustedProxies trusts the X-Forwarded-For and X-Real-IP headers of
+// requests from proxies, which are IP addresses or CIDR ranges, when working out
+// the caller's IP address for rate limiting and logging. Otherwise the headers
+// are ignored since any caller can set them.
+func WithTrustedProxies(proxies []string) Option {
+	return func(i *instance) {
+		i.trustedProxies = proxies
+	}
+}
+
+// WithChargeConcurrency limits how many requests can be calling, or waiting to
+// call, the charge service at once to n. Requests over the limit are rejected
+// instead of queueing up behind a slow charge service.
+func WithChargeConcurrency(n int) Option {
+	return func(i *instance) {
+		i.chargeSlots = make(chan struct{}, n)
+	}
+}
+
+// WithChargeRetryAfter only lets a charge be retried for an order that was left
+// charging, because it's unknown whether the charge service charged it, once
+// it's been charging for d. This only needs to be set, to longer than a charge
+// can take, when several instances share the same storage since each instance
+// knows which orders its own requests are charging.
+func WithChargeRetryAfter(d time.Duration) Option {
+	return func(i *instance) {
+		i.chargeRetryAfter = d
+	}
+}
+
+// WithMetrics records the handler's metrics in registry and serves them, along
+// with anything else in registry, at GET /metrics for Prometheus to scrape
+func WithMetrics(registry *prometheus.Registry) Option {
+	return func(i *instance) {
+		i.registry = registry
+	}
+}
+
+// WithClock replaces the clock used for the timestamps set by the handlers, like
+// when a payment or refund was made, which is useful for tests.
+func WithClock(now func() time.Time) Option {
+	return func(i *instance) {
+		i.now = now
+	}
 }
 
 // Handler returns an implementation of the http.Handler interface that can be
 // passed to an http.Server to handle incoming HTTP requests. This accepts
 // an interface for the storage.Instance and http.Client's for the 2 dependent
 // services. Typically this would accept just a *storage.Instance but the mock
-// allows us to separate the api tests from the storage tests.
-func Handler(stor mocks.StorageInstance, fulfillmentService, chargeService *http.Client) http.Handler {
+// allows us to separate the api tests from the storage tests. Any optional
+// functionality can be enabled by passing Options.
+func Handler(stor mocks.StorageInstance, fulfillmentService, chargeService *http.Client, opts ...Option) http.Handler {
 	// inst is pointer to a new instance that's holding a new storage.Instance for
 	// talking to the underlying database
 	inst := &instance{
@@ -42,39 +248,245 @@ func Handler(stor mocks.StorageInstance, fulfillmentService, chargeService *http
 		router:             gin.Default(),
 		fulfillmentService: fulfillmentService,
 		chargeService:      chargeService,
+		charging:           map[string]int{},
+		idemLockTimeout:    DefaultIdempotencyLockTimeout,
+		idemTTL:            DefaultIdempotencyKeyTTL,
+		now:                time.Now,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	inst.setupMetrics()
+
+	// gin trusts the forwarding headers from everyone by default which would let
+	// callers pick their own IP address and get around the IP rate limit
+	if err := inst.router.SetTrustedProxies(inst.trustedProxies); err != nil {
+		llog.Error("invalid trusted proxies, trusting none", llog.KV{
+			"trusted_proxies": strings.Join(inst.trustedProxies, ","),
+		}, llog.ErrKV(err))
+		inst.router.SetTrustedProxies(nil)
 	}
 
-	// Add logging middleware to all routes
-	inst.router.Use(inst.loggingMiddleware())
+	// Add request ID and logging middleware to all routes
+	inst.router.Use(inst.requestIDMiddleware(), inst.loggingMiddleware())
 
 	// set up the various REST endpoints that are exposed publicly over HTTP
 	// go implicitly binds these functions to inst
 	inst.router.GET("/healthz", inst.healthCheck)
-	inst.router.GET("/orders", inst.getOrders)
-	inst.router.POST("/orders", inst.postOrders)
+
+	// every other route requires the caller to be authenticated, if there's an
+	// authenticator, so load balancers can still check the service's health
+	// the IP limit is checked before authenticating so that callers without valid
+	// credentials can't make us check as many as they like
+	routes := inst.router.Group("/", inst.rateLimitMiddleware(RateLimitIP))
+	if inst.authn != nil {
+		routes.Use(inst.authMiddleware(), inst.authorizeMiddleware())
+	}
+
+	// every route is in a rate limit group so a caller that's hammering one kind
+	// of request, like charges, doesn't use up their limit for the others
+	reads := routes.Group("", inst.rateLimitMiddleware(RateLimitRead))
+	writes := routes.Group("", inst.rateLimitMiddleware(RateLimitWrite))
+	charges := routes.Group("", inst.rateLimitMiddleware(RateLimitCharge))
+
+	// the metrics aren't in a group since Prometheus scrapes them on a schedule
+	// and they include every caller's requests so they need the metrics role
+	if inst.registry != nil {
+		routes.GET("/metrics", gin.WrapH(promhttp.HandlerFor(inst.registry, promhttp.HandlerOpts{})))
+	}
+
+	reads.GET("/orders", inst.getOrders)
+	if inst.broker != nil {
+		reads.GET("/orders/stream", inst.streamOrders)
+	}
+	writes.POST("/orders", inst.idempotencyMiddleware(), inst.postOrders)
 
 	// Use order fetch middleware for routes that need to fetch an order
-	inst.router.GET("/orders/:id", inst.orderFetchMiddleware(), inst.getOrder)
-	inst.router.POST("/orders/:id/charge", inst.orderFetchMiddleware(), inst.chargeOrder)
-	inst.router.POST("/orders/:id/cancel", inst.orderFetchMiddleware(), inst.cancelOrder)
+	reads.GET("/orders/:id", inst.orderFetchMiddleware(), inst.getOrder)
+	writes.PUT("/orders/:id", inst.orderFetchMiddleware(), inst.ifMatchMiddleware(), inst.putOrder)
+	charges.POST("/orders/:id/charge", inst.idempotencyMiddleware(), inst.orderFetchMiddleware(), inst.ifMatchMiddleware(), inst.chargeOrder)
+	charges.POST("/orders/:id/cancel", inst.orderFetchMiddleware(), inst.ifMatchMiddleware(), inst.cancelOrder)
+	writes.POST("/orders/:id/fulfill", inst.orderFetchMiddleware(), inst.requireIfMatchMiddleware(), inst.ifMatchMiddleware(), inst.fulfillOrder)
+	charges.POST("/orders/:id/refunds", inst.orderFetchMiddleware(), inst.requireIfMatchMiddleware(), inst.ifMatchMiddleware(), inst.refundOrder)
+	if inst.events != nil {
+		reads.GET("/orders/:id/events", inst.orderFetchMiddleware(), inst.getOrderEvents)
+	}
+	if inst.webhooks != nil {
+		reads.GET("/webhooks", inst.getWebhooks)
+		writes.POST("/webhooks", inst.postWebhooks)
+		writes.DELETE("/webhooks/:id", inst.deleteWebhook)
+		reads.GET("/webhooks/dead-letters", inst.getWebhookDeadLetters)
+		writes.POST("/webhooks/dead-letters/:id/retry", inst.retryWebhookDeadLetter)
+	}
 
 	// *instance implements the http.Handler interface with the ServeHTTP method
 	// below so we can just return inst
 	return inst
 }
 
+// setupMetrics registers the instance's metrics in its registry. The metrics
+// are always recorded, in a registry of their own if one wasn't passed to
+// WithMetrics, so the handlers don't need to check if they're enabled.
+func (i *instance) setupMetrics() {
+	registry := i.registry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+	i.metrics = newInstanceMetrics(registry)
+}
+
 // ServeHTTP implements the http.Handler interface and passes incoming HTTP
 // requests to the underlying *gin.Engine
 func (i *instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	i.router.ServeHTTP(w, r)
 }
 
+// instanceMetrics are the metrics recorded by the handler
+type instanceMetrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	ordersCreated   prometheus.Counter
+	ordersCharged   prometheus.Counter
+	ordersCancelled prometheus.Counter
+	refundedCents   prometheus.Counter
+
+	dependencyRequests *prometheus.CounterVec
+	dependencyDuration *prometheus.HistogramVec
+
+	rateLimited    *prometheus.CounterVec
+	chargeRejected prometheus.Counter
+	chargeInFlight prometheus.Gauge
+}
+
+// newInstanceMetrics registers the handler's metrics in registry. Registering
+// them again returns the same metrics so RecoverCharges and Handler can share a
+// registry.
+func newInstanceMetrics(registry *prometheus.Registry) *instanceMetrics {
+	return &instanceMetrics{
+		requests: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_up_http_requests_total",
+			Help: "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"})),
+		requestDuration: register(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "order_up_http_request_duration_seconds",
+			Help: "How long HTTP requests took by method, route and status code.",
+		}, []string{"method", "route", "status"})),
+
+		ordersCreated: register(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "order_up_orders_created_total",
+			Help: "Orders created.",
+		})),
+		ordersCharged: register(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "order_up_orders_charged_total",
+			Help: "Orders charged, including orders with nothing to charge.",
+		})),
+		ordersCancelled: register(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "order_up_orders_cancelled_total",
+			Help: "Orders cancelled.",
+		})),
+		refundedCents: register(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "order_up_refunded_cents_total",
+			Help: "Cents refunded to customers by refunds and cancellations.",
+		})),
+
+		dependencyRequests: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_up_dependency_requests_total",
+			Help: "Requests made to the charge and fulfillment services by service, operation and result, which is success or error.",
+		}, []string{"service", "operation", "result"})),
+		dependencyDuration: register(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "order_up_dependency_request_duration_seconds",
+			Help: "How long requests to the charge and fulfillment services took by service and operation.",
+		}, []string{"service", "operation"})),
+
+		rateLimited: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_up_rate_limited_requests_total",
+			Help: "Requests rejected because the caller was over the rate limit of the route's group.",
+		}, []string{"group"})),
+		chargeRejected: register(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "order_up_charge_service_rejected_requests_total",
+			Help: "Requests rejected because too many requests were already calling the charge service.",
+		})),
+		chargeInFlight: register(registry, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "order_up_charge_service_in_flight_requests",
+			Help: "Requests calling, or waiting to call, the charge service.",
+		})),
+	}
+}
+
+// register registers c in registry and returns it, or the collector that was
+// already registered in its place. Any other error is a programming error, like
+// two different metrics with the same name, so that panics.
+func register[C prometheus.Collector](registry *prometheus.Registry, c C) C {
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(C)
+		}
+		panic(err)
+	}
+	return c
+}
+
+// metricsMethod returns the method label for a request's method. Callers can
+// send any method they like so the ones we don't know about share a label
+// rather than each creating their own series.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// observeEvent counts the orders created, charged and cancelled and the cents
+// refunded from the events recorded for them. Cancellations and refunds are
+// recorded before the charge service refunds the customer so it's only called
+// once the change the event records has fully succeeded.
+func (m *instanceMetrics) observeEvent(event storage.OrderEvent) {
+	switch event.Type {
+	case storage.OrderEventCreated:
+		m.ordersCreated.Inc()
+	case storage.OrderEventCharged:
+		m.ordersCharged.Inc()
+	case storage.OrderEventCancelled:
+		m.ordersCancelled.Inc()
+		// cancelling a charged order refunds whatever was left
+		m.refundedCents.Add(float64(event.AmountCents))
+	case storage.OrderEventRefunded:
+		m.refundedCents.Add(float64(event.AmountCents))
+	}
+}
+
+// observeDependency records a request to the charge or fulfillment service that
+// started at start and failed if err isn't nil
+func (m *instanceMetrics) observeDependency(service, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.dependencyRequests.WithLabelValues(service, operation, result).Inc()
+	m.dependencyDuration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 type getOrdersRes struct {
 	Orders []storage.Order `json:"orders"`
+	// NextCursor is sent as the cursor query parameter to get the next page and is
+	// omitted on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
+const (
+	// defaultOrdersLimit is how many orders GET /orders returns if no limit is sent
+	defaultOrdersLimit = 100
+	// maxOrdersLimit is the most orders GET /orders returns in a single page
+	maxOrdersLimit = 1000
+)
+
 type errorResponse struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
@@ -82,17 +494,38 @@ type errorResponse struct {
 
 // Error codes for different types of errors
 const (
-	ErrCodeOrderNotFound      = "order_not_found"
-	ErrCodeOrderExists        = "order_already_exists"
-	ErrCodeInvalidEmail       = "invalid_email"
-	ErrCodeInvalidLineItems   = "invalid_line_items"
-	ErrCodeInvalidTotal       = "invalid_total"
-	ErrCodeInvalidStatus      = "invalid_status"
-	ErrCodeOrderNotCharged    = "order_not_charged"
-	ErrCodeOrderNotEligible   = "order_not_eligible"
-	ErrCodeInvalidJSON        = "invalid_json"
-	ErrCodeInternalError      = "internal_error"
-	ErrCodeChargeServiceError = "charge_service_error"
+	ErrCodeOrderNotFound           = "order_not_found"
+	ErrCodeOrderExists             = "order_already_exists"
+	ErrCodeInvalidEmail            = "invalid_email"
+	ErrCodeInvalidLineItems        = "invalid_line_items"
+	ErrCodeInvalidTotal            = "invalid_total"
+	ErrCodeInvalidStatus           = "invalid_status"
+	ErrCodeOrderNotCharged         = "order_not_charged"
+	ErrCodeOrderNotEligible        = "order_not_eligible"
+	ErrCodeInvalidJSON             = "invalid_json"
+	ErrCodeInternalError           = "internal_error"
+	ErrCodeChargeServiceError      = "charge_service_error"
+	ErrCodeFulfillmentServiceError = "fulfillment_service_error"
+	ErrCodeIdempotencyKeyReused    = "idempotency_key_reused"
+	ErrCodeInvalidRefund           = "invalid_refund"
+	ErrCodeRefundExceedsCharge     = "refund_exceeds_charge"
+	ErrCodeVersionMismatch         = "order_version_mismatch"
+	ErrCodeIfMatchRequired         = "if_match_required"
+	ErrCodeInvalidTimeRange        = "invalid_time_range"
+	ErrCodeInvalidTotalRange       = "invalid_total_range"
+	ErrCodeInvalidLimit            = "invalid_limit"
+	ErrCodeInvalidCursor           = "invalid_cursor"
+	ErrCodeIdempotencyKeyInUse     = "idempotency_key_in_use"
+	ErrCodeInvalidWebhookURL       = "invalid_webhook_url"
+	ErrCodeInvalidEventTypes       = "invalid_event_types"
+	ErrCodeWebhookNotFound         = "webhook_not_found"
+	ErrCodeWebhookDeliveryNotFound = "webhook_delivery_not_found"
+	ErrCodeWebhookDeliveryNotDead  = "webhook_delivery_not_dead"
+	ErrCodeInvalidLastEventID      = "invalid_last_event_id"
+	ErrCodeUnauthorized            = "unauthorized"
+	ErrCodeForbidden               = "forbidden"
+	ErrCodeRateLimited             = "rate_limited"
+	ErrCodeChargeServiceBusy       = "charge_service_busy"
 )
 
 // Helper functions for creating structured errors
@@ -103,6 +536,29 @@ func (i *instance) handleError(c *gin.Context, statusCode int, code, message str
 	})
 }
 
+// handleTransitionError responds with the appropriate error when changing an
+// order with ApplyOrderChange fails. If the order's status
+// changed since we fetched it then another request beat us to it so the caller
+// gets a conflict.
+func (i *instance) handleTransitionError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, storage.ErrOrderVersionMismatch):
+		i.handleError(c, http.StatusPreconditionFailed, ErrCodeVersionMismatch,
+			fmt.Sprintf("order ineligible for %s - it was changed since the version in If-Match", action))
+	case errors.Is(err, storage.ErrOrderStatusMismatch):
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			fmt.Sprintf("order ineligible for %s - its status was changed by another request", action))
+	case errors.Is(err, storage.ErrLineItemFulfillmentMismatch):
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			fmt.Sprintf("order ineligible for %s - its line items were changed by another request", action))
+	case errors.Is(err, storage.ErrOrderNotFound):
+		i.handleError(c, http.StatusNotFound, ErrCodeOrderNotFound, "not found")
+	default:
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError,
+			fmt.Sprintf("error updating order: %v", err))
+	}
+}
+
 // Middleware for centralized logging
 // loggingMiddleware provides structured logging using llog for all requests
 func (i *instance) loggingMiddleware() gin.HandlerFunc {
@@ -128,10 +584,28 @@ func (i *instance) loggingMiddleware() gin.HandlerFunc {
 			"user_agent":  c.Request.UserAgent(),
 		}
 
+		// the route, rather than the path, is used for the metrics so that there's
+		// one series per endpoint instead of one per order
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := metricsMethod(c.Request.Method)
+		status := strconv.Itoa(c.Writer.Status())
+		i.metrics.requests.WithLabelValues(method, route, status).Inc()
+		i.metrics.requestDuration.WithLabelValues(method, route, status).Observe(duration.Seconds())
+
 		// Add order ID if present
 		if orderID != "" {
 			kv["order_id"] = orderID
 		}
+		if id := requestID(c); id != "" {
+			kv["request_id"] = id
+		}
+		if id, ok := identity(c); ok {
+			kv["subject"] = id.Subject
+			kv["auth_method"] = id.Method
+		}
 
 		// Log based on status code
 		if c.Writer.Status() >= 400 {
@@ -142,180 +616,1024 @@ func (i *instance) loggingMiddleware() gin.HandlerFunc {
 	}
 }
 
-// Middleware for handling order fetching with centralized error handling
-func (i *instance) orderFetchMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx := c.Request.Context()
+// maxRequestIDLength is the longest X-Request-ID we accept from a caller before
+// generating our own instead
+const maxRequestIDLength = 128
 
-		// Get order ID from URL parameter
-		id := c.Param("id")
-		if id == "" {
-			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidStatus, "missing order ID")
-			c.Abort()
-			return
+// Middleware for identifying requests
+// requestIDMiddleware uses the X-Request-ID header sent by the caller, or a new
+// random ID if there wasn't one, to identify the request in logs and order
+// events and sends it back in the response's X-Request-ID header
+func (i *instance) requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := strings.TrimSpace(c.GetHeader("X-Request-ID"))
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
 		}
+		c.Set("requestID", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
 
-		// Fetch order from storage
-		order, err := i.stor.GetOrder(ctx, id)
+// requestID returns the ID that requestIDMiddleware set for the request
+func requestID(c *gin.Context) string {
+	return c.GetString("requestID")
+}
+
+// Middleware for authenticating callers
+// authMiddleware responds with a 401 unless the authenticator identifies the
+// caller, in which case their identity is set on the context for the handlers
+func (i *instance) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := i.authn.Authenticate(c.Request)
 		if err != nil {
-			if errors.Is(err, storage.ErrOrderNotFound) {
-				i.handleError(c, http.StatusNotFound, ErrCodeOrderNotFound, "not found")
-			} else {
-				i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting order: %v", err))
+			var msg string
+			switch {
+			case errors.Is(err, auth.ErrNoCredentials):
+				c.Header("WWW-Authenticate", `Bearer realm="order-up"`)
+				msg = "missing Authorization header with an API key or token"
+			case errors.Is(err, auth.ErrExpiredCredentials):
+				c.Header("WWW-Authenticate", `Bearer realm="order-up", error="invalid_token"`)
+				msg = "token is expired or not valid yet"
+			default:
+				c.Header("WWW-Authenticate", `Bearer realm="order-up", error="invalid_token"`)
+				msg = "invalid API key or token"
 			}
+			llog.Warn("request not authenticated", llog.KV{
+				"path":      c.Request.URL.Path,
+				"client_ip": c.ClientIP(),
+			}, llog.ErrKV(err))
+			i.handleError(c, http.StatusUnauthorized, ErrCodeUnauthorized, msg)
 			c.Abort()
 			return
 		}
-
-		// Store order in context for use by handlers
-		c.Set("order", order)
+		c.Set("identity", id)
 		c.Next()
 	}
 }
 
-// Helper function to get order from context (set by middleware)
-func (i *instance) getOrderFromContext(c *gin.Context) storage.Order {
-	order, _ := c.Get("order")
-	return order.(storage.Order)
+// identity returns the caller's identity that authMiddleware set for the
+// request and false if the caller wasn't authenticated
+func identity(c *gin.Context) (auth.Identity, bool) {
+	id, ok := c.Get("identity")
+	if !ok {
+		return auth.Identity{}, false
+	}
+	return id.(auth.Identity), true
 }
 
-// healthCheck is called by incoming HTTP GET requests to /healthz
-func (i *instance) healthCheck(c *gin.Context) {
-	llog.Info("health check requested", llog.KV{"handler": "healthCheck"})
-
-	c.Status(http.StatusOK)
+// Roles that callers are given by their API key or token which decide what
+// they're allowed to do
+const (
+	// RoleCustomer can only read their own orders, which are the ones whose
+	// CustomerEmail is the caller's subject
+	RoleCustomer = "customer"
+	// RoleCharge is for the checkout service which creates, edits and charges
+	// orders and can cancel orders that haven't been charged yet
+	RoleCharge = "charge"
+	// RoleSupport is for customer support which can read, cancel and refund any
+	// order and manages webhooks
+	RoleSupport = "support"
+	// RoleWarehouse is for the warehouse which fulfills orders
+	RoleWarehouse = "warehouse"
+	// RoleMetrics is for Prometheus which scrapes the service's metrics
+	RoleMetrics = "metrics"
+)
 
-	llog.Info("health check completed successfully", llog.KV{"handler": "healthCheck"})
+// permission is what a role is allowed to do on a route
+type permission struct {
+	// own limits the role to orders whose CustomerEmail is the caller's subject
+	own bool
+	// statuses limits the role to orders with one of the statuses and if it's
+	// empty then orders with any status are allowed
+	statuses []storage.OrderStatus
 }
 
-// getOrders is called by incoming HTTP GET requests to /orders
-func (i *instance) getOrders(c *gin.Context) {
-	llog.Info("get orders request started", llog.KV{"handler": "getOrders"})
-
-	// the context of the request we pass along to every downstream function so we
-	// can stop processing if the caller aborts the request and also to ensure that
-	// the tracing context is kept throughout the whole request
-	ctx := c.Request.Context()
-
-	// get and parse the optional status query parameter from the request
-	// this lets you do /orders?status=pending to limit the orders to only those that
-	// are currently pending
-	var status storage.OrderStatus
-	statusStr := c.Query("status")
-	switch statusStr {
-	case "pending":
-		status = storage.OrderStatusPending
-		// the final break is implied if there's no fallthrough keyword
-	case "charged":
-		status = storage.OrderStatusCharged
-	case "fulfilled":
-		status = storage.OrderStatusFulfilled
-	case "cancelled":
-		status = storage.OrderStatusCancelled
-	case "":
-		// GetAllOrders accepts a -1 to indicate that all orders should be returned
-		status = -1
-	default:
-		llog.Error("invalid status parameter", llog.KV{"handler": "getOrders", "status": statusStr})
-		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidStatus, "unknown value for status: %v")
-		return
+// allows returns true if the permission lets the caller act on the order
+func (p permission) allows(id auth.Identity, order storage.Order) bool {
+	if p.own && !strings.EqualFold(order.CustomerEmail, id.Subject) {
+		return false
 	}
+	if len(p.statuses) == 0 {
+		return true
+	}
+	for _, status := range p.statuses {
+		if order.Status == status {
+			return true
+		}
+	}
+	return false
+}
 
-	llog.Info("fetching orders from storage", llog.KV{
-		"handler":       "getOrders",
-		"status_filter": statusStr,
-		"status_code":   int(status),
-	})
+// policy is which roles are allowed to call each route, keyed by the method and
+// the path the route was registered with, and any limits on the orders they can
+// call it for. Roles that aren't listed for a route, and routes that aren't
+// listed at all, are forbidden.
+var policy = map[string]map[string]permission{
+	"GET /orders": {
+		RoleCustomer:  {own: true},
+		RoleCharge:    {},
+		RoleSupport:   {},
+		RoleWarehouse: {},
+	},
+	"GET /orders/stream": {
+		RoleSupport:   {},
+		RoleWarehouse: {},
+	},
+	"POST /orders": {
+		RoleCharge:  {},
+		RoleSupport: {},
+	},
+	"GET /orders/:id": {
+		RoleCustomer:  {own: true},
+		RoleCharge:    {},
+		RoleSupport:   {},
+		RoleWarehouse: {},
+	},
+	"PUT /orders/:id": {
+		RoleCharge:  {},
+		RoleSupport: {},
+	},
+	"POST /orders/:id/charge": {
+		RoleCharge: {},
+	},
+	"POST /orders/:id/cancel": {
+		// cancelling a charged order refunds the customer so only support can
+		RoleCharge:  {statuses: []storage.OrderStatus{storage.OrderStatusPending}},
+		RoleSupport: {},
+	},
+	"POST /orders/:id/fulfill": {
+		RoleWarehouse: {},
+	},
+	"POST /orders/:id/refunds": {
+		RoleSupport: {},
+	},
+	"GET /orders/:id/events": {
+		RoleCustomer: {own: true},
+		RoleSupport:  {},
+	},
+	"GET /metrics": {
+		RoleMetrics: {},
+		RoleSupport: {},
+	},
+	"GET /webhooks":                         {RoleSupport: {}},
+	"POST /webhooks":                        {RoleSupport: {}},
+	"DELETE /webhooks/:id":                  {RoleSupport: {}},
+	"GET /webhooks/dead-letters":            {RoleSupport: {}},
+	"POST /webhooks/dead-letters/:id/retry": {RoleSupport: {}},
+}
 
-	// pass along the status and get all of the resulting orders from the storage
-	// instance
-	orders, err := i.stor.GetOrders(ctx, status)
-	if err != nil {
-		llog.Error("failed to get orders from storage", llog.KV{"handler": "getOrders"}, llog.ErrKV(err))
-		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting orders: %v", err))
-		return
+// permissions returns the permissions the caller's roles give them on the
+// route. If the caller wasn't authenticated then false is returned and they're
+// allowed to do anything.
+func permissions(c *gin.Context) ([]permission, bool) {
+	id, ok := identity(c)
+	if !ok {
+		return nil, false
+	}
+	rules := policy[c.Request.Method+" "+c.FullPath()]
+	var perms []permission
+	for _, role := range id.Roles {
+		if p, ok := rules[role]; ok {
+			perms = append(perms, p)
+		}
 	}
+	return perms, true
+}
 
-	// by default slices are nil and if we return that the resulting JSON would be
-	// {"orders":null} which some languages/clients have a problem with
-	// instead set it to an empty slice
-	if orders == nil {
-		orders = []storage.Order{}
+// authorizeOrder returns true if any of the caller's permissions on the route
+// let them act on the order
+func authorizeOrder(c *gin.Context, order storage.Order) bool {
+	perms, ok := permissions(c)
+	if !ok {
+		return true
+	}
+	id, _ := identity(c)
+	for _, p := range perms {
+		if p.allows(id, order) {
+			return true
+		}
 	}
+	return false
+}
 
-	llog.Info("successfully retrieved orders from storage", llog.KV{
-		"handler":     "getOrders",
-		"order_count": len(orders),
-	})
+// onlyOwnOrders returns true if the caller's permissions on the route limit
+// them to their own orders
+func onlyOwnOrders(c *gin.Context) bool {
+	perms, ok := permissions(c)
+	if !ok {
+		return false
+	}
+	for _, p := range perms {
+		if !p.own {
+			return false
+		}
+	}
+	return true
+}
 
-	// respond with a success and return the orders
-	c.JSON(http.StatusOK, getOrdersRes{
-		Orders: orders,
+// handleForbidden logs and responds with a 403 for a caller that isn't allowed
+// to do what they asked
+func (i *instance) handleForbidden(c *gin.Context, message string) {
+	id, _ := identity(c)
+	llog.Warn("request not authorized", llog.KV{
+		"route":   c.Request.Method + " " + c.FullPath(),
+		"subject": id.Subject,
+		"roles":   strings.Join(id.Roles, ","),
 	})
-
-	llog.Info("get orders request completed successfully", llog.KV{"handler": "getOrders"})
+	i.handleError(c, http.StatusForbidden, ErrCodeForbidden, message)
 }
 
-////////////////////////////////////////////////////////////////////////////////
-
-// getOrderRes is the result of the GET /orders/:id handler
-// you might think its unnecessary for this struct and we should instead just
-// return the order itself but this gives us future flexibility to return
-// anything else alongside that we can't think of right now
-type getOrderRes struct {
-	Order storage.Order `json:"order"`
+// Middleware for authorizing callers
+// authorizeMiddleware responds with a 403 unless one of the caller's roles is
+// allowed to call the route. Any limits on the orders they can call it for are
+// checked by orderFetchMiddleware and getOrders.
+func (i *instance) authorizeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if perms, ok := permissions(c); ok && len(perms) == 0 {
+			i.handleForbidden(c, "not allowed to call this endpoint")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
 
-// getOrder is called by incoming HTTP GET requests to /orders/:id
-func (i *instance) getOrder(c *gin.Context) {
-	llog.Info("get order request started", llog.KV{"handler": "getOrder"})
-
-	// Get order from context (set by middleware)
-	order := i.getOrderFromContext(c)
+// RateLimitGroup is a group of routes that share a rate limit
+type RateLimitGroup string
 
-	llog.Info("retrieved order from context", llog.KV{
-		"handler":      "getOrder",
-		"order_id":     order.ID,
-		"order_status": int(order.Status),
-	})
+const (
+	// RateLimitRead is the routes that only read orders and webhooks
+	RateLimitRead RateLimitGroup = "read"
+	// RateLimitWrite is the routes that change orders or webhooks without calling
+	// the charge service
+	RateLimitWrite RateLimitGroup = "write"
+	// RateLimitCharge is the routes that call the charge service, which are
+	// charging, cancelling and refunding orders
+	RateLimitCharge RateLimitGroup = "charge"
+	// RateLimitIP is every route in the other groups, limited by IP address
+	// before the caller is authenticated
+	RateLimitIP RateLimitGroup = "ip"
+)
 
-	// respond with a success and return the order
-	c.JSON(http.StatusOK, getOrderRes{
-		Order: order,
-	})
+// rateLimitKey returns who the caller is for rate limiting which is their
+// identity if they were authenticated and otherwise their IP address
+func rateLimitKey(c *gin.Context) string {
+	if id, ok := identity(c); ok {
+		return "subject:" + id.Subject
+	}
+	return "ip:" + c.ClientIP()
+}
 
-	llog.Info("get order request completed successfully", llog.KV{"handler": "getOrder"})
+// durationSeconds returns d in whole seconds, rounded up, for headers
+func durationSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// Middleware for rate limiting callers
+// rateLimitMiddleware responds with a 429 if the caller has made too many
+// requests to the routes in the group recently. Every response includes the
+// RateLimit-* headers describing the caller's limit and Retry-After is added
+// when they're over it.
+func (i *instance) rateLimitMiddleware(group RateLimitGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := i.limiters[group]
+		if limiter == nil {
+			c.Next()
+			return
+		}
 
-// postOrderArgs is the expected body for the POST /orders handler
-type postOrderArgs struct {
-	CustomerEmail string             `json:"customerEmail"`
-	LineItems     []storage.LineItem `json:"lineItems"`
+		res := limiter.Allow(rateLimitKey(c))
+		c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", durationSeconds(res.Reset))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%s", res.Limit, durationSeconds(limiter.Rate().Per)))
+		if !res.Allowed {
+			i.metrics.rateLimited.WithLabelValues(string(group)).Inc()
+			llog.Warn("request rate limited", llog.KV{
+				"group":     group,
+				"path":      c.Request.URL.Path,
+				"client_ip": c.ClientIP(),
+			})
+			c.Header("Retry-After", durationSeconds(res.RetryAfter))
+			i.handleError(c, http.StatusTooManyRequests, ErrCodeRateLimited,
+				fmt.Sprintf("too many requests, retry in %s seconds", durationSeconds(res.RetryAfter)))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
 
-// chargeOrderRes is the result of the POST /orders/:id/charge handler
-type postOrderRes struct {
-	Order storage.Order `json:"order"`
+// actor returns who is making the request for the order events. Authenticated
+// callers are their identity's subject and everyone else is anonymous since
+// anything else they could tell us about themselves can't be trusted.
+func (i *instance) actor(c *gin.Context) string {
+	if id, ok := identity(c); ok {
+		return id.Subject
+	}
+	return anonymousActor
 }
 
-// postOrders is called by incoming HTTP POST requests to /orders
-func (i *instance) postOrders(c *gin.Context) {
-	llog.Info("post orders request started", llog.KV{"handler": "postOrders"})
+const (
+	// systemActor is the actor for changes that the service made on its own
+	// rather than because of a request
+	systemActor = "system"
+	// anonymousActor is the actor for changes made by unauthenticated requests
+	anonymousActor = "anonymous"
+)
 
-	// the context of the request we pass along to every downstream function so we
-	// can stop processing if the caller aborts the request and also to ensure that
-	// the tracing context is kept throughout the whole request
-	ctx := c.Request.Context()
+// applyChange makes a change the request made to an order, and records its event
+// attributed to the request's caller, with storeChange
+func (i *instance) applyChange(c *gin.Context, change storage.OrderChange) (storage.OrderEvent, error) {
+	change.Event.Actor = i.actor(c)
+	change.Event.RequestID = requestID(c)
+	return i.storeChange(c.Request.Context(), change)
+}
 
-	// parse the body as JSON into the newOrderArgs struct
-	var args postOrderArgs
-	err := c.BindJSON(&args)
+// storeChange makes the change to the order and records its event in a single
+// transaction so an order is never changed without the event that records it,
+// or the other way around. If it created the order or changed its status then
+// the event is published to the stream. It returns the event as it was stored.
+func (i *instance) storeChange(ctx context.Context, change storage.OrderChange) (storage.OrderEvent, error) {
+	change.Event.CreatedAt = i.now()
+	event, err := i.stor.ApplyOrderChange(ctx, change)
 	if err != nil {
-		llog.Error("failed to parse JSON body", llog.KV{"handler": "postOrders"}, llog.ErrKV(err))
-		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
-		return
+		return storage.OrderEvent{}, err
+	}
+	if i.broker != nil && (event.Type == storage.OrderEventCreated || event.OldStatus != event.NewStatus) {
+		i.broker.Publish(event)
+	}
+	return event, nil
+}
+
+// bodyRecorder wraps a gin.ResponseWriter and keeps a copy of everything written
+// to the body so it can be stored after the handler is done
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Middleware for replaying responses to requests retried with the same
+// Idempotency-Key header
+// the first request with a key stores its response and any later request with
+// the same key on the same route gets that response back without the handler
+// running again until the key expires
+func (i *instance) idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if i.idem == nil || key == "" {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		// the path includes the order ID so the same key can be used to charge
+		// different orders
+		route := c.Request.Method + " " + c.Request.URL.Path
+		// authenticated callers each get their own keys so they can't replay each
+		// other's responses by guessing a key
+		if id, ok := identity(c); ok {
+			key = id.Subject + ":" + key
+		}
+		kv := llog.KV{"idempotency_key": key, "route": route}
+
+		// we need the body to detect a key being reused for a different request but
+		// the handler needs to read it too so we put a copy back afterwards
+		byts, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			llog.Error("failed to read request body", kv, llog.ErrKV(err))
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error reading body: %v", err))
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(byts))
+		hash := sha256.Sum256(byts)
+
+		existing, err := i.idem.InsertIdempotencyKey(ctx, storage.IdempotencyKey{
+			Key:         key,
+			Route:       route,
+			RequestHash: hex.EncodeToString(hash[:]),
+			// if we crash before finishing then the key is taken over by the next
+			// request with it after this instead of being in use forever
+			ExpiresAt: i.now().Add(i.idemLockTimeout),
+		})
+		switch {
+		case errors.Is(err, storage.ErrIdempotencyKeyExists):
+			if existing.RequestHash != hex.EncodeToString(hash[:]) {
+				llog.Error("idempotency key reused with a different body", kv)
+				i.handleError(c, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused,
+					"idempotency key was already used for a different request")
+			} else if !existing.Completed {
+				llog.Error("idempotency key is still in use", kv)
+				i.handleError(c, http.StatusConflict, ErrCodeIdempotencyKeyInUse,
+					"a request with this idempotency key is still being processed")
+			} else {
+				llog.Info("replaying response for idempotency key", kv)
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.StatusCode, "application/json; charset=utf-8", existing.Body)
+			}
+			c.Abort()
+			return
+		case err != nil:
+			llog.Error("failed to insert idempotency key", kv, llog.ErrKV(err))
+			i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error storing idempotency key: %v", err))
+			c.Abort()
+			return
+		}
+
+		w := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		// server errors like the charge service being down are worth retrying so we
+		// forget the key instead of replaying the error forever
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			err = i.idem.DeleteIdempotencyKey(ctx, key, route)
+		} else {
+			err = i.idem.CompleteIdempotencyKey(ctx, key, route, c.Writer.Status(), w.body.Bytes(), i.now().Add(i.idemTTL))
+		}
+		if err != nil {
+			llog.Error("failed to update idempotency key", kv, llog.ErrKV(err))
+		}
+	}
+}
+
+// Middleware for handling order fetching with centralized error handling
+func (i *instance) orderFetchMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		// Get order ID from URL parameter
+		id := c.Param("id")
+		if id == "" {
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidStatus, "missing order ID")
+			c.Abort()
+			return
+		}
+
+		// Fetch order from storage
+		order, err := i.stor.GetOrder(ctx, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrOrderNotFound) {
+				i.handleError(c, http.StatusNotFound, ErrCodeOrderNotFound, "not found")
+			} else {
+				i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting order: %v", err))
+			}
+			c.Abort()
+			return
+		}
+
+		// the caller might only be allowed to act on some orders, like their own
+		if !authorizeOrder(c, order) {
+			i.handleForbidden(c, "not allowed to access this order")
+			c.Abort()
+			return
+		}
+
+		// Store order in context for use by handlers
+		c.Set("order", order)
+		c.Next()
+	}
+}
+
+// Helper function to get order from context (set by middleware)
+func (i *instance) getOrderFromContext(c *gin.Context) storage.Order {
+	order, _ := c.Get("order")
+	return order.(storage.Order)
+}
+
+// orderETag returns the ETag for the order which is just its quoted version
+func orderETag(order storage.Order) string {
+	return strconv.Quote(strconv.FormatInt(order.Version, 10))
+}
+
+// ifMatchMiddleware checks the If-Match header, if there is one, against the
+// order fetched by orderFetchMiddleware and responds with a 412 if the order has
+// changed since the caller read it. The check here only lets us fail early, the
+// handler must still make its first change at the ifMatchVersion so that the
+// order can't change between this check and the handler's change.
+func (i *instance) ifMatchMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := strings.TrimSpace(c.GetHeader("If-Match"))
+		// * matches any version of an order that exists which orderFetchMiddleware
+		// already checked
+		if header == "" || header == "*" {
+			c.Next()
+			return
+		}
+
+		order := i.getOrderFromContext(c)
+		// If-Match requires a strong comparison so weak ETags never match and we
+		// only ever send a single ETag so we don't bother parsing lists
+		unquoted, err := strconv.Unquote(header)
+		var version int64
+		if err == nil {
+			version, err = strconv.ParseInt(unquoted, 10, 64)
+		}
+		if err != nil || version != order.Version {
+			llog.Error("if-match precondition failed", llog.KV{
+				"order_id":      order.ID,
+				"if_match":      header,
+				"order_version": order.Version,
+			})
+			i.handleError(c, http.StatusPreconditionFailed, ErrCodeVersionMismatch,
+				"order was changed since the version in If-Match")
+			c.Abort()
+			return
+		}
+
+		c.Set("ifMatchVersion", version)
+		c.Next()
+	}
+}
+
+// requireIfMatchMiddleware responds with a 428 if the caller didn't send an
+// If-Match header with the version of the order they read. It goes before
+// ifMatchMiddleware on routes that ship items or move money after the caller
+// decided to based on what the order looked like. * is rejected as well since it
+// would match any version.
+func (i *instance) requireIfMatchMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := strings.TrimSpace(c.GetHeader("If-Match"))
+		if header == "" || header == "*" {
+			llog.Error("if-match precondition required", llog.KV{
+				"order_id": i.getOrderFromContext(c).ID,
+				"if_match": header,
+			})
+			i.handleError(c, http.StatusPreconditionRequired, ErrCodeIfMatchRequired,
+				"If-Match with the order's ETag is required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ifMatchVersion returns the version the caller sent in If-Match, if they sent
+// one, which ifMatchMiddleware already checked matches the fetched order
+func (i *instance) ifMatchVersion(c *gin.Context) (int64, bool) {
+	version, ok := c.Get("ifMatchVersion")
+	if !ok {
+		return 0, false
+	}
+	return version.(int64), true
+}
+
+// healthCheck is called by incoming HTTP GET requests to /healthz
+func (i *instance) healthCheck(c *gin.Context) {
+	llog.Info("health check requested", llog.KV{"handler": "healthCheck"})
+
+	c.Status(http.StatusOK)
+
+	llog.Info("health check completed successfully", llog.KV{"handler": "healthCheck"})
+}
+
+// parseOrderStatus returns the status for the name used in query parameters and
+// false if the name isn't known
+func parseOrderStatus(str string) (storage.OrderStatus, bool) {
+	switch str {
+	case "pending":
+		return storage.OrderStatusPending, true
+	case "charging":
+		return storage.OrderStatusCharging, true
+	case "charged":
+		return storage.OrderStatusCharged, true
+	case "fulfilled":
+		return storage.OrderStatusFulfilled, true
+	case "partially_fulfilled":
+		return storage.OrderStatusPartiallyFulfilled, true
+	case "fulfilling":
+		return storage.OrderStatusFulfilling, true
+	case "cancelled":
+		return storage.OrderStatusCancelled, true
+	default:
+		return 0, false
+	}
+}
+
+// getOrders is called by incoming HTTP GET requests to /orders
+func (i *instance) getOrders(c *gin.Context) {
+	llog.Info("get orders request started", llog.KV{"handler": "getOrders"})
+
+	// the context of the request we pass along to every downstream function so we
+	// can stop processing if the caller aborts the request and also to ensure that
+	// the tracing context is kept throughout the whole request
+	ctx := c.Request.Context()
+
+	// get and parse the optional status query parameter from the request
+	// this lets you do /orders?status=pending to limit the orders to only those that
+	// are currently pending and multiple statuses can be sent either separated by
+	// commas, like /orders?status=pending,charging, or by repeating the parameter
+	var query storage.OrderQuery
+	statusStrs := c.QueryArray("status")
+	for _, str := range statusStrs {
+		// an empty status, like /orders?status=, means all orders
+		if str == "" {
+			continue
+		}
+		for _, statusStr := range strings.Split(str, ",") {
+			status, ok := parseOrderStatus(statusStr)
+			if !ok {
+				llog.Error("invalid status parameter", llog.KV{"handler": "getOrders", "status": statusStr})
+				i.handleError(c, http.StatusBadRequest, ErrCodeInvalidStatus, fmt.Sprintf("unknown value for status: %v", statusStr))
+				return
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+
+	// the optional email and email_domain query parameters limit the orders to
+	// those placed by a specific customer, like /orders?email=bob@example.com, or
+	// by anyone at a domain, like /orders?email_domain=example.com
+	query.CustomerEmail = c.Query("email")
+	query.CustomerEmailDomain = strings.TrimPrefix(c.Query("email_domain"), "@")
+
+	// customers can only list their own orders so they're always filtered to the
+	// caller's email
+	if onlyOwnOrders(c) {
+		id, _ := identity(c)
+		if query.CustomerEmail != "" && !strings.EqualFold(query.CustomerEmail, id.Subject) {
+			i.handleForbidden(c, "not allowed to list other customers' orders")
+			return
+		}
+		query.CustomerEmail = id.Subject
+	}
+
+	// the optional min_total_cents and max_total_cents query parameters limit the
+	// orders to those whose total is within the range, inclusive
+	for _, param := range []struct {
+		name string
+		dest **int64
+	}{
+		{"min_total_cents", &query.MinTotalCents},
+		{"max_total_cents", &query.MaxTotalCents},
+	} {
+		str := c.Query(param.name)
+		if str == "" {
+			continue
+		}
+		cents, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			llog.Error("invalid total parameter", llog.KV{"handler": "getOrders", param.name: str}, llog.ErrKV(err))
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidTotalRange,
+				fmt.Sprintf("%s must be a whole number of cents: %v", param.name, str))
+			return
+		}
+		*param.dest = &cents
+	}
+	if query.MinTotalCents != nil && query.MaxTotalCents != nil && *query.MinTotalCents > *query.MaxTotalCents {
+		llog.Error("invalid total range", llog.KV{
+			"handler":         "getOrders",
+			"min_total_cents": *query.MinTotalCents,
+			"max_total_cents": *query.MaxTotalCents,
+		})
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidTotalRange, "min_total_cents must not be greater than max_total_cents")
+		return
+	}
+
+	// the optional description query parameter limits the orders to those with a
+	// line item whose description contains it, like /orders?description=widget
+	query.LineItemDescription = c.Query("description")
+
+	// the optional created_after and created_before query parameters limit the
+	// orders to those created in that range, like
+	// /orders?created_after=2024-01-01T00:00:00Z&created_before=2024-01-02T00:00:00Z
+	// for all of the orders created on January 1st
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{
+		{"created_after", &query.Created.After},
+		{"created_before", &query.Created.Before},
+	} {
+		str := c.Query(param.name)
+		if str == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			llog.Error("invalid time parameter", llog.KV{"handler": "getOrders", param.name: str}, llog.ErrKV(err))
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidTimeRange,
+				fmt.Sprintf("%s must be an RFC 3339 time: %v", param.name, str))
+			return
+		}
+		*param.dest = t
+	}
+
+	// the optional limit and cursor query parameters page through the orders,
+	// the cursor being the nextCursor from the previous page
+	page := storage.Page{
+		Limit:  defaultOrdersLimit,
+		Cursor: c.Query("cursor"),
+	}
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxOrdersLimit {
+			llog.Error("invalid limit parameter", llog.KV{"handler": "getOrders", "limit": limitStr})
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidLimit,
+				fmt.Sprintf("limit must be between 1 and %d: %v", maxOrdersLimit, limitStr))
+			return
+		}
+		page.Limit = limit
+	}
+
+	llog.Info("fetching orders from storage", llog.KV{
+		"handler":         "getOrders",
+		"status_filter":   strings.Join(statusStrs, ","),
+		"email":           query.CustomerEmail,
+		"email_domain":    query.CustomerEmailDomain,
+		"min_total_cents": c.Query("min_total_cents"),
+		"max_total_cents": c.Query("max_total_cents"),
+		"description":     query.LineItemDescription,
+		"created_after":   c.Query("created_after"),
+		"created_before":  c.Query("created_before"),
+		"limit":           page.Limit,
+	})
+
+	// pass along the filters and get the page of resulting orders from the
+	// storage instance
+	orders, nextCursor, err := i.stor.GetOrders(ctx, query, page)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			llog.Error("invalid cursor parameter", llog.KV{"handler": "getOrders"}, llog.ErrKV(err))
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidCursor, "invalid cursor")
+			return
+		}
+		llog.Error("failed to get orders from storage", llog.KV{"handler": "getOrders"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting orders: %v", err))
+		return
+	}
+
+	// by default slices are nil and if we return that the resulting JSON would be
+	// {"orders":null} which some languages/clients have a problem with
+	// instead set it to an empty slice
+	if orders == nil {
+		orders = []storage.Order{}
+	}
+
+	llog.Info("successfully retrieved orders from storage", llog.KV{
+		"handler":     "getOrders",
+		"order_count": len(orders),
+	})
+
+	// respond with a success and return the orders
+	c.JSON(http.StatusOK, getOrdersRes{
+		Orders:     orders,
+		NextCursor: nextCursor,
+	})
+
+	llog.Info("get orders request completed successfully", llog.KV{"handler": "getOrders"})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// getOrderRes is the result of the GET /orders/:id handler
+// you might think its unnecessary for this struct and we should instead just
+// return the order itself but this gives us future flexibility to return
+// anything else alongside that we can't think of right now
+type getOrderRes struct {
+	Order storage.Order `json:"order"`
+}
+
+// getOrder is called by incoming HTTP GET requests to /orders/:id
+func (i *instance) getOrder(c *gin.Context) {
+	llog.Info("get order request started", llog.KV{"handler": "getOrder"})
+
+	// Get order from context (set by middleware)
+	order := i.getOrderFromContext(c)
+
+	llog.Info("retrieved order from context", llog.KV{
+		"handler":      "getOrder",
+		"order_id":     order.ID,
+		"order_status": int(order.Status),
+	})
+
+	// the ETag lets callers send If-Match when changing the order so they don't
+	// overwrite changes made since they read it
+	c.Header("ETag", orderETag(order))
+
+	// respond with a success and return the order
+	c.JSON(http.StatusOK, getOrderRes{
+		Order: order,
+	})
+
+	llog.Info("get order request completed successfully", llog.KV{"handler": "getOrder"})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// streamKeepAlive is how often a comment is sent on an idle stream so proxies
+// don't close the connection
+const streamKeepAlive = 15 * time.Second
+
+// Stream event names
+const (
+	// streamEventCreated is sent when an order is created
+	streamEventCreated = "created"
+	// streamEventStatusChanged is sent when an order's status changes
+	streamEventStatusChanged = "status_changed"
+	// streamEventReset is sent when a client resumes but some of the changes
+	// since its Last-Event-ID are no longer buffered so it needs to reload the
+	// orders it's tracking
+	streamEventReset = "reset"
+)
+
+// streamOrders is called by incoming HTTP GET requests to /orders/stream and
+// keeps the response open, sending a Server-Sent Event for every order that's
+// created or changes status
+func (i *instance) streamOrders(c *gin.Context) {
+	llog.Info("stream orders request started", llog.KV{"handler": "streamOrders"})
+
+	ctx := c.Request.Context()
+
+	// the status query parameter works the same as GET /orders and only sends
+	// changes to one of the statuses
+	statuses := make(map[storage.OrderStatus]bool)
+	for _, str := range c.QueryArray("status") {
+		if str == "" {
+			continue
+		}
+		for _, statusStr := range strings.Split(str, ",") {
+			status, ok := parseOrderStatus(statusStr)
+			if !ok {
+				llog.Error("invalid status parameter", llog.KV{"handler": "streamOrders", "status": statusStr})
+				i.handleError(c, http.StatusBadRequest, ErrCodeInvalidStatus, fmt.Sprintf("unknown value for status: %v", statusStr))
+				return
+			}
+			statuses[status] = true
+		}
+	}
+	// the order_id query parameter only sends changes to those orders and can be
+	// repeated or separated by commas just like status
+	orderIDs := make(map[string]bool)
+	for _, str := range c.QueryArray("order_id") {
+		for _, id := range strings.Split(str, ",") {
+			if id != "" {
+				orderIDs[id] = true
+			}
+		}
+	}
+	matches := func(event storage.OrderEvent) bool {
+		if len(statuses) > 0 && !statuses[event.NewStatus] {
+			return false
+		}
+		return len(orderIDs) == 0 || orderIDs[event.OrderID]
+	}
+
+	// browsers send the Last-Event-ID header when they reconnect but it can't be
+	// set on the first connection so it can also be sent as a query parameter
+	var after uint64
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		var err error
+		after, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			llog.Error("invalid last event id", llog.KV{"handler": "streamOrders", "last_event_id": lastEventID})
+			i.handleError(c, http.StatusBadRequest, ErrCodeInvalidLastEventID, fmt.Sprintf("invalid Last-Event-ID: %v", lastEventID))
+			return
+		}
+	}
+
+	sub, backlog, complete := i.broker.Subscribe(after)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream;charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// nginx buffers responses by default which would hold the events back
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(msg stream.Message) {
+		if !matches(msg.Event) {
+			return
+		}
+		name := streamEventStatusChanged
+		if msg.Event.Type == storage.OrderEventCreated {
+			name = streamEventCreated
+		}
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatUint(msg.ID, 10),
+			Event: name,
+			Data:  msg.Event,
+		})
+	}
+	if !complete {
+		llog.Warn("stream resumed after its last event id was dropped", llog.KV{"handler": "streamOrders", "last_event_id": after})
+		c.Render(-1, sse.Event{Event: streamEventReset, Data: "{}"})
+	}
+	for _, msg := range backlog {
+		write(msg)
+	}
+	c.Writer.Flush()
+
+	llog.Info("streaming orders", llog.KV{
+		"handler":       "streamOrders",
+		"last_event_id": after,
+		"backlog_count": len(backlog),
+	})
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-sub.C():
+			if !ok {
+				// we fell behind or the server is shutting down, either way the
+				// client can reconnect with the last event ID it got
+				llog.Info("stream closed by broker", llog.KV{"handler": "streamOrders"})
+				return
+			}
+			write(msg)
+		case <-keepAlive.C:
+			c.Writer.WriteString(": keep-alive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// getOrderEventsRes is the result of the GET /orders/:id/events handler
+type getOrderEventsRes struct {
+	Events []storage.OrderEvent `json:"events"`
+}
+
+// getOrderEvents is called by incoming HTTP GET requests to /orders/:id/events
+func (i *instance) getOrderEvents(c *gin.Context) {
+	llog.Info("get order events request started", llog.KV{"handler": "getOrderEvents"})
+
+	ctx := c.Request.Context()
+
+	// Get order from context (set by middleware) which also checks that it exists
+	order := i.getOrderFromContext(c)
+
+	events, err := i.events.GetOrderEvents(ctx, order.ID)
+	if err != nil {
+		llog.Error("failed to get order events", llog.KV{"handler": "getOrderEvents", "order_id": order.ID}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting order events: %v", err))
+		return
+	}
+
+	llog.Info("retrieved order events", llog.KV{
+		"handler":      "getOrderEvents",
+		"order_id":     order.ID,
+		"events_count": len(events),
+	})
+
+	c.JSON(http.StatusOK, getOrderEventsRes{
+		Events: events,
+	})
+
+	llog.Info("get order events request completed successfully", llog.KV{"handler": "getOrderEvents"})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// postOrderArgs is the expected body for the POST /orders handler
+type postOrderArgs struct {
+	CustomerEmail string             `json:"customerEmail"`
+	LineItems     []storage.LineItem `json:"lineItems"`
+}
+
+// chargeOrderRes is the result of the POST /orders/:id/charge handler
+type postOrderRes struct {
+	Order storage.Order `json:"order"`
+}
+
+// postOrders is called by incoming HTTP POST requests to /orders
+func (i *instance) postOrders(c *gin.Context) {
+	llog.Info("post orders request started", llog.KV{"handler": "postOrders"})
+
+	// the context of the request we pass along to every downstream function so we
+	// can stop processing if the caller aborts the request and also to ensure that
+	// the tracing context is kept throughout the whole request
+	ctx := c.Request.Context()
+
+	// parse the body as JSON into the newOrderArgs struct
+	var args postOrderArgs
+	err := c.BindJSON(&args)
+	if err != nil {
+		llog.Error("failed to parse JSON body", llog.KV{"handler": "postOrders"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
+		return
 	}
 
 	llog.Info("parsed order request body", llog.KV{
@@ -324,105 +1642,1336 @@ func (i *instance) postOrders(c *gin.Context) {
 		"line_items_count": len(args.LineItems),
 	})
 
-	// do some light validation
-	// we could use something like https://pkg.go.dev/gopkg.in/validator.v2
-	// so we could set struct tags but since we only do validation in this one
-	// spot that feels like overkill
-	if !strings.Contains(args.CustomerEmail, "@") {
-		llog.Error("invalid customer email format", llog.KV{"handler": "postOrders"})
-		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidEmail, "invalid customerEmail")
-		return
-	}
-	if len(args.LineItems) < 1 {
-		llog.Error("order has no line items", llog.KV{"handler": "postOrders"})
-		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidLineItems, "an order must contain at least one line item")
-		return
+	// new orders haven't been fulfilled at all so we ignore any fulfillment
+	// progress that the caller might have sent along
+	resetFulfillment(args.LineItems)
+
+	order := storage.Order{
+		CustomerEmail: args.CustomerEmail,
+		LineItems:     args.LineItems,
+		Status:        storage.OrderStatusPending,
+	}
+	if res := validateOrder(order); res != nil {
+		llog.Error("invalid order", llog.KV{
+			"handler":     "postOrders",
+			"code":        res.Code,
+			"total_cents": order.TotalCents(),
+		})
+		i.handleError(c, http.StatusBadRequest, res.Code, res.Message)
+		return
+	}
+
+	llog.Info("validated order data, inserting into storage", llog.KV{
+		"handler":     "postOrders",
+		"total_cents": order.TotalCents(),
+	})
+
+	// the order is inserted along with its event so it's never created without
+	// one
+	event, err := i.applyChange(c, storage.OrderChange{
+		Insert: &order,
+		Event: storage.OrderEvent{
+			Type:        storage.OrderEventCreated,
+			AmountCents: order.TotalCents(),
+		},
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderExists) {
+			llog.Error("order already exists", llog.KV{"handler": "postOrders"})
+			i.handleError(c, http.StatusConflict, ErrCodeOrderExists, "order already exists")
+		} else {
+			llog.Error("failed to insert order into storage", llog.KV{"handler": "postOrders"}, llog.ErrKV(err))
+			i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error inserting order: %v", err))
+		}
+		return
+	}
+	i.metrics.observeEvent(event)
+	id := event.OrderID
+
+	llog.Info("successfully inserted order into storage", llog.KV{
+		"handler":  "postOrders",
+		"order_id": id,
+	})
+
+	// fetch the order so we respond with the version and timestamps that the
+	// storage set when inserting it
+	order, err = i.stor.GetOrder(ctx, id)
+	if err != nil {
+		llog.Error("failed to get inserted order", llog.KV{"handler": "postOrders", "order_id": id}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting order: %v", err))
+		return
+	}
+	c.Header("ETag", orderETag(order))
+
+	// respond with a success and return the order
+	c.JSON(http.StatusCreated, postOrderRes{
+		Order: order,
+	})
+
+	llog.Info("post orders request completed successfully", llog.KV{"handler": "postOrders"})
+}
+
+// validateOrder does some light validation of a new or edited order and returns
+// the error to respond with if it's invalid
+// we could use something like https://pkg.go.dev/gopkg.in/validator.v2
+// so we could set struct tags but since we only validate orders that feels like
+// overkill
+func validateOrder(order storage.Order) *errorResponse {
+	if !strings.Contains(order.CustomerEmail, "@") {
+		return &errorResponse{Code: ErrCodeInvalidEmail, Message: "invalid customerEmail"}
+	}
+	if len(order.LineItems) < 1 {
+		return &errorResponse{Code: ErrCodeInvalidLineItems, Message: "an order must contain at least one line item"}
+	}
+	if order.TotalCents() < 0 {
+		return &errorResponse{Code: ErrCodeInvalidTotal, Message: "an order's total cannot be less than 0"}
+	}
+	return nil
+}
+
+// resetFulfillment clears any fulfillment progress on line items sent by a caller
+// since only the fulfill handler is allowed to record fulfillment
+func resetFulfillment(lineItems []storage.LineItem) {
+	for idx := range lineItems {
+		lineItems[idx].FulfillmentStatus = storage.LineItemStatusUnfulfilled
+		lineItems[idx].FulfilledQuantity = 0
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// putOrderArgs is the expected body for the PUT /orders/:id handler
+type putOrderArgs struct {
+	LineItems []storage.LineItem `json:"lineItems"`
+}
+
+// putOrderRes is the result of the PUT /orders/:id handler
+type putOrderRes struct {
+	Order storage.Order `json:"order"`
+}
+
+// putOrder is called by incoming HTTP PUT requests to /orders/:id and replaces
+// the line items on a pending order
+func (i *instance) putOrder(c *gin.Context) {
+	llog.Info("put order request started", llog.KV{"handler": "putOrder"})
+
+	ctx := c.Request.Context()
+
+	// parse the body as JSON into the putOrderArgs struct
+	var args putOrderArgs
+	err := c.BindJSON(&args)
+	if err != nil {
+		llog.Error("failed to parse JSON body", llog.KV{"handler": "putOrder"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
+		return
+	}
+
+	// Get order from context (set by middleware)
+	order := i.getOrderFromContext(c)
+
+	llog.Info("retrieved order from context", llog.KV{
+		"handler":          "putOrder",
+		"order_id":         order.ID,
+		"order_status":     int(order.Status),
+		"line_items_count": len(args.LineItems),
+	})
+
+	// once an order starts being charged the amount is locked in so only pending
+	// orders can be edited
+	if order.Status != storage.OrderStatusPending {
+		llog.Error("order not eligible for editing", llog.KV{
+			"handler":        "putOrder",
+			"current_status": int(order.Status),
+		})
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			"order cannot be edited - only pending orders can be edited")
+		return
+	}
+
+	resetFulfillment(args.LineItems)
+	oldTotal := order.TotalCents()
+	order.LineItems = args.LineItems
+	if res := validateOrder(order); res != nil {
+		llog.Error("invalid order", llog.KV{
+			"handler":     "putOrder",
+			"code":        res.Code,
+			"total_cents": order.TotalCents(),
+		})
+		i.handleError(c, http.StatusBadRequest, res.Code, res.Message)
+		return
+	}
+
+	// the update only succeeds if the order is still pending so a concurrent charge
+	// can't end up charging a different amount than what's stored and the version
+	// is only checked if the caller asked for the edit to be conditional with
+	// If-Match
+	version, _ := i.ifMatchVersion(c)
+	_, err = i.applyChange(c, storage.OrderChange{
+		LineItems:     order.LineItems,
+		RequireStatus: true,
+		Version:       version,
+		Event: storage.OrderEvent{
+			OrderID:     order.ID,
+			Type:        storage.OrderEventEdited,
+			OldStatus:   storage.OrderStatusPending,
+			NewStatus:   storage.OrderStatusPending,
+			AmountCents: order.TotalCents(),
+			Detail:      fmt.Sprintf("total changed from %d to %d cents", oldTotal, order.TotalCents()),
+		},
+	})
+	if err != nil {
+		llog.Error("failed to update order", llog.KV{"handler": "putOrder"}, llog.ErrKV(err))
+		i.handleTransitionError(c, err, "editing")
+		return
+	}
+
+	llog.Info("successfully updated order", llog.KV{
+		"handler":     "putOrder",
+		"order_id":    order.ID,
+		"total_cents": order.TotalCents(),
+	})
+
+	// fetch the order again so we respond with its new version
+	order, err = i.stor.GetOrder(ctx, order.ID)
+	if err != nil {
+		llog.Error("failed to get updated order", llog.KV{"handler": "putOrder"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting order: %v", err))
+		return
+	}
+	c.Header("ETag", orderETag(order))
+
+	c.JSON(http.StatusOK, putOrderRes{
+		Order: order,
+	})
+
+	llog.Info("put order request completed successfully", llog.KV{"handler": "putOrder"})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// chargeOrderArgs is the expected body for the POST /orders/:id/charge handler
+type chargeOrderArgs struct {
+	CardToken string `json:"cardToken"`
+}
+
+// chargeServiceChargeArgs is the expected body for the charge service
+type chargeServiceChargeArgs struct {
+	CardToken   string `json:"cardToken"`
+	AmountCents int64  `json:"amountCents"`
+	// OrderID lets the charge service associate the charge with the order so we
+	// can later look up whether an order was charged
+	OrderID string `json:"orderId,omitempty"`
+	// ChargeID is set on refunds to reference the original charge
+	ChargeID string `json:"chargeId,omitempty"`
+	// RefundID is set on refunds so we can later look up whether the refund was
+	// made
+	RefundID string `json:"refundId,omitempty"`
+}
+
+// chargeServiceChargeRes is the response body from the charge service for both
+// creating and looking up a charge
+type chargeServiceChargeRes struct {
+	ID string `json:"id"`
+}
+
+// errChargeRejected is returned by innerChargeOrder when the charge service
+// responded with a 4xx, meaning it refused the charge and the customer definitely
+// wasn't charged
+var errChargeRejected = errors.New("charge service rejected charge")
+
+// fulfillmentServiceFulfillArgs is the expected body for the fulfillment service
+type fulfillmentServiceFulfillArgs struct {
+	Description string `json:"description"`
+	Quantity    int64  `json:"quantity"`
+	OrderID     string `json:"orderId"`
+}
+
+// chargeOrderRes is the result of the POST /orders/:id/charge handler
+type chargeOrderRes struct {
+	ChargedCents int64 `json:"chargedCents"`
+}
+
+// chargeOrder is called by incoming HTTP POST requests to /orders/:id/charge
+func (i *instance) chargeOrder(c *gin.Context) {
+	llog.Info("charge order request started", llog.KV{"handler": "chargeOrder"})
+
+	ctx := c.Request.Context()
+
+	// parse the body as JSON into the chargeOrderArgs struct
+	var args chargeOrderArgs
+	err := c.BindJSON(&args)
+	if err != nil {
+		llog.Error("failed to parse JSON body", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
+		return
+	}
+
+	// Get order from context (set by middleware)
+	order := i.getOrderFromContext(c)
+
+	llog.Info("retrieved order from context", llog.KV{
+		"handler":      "chargeOrder",
+		"order_id":     order.ID,
+		"order_status": int(order.Status),
+		"amount_cents": order.TotalCents(),
+	})
+
+	// orders left charging because the charge service failed can be charged
+	// again once nothing is still charging them, and the charge service is asked
+	// whether the earlier charge went through first
+	retry := order.Status == storage.OrderStatusCharging && i.claimChargeRetry(order)
+	if order.Status != storage.OrderStatusPending && !retry {
+		llog.Error("order not eligible for charging", llog.KV{
+			"handler":        "chargeOrder",
+			"current_status": int(order.Status),
+		})
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			"order ineligible for charging")
+		return
+	}
+	if retry {
+		defer i.stopCharging(order.ID)
+	}
+
+	// the status is only changed if the order is still pending, and at the
+	// version in If-Match if the caller sent one, so if another request already
+	// started charging it we'll get a conflict
+	version, _ := i.ifMatchVersion(c)
+
+	// we make sure the charge service isn't too busy before changing the order so
+	// that a rejected request doesn't change anything
+	if order.TotalCents() > 0 {
+		if !i.acquireCharge(c) {
+			return
+		}
+		defer i.releaseCharge()
+	}
+
+	if retry {
+		charged, err := i.resolveCharging(c, order)
+		if err != nil {
+			llog.Error("failed to resolve charging order", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+			if errors.Is(err, errLookupFailed) {
+				i.handleError(c, http.StatusInternalServerError, ErrCodeChargeServiceError, err.Error())
+			} else {
+				i.handleTransitionError(c, err, "charging")
+			}
+			return
+		}
+		if charged {
+			llog.Info("recovered the earlier charge", llog.KV{"handler": "chargeOrder"})
+			c.JSON(http.StatusOK, chargeOrderRes{
+				ChargedCents: order.TotalCents(),
+			})
+			return
+		}
+		// the order is back to pending at a new version so the rest of the charge
+		// can't check the version the caller sent, but resolving it already did
+		// since it's the version that was fetched
+		order.Status = storage.OrderStatusPending
+		version = 0
+	}
+
+	// discounts can bring an order's total down to 0 in which case there's
+	// nothing to charge but we still want to move the order along to charged
+	if order.TotalCents() <= 0 {
+		event, err := i.applyChange(c, storage.OrderChange{
+			Version: version,
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventCharged,
+				OldStatus: storage.OrderStatusPending,
+				NewStatus: storage.OrderStatusCharged,
+			},
+		})
+		if err != nil {
+			llog.Error("failed to update order status to charged", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+			i.handleTransitionError(c, err, "charging")
+			return
+		}
+		i.metrics.observeEvent(event)
+	} else {
+		// retries of this order's charge leave it alone until we're done with it
+		i.startCharging(order.ID)
+		defer i.stopCharging(order.ID)
+
+		// this is a two-phase change where we mark the order as charging before we
+		// call the charge service and as charged after so if this service crashes
+		// in between the order is left as charging and recoverCharges can figure out
+		// at startup whether the customer was actually charged
+		// the status is only changed if the order is still pending which means if
+		// two requests race to charge the same order only one of them will get past
+		// here and call the charge service
+		_, err = i.applyChange(c, storage.OrderChange{
+			Version: version,
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventChargeAttempted,
+				OldStatus:   storage.OrderStatusPending,
+				NewStatus:   storage.OrderStatusCharging,
+				AmountCents: order.TotalCents(),
+			},
+		})
+		if err != nil {
+			llog.Error("failed to update order status to charging", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+			i.handleTransitionError(c, err, "charging")
+			return
+		}
+
+		llog.Info("calling charge service", llog.KV{"handler": "chargeOrder"})
+		charge, err := i.innerChargeOrder(ctx, chargeServiceChargeArgs{
+			CardToken:   args.CardToken,
+			AmountCents: order.TotalCents(),
+			OrderID:     order.ID,
+		})
+		if err != nil {
+			llog.Error("charge service failed", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+			// if the charge service told us it rejected the charge then we know the
+			// customer wasn't charged and the order can go back to pending so it can be
+			// retried, otherwise we don't know what happened and we leave it as
+			// charging for recoverCharges to resolve
+			event := storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventChargeFailed,
+				OldStatus:   storage.OrderStatusCharging,
+				NewStatus:   storage.OrderStatusCharging,
+				AmountCents: order.TotalCents(),
+				Detail:      err.Error(),
+			}
+			if errors.Is(err, errChargeRejected) {
+				event.NewStatus = storage.OrderStatusPending
+			}
+			if _, rerr := i.applyChange(c, storage.OrderChange{Event: event}); rerr != nil {
+				llog.Error("failed to record failed charge", llog.KV{
+					"handler":    "chargeOrder",
+					"new_status": int(event.NewStatus),
+				}, llog.ErrKV(rerr))
+			}
+			i.handleError(c, http.StatusInternalServerError, ErrCodeChargeServiceError,
+				err.Error())
+			return
+		}
+
+		llog.Info("charge service succeeded, recording payment", llog.KV{
+			"handler":   "chargeOrder",
+			"charge_id": charge.ID,
+		})
+
+		// the payment is recorded in the same change that marks the order charged
+		// so that by the time anyone sees a charged order they can also refund it
+		// and since we already charged the customer at this point if this fails for
+		// any reason it's an internal error rather than a conflict
+		event, err := i.applyChange(c, storage.OrderChange{
+			Payment: &storage.Payment{
+				CardToken:   args.CardToken,
+				ChargeID:    charge.ID,
+				AmountCents: order.TotalCents(),
+				ChargedAt:   i.now(),
+			},
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventCharged,
+				OldStatus:   storage.OrderStatusCharging,
+				NewStatus:   storage.OrderStatusCharged,
+				AmountCents: order.TotalCents(),
+				ChargeID:    charge.ID,
+			},
+		})
+		if err != nil {
+			llog.Error("failed to update order status to charged", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+			i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error updating order to charged: %v", err))
+			return
+		}
+		i.metrics.observeEvent(event)
+	}
+
+	llog.Info("successfully updated order status to charged", llog.KV{"handler": "chargeOrder"})
+
+	// since we successfully charged the order and updated the order status we can
+	// return a success to the caller
+	c.JSON(http.StatusOK, chargeOrderRes{
+		ChargedCents: order.TotalCents(),
+	})
+
+	llog.Info("charge order request completed successfully", llog.KV{"handler": "chargeOrder"})
+}
+
+// claimChargeRetry returns true, and records that the request is charging the
+// order until stopCharging is called, if the order was left charging, because
+// it's unknown whether the charge service charged it, and nothing else is
+// charging it
+func (i *instance) claimChargeRetry(order storage.Order) bool {
+	i.chargingLock.Lock()
+	defer i.chargingLock.Unlock()
+	if i.charging[order.ID] > 0 || i.now().Sub(order.UpdatedAt) < i.chargeRetryAfter {
+		return false
+	}
+	i.charging[order.ID]++
+	return true
+}
+
+// startCharging records that a request is charging the order until stopCharging
+// is called
+func (i *instance) startCharging(orderID string) {
+	i.chargingLock.Lock()
+	defer i.chargingLock.Unlock()
+	i.charging[orderID]++
+}
+
+// stopCharging records that a request that called startCharging, or
+// claimChargeRetry, is done charging the order
+func (i *instance) stopCharging(orderID string) {
+	i.chargingLock.Lock()
+	defer i.chargingLock.Unlock()
+	if i.charging[orderID]--; i.charging[orderID] <= 0 {
+		delete(i.charging, orderID)
+	}
+}
+
+// errLookupFailed is returned by resolveCharging when the charge service
+// couldn't tell us whether the order was charged
+var errLookupFailed = errors.New("error looking up charge")
+
+// resolveCharging asks the charge service whether an order that was left
+// charging was charged and records it as charged if it was, and moves it back
+// to pending otherwise. It returns true if the order was charged.
+func (i *instance) resolveCharging(c *gin.Context, order storage.Order) (bool, error) {
+	charge, err := i.innerLookupCharge(c.Request.Context(), order.ID, "")
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", errLookupFailed, err)
+	}
+	// the change is only made if the order is still at the version we fetched
+	// since another instance could've resolved it and started charging it again
+	// while we were looking it up, which the status alone wouldn't catch
+	change := chargingResolution(order, charge, i.now())
+	change.Version = order.Version
+	event, err := i.applyChange(c, change)
+	if errors.Is(err, storage.ErrOrderVersionMismatch) {
+		return false, storage.ErrOrderStatusMismatch
+	} else if err != nil {
+		return false, err
+	}
+	i.metrics.observeEvent(event)
+	return charge != nil, nil
+}
+
+// chargingResolution returns the change that resolves an order that was left
+// charging by recording the charge, if the charge service has one for the
+// order, at now and otherwise moving the order back to pending
+func chargingResolution(order storage.Order, charge *chargeServiceChargeRes, now time.Time) storage.OrderChange {
+	change := storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:     order.ID,
+			Type:        storage.OrderEventChargeFailed,
+			OldStatus:   storage.OrderStatusCharging,
+			NewStatus:   storage.OrderStatusPending,
+			AmountCents: order.TotalCents(),
+			Detail:      "the charge service has no charge for the order",
+		},
+	}
+	if charge != nil {
+		change.Event.Type = storage.OrderEventCharged
+		change.Event.NewStatus = storage.OrderStatusCharged
+		change.Event.ChargeID = charge.ID
+		change.Event.Detail = "recovered the charge from the charge service"
+		// we never found out about the charge when it happened so we need to record
+		// it now, the card token isn't stored until the charge succeeds so refunds
+		// will only be able to reference the charge ID
+		change.Payment = &storage.Payment{
+			ChargeID:    charge.ID,
+			AmountCents: order.TotalCents(),
+			ChargedAt:   now,
+		}
+	}
+	return change
+}
+
+// acquireCharge reserves a slot for the request to call the charge service and
+// responds with a 503 if every slot is taken. If it returns true then
+// releaseCharge must be called once the request is done with the charge
+// service.
+func (i *instance) acquireCharge(c *gin.Context) bool {
+	if i.chargeSlots == nil {
+		return true
+	}
+	select {
+	case i.chargeSlots <- struct{}{}:
+		i.metrics.chargeInFlight.Inc()
+		return true
+	default:
+		i.metrics.chargeRejected.Inc()
+		llog.Warn("too many requests calling the charge service", llog.KV{
+			"path":  c.Request.URL.Path,
+			"limit": cap(i.chargeSlots),
+		})
+		c.Header("Retry-After", "1")
+		i.handleError(c, http.StatusServiceUnavailable, ErrCodeChargeServiceBusy,
+			"too many charges are in progress, try again shortly")
+		return false
+	}
+}
+
+// releaseCharge frees the slot reserved by acquireCharge
+func (i *instance) releaseCharge() {
+	if i.chargeSlots == nil {
+		return
+	}
+	i.metrics.chargeInFlight.Dec()
+	<-i.chargeSlots
+}
+
+// innerChargeOrder actually does the charging or refunding (negative amount) by
+// making at POST request to the charge service and returns the created charge
+func (i *instance) innerChargeOrder(ctx context.Context, args chargeServiceChargeArgs) (res chargeServiceChargeRes, err error) {
+	// encode the charge service's charge arguments as JSON so we can POST them to
+	// the /charge path on the charge service
+	// this method returns a byte slice that we can later pass to the Post message
+	// as the body of the POST request
+	// there's a package called "bytes" so we call the variable byts
+	byts, err := json.Marshal(args)
+	if err != nil {
+		return chargeServiceChargeRes{}, fmt.Errorf("error encoding charge body: %w", err)
+	}
+
+	i.chargeLock.Lock()
+	defer i.chargeLock.Unlock()
+
+	// the latency doesn't include waiting for the lock since we want to know how
+	// long the charge service takes
+	// refunds are charges with a negative amount
+	operation := "charge"
+	if args.AmountCents < 0 {
+		operation = "refund"
+	}
+	start := time.Now()
+	defer func() {
+		i.metrics.observeDependency("charge", operation, start, err)
+	}()
+
+	// make a POST request to the /charge endpoint on the charge service
+	// the body is JSON but this method accepts a io.Reader so we need to wrap the
+	// byte slice in bytes.NewReader which simply reads over the sent byte slice
+	resp, err := i.chargeService.Post("/charge", "application/json", bytes.NewReader(byts))
+	if err != nil {
+		return chargeServiceChargeRes{}, fmt.Errorf("error making charge request: %w", err)
+	}
+	// we need to make sure we close the body otherwise this will leak memory
+	defer resp.Body.Close()
+	// /charge creates a new charge so we expect a 201 response, if we didn't get
+	// that then we must've errored
+	if resp.StatusCode != http.StatusCreated {
+		// we opportunistically try to read the body in case it contains an error but
+		// if it fails then that's not the end of the world so we ignore the error
+		body, _ := ioutil.ReadAll(resp.Body)
+		// only a 4xx definitely means the charge service refused the charge, a 5xx
+		// or anything else could've come after the customer was charged
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return chargeServiceChargeRes{}, fmt.Errorf("%w: %d %s", errChargeRejected, resp.StatusCode, body)
+		}
+		return chargeServiceChargeRes{}, fmt.Errorf("error charging: %d %s", resp.StatusCode, body)
+	}
+
+	// the charge already happened at this point so if we can't decode the body we
+	// don't want to return an error and have the caller think the customer wasn't
+	// charged, we'll just be missing the charge ID
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		llog.Error("failed to decode charge response", llog.KV{"amount_cents": args.AmountCents}, llog.ErrKV(err))
+	}
+	return res, nil
+}
+
+// innerLookupCharge asks the charge service whether a charge was made for the
+// given order, or the refund with refundID if it's set, by making a GET request
+// to /charge?orderId={orderID}&refundId={refundID} on the charge service. This
+// is the only way to find out what happened to a charge or refund whose POST
+// failed without the charge service rejecting it so the charge service must
+// keep the orderId and refundId it was sent with every charge and refund. It
+// responds with a 200 and the charge if one exists and a 404 if not. A nil
+// charge is returned if the order wasn't charged or refunded.
+func (i *instance) innerLookupCharge(ctx context.Context, orderID, refundID string) (_ *chargeServiceChargeRes, err error) {
+	query := url.Values{"orderId": {orderID}}
+	if refundID != "" {
+		query.Set("refundId", refundID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/charge?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building charge lookup request: %w", err)
+	}
+
+	// the charge service can't handle concurrent requests and a lookup has to
+	// wait for any charge that's in flight anyway
+	i.chargeLock.Lock()
+	defer i.chargeLock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		i.metrics.observeDependency("charge", "lookup", start, err)
+	}()
+
+	resp, err := i.chargeService.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making charge lookup request: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var res chargeServiceChargeRes
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			llog.Error("failed to decode charge lookup response", llog.KV{"order_id": orderID}, llog.ErrKV(err))
+		}
+		return &res, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("error looking up charge: %d %s", resp.StatusCode, body)
+	}
+}
+
+// RecoverCharges looks for any orders that were left in the charging status,
+// because the service crashed or the charge service didn't respond, and asks the
+// charge service whether the customer was actually charged. Orders that were
+// charged are moved to charged and the rest are moved back to pending so they
+// can be charged again. This should be called at startup before any requests
+// are handled. Only the WithClock and WithMetrics options are used.
+func RecoverCharges(ctx context.Context, stor mocks.StorageInstance, chargeService *http.Client, opts ...Option) error {
+	inst := &instance{
+		stor:          stor,
+		chargeService: chargeService,
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	inst.setupMetrics()
+	return inst.recoverCharges(ctx)
+}
+
+func (i *instance) recoverCharges(ctx context.Context) error {
+	// there shouldn't ever be many charging orders so we don't bother paging
+	orders, _, err := i.stor.GetOrders(ctx, storage.OrderQuery{
+		Statuses: []storage.OrderStatus{storage.OrderStatusCharging},
+	}, storage.Page{})
+	if err != nil {
+		return fmt.Errorf("error getting charging orders: %w", err)
+	}
+
+	llog.Info("recovering charging orders", llog.KV{"order_count": len(orders)})
+
+	// we try to recover every order even if one fails so a single bad order
+	// doesn't leave the rest stuck but we still return the last error we saw
+	var lastErr error
+	for _, order := range orders {
+		kv := llog.KV{"order_id": order.ID}
+		charge, err := i.innerLookupCharge(ctx, order.ID, "")
+		if err != nil {
+			llog.Error("failed to look up charge for charging order", kv, llog.ErrKV(err))
+			lastErr = err
+			continue
+		}
+
+		change := chargingResolution(order, charge, i.now())
+		change.Event.Actor = systemActor
+		kv["new_status"] = int(change.Event.NewStatus)
+		event, err := i.storeChange(ctx, change)
+		if err != nil {
+			llog.Error("failed to update charging order", kv, llog.ErrKV(err))
+			lastErr = err
+			continue
+		}
+		i.metrics.observeEvent(event)
+		llog.Info("recovered charging order", kv)
+	}
+	return lastErr
+}
+
+// RecoverRefunds looks for any orders with pending refunds, because the charge
+// service didn't respond when they were made, and asks the charge service
+// whether each refund was actually made. Refunds that were made are no longer
+// pending and the rest are removed from their orders, moving cancelled orders
+// back to charged so they can be cancelled again. This should be called at
+// startup before any requests are handled. Only the WithClock and WithMetrics
+// options are used.
+func RecoverRefunds(ctx context.Context, stor mocks.StorageInstance, chargeService *http.Client, opts ...Option) error {
+	inst := &instance{
+		stor:          stor,
+		chargeService: chargeService,
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	inst.setupMetrics()
+	return inst.recoverRefunds(ctx)
+}
+
+func (i *instance) recoverRefunds(ctx context.Context) error {
+	// there shouldn't ever be many pending refunds so we don't bother paging
+	orders, _, err := i.stor.GetOrders(ctx, storage.OrderQuery{PendingRefunds: true}, storage.Page{})
+	if err != nil {
+		return fmt.Errorf("error getting orders with pending refunds: %w", err)
+	}
+
+	llog.Info("recovering pending refunds", llog.KV{"order_count": len(orders)})
+
+	// like recoverCharges we try every refund even if one fails
+	var lastErr error
+	for _, order := range orders {
+		for _, refund := range order.Refunds {
+			if !refund.Pending {
+				continue
+			}
+			kv := llog.KV{"order_id": order.ID, "refund_id": refund.ID}
+			charge, err := i.innerLookupCharge(ctx, order.ID, refund.ID)
+			if err != nil {
+				llog.Error("failed to look up pending refund", kv, llog.ErrKV(err))
+				lastErr = err
+				continue
+			}
+
+			change := storage.OrderChange{
+				DeleteRefundID: refund.ID,
+				Event: storage.OrderEvent{
+					OrderID:     order.ID,
+					Type:        storage.OrderEventRefundFailed,
+					Actor:       systemActor,
+					OldStatus:   order.Status,
+					NewStatus:   order.Status,
+					AmountCents: refund.AmountCents,
+					RefundID:    refund.ID,
+					Detail:      "the charge service has no refund for the order",
+				},
+			}
+			switch {
+			case charge != nil:
+				change.DeleteRefundID = ""
+				change.ResolveRefundID = refund.ID
+				change.Event.Type = storage.OrderEventRefunded
+				change.Event.Detail = "recovered the refund from the charge service"
+			case order.Status == storage.OrderStatusCancelled:
+				// only cancelling a charged order leaves a cancelled order with a
+				// pending refund so the cancellation failed and the order goes back to
+				// charged so it can be retried
+				change.Event.Type = storage.OrderEventCancellationFailed
+				change.Event.NewStatus = storage.OrderStatusCharged
+			}
+			kv["refunded"] = charge != nil
+			event, err := i.storeChange(ctx, change)
+			if err != nil {
+				llog.Error("failed to resolve pending refund", kv, llog.ErrKV(err))
+				lastErr = err
+				continue
+			}
+			i.metrics.observeEvent(event)
+			llog.Info("recovered pending refund", kv)
+		}
+	}
+	return lastErr
+}
+
+// RecoverFulfillments looks for any orders that were left in the fulfilling
+// status, because the service crashed part way through fulfilling them, and
+// sends their fulfilled line items to the fulfillment service again since the
+// last one recorded might never have been sent. The fulfillment service ignores
+// line items it has already fulfilled. Orders with every line item fulfilled are
+// moved to fulfilled and the rest are moved back to partially fulfilled, or
+// charged, so they can be fulfilled again. This should be called at startup
+// before any requests are handled. Only the WithClock and WithMetrics options are
+// used.
+func RecoverFulfillments(ctx context.Context, stor mocks.StorageInstance, fulfillmentService *http.Client, opts ...Option) error {
+	inst := &instance{
+		stor:               stor,
+		fulfillmentService: fulfillmentService,
+		now:                time.Now,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	inst.setupMetrics()
+	return inst.recoverFulfillments(ctx)
+}
+
+func (i *instance) recoverFulfillments(ctx context.Context) error {
+	// there shouldn't ever be many fulfilling orders so we don't bother paging
+	orders, _, err := i.stor.GetOrders(ctx, storage.OrderQuery{
+		Statuses: []storage.OrderStatus{storage.OrderStatusFulfilling},
+	}, storage.Page{})
+	if err != nil {
+		return fmt.Errorf("error getting fulfilling orders: %w", err)
+	}
+
+	llog.Info("recovering fulfilling orders", llog.KV{"order_count": len(orders)})
+
+	// like recoverCharges we try every order even if one fails
+	var lastErr error
+nextOrder:
+	for _, order := range orders {
+		kv := llog.KV{"order_id": order.ID}
+		done, started := true, false
+		for _, li := range order.LineItems {
+			// discounts and empty line items are never sent
+			if li.Quantity < 1 || li.PriceCents < 0 {
+				continue
+			}
+			if li.FulfillmentStatus != storage.LineItemStatusFulfilled {
+				done = false
+				started = started || li.FulfilledQuantity > 0
+				continue
+			}
+			started = true
+			err := i.innerFulfillLineItem(ctx, fulfillmentServiceFulfillArgs{
+				Description: li.Description,
+				Quantity:    li.Quantity,
+				OrderID:     order.ID,
+			})
+			if err != nil {
+				llog.Error("failed to fulfill line item for fulfilling order", kv, llog.KV{
+					"description": li.Description,
+				}, llog.ErrKV(err))
+				lastErr = err
+				continue nextOrder
+			}
+		}
+
+		change := storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventFulfilled,
+				Actor:     systemActor,
+				OldStatus: storage.OrderStatusFulfilling,
+				NewStatus: storage.OrderStatusFulfilled,
+				Detail:    "recovered the fulfillment after the service stopped",
+			},
+		}
+		if !done {
+			change.Event.Type = storage.OrderEventFulfillmentFailed
+			change.Event.NewStatus = storage.OrderStatusCharged
+			if started {
+				change.Event.NewStatus = storage.OrderStatusPartiallyFulfilled
+			}
+			change.Event.Detail = "the service stopped while fulfilling the order"
+		}
+		kv["new_status"] = int(change.Event.NewStatus)
+		if _, err := i.storeChange(ctx, change); err != nil {
+			llog.Error("failed to update fulfilling order", kv, llog.ErrKV(err))
+			lastErr = err
+			continue
+		}
+		llog.Info("recovered fulfilling order", kv)
+	}
+	return lastErr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// cancelOrderRes is the result of the POST /orders/:id/cancel handler
+type cancelOrderRes struct {
+	Message       string `json:"message"`
+	OrderID       string `json:"orderId"`
+	RefundedCents int64  `json:"refundedCents,omitempty"`
+}
+
+// cancelOrder is called by incoming HTTP POST requests to /orders/:id/cancel
+func (i *instance) cancelOrder(c *gin.Context) {
+	llog.Info("cancel order request started", llog.KV{"handler": "cancelOrder"})
+
+	ctx := c.Request.Context()
+
+	// Get order from context (set by middleware)
+	order := i.getOrderFromContext(c)
+
+	llog.Info("retrieved order from context", llog.KV{
+		"handler":      "cancelOrder",
+		"order_id":     order.ID,
+		"order_status": int(order.Status),
+		"total_cents":  order.TotalCents(),
+	})
+
+	// Check if order can be cancelled (pending or charged orders can be cancelled)
+	if order.Status != storage.OrderStatusPending && order.Status != storage.OrderStatusCharged {
+		llog.Error("order not eligible for cancellation", llog.KV{
+			"handler":        "cancelOrder",
+			"current_status": int(order.Status),
+		})
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			"order cannot be cancelled - only pending or charged orders can be cancelled")
+		return
+	}
+
+	// cancelling a charged order refunds it so we make sure the charge service
+	// isn't too busy before cancelling it
+	if order.Status == storage.OrderStatusCharged && order.ChargedCents()-order.RefundedCents() > 0 {
+		if !i.acquireCharge(c) {
+			return
+		}
+		defer i.releaseCharge()
+	}
+
+	change := storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventCancelled,
+			OldStatus: order.Status,
+			NewStatus: storage.OrderStatusCancelled,
+		},
+	}
+	change.Version, _ = i.ifMatchVersion(c)
+
+	// we refund whatever was charged that hasn't already been refunded by a
+	// partial refund
+	remainingCents := order.ChargedCents() - order.RefundedCents()
+
+	// If the order is charged, we need to process a refund unless nothing is left
+	// to refund because discounts brought the total down to 0 or it was already
+	// refunded
+	var refund *storage.Refund
+	if order.Status == storage.OrderStatusCharged && remainingCents > 0 {
+		refund = &storage.Refund{
+			ID:          uuid.New().String(),
+			AmountCents: remainingCents,
+			Reason:      "order cancelled",
+			CreatedAt:   i.now(),
+		}
+		// the refund is recorded, with the amount that was charged as the limit,
+		// in the same change that cancels the order so concurrent refunds can never
+		// add up to more than the customer paid
+		change.Refund = refund
+		change.RefundLimitCents = order.ChargedCents()
+		change.Event.AmountCents = refund.AmountCents
+		change.Event.RefundID = refund.ID
+	}
+
+	llog.Info("updating order status to cancelled", llog.KV{"handler": "cancelOrder"})
+	// Update order status to cancelled before refunding so that if two requests
+	// race to cancel the same charged order only one of them issues a refund
+	event, err := i.applyChange(c, change)
+	if err != nil {
+		llog.Error("failed to update order status to cancelled", llog.KV{"handler": "cancelOrder"}, llog.ErrKV(err))
+		i.handleRefundError(c, err, "cancellation")
+		return
+	}
+
+	var refundedCents int64 = 0
+	if refund != nil {
+		llog.Info("order is charged, processing refund", llog.KV{"handler": "cancelOrder"})
+		err := i.innerRefundOrder(ctx, order, *refund)
+		if err != nil {
+			llog.Error("refund processing failed", llog.KV{"handler": "cancelOrder"}, llog.ErrKV(err))
+			// if the charge service rejected the refund then we know the customer
+			// wasn't refunded so we remove the refund and put the order back to charged
+			// so the cancellation can be retried, otherwise we don't know what happened
+			// and the order stays cancelled with the refund pending for recoverRefunds
+			// to resolve
+			change := storage.OrderChange{
+				PendingRefundID: refund.ID,
+				Event: storage.OrderEvent{
+					OrderID:     order.ID,
+					Type:        storage.OrderEventRefundFailed,
+					OldStatus:   storage.OrderStatusCancelled,
+					NewStatus:   storage.OrderStatusCancelled,
+					AmountCents: refund.AmountCents,
+					RefundID:    refund.ID,
+					Detail:      err.Error(),
+				},
+			}
+			if errors.Is(err, errChargeRejected) {
+				change.PendingRefundID = ""
+				change.DeleteRefundID = refund.ID
+				change.Event.Type = storage.OrderEventCancellationFailed
+				change.Event.NewStatus = storage.OrderStatusCharged
+			}
+			if _, rerr := i.applyChange(c, change); rerr != nil {
+				llog.Error("failed to record failed cancellation refund", llog.KV{
+					"handler":    "cancelOrder",
+					"refund_id":  refund.ID,
+					"new_status": int(change.Event.NewStatus),
+				}, llog.ErrKV(rerr))
+			}
+			i.handleRefundError(c, err, "cancellation")
+			return
+		}
+		refundedCents = refund.AmountCents
+		llog.Info("refund processed successfully", llog.KV{
+			"handler":        "cancelOrder",
+			"refunded_cents": refundedCents,
+		})
+	}
+
+	llog.Info("successfully updated order status to cancelled", llog.KV{"handler": "cancelOrder"})
+	i.metrics.observeEvent(event)
+
+	// Return success response
+	response := cancelOrderRes{
+		Message: "order cancelled successfully",
+		OrderID: order.ID,
+	}
+
+	// Include refund amount if applicable
+	if refundedCents > 0 {
+		response.RefundedCents = refundedCents
+	}
+
+	c.JSON(http.StatusOK, response)
+
+	llog.Info("cancel order request completed successfully", llog.KV{"handler": "cancelOrder"})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fulfillOrderRes is the result of the POST /orders/:id/fulfill handler
+type fulfillOrderRes struct {
+	FulfilledLineItems int `json:"fulfilledLineItems"`
+}
+
+// fulfillOrder is called by incoming HTTP POST requests to /orders/:id/fulfill
+func (i *instance) fulfillOrder(c *gin.Context) {
+	llog.Info("fulfill order request started", llog.KV{"handler": "fulfillOrder"})
+
+	ctx := c.Request.Context()
+
+	// Get order from context (set by middleware)
+	order := i.getOrderFromContext(c)
+
+	llog.Info("retrieved order from context", llog.KV{
+		"handler":          "fulfillOrder",
+		"order_id":         order.ID,
+		"order_status":     int(order.Status),
+		"line_items_count": len(order.LineItems),
+	})
+
+	// we can only ship orders that the customer has already paid for and a
+	// partially fulfilled order is one where a previous attempt failed part way
+	if order.Status != storage.OrderStatusCharged && order.Status != storage.OrderStatusPartiallyFulfilled {
+		llog.Error("order not eligible for fulfillment", llog.KV{
+			"handler":        "fulfillOrder",
+			"current_status": int(order.Status),
+		})
+		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
+			"order ineligible for fulfillment - only charged orders can be fulfilled")
+		return
+	}
+
+	// mark the order as fulfilling before anything is sent to the fulfillment
+	// service so only one request can fulfill it at a time and it can't be
+	// cancelled while its line items are being shipped, this is only done if the
+	// order is still at the version in If-Match
+	version, _ := i.ifMatchVersion(c)
+	startStatus := order.Status
+	_, err := i.applyChange(c, storage.OrderChange{
+		Version: version,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventFulfillmentStarted,
+			OldStatus: startStatus,
+			NewStatus: storage.OrderStatusFulfilling,
+		},
+	})
+	if err != nil {
+		llog.Error("failed to mark order as fulfilling", llog.KV{"handler": "fulfillOrder"}, llog.ErrKV(err))
+		i.handleTransitionError(c, err, "fulfillment")
+		return
+	}
+
+	var fulfilled int
+	for idx, li := range order.LineItems {
+		// discounts (negative prices) and empty line items aren't anything that
+		// can be shipped so there's nothing to tell the fulfillment service
+		if li.Quantity < 1 || li.PriceCents < 0 {
+			continue
+		}
+		// any line items that we already recorded as fulfilled were done by a
+		// previous attempt and shouldn't be sent again
+		if li.FulfillmentStatus == storage.LineItemStatusFulfilled {
+			continue
+		}
+
+		// the line item is recorded as fulfilled before the fulfillment service is
+		// called, and only if nothing else fulfilled it first, so it's never sent
+		// twice and if we crash then RecoverFulfillments knows to send it again
+		_, err := i.applyChange(c, storage.OrderChange{
+			Fulfillments: []storage.LineItemFulfillment{{
+				LineItem: idx,
+				From:     li.FulfilledQuantity,
+				Quantity: li.Quantity,
+			}},
+			RequireStatus: true,
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventPartiallyFulfilled,
+				OldStatus: storage.OrderStatusFulfilling,
+				NewStatus: storage.OrderStatusFulfilling,
+				Detail:    li.Description,
+			},
+		})
+		if err != nil {
+			llog.Error("failed to record line item fulfillment", llog.KV{
+				"handler":     "fulfillOrder",
+				"description": li.Description,
+			}, llog.ErrKV(err))
+			i.failFulfillment(c, order.ID, fulfillmentFailedStatus(startStatus, fulfilled), nil, err.Error())
+			i.handleTransitionError(c, err, "fulfillment")
+			return
+		}
+
+		err = i.innerFulfillLineItem(ctx, fulfillmentServiceFulfillArgs{
+			Description: li.Description,
+			Quantity:    li.Quantity - li.FulfilledQuantity,
+			OrderID:     order.ID,
+		})
+		if err != nil {
+			llog.Error("fulfillment service failed", llog.KV{
+				"handler":          "fulfillOrder",
+				"description":      li.Description,
+				"fulfilled_so_far": fulfilled,
+			}, llog.ErrKV(err))
+			// the line item goes back to what it was so a retry sends it again
+			i.failFulfillment(c, order.ID, fulfillmentFailedStatus(startStatus, fulfilled), &storage.LineItemFulfillment{
+				LineItem: idx,
+				From:     li.Quantity,
+				Quantity: li.FulfilledQuantity,
+			}, err.Error())
+			i.handleError(c, http.StatusInternalServerError, ErrCodeFulfillmentServiceError,
+				fmt.Sprintf("error fulfilling line item %q: %v", li.Description, err))
+			return
+		}
+		fulfilled++
+	}
+
+	// every line item has been sent, including any that a previous attempt
+	// already fulfilled, so the order is done
+	_, err = i.applyChange(c, storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventFulfilled,
+			OldStatus: storage.OrderStatusFulfilling,
+			NewStatus: storage.OrderStatusFulfilled,
+		},
+	})
+	if err != nil {
+		llog.Error("failed to update order status to fulfilled", llog.KV{"handler": "fulfillOrder"}, llog.ErrKV(err))
+		i.handleTransitionError(c, err, "fulfillment")
+		return
+	}
+
+	llog.Info("successfully updated order status to fulfilled", llog.KV{"handler": "fulfillOrder"})
+
+	c.JSON(http.StatusOK, fulfillOrderRes{
+		FulfilledLineItems: fulfilled,
+	})
+
+	llog.Info("fulfill order request completed successfully", llog.KV{"handler": "fulfillOrder"})
+}
+
+// fulfilledStatus returns the status a fulfilling order that started at
+// startStatus goes back to if it fails after fulfilled line items were sent, it's
+// left partially fulfilled if any of them shipped
+func fulfillmentFailedStatus(startStatus storage.OrderStatus, fulfilled int) storage.OrderStatus {
+	if fulfilled > 0 {
+		return storage.OrderStatusPartiallyFulfilled
 	}
+	return startStatus
+}
 
-	order := storage.Order{
-		CustomerEmail: args.CustomerEmail,
-		LineItems:     args.LineItems,
-		Status:        storage.OrderStatusPending,
+// failFulfillment moves a fulfilling order back to status, along with reverting
+// the line item if it's set, and records why in the fulfillment_failed event. If
+// it can't then the order is left fulfilling for RecoverFulfillments to resolve.
+func (i *instance) failFulfillment(c *gin.Context, orderID string, status storage.OrderStatus, revert *storage.LineItemFulfillment, detail string) {
+	change := storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   orderID,
+			Type:      storage.OrderEventFulfillmentFailed,
+			OldStatus: storage.OrderStatusFulfilling,
+			NewStatus: status,
+			Detail:    detail,
+		},
 	}
-	if order.TotalCents() < 0 {
-		llog.Error("order total is negative", llog.KV{
-			"handler":     "postOrders",
-			"total_cents": order.TotalCents(),
-		})
-		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidTotal, "an order's total cannot be less than 0")
-		return
+	if revert != nil {
+		change.Fulfillments = []storage.LineItemFulfillment{*revert}
 	}
+	if _, err := i.applyChange(c, change); err != nil {
+		llog.Error("failed to move order back from fulfilling", llog.KV{
+			"handler":    "fulfillOrder",
+			"order_id":   orderID,
+			"new_status": int(status),
+		}, llog.ErrKV(err))
+	}
+}
 
-	llog.Info("validated order data, inserting into storage", llog.KV{
-		"handler":     "postOrders",
-		"total_cents": order.TotalCents(),
-	})
-
-	id, err := i.stor.InsertOrder(ctx, order)
+// innerFulfillLineItem asks the fulfillment service to ship a single line item
+// by making a PUT request to the fulfillment service
+func (i *instance) innerFulfillLineItem(ctx context.Context, args fulfillmentServiceFulfillArgs) (err error) {
+	byts, err := json.Marshal(args)
 	if err != nil {
-		if errors.Is(err, storage.ErrOrderExists) {
-			llog.Error("order already exists", llog.KV{
-				"handler":  "postOrders",
-				"order_id": id,
-			})
-			i.handleError(c, http.StatusConflict, ErrCodeOrderExists, "order already exists")
-		} else {
-			llog.Error("failed to insert order into storage", llog.KV{"handler": "postOrders"}, llog.ErrKV(err))
-			i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error inserting order: %v", err))
-		}
-		return
+		return fmt.Errorf("error encoding fulfill body: %w", err)
 	}
-	order.ID = id
 
-	llog.Info("successfully inserted order into storage", llog.KV{
-		"handler":  "postOrders",
-		"order_id": id,
-	})
+	// http.Client doesn't have a helper for PUT requests like it does for POST so
+	// we need to build the request ourselves
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/fulfill", bytes.NewReader(byts))
+	if err != nil {
+		return fmt.Errorf("error building fulfill request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	// respond with a success and return the order
-	c.JSON(http.StatusCreated, postOrderRes{
-		Order: order,
-	})
+	start := time.Now()
+	defer func() {
+		i.metrics.observeDependency("fulfillment", "fulfill", start, err)
+	}()
 
-	llog.Info("post orders request completed successfully", llog.KV{"handler": "postOrders"})
+	resp, err := i.fulfillmentService.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making fulfill request: %w", err)
+	}
+	// we need to make sure we close the body otherwise this will leak memory
+	defer resp.Body.Close()
+	// /fulfill is idempotent so it responds with a 200 whether or not this is the
+	// first time we've asked for this line item
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error fulfilling line item: %d %s", resp.StatusCode, body)
+	}
+	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// chargeOrderArgs is the expected body for the POST /orders/:id/charge handler
-type chargeOrderArgs struct {
-	CardToken string `json:"cardToken"`
+// refundOrderLineItemArgs is a quantity of a single line item to refund
+type refundOrderLineItemArgs struct {
+	// LineItem is the index of the line item in the order's lineItems
+	LineItem int   `json:"lineItem"`
+	Quantity int64 `json:"quantity"`
 }
 
-// chargeServiceChargeArgs is the expected body for the charge service
-type chargeServiceChargeArgs struct {
-	CardToken   string `json:"cardToken"`
-	AmountCents int64  `json:"amountCents"`
+// refundOrderArgs is the expected body for the POST /orders/:id/refunds handler
+// exactly one of AmountCents or LineItems should be set
+type refundOrderArgs struct {
+	AmountCents int64                     `json:"amountCents"`
+	LineItems   []refundOrderLineItemArgs `json:"lineItems"`
+	Reason      string                    `json:"reason"`
 }
 
-// fulfillmentServiceFulfillArgs is the expected body for the fulfillment service
-type fulfillmentServiceFulfillArgs struct {
-	Description string `json:"description"`
-	Quantity    int64  `json:"quantity"`
-	OrderID     string `json:"orderId"`
+// refundOrderRes is the result of the POST /orders/:id/refunds handler
+type refundOrderRes struct {
+	Refund storage.Refund `json:"refund"`
+	// RefundedCents is the total refunded for the order including this refund
+	RefundedCents int64 `json:"refundedCents"`
 }
 
-// chargeOrderRes is the result of the POST /orders/:id/charge handler
-type chargeOrderRes struct {
-	ChargedCents int64 `json:"chargedCents"`
-}
+// errRefundFailed is returned by innerRefundOrder when the charge service failed
+// to refund the customer
+var errRefundFailed = errors.New("error processing refund")
 
-// chargeOrder is called by incoming HTTP POST requests to /orders/:id/charge
-func (i *instance) chargeOrder(c *gin.Context) {
-	llog.Info("charge order request started", llog.KV{"handler": "chargeOrder"})
+// refundOrder is called by incoming HTTP POST requests to /orders/:id/refunds
+func (i *instance) refundOrder(c *gin.Context) {
+	llog.Info("refund order request started", llog.KV{"handler": "refundOrder"})
 
 	ctx := c.Request.Context()
 
-	// parse the body as JSON into the chargeOrderArgs struct
-	var args chargeOrderArgs
+	// parse the body as JSON into the refundOrderArgs struct
+	var args refundOrderArgs
 	err := c.BindJSON(&args)
 	if err != nil {
-		llog.Error("failed to parse JSON body", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
+		llog.Error("failed to parse JSON body", llog.KV{"handler": "refundOrder"}, llog.ErrKV(err))
 		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
 		return
 	}
@@ -431,176 +2980,437 @@ func (i *instance) chargeOrder(c *gin.Context) {
 	order := i.getOrderFromContext(c)
 
 	llog.Info("retrieved order from context", llog.KV{
-		"handler":      "chargeOrder",
-		"order_id":     order.ID,
-		"order_status": int(order.Status),
-		"amount_cents": order.TotalCents(),
+		"handler":        "refundOrder",
+		"order_id":       order.ID,
+		"order_status":   int(order.Status),
+		"charged_cents":  order.ChargedCents(),
+		"refunded_cents": order.RefundedCents(),
 	})
 
-	if order.Status != storage.OrderStatusPending {
-		llog.Error("order not eligible for charging", llog.KV{
-			"handler":        "chargeOrder",
+	// only orders that the customer has paid for can be refunded, cancelled orders
+	// were already refunded when they were cancelled
+	switch order.Status {
+	case storage.OrderStatusCharged, storage.OrderStatusPartiallyFulfilled, storage.OrderStatusFulfilled:
+	default:
+		llog.Error("order not eligible for refund", llog.KV{
+			"handler":        "refundOrder",
 			"current_status": int(order.Status),
 		})
 		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
-			"order ineligible for charging")
+			"order ineligible for refund - only charged or fulfilled orders can be refunded")
 		return
 	}
 
-	llog.Info("calling charge service", llog.KV{"handler": "chargeOrder"})
-	err = i.innerChargeOrder(ctx, chargeServiceChargeArgs{
-		CardToken:   args.CardToken,
-		AmountCents: order.TotalCents(),
-	})
+	refund, err := buildRefund(order, args, i.now())
 	if err != nil {
-		llog.Error("charge service failed", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
-		i.handleError(c, http.StatusInternalServerError, ErrCodeChargeServiceError,
-			err.Error())
+		llog.Error("invalid refund request", llog.KV{"handler": "refundOrder"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidRefund, err.Error())
 		return
 	}
 
-	llog.Info("charge service succeeded, updating order status", llog.KV{"handler": "chargeOrder"})
+	llog.Info("processing refund", llog.KV{
+		"handler":      "refundOrder",
+		"refund_id":    refund.ID,
+		"amount_cents": refund.AmountCents,
+	})
 
-	// in a real-world scenario we would do a two-phase change where we set it to
-	// charging ahead of time and then mark it as charged after so we would be able
-	// to understand if this was retried that we already tried to charge
-	// as it's written if this service crashed before this line then we would've
-	// charged the customer and not reflected that on the order but for now we're
-	// ignoring this scenario
-	err = i.stor.SetOrderStatus(ctx, order.ID, storage.OrderStatusCharged)
+	if !i.acquireCharge(c) {
+		return
+	}
+	defer i.releaseCharge()
+
+	// the refund is recorded before the charge service is called, with the
+	// amount that was charged as the limit, so that concurrent refunds can never
+	// add up to more than the customer paid
+	version, _ := i.ifMatchVersion(c)
+	event, err := i.applyChange(c, storage.OrderChange{
+		Version:          version,
+		Refund:           &refund,
+		RefundLimitCents: order.ChargedCents(),
+		Event: storage.OrderEvent{
+			OrderID:     order.ID,
+			Type:        storage.OrderEventRefunded,
+			OldStatus:   order.Status,
+			NewStatus:   order.Status,
+			AmountCents: refund.AmountCents,
+			RefundID:    refund.ID,
+			Detail:      refund.Reason,
+		},
+	})
 	if err != nil {
-		llog.Error("failed to update order status to charged", llog.KV{"handler": "chargeOrder"}, llog.ErrKV(err))
-		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error updating order to charged: %v", err))
+		llog.Error("failed to record refund", llog.KV{"handler": "refundOrder"}, llog.ErrKV(err))
+		i.handleRefundError(c, err, "refund")
 		return
 	}
 
-	llog.Info("successfully updated order status to charged", llog.KV{"handler": "chargeOrder"})
+	err = i.innerRefundOrder(ctx, order, refund)
+	if err != nil {
+		llog.Error("refund processing failed", llog.KV{"handler": "refundOrder"}, llog.ErrKV(err))
+		// if the charge service rejected the refund then we know the customer wasn't
+		// refunded and the refund is removed from the order, otherwise we don't know
+		// what happened so the refund is left in place, and still counts towards the
+		// limit, as pending for recoverRefunds to resolve
+		change := storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventRefundFailed,
+				OldStatus:   order.Status,
+				NewStatus:   order.Status,
+				AmountCents: refund.AmountCents,
+				RefundID:    refund.ID,
+				Detail:      err.Error(),
+			},
+		}
+		if errors.Is(err, errChargeRejected) {
+			change.DeleteRefundID = refund.ID
+		} else {
+			change.PendingRefundID = refund.ID
+		}
+		if _, rerr := i.applyChange(c, change); rerr != nil {
+			llog.Error("failed to record failed refund", llog.KV{
+				"handler":   "refundOrder",
+				"refund_id": refund.ID,
+				"pending":   change.PendingRefundID != "",
+			}, llog.ErrKV(rerr))
+		}
+		i.handleRefundError(c, err, "refund")
+		return
+	}
+	i.metrics.observeEvent(event)
 
-	// since we successfully charged the order and updated the order status we can
-	// return a success to the caller
-	c.JSON(http.StatusOK, chargeOrderRes{
-		ChargedCents: order.TotalCents(),
+	llog.Info("refund processed successfully", llog.KV{
+		"handler":      "refundOrder",
+		"refund_id":    refund.ID,
+		"amount_cents": refund.AmountCents,
 	})
 
-	llog.Info("charge order request completed successfully", llog.KV{"handler": "chargeOrder"})
+	c.JSON(http.StatusCreated, refundOrderRes{
+		Refund:        refund,
+		RefundedCents: order.RefundedCents() + refund.AmountCents,
+	})
+
+	llog.Info("refund order request completed successfully", llog.KV{"handler": "refundOrder"})
 }
 
-// innerChargeOrder actually does the charging or refunding (negative amount) by
-// making at POST request to the charge service
-func (i *instance) innerChargeOrder(ctx context.Context, args chargeServiceChargeArgs) error {
-	// encode the charge service's charge arguments as JSON so we can POST them to
-	// the /charge path on the charge service
-	// this method returns a byte slice that we can later pass to the Post message
-	// as the body of the POST request
-	// there's a package called "bytes" so we call the variable byts
-	byts, err := json.Marshal(args)
-	if err != nil {
-		return fmt.Errorf("error encoding charge body: %w", err)
+// buildRefund validates the refund arguments against the order and returns the
+// refund to make at now
+func buildRefund(order storage.Order, args refundOrderArgs, now time.Time) (storage.Refund, error) {
+	refund := storage.Refund{
+		ID:        uuid.New().String(),
+		Reason:    args.Reason,
+		CreatedAt: now,
 	}
 
-	// make a POST request to the /charge endpoint on the charge service
-	// the body is JSON but this method accepts a io.Reader so we need to wrap the
-	// byte slice in bytes.NewReader which simply reads over the sent byte slice
-	resp, err := i.chargeService.Post("/charge", "application/json", bytes.NewReader(byts))
-	if err != nil {
-		return fmt.Errorf("error making charge request: %w", err)
+	switch {
+	case args.AmountCents != 0 && len(args.LineItems) > 0:
+		return storage.Refund{}, errors.New("only one of amountCents or lineItems can be sent")
+	case args.AmountCents != 0:
+		if args.AmountCents < 0 {
+			return storage.Refund{}, errors.New("amountCents must be more than 0")
+		}
+		refund.AmountCents = args.AmountCents
+		return refund, nil
+	case len(args.LineItems) == 0:
+		return storage.Refund{}, errors.New("either amountCents or lineItems must be sent")
 	}
-	// we need to make sure we close the body otherwise this will leak memory
-	defer resp.Body.Close()
-	// /charge creates a new charge so we expect a 201 response, if we didn't get
-	// that then we must've errored
-	if resp.StatusCode != http.StatusCreated {
-		// we opportunistically try to read the body in case it contains an error but
-		// if it fails then that's not the end of the world so we ignore the error
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("error charging body: %d %s", resp.StatusCode, body)
+
+	// figure out how much of each line item was already refunded so we don't
+	// refund the same item more times than it was bought
+	refundedQuantities := map[int]int64{}
+	for _, r := range order.Refunds {
+		for _, rli := range r.LineItems {
+			refundedQuantities[rli.LineItem] += rli.Quantity
+		}
+	}
+
+	for _, rli := range args.LineItems {
+		if rli.LineItem < 0 || rli.LineItem >= len(order.LineItems) {
+			return storage.Refund{}, fmt.Errorf("unknown line item: %d", rli.LineItem)
+		}
+		li := order.LineItems[rli.LineItem]
+		if rli.Quantity < 1 {
+			return storage.Refund{}, fmt.Errorf("quantity for line item %d must be more than 0", rli.LineItem)
+		}
+		if li.PriceCents < 0 {
+			return storage.Refund{}, fmt.Errorf("line item %d is a discount and can't be refunded", rli.LineItem)
+		}
+		refundedQuantities[rli.LineItem] += rli.Quantity
+		if refundedQuantities[rli.LineItem] > li.Quantity {
+			return storage.Refund{}, fmt.Errorf("can't refund more than the quantity of line item %d", rli.LineItem)
+		}
+		refund.AmountCents += li.PriceCents * rli.Quantity
+		refund.LineItems = append(refund.LineItems, storage.RefundLineItem{
+			LineItem: rli.LineItem,
+			Quantity: rli.Quantity,
+		})
+	}
+	if refund.AmountCents <= 0 {
+		return storage.Refund{}, errors.New("refund must be for more than 0")
+	}
+	return refund, nil
+}
+
+// innerRefundOrder refunds the customer by charging a negative amount with the
+// charge service. The refund must already be recorded on the order so that
+// concurrent refunds can never add up to more than the customer paid.
+func (i *instance) innerRefundOrder(ctx context.Context, order storage.Order, refund storage.Refund) error {
+	args := chargeServiceChargeArgs{
+		AmountCents: -refund.AmountCents, // Negative amount for refund
+		OrderID:     order.ID,
+	}
+	// orders charged before payments were recorded won't have a card token or
+	// charge ID to reference
+	if order.Payment != nil {
+		args.CardToken = order.Payment.CardToken
+		args.ChargeID = order.Payment.ChargeID
+	}
+	args.RefundID = refund.ID
+	if _, err := i.innerChargeOrder(ctx, args); err != nil {
+		return fmt.Errorf("%w: %w", errRefundFailed, err)
 	}
 	return nil
 }
 
+// handleRefundError responds with the appropriate error when recording a refund
+// for the action, or making it with innerRefundOrder, fails
+func (i *instance) handleRefundError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, storage.ErrRefundExceedsCharge):
+		i.handleError(c, http.StatusConflict, ErrCodeRefundExceedsCharge,
+			"refund would exceed the amount charged for the order")
+	case errors.Is(err, errRefundFailed):
+		i.handleError(c, http.StatusInternalServerError, ErrCodeChargeServiceError, err.Error())
+	default:
+		i.handleTransitionError(c, err, action)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
-// cancelOrderRes is the result of the POST /orders/:id/cancel handler
-type cancelOrderRes struct {
-	Message       string `json:"message"`
-	OrderID       string `json:"orderId"`
-	RefundedCents int64  `json:"refundedCents,omitempty"`
+// getWebhooksRes is the result of the GET /webhooks handler
+type getWebhooksRes struct {
+	Subscriptions []storage.WebhookSubscription `json:"subscriptions"`
 }
 
-// cancelOrder is called by incoming HTTP POST requests to /orders/:id/cancel
-func (i *instance) cancelOrder(c *gin.Context) {
-	llog.Info("cancel order request started", llog.KV{"handler": "cancelOrder"})
+// getWebhooks is called by incoming HTTP GET requests to /webhooks
+func (i *instance) getWebhooks(c *gin.Context) {
+	llog.Info("get webhooks request started", llog.KV{"handler": "getWebhooks"})
 
-	ctx := c.Request.Context()
+	subs, err := i.webhooks.GetWebhookSubscriptions(c.Request.Context())
+	if err != nil {
+		llog.Error("failed to get webhook subscriptions", llog.KV{"handler": "getWebhooks"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting webhooks: %v", err))
+		return
+	}
 
-	// Get order from context (set by middleware)
-	order := i.getOrderFromContext(c)
+	c.JSON(http.StatusOK, getWebhooksRes{
+		Subscriptions: subs,
+	})
 
-	llog.Info("retrieved order from context", llog.KV{
-		"handler":      "cancelOrder",
-		"order_id":     order.ID,
-		"order_status": int(order.Status),
-		"total_cents":  order.TotalCents(),
+	llog.Info("get webhooks request completed successfully", llog.KV{
+		"handler":             "getWebhooks",
+		"subscriptions_count": len(subs),
 	})
+}
 
-	// Check if order can be cancelled (pending or charged orders can be cancelled)
-	if order.Status != storage.OrderStatusPending && order.Status != storage.OrderStatusCharged {
-		llog.Error("order not eligible for cancellation", llog.KV{
-			"handler":        "cancelOrder",
-			"current_status": int(order.Status),
-		})
-		i.handleError(c, http.StatusConflict, ErrCodeOrderNotEligible,
-			"order cannot be cancelled - only pending or charged orders can be cancelled")
-		return
+// postWebhooksArgs is the expected body for the POST /webhooks handler
+type postWebhooksArgs struct {
+	URL string `json:"url"`
+	// EventTypes are the order events to send and if it's empty every event is
+	// sent
+	EventTypes []storage.OrderEventType `json:"eventTypes"`
+	// Secret is used to sign the webhooks and if it's empty one is generated
+	Secret string `json:"secret"`
+}
+
+// postWebhooksRes is the result of the POST /webhooks handler. The secret is
+// only ever returned here so the caller needs to keep it.
+type postWebhooksRes struct {
+	Subscription storage.WebhookSubscription `json:"subscription"`
+	Secret       string                      `json:"secret"`
+}
+
+// validateWebhookURL returns an error if the URL can't be sent webhooks
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url must be http or https")
 	}
+	if u.Host == "" {
+		return errors.New("url must have a host")
+	}
+	return nil
+}
 
-	var refundedCents int64 = 0
+// validateEventTypes returns an error if any of the types aren't order event
+// types or are listed more than once
+func validateEventTypes(types []storage.OrderEventType) error {
+	seen := make(map[storage.OrderEventType]bool, len(types))
+	for _, typ := range types {
+		known := false
+		for _, t := range storage.OrderEventTypes {
+			if t == typ {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", typ)
+		}
+		if seen[typ] {
+			return fmt.Errorf("event type %q is listed more than once", typ)
+		}
+		seen[typ] = true
+	}
+	return nil
+}
 
-	// If the order is charged, we need to process a refund
-	if order.Status == storage.OrderStatusCharged {
-		llog.Info("order is charged, processing refund", llog.KV{"handler": "cancelOrder"})
-		// Process refund by charging a negative amount
-		err := i.innerChargeOrder(ctx, chargeServiceChargeArgs{
-			CardToken:   "",                  // In a real implementation, we'd need to store the card token
-			AmountCents: -order.TotalCents(), // Negative amount for refund
-		})
+// postWebhooks is called by incoming HTTP POST requests to /webhooks
+func (i *instance) postWebhooks(c *gin.Context) {
+	llog.Info("post webhooks request started", llog.KV{"handler": "postWebhooks"})
+
+	ctx := c.Request.Context()
+
+	var args postWebhooksArgs
+	if err := c.BindJSON(&args); err != nil {
+		llog.Error("failed to parse JSON body", llog.KV{"handler": "postWebhooks"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidJSON, fmt.Sprintf("error decoding body: %v", err))
+		return
+	}
+	if err := validateWebhookURL(args.URL); err != nil {
+		llog.Warn("invalid webhook url", llog.KV{"handler": "postWebhooks", "url": args.URL}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidWebhookURL, fmt.Sprintf("invalid url: %v", err))
+		return
+	}
+	if err := validateEventTypes(args.EventTypes); err != nil {
+		llog.Warn("invalid webhook event types", llog.KV{"handler": "postWebhooks"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusBadRequest, ErrCodeInvalidEventTypes, err.Error())
+		return
+	}
+
+	secret := args.Secret
+	if secret == "" {
+		var err error
+		secret, err = webhooks.NewSecret()
 		if err != nil {
-			llog.Error("refund processing failed", llog.KV{"handler": "cancelOrder"}, llog.ErrKV(err))
-			i.handleError(c, http.StatusInternalServerError, ErrCodeChargeServiceError,
-				fmt.Sprintf("error processing refund: %v", err))
+			llog.Error("failed to generate webhook secret", llog.KV{"handler": "postWebhooks"}, llog.ErrKV(err))
+			i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, err.Error())
 			return
 		}
-		refundedCents = order.TotalCents()
-		llog.Info("refund processed successfully", llog.KV{
-			"handler":        "cancelOrder",
-			"refunded_cents": refundedCents,
-		})
 	}
 
-	llog.Info("updating order status to cancelled", llog.KV{"handler": "cancelOrder"})
-	// Update order status to cancelled
-	err := i.stor.SetOrderStatus(ctx, order.ID, storage.OrderStatusCancelled)
+	sub, err := i.webhooks.InsertWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:        args.URL,
+		Secret:     secret,
+		EventTypes: args.EventTypes,
+		CreatedAt:  i.now(),
+	})
 	if err != nil {
-		llog.Error("failed to update order status to cancelled", llog.KV{"handler": "cancelOrder"}, llog.ErrKV(err))
-		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError,
-			fmt.Sprintf("error cancelling order: %v", err))
+		llog.Error("failed to insert webhook subscription", llog.KV{"handler": "postWebhooks"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error inserting webhook: %v", err))
 		return
 	}
 
-	llog.Info("successfully updated order status to cancelled", llog.KV{"handler": "cancelOrder"})
+	c.JSON(http.StatusCreated, postWebhooksRes{
+		Subscription: sub,
+		Secret:       secret,
+	})
 
-	// Return success response
-	response := cancelOrderRes{
-		Message: "order cancelled successfully",
-		OrderID: order.ID,
+	llog.Info("post webhooks request completed successfully", llog.KV{
+		"handler":         "postWebhooks",
+		"subscription_id": sub.ID,
+		"url":             sub.URL,
+	})
+}
+
+// deleteWebhook is called by incoming HTTP DELETE requests to /webhooks/:id
+func (i *instance) deleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+	llog.Info("delete webhook request started", llog.KV{"handler": "deleteWebhook", "subscription_id": id})
+
+	err := i.webhooks.DeleteWebhookSubscription(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrWebhookSubscriptionNotFound) {
+		i.handleError(c, http.StatusNotFound, ErrCodeWebhookNotFound, "not found")
+		return
+	}
+	if err != nil {
+		llog.Error("failed to delete webhook subscription", llog.KV{"handler": "deleteWebhook", "subscription_id": id}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error deleting webhook: %v", err))
+		return
 	}
 
-	// Include refund amount if applicable
-	if refundedCents > 0 {
-		response.RefundedCents = refundedCents
+	c.Status(http.StatusNoContent)
+
+	llog.Info("delete webhook request completed successfully", llog.KV{"handler": "deleteWebhook", "subscription_id": id})
+}
+
+// getWebhookDeadLettersRes is the result of the GET /webhooks/dead-letters
+// handler
+type getWebhookDeadLettersRes struct {
+	Deliveries []storage.WebhookDelivery `json:"deliveries"`
+}
+
+// getWebhookDeadLetters is called by incoming HTTP GET requests to
+// /webhooks/dead-letters
+func (i *instance) getWebhookDeadLetters(c *gin.Context) {
+	llog.Info("get webhook dead letters request started", llog.KV{"handler": "getWebhookDeadLetters"})
+
+	deliveries, err := i.webhooks.GetWebhookDeliveries(c.Request.Context(), storage.WebhookDeliveryQuery{
+		Status: storage.WebhookDeliveryDead,
+	})
+	if err != nil {
+		llog.Error("failed to get dead webhook deliveries", llog.KV{"handler": "getWebhookDeadLetters"}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error getting dead letters: %v", err))
+		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, getWebhookDeadLettersRes{
+		Deliveries: deliveries,
+	})
 
-	llog.Info("cancel order request completed successfully", llog.KV{"handler": "cancelOrder"})
+	llog.Info("get webhook dead letters request completed successfully", llog.KV{
+		"handler":          "getWebhookDeadLetters",
+		"deliveries_count": len(deliveries),
+	})
+}
+
+// retryWebhookDeadLetter is called by incoming HTTP POST requests to
+// /webhooks/dead-letters/:id/retry and makes a dead delivery pending again with
+// a fresh set of attempts
+func (i *instance) retryWebhookDeadLetter(c *gin.Context) {
+	llog.Info("retry webhook dead letter request started", llog.KV{"handler": "retryWebhookDeadLetter"})
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		i.handleError(c, http.StatusNotFound, ErrCodeWebhookDeliveryNotFound, "not found")
+		return
+	}
+
+	err = i.webhooks.UpdateWebhookDelivery(c.Request.Context(), storage.WebhookDelivery{
+		ID:            id,
+		Status:        storage.WebhookDeliveryPending,
+		NextAttemptAt: i.now(),
+	}, storage.WebhookDeliveryDead)
+	switch {
+	case errors.Is(err, storage.ErrWebhookDeliveryNotFound):
+		i.handleError(c, http.StatusNotFound, ErrCodeWebhookDeliveryNotFound, "not found")
+		return
+	case errors.Is(err, storage.ErrWebhookDeliveryStatusMismatch):
+		i.handleError(c, http.StatusConflict, ErrCodeWebhookDeliveryNotDead, "only dead deliveries can be retried")
+		return
+	case err != nil:
+		llog.Error("failed to retry webhook delivery", llog.KV{"handler": "retryWebhookDeadLetter", "delivery_id": id}, llog.ErrKV(err))
+		i.handleError(c, http.StatusInternalServerError, ErrCodeInternalError, fmt.Sprintf("error retrying delivery: %v", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+
+	llog.Info("retry webhook dead letter request completed successfully", llog.KV{
+		"handler":     "retryWebhookDeadLetter",
+		"delivery_id": id,
+	})
 }
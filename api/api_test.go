@@ -1,21 +1,36 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/order-up/auth"
 	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/ratelimit"
 	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/stream"
+	"github.com/levenlabs/order-up/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -26,6 +41,47 @@ func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// isChange matches an order change whose event has the type and moves the order
+// from one status to another
+func isChange(typ storage.OrderEventType, from, to storage.OrderStatus) interface{} {
+	return isChangeWhere(typ, from, to, func(storage.OrderChange) bool { return true })
+}
+
+// isChangeWhere is like isChange except the change must also satisfy fn
+func isChangeWhere(typ storage.OrderEventType, from, to storage.OrderStatus, fn func(storage.OrderChange) bool) interface{} {
+	return mock.MatchedBy(func(ch storage.OrderChange) bool {
+		return ch.Event.Type == typ && ch.Event.OldStatus == from && ch.Event.NewStatus == to && fn(ch)
+	})
+}
+
+// isFulfillment matches an order change that records a single line item of a
+// fulfilling order as fulfilled from one quantity to another
+func isFulfillment(lineItem int, from, quantity int64) interface{} {
+	return isChangeWhere(storage.OrderEventPartiallyFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilling, func(ch storage.OrderChange) bool {
+		return ch.RequireStatus &&
+			assert.ObjectsAreEqual([]storage.LineItemFulfillment{{LineItem: lineItem, From: from, Quantity: quantity}}, ch.Fulfillments)
+	})
+}
+
+// isInsert matches an order change that inserts the order
+func isInsert(order storage.Order) interface{} {
+	return mock.MatchedBy(func(ch storage.OrderChange) bool {
+		return ch.Insert != nil && assert.ObjectsAreEqual(order, *ch.Insert) && ch.Event.Type == storage.OrderEventCreated
+	})
+}
+
+// insertedEvent returns the event that ApplyOrderChange returns after inserting
+// an order with the ID
+func insertedEvent(id string) storage.OrderEvent {
+	return storage.OrderEvent{OrderID: id, Type: storage.OrderEventCreated}
+}
+
+// appliedEvent can be passed to Return when mocking ApplyOrderChange so that the
+// change's event is returned as if it was stored
+func appliedEvent(_ context.Context, change storage.OrderChange) storage.OrderEvent {
+	return change.Event
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func TestGetOrders(t *testing.T) {
@@ -45,7 +101,7 @@ func TestGetOrders(t *testing.T) {
 		// On queues up a new expected call with the provided arguments and returns
 		// the values sent to Return
 		// we also only expect this call to only happen Once
-		stor.On("GetOrders", ctx, storage.OrderStatus(-1)).Return([]storage.Order{}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{}, "", nil).Once()
 		// we know that this call doesn't make any external calls so we can just pass
 		// nil to simplify this code
 		h := Handler(stor, nil, nil)
@@ -85,7 +141,7 @@ func TestGetOrders(t *testing.T) {
 	// should return all orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatus(-1)).Return([]storage.Order{order1, order2}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{order1, order2}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
@@ -106,7 +162,7 @@ func TestGetOrders(t *testing.T) {
 	// should return charged orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatusCharged).Return([]storage.Order{order1}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharged}}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{order1}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders?status=charged", nil).WithContext(ctx)
@@ -126,7 +182,7 @@ func TestGetOrders(t *testing.T) {
 	// should return pending orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatusPending).Return([]storage.Order{}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusPending}}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders?status=pending", nil).WithContext(ctx)
@@ -151,6 +207,162 @@ func TestGetOrders(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 		stor.AssertExpectations(t)
 	}
+
+	// should pass along multiple statuses
+	for _, query := range []string{"status=pending,charged", "status=pending&status=charged"} {
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{
+			Statuses: []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusCharged},
+		}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{order1}, "", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, query)
+		stor.AssertExpectations(t)
+	}
+
+	// should error if any of the statuses are unknown
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?status=pending,unknown", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeInvalidStatus, res.Code)
+			assert.Equal(t, "unknown value for status: unknown", res.Message)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should pass along the email, total and description filters
+	{
+		minTotal, maxTotal := int64(-100), int64(5000)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{
+			CustomerEmail:       "bob@example.com",
+			CustomerEmailDomain: "example.com",
+			MinTotalCents:       &minTotal,
+			MaxTotalCents:       &maxTotal,
+			LineItemDescription: "widget",
+		}, storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{order1}, "", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?email=bob@example.com&email_domain=@example.com&min_total_cents=-100&max_total_cents=5000&description=widget", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should error on invalid totals
+	for _, query := range []string{"min_total_cents=ten", "max_total_cents=1.5", "min_total_cents=100&max_total_cents=99"} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, query) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeInvalidTotalRange, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should pass along the created range
+	{
+		created := storage.TimeRange{
+			After:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Before: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, mock.MatchedBy(func(q storage.OrderQuery) bool {
+			return q.Created.After.Equal(created.After) && q.Created.Before.Equal(created.Before)
+		}), storage.Page{Limit: defaultOrdersLimit}).Return([]storage.Order{}, "", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?created_after=2024-01-01T00:00:00Z&created_before=2024-01-01T19:00:00-05:00", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should error on invalid times
+	for _, query := range []string{"created_after=yesterday", "created_before=2024-01-01"} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, query) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeInvalidTimeRange, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should pass along the page and return the next cursor
+	{
+		order1 := storage.Order{
+			ID:        "test1",
+			LineItems: []storage.LineItem{},
+			Status:    storage.OrderStatusCharged,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, storage.Page{Limit: 1, Cursor: "abc"}).Return([]storage.Order{order1}, "def", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?limit=1&cursor=abc", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrdersRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, []storage.Order{order1}, res.Orders)
+			assert.Equal(t, "def", res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error on invalid limits
+	for _, limit := range []string{"0", "-1", "1001", "ten"} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?limit="+limit, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, limit) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeInvalidLimit, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error on invalid cursors
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, storage.Page{Limit: defaultOrdersLimit, Cursor: "bad"}).Return(nil, "", storage.ErrInvalidCursor).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?cursor=bad", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeInvalidCursor, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -196,6 +408,7 @@ func TestGetOrder(t *testing.T) {
 		ID:        "test1",
 		LineItems: []storage.LineItem{},
 		Status:    storage.OrderStatusCharged,
+		Version:   3,
 	}
 
 	// should return the above order
@@ -215,6 +428,7 @@ func TestGetOrder(t *testing.T) {
 			err := json.Unmarshal(w.Body.Bytes(), &res)
 			require.NoError(t, err)
 			assert.Equal(t, order1, res.Order)
+			assert.Equal(t, `"3"`, w.Header().Get("ETag"))
 		}
 		stor.AssertExpectations(t)
 	}
@@ -255,7 +469,14 @@ func TestPostOrders(t *testing.T) {
 		// On queues up a new expected call with the provided arguments and returns
 		// the values sent to Return
 		// we also only expect this call to only happen Once
-		stor.On("InsertOrder", ctx, expOrder).Return(id, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isInsert(expOrder)).Return(insertedEvent(id), nil).Once()
+		// the handler responds with the order as it was stored
+		stored := expOrder
+		stored.ID = id
+		stored.Version = 1
+		stored.CreatedAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		stored.UpdatedAt = stored.CreatedAt
+		stor.On("GetOrder", ctx, id).Return(stored, nil).Once()
 		// we know that this call doesn't make any external calls so we can just pass
 		// nil to simplify this code
 		h := Handler(stor, nil, nil)
@@ -286,9 +507,8 @@ func TestPostOrders(t *testing.T) {
 			var res postOrderRes
 			err = json.Unmarshal(w.Body.Bytes(), &res)
 			require.NoError(t, err)
-			// set the ID since that happens inside of the handler
-			expOrder.ID = id
-			assert.Equal(t, expOrder, res.Order)
+			assert.Equal(t, stored, res.Order)
+			assert.Equal(t, `"1"`, w.HeaderMap.Get("ETag"))
 		}
 		stor.AssertExpectations(t)
 	}
@@ -356,6 +576,208 @@ func TestPostOrders(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 		stor.AssertExpectations(t)
 	}
+
+	// should error if the inserted order can't be fetched
+	{
+		order := storage.Order{
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  1000,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, isInsert(order)).Return(insertedEvent("random"), nil).Once()
+		stor.On("GetOrder", ctx, "random").Return(storage.Order{}, errors.New("database down")).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(postOrderArgs{
+			CustomerEmail: order.CustomerEmail,
+			LineItems:     order.LineItems,
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPutOrder(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	newOrder := func(status storage.OrderStatus) storage.Order {
+		return storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    2,
+					PriceCents:  100,
+				},
+			},
+			Status:  status,
+			Version: 1,
+		}
+	}
+
+	putIfMatch := func(h http.Handler, order storage.Order, ifMatch, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", path.Join("/orders", order.ID), bytes.NewReader([]byte(body))).WithContext(ctx)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+	put := func(h http.Handler, order storage.Order, body string) *httptest.ResponseRecorder {
+		return putIfMatch(h, order, "", body)
+	}
+
+	// should replace the line items on a pending order
+	{
+		order := newOrder(storage.OrderStatusPending)
+		edited := order
+		edited.LineItems = []storage.LineItem{
+			{
+				Description: "item 2",
+				Quantity:    1,
+				PriceCents:  500,
+			},
+			{
+				Description: "discount",
+				Quantity:    1,
+				PriceCents:  -100,
+			},
+		}
+		// without If-Match the update shouldn't be conditional on the version
+		edited.Version = 0
+		stored := edited
+		stored.Version = 2
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventEdited, storage.OrderStatusPending, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.RequireStatus && ch.Version == edited.Version && ch.Event.OrderID == order.ID &&
+				ch.Event.AmountCents == 400 && assert.ObjectsAreEqual(edited.LineItems, ch.LineItems)
+		})).Return(appliedEvent, nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(stored, nil).Once()
+		// the fulfillment fields should be ignored
+		w := put(Handler(stor, nil, nil), order, `{"lineItems":[
+			{"description":"item 2","quantity":1,"priceCents":500,"fulfillmentStatus":2,"fulfilledQuantity":1},
+			{"description":"discount","quantity":1,"priceCents":-100}
+		]}`)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res putOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, stored, res.Order)
+			assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should make the update conditional on the version in If-Match
+	{
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventEdited, storage.OrderStatusPending, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.Version == 1
+		})).Return(appliedEvent, nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := putIfMatch(Handler(stor, nil, nil), order, `"1"`, `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 412 if If-Match doesn't match the current version
+	for _, ifMatch := range []string{`"2"`, `W/"1"`, `1`} {
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := putIfMatch(Handler(stor, nil, nil), order, ifMatch, `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		if assert.Equal(t, http.StatusPreconditionFailed, w.Code, ifMatch) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeVersionMismatch, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should return 412 if the order changed after it was fetched
+	{
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventEdited, storage.OrderStatusPending, storage.OrderStatusPending)).Return(storage.OrderEvent{}, storage.ErrOrderVersionMismatch).Once()
+		w := putIfMatch(Handler(stor, nil, nil), order, `"1"`, `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// * should match any version
+	{
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventEdited, storage.OrderStatusPending, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.Version == 0
+		})).Return(appliedEvent, nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := putIfMatch(Handler(stor, nil, nil), order, "*", `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should validate the line items like new orders
+	for body, code := range map[string]string{
+		`{"lineItems":[]}`: ErrCodeInvalidLineItems,
+		`{"lineItems":[{"description":"discount","quantity":1,"priceCents":-100}]}`: ErrCodeInvalidTotal,
+		`{"lineItems":`: ErrCodeInvalidJSON,
+	} {
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Maybe()
+		w := put(Handler(stor, nil, nil), order, body)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, body) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, code, res.Code, body)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error on orders that aren't pending
+	for _, status := range []storage.OrderStatus{storage.OrderStatusCharging, storage.OrderStatusCharged, storage.OrderStatusCancelled} {
+		order := newOrder(status)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := put(Handler(stor, nil, nil), order, `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should error if the order started being charged in the meantime
+	{
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventEdited, storage.OrderStatusPending, storage.OrderStatusPending)).Return(storage.OrderEvent{}, storage.ErrOrderStatusMismatch).Once()
+		w := put(Handler(stor, nil, nil), order, `{"lineItems":[{"description":"item 2","quantity":1,"priceCents":500}]}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -380,11 +802,13 @@ func TestChargeOrder(t *testing.T) {
 		// make sure the args are sane
 		require.True(t, args.AmountCents > 0, "amountCents must be more than 0: %v", args.AmountCents)
 		require.NotEmpty(t, args.CardToken)
+		require.NotEmpty(t, args.OrderID)
 
 		// increment calls so we can test to make sure the charge service was ever
 		// called and that it was only called an expected number of times
 		atomic.AddInt64(&chgServCalled, 1)
 		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"ch_1"}`))
 	}))
 
 	// these braces form a new scope so we don't end up polluting the top-level
@@ -416,7 +840,13 @@ func TestChargeOrder(t *testing.T) {
 		// the values sent to Return
 		// we also only expect this call to only happen Once
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		// the payment is recorded with the time it was charged so we can only check
+		// the fields we know ahead of time
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			p := ch.Payment
+			return p != nil && p.CardToken == args.CardToken && p.ChargeID == "ch_1" && p.AmountCents == 100 && !p.ChargedAt.IsZero()
+		})).Return(appliedEvent, nil).Once()
 		// no need to pass along a fulfillment service since we know we're only
 		// calling storage and charge service
 		h := Handler(stor, nil, chgServ)
@@ -544,7 +974,7 @@ func TestChargeOrder(t *testing.T) {
 		}
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventCharged, storage.OrderStatusPending, storage.OrderStatusCharged)).Return(appliedEvent, nil).Once()
 		h := Handler(stor, nil, chgServ)
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
@@ -562,9 +992,10 @@ func TestChargeOrder(t *testing.T) {
 		stor.AssertExpectations(t)
 	}
 
-	// should not have more than 1 outstanding charge service request
+	// should error and skip charging if the order only just started charging
 	{
 		chgServCalled = 0
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
 		order := storage.Order{
 			ID:            "test",
 			CustomerEmail: "test@test",
@@ -575,44 +1006,356 @@ func TestChargeOrder(t *testing.T) {
 					PriceCents:  100,
 				},
 			},
-			Status: storage.OrderStatusPending,
+			Status:    storage.OrderStatusCharging,
+			UpdatedAt: now.Add(-time.Second),
 		}
 		args := chargeOrderArgs{
 			CardToken: "amex",
 		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, chgServ, WithChargeRetryAfter(time.Minute), WithClock(func() time.Time { return now }))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, chgServCalled)
+		stor.AssertExpectations(t)
+	}
 
-		// we make a new chgServ mock that tracks the concurrency using the atomic
-		// package
-		var concurrent int64
+	// retrying the charge of an order that was left charging looks up the earlier
+	// charge first
+	{
+		charging := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:  storage.OrderStatusCharging,
+			Version: 4,
+		}
+		// lookup is how the charge service responds to looking up the charge and
+		// every charge it's asked to make succeeds
+		var lookup int
+		var charges int64
 		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			require.Equal(t, "/charge", r.URL.Path)
-			require.Equal(t, http.MethodPost, r.Method)
-
-			// ensure that only 1 call is happening concurrently by adding 1 to concurrent
-			// and checking to ensure it was 0 and is now 1
-			// the atomic package allows us to avoid locking and its a little simpler to
-			// work with in this situation
-			running := atomic.AddInt64(&concurrent, 1)
-			// defer decrementing the concurrent when this function is done running
-			defer atomic.AddInt64(&concurrent, -1)
-			require.EqualValues(t, 1, running, "detected more than 1 /charge happening concurrently")
+			if r.Method == http.MethodPost {
+				charges++
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":"ch_2"}`))
+				return
+			}
+			require.Equal(t, http.MethodGet, r.Method)
+			require.Equal(t, "test", r.URL.Query().Get("orderId"))
+			w.WriteHeader(lookup)
+			if lookup == http.StatusOK {
+				w.Write([]byte(`{"id":"ch_1"}`))
+			}
+		}))
+		retry := func(stor *mocks.MockStorageInstance) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/orders/test/charge", strings.NewReader(`{"cardToken":"amex"}`)).WithContext(ctx)
+			Handler(stor, nil, chgServ).ServeHTTP(w, r)
+			return w
+		}
 
-			// goroutines do not start immediately and we can't control how go schedules
-			// them so this sleep gives us a chance to try and see if another goroutine
-			// ends up calling this while we're sleeping to try and detect concurrency
-			// this isn't perfect but should be sufficient enough for this project
+		// should record the earlier charge without charging again
+		lookup, charges = http.StatusOK, 0
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, charging.ID).Return(charging, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Version == 4 && ch.Event.ChargeID == "ch_1" && ch.Payment != nil && ch.Payment.ChargeID == "ch_1"
+		})).Return(appliedEvent, nil).Once()
+		w := retry(stor)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res chargeOrderRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.EqualValues(t, 100, res.ChargedCents)
+		}
+		assert.EqualValues(t, 0, charges)
+		stor.AssertExpectations(t)
+
+		// should move the order back to pending and charge it again if the earlier
+		// charge wasn't made
+		lookup, charges = http.StatusNotFound, 0
+		stor = new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, charging.ID).Return(charging, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.Version == 4
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging, func(ch storage.OrderChange) bool {
+			return ch.Version == 0
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Payment != nil && ch.Payment.ChargeID == "ch_2" && ch.Payment.CardToken == "amex"
+		})).Return(appliedEvent, nil).Once()
+		assert.Equal(t, http.StatusOK, retry(stor).Code)
+		assert.EqualValues(t, 1, charges)
+		stor.AssertExpectations(t)
+
+		// should leave the order charging if the lookup fails
+		lookup, charges = http.StatusInternalServerError, 0
+		stor = new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, charging.ID).Return(charging, nil).Once()
+		w = retry(stor)
+		if assert.Equal(t, http.StatusInternalServerError, w.Code) {
+			var res errorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, ErrCodeChargeServiceError, res.Code)
+		}
+		assert.EqualValues(t, 0, charges)
+		stor.AssertExpectations(t)
+
+		// should conflict without charging if something else resolved the order
+		// first
+		lookup, charges = http.StatusNotFound, 0
+		stor = new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, charging.ID).Return(charging, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusPending)).Return(storage.OrderEvent{}, storage.ErrOrderVersionMismatch).Once()
+		assert.Equal(t, http.StatusConflict, retry(stor).Code)
+		assert.EqualValues(t, 0, charges)
+		stor.AssertExpectations(t)
+	}
+
+	// should revert to pending if the charge service rejects the charge
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		args := chargeOrderArgs{
+			CardToken: "declined",
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "card declined", http.StatusPaymentRequired)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusPending)).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave the order charging if the charge service can't be reached
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		chgServ := &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection reset")
+			}),
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		// the failure is recorded without changing the status
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave the order charging if the charge service errors since the
+	// customer might've been charged anyway
+	for _, code := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusCharging)).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code, code)
+		stor.AssertExpectations(t)
+	}
+
+	// should error and skip charging if another request started charging first
+	{
+		chgServCalled = 0
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		// the order was pending when we fetched it but another request changed it
+		// before we could
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(storage.OrderEvent{}, storage.ErrOrderStatusMismatch).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, chgServCalled)
+		stor.AssertExpectations(t)
+	}
+
+	// should error and skip charging if the order changed since the If-Match version
+	{
+		chgServCalled = 0
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:  storage.OrderStatusPending,
+			Version: 2,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		// the order was at the matched version when we fetched it but another
+		// request changed it before we could
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging, func(ch storage.OrderChange) bool {
+			return ch.Version == 2
+		})).Return(storage.OrderEvent{}, storage.ErrOrderVersionMismatch).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("If-Match", `"2"`)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		assert.EqualValues(t, 0, chgServCalled)
+		stor.AssertExpectations(t)
+	}
+
+	// should not have more than 1 outstanding charge service request
+	{
+		chgServCalled = 0
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+
+		// we make a new chgServ mock that tracks the concurrency using the atomic
+		// package
+		var concurrent int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/charge", r.URL.Path)
+			require.Equal(t, http.MethodPost, r.Method)
+
+			// ensure that only 1 call is happening concurrently by adding 1 to concurrent
+			// and checking to ensure it was 0 and is now 1
+			// the atomic package allows us to avoid locking and its a little simpler to
+			// work with in this situation
+			running := atomic.AddInt64(&concurrent, 1)
+			// defer decrementing the concurrent when this function is done running
+			defer atomic.AddInt64(&concurrent, -1)
+			require.EqualValues(t, 1, running, "detected more than 1 /charge happening concurrently")
+
+			// goroutines do not start immediately and we can't control how go schedules
+			// them so this sleep gives us a chance to try and see if another goroutine
+			// ends up calling this while we're sleeping to try and detect concurrency
+			// this isn't perfect but should be sufficient enough for this project
 			time.Sleep(time.Second)
 
 			// increment calls so we can test to make sure the charge service was ever
 			// called and that it was only called an expected number of times
 			atomic.AddInt64(&chgServCalled, 1)
 			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"ch_1"}`))
 		}))
 
 		times := 5
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Times(times)
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Times(times)
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)).Return(appliedEvent, nil).Times(times)
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged)).Return(appliedEvent, nil).Times(times)
 		h := Handler(stor, nil, chgServ)
 
 		// sync.WaitGroup is a handy tool for waiting until a bunch of goroutines
@@ -645,67 +1388,2707 @@ func TestChargeOrder(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func TestPostCancelOrder(t *testing.T) {
-	// TODO: add tests
-}
-
-////////////////////////////////////////////////////////////////////////////////
-
-func TestPostFulfillOrder(t *testing.T) {
+func TestIdempotencyKey(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
 	ctx := context.Background()
 
-	// keep track of which items have already been fulfilled so we can ignore ones
-	// that have already been requested
-	fulfilledItems := map[string]bool{}
-	var fulfilledItemsLock sync.Mutex
-	// fulfillments will only be incremented if the fulfillment happened for the
-	// first time so this can be used to test for deduplication of the actual
-	// fulfillment service
-	var fulfillments int64
-	fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// make sure the URL is /fulfill and the method is PUT since that's the only
-		// endpoint the fufillment service has
-		require.Equal(t, "/fulfill", r.URL.Path)
-		require.Equal(t, http.MethodPut, r.Method)
+	expOrder := storage.Order{
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+		},
+		Status: storage.OrderStatusPending,
+	}
+	byts, err := json.Marshal(postOrderArgs{
+		CustomerEmail: expOrder.CustomerEmail,
+		LineItems:     expOrder.LineItems,
+	})
+	require.NoError(t, err)
+	hash := sha256.Sum256(byts)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := WithClock(func() time.Time {
+		return now
+	})
+	key := storage.IdempotencyKey{
+		Key:         "abc",
+		Route:       "POST /orders",
+		RequestHash: hex.EncodeToString(hash[:]),
+		ExpiresAt:   now.Add(DefaultIdempotencyLockTimeout),
+	}
 
-		// decode the body as a fulfillmentServiceFulfillArgs
-		var args fulfillmentServiceFulfillArgs
-		err := json.NewDecoder(r.Body).Decode(&args)
-		require.NoError(t, err)
+	// these braces form a new scope so we don't end up polluting the top-level
+	// function with our recorder, request, etc
+	// they also visually break up the inner tests
 
-		// make sure the args are sane
-		require.NotEmpty(t, args.Description)
-		require.True(t, args.Quantity > 0, "quantity must be more than 0: %v", args.Quantity)
-		require.NotEmpty(t, args.OrderID)
+	// should store the response for the first request
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, isInsert(expOrder)).Return(insertedEvent("random"), nil).Once()
+		stor.On("GetOrder", ctx, "random").Return(expOrder, nil).Once()
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(key, nil).Once()
+		idem.On("CompleteIdempotencyKey", ctx, key.Key, key.Route, http.StatusCreated, mock.Anything, now.Add(DefaultIdempotencyKeyTTL)).Return(nil).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			// the stored body should be exactly what we responded with
+			stored := idem.Calls[1].Arguments.Get(4).([]byte)
+			assert.Equal(t, w.Body.String(), string(stored))
+		}
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
 
-		// we need to lock around a map since the map isn't safe for concurrent
-		// reads/writes
-		fulfilledItemsLock.Lock()
-		// we want to make sure we ALWAYS unlock no matter
-		defer fulfilledItemsLock.Unlock()
+	// should replay the stored response without calling the handler
+	{
+		stored := key
+		stored.Completed = true
+		stored.StatusCode = http.StatusCreated
+		stored.Body = []byte(`{"order":{"id":"random"}}`)
+		stor := new(mocks.MockStorageInstance)
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(stored, storage.ErrIdempotencyKeyExists).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, string(stored.Body), w.Body.String())
+		assert.Equal(t, "true", w.HeaderMap.Get("Idempotent-Replayed"))
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
 
-		// the "key" in the fulfilledItems map is the orderID and the description
-		// this could probably be more complicated but that seems unnecessary
-		key := args.OrderID + args.Description
-		// if the map already contains a true value for that key then we can
-		// immediately return since we've already fulfilled
-		if fulfilledItems[key] {
+	// should reject a reused key with a different body
+	{
+		stored := key
+		stored.RequestHash = "different"
+		stored.Completed = true
+		stor := new(mocks.MockStorageInstance)
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(stored, storage.ErrIdempotencyKeyExists).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
+
+	// should conflict if the original request is still in progress
+	{
+		stor := new(mocks.MockStorageInstance)
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(key, storage.ErrIdempotencyKeyExists).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
+
+	// should forget the key if the handler fails so the request can be retried
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, isInsert(expOrder)).Return(storage.OrderEvent{}, errors.New("database down")).Once()
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(key, nil).Once()
+		idem.On("DeleteIdempotencyKey", ctx, key.Key, key.Route).Return(nil).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
+
+	// should hold the key for the lock timeout and keep the response for the TTL
+	{
+		key := key
+		key.ExpiresAt = now.Add(5 * time.Minute)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, isInsert(expOrder)).Return(insertedEvent("random"), nil).Once()
+		stor.On("GetOrder", ctx, "random").Return(expOrder, nil).Once()
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(key, nil).Once()
+		idem.On("CompleteIdempotencyKey", ctx, key.Key, key.Route, http.StatusCreated, mock.Anything, now.Add(time.Hour)).Return(nil).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyStorage(idem), clock,
+			WithIdempotencyLockTimeout(5*time.Minute),
+			WithIdempotencyKeyTTL(time.Hour),
+		)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
+
+	// should ignore the header if no idempotency storage was given
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, isInsert(expOrder)).Return(insertedEvent("random"), nil).Once()
+		stor.On("GetOrder", ctx, "random").Return(expOrder, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Idempotency-Key", key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// roundTripperFunc lets a test build an *http.Client whose requests fail before
+// ever reaching a handler, which mocks.NewMockedService can't do
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestRecoverCharges(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	// the charge service only knows about charges for the "charged" order
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/charge", r.URL.Path)
+		require.Equal(t, http.MethodGet, r.Method)
+		switch r.URL.Query().Get("orderId") {
+		case "charged":
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"ch_1"}`))
+		case "notcharged":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	// should resolve each charging order against the charge service
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharging}}, storage.Page{}).Return([]storage.Order{
+			{ID: "charged", Status: storage.OrderStatusCharging},
+			{ID: "notcharged", Status: storage.OrderStatusCharging},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "charged" && ch.Event.ChargeID == "ch_1" &&
+				ch.Payment != nil && ch.Payment.ChargeID == "ch_1" && !ch.Payment.ChargedAt.IsZero()
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "notcharged"
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverCharges(ctx, stor, chgServ)
+		assert.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave orders charging if the charge service errors but still recover
+	// the rest
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharging}}, storage.Page{}).Return([]storage.Order{
+			{ID: "broken", Status: storage.OrderStatusCharging},
+			{ID: "charged", Status: storage.OrderStatusCharging},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged)).Return(appliedEvent, nil).Once()
+		err := RecoverCharges(ctx, stor, chgServ)
+		assert.Error(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should record each recovered order's event as the system
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharging}}, storage.Page{}).Return([]storage.Order{
+			{ID: "charged", Status: storage.OrderStatusCharging},
+			{ID: "notcharged", Status: storage.OrderStatusCharging},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "charged" && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventChargeFailed, storage.OrderStatusCharging, storage.OrderStatusPending, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "notcharged" && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverCharges(ctx, stor, chgServ)
+		assert.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should return an error if a recovered order couldn't be updated
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharging}}, storage.Page{}).Return([]storage.Order{
+			{ID: "charged", Status: storage.OrderStatusCharging},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventCharged, storage.OrderStatusCharging, storage.OrderStatusCharged)).Return(storage.OrderEvent{}, errors.New("database down")).Once()
+		err := RecoverCharges(ctx, stor, chgServ)
+		assert.Error(t, err)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestRecoverRefunds(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	// the charge service only knows about the "made" refund
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/charge", r.URL.Path)
+		require.Equal(t, http.MethodGet, r.Method)
+		require.Equal(t, "test", r.URL.Query().Get("orderId"))
+		switch r.URL.Query().Get("refundId") {
+		case "made":
 			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"re_1"}`))
+		case "notmade":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	query := storage.OrderQuery{PendingRefunds: true}
+
+	// should resolve each pending refund against the charge service and leave the
+	// rest alone
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, query, storage.Page{}).Return([]storage.Order{{
+			ID:     "test",
+			Status: storage.OrderStatusFulfilled,
+			Refunds: []storage.Refund{
+				{ID: "made", AmountCents: 10, Pending: true},
+				{ID: "done", AmountCents: 20},
+				{ID: "notmade", AmountCents: 30, Pending: true},
+			},
+		}}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusFulfilled, storage.OrderStatusFulfilled, func(ch storage.OrderChange) bool {
+			return ch.ResolveRefundID == "made" && ch.DeleteRefundID == "" && ch.Event.RefundID == "made" &&
+				ch.Event.AmountCents == 10 && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefundFailed, storage.OrderStatusFulfilled, storage.OrderStatusFulfilled, func(ch storage.OrderChange) bool {
+			return ch.DeleteRefundID == "notmade" && ch.ResolveRefundID == "" && ch.Event.RefundID == "notmade" &&
+				ch.Event.AmountCents == 30 && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverRefunds(ctx, stor, chgServ)
+		assert.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave refunds pending if the charge service errors but still recover
+	// the rest
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, query, storage.Page{}).Return([]storage.Order{{
+			ID:     "test",
+			Status: storage.OrderStatusCharged,
+			Refunds: []storage.Refund{
+				{ID: "broken", AmountCents: 10, Pending: true},
+				{ID: "made", AmountCents: 20, Pending: true},
+			},
+		}}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.ResolveRefundID == "made"
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverRefunds(ctx, stor, chgServ)
+		assert.Error(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should move a cancelled order back to charged if its refund wasn't made
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, query, storage.Page{}).Return([]storage.Order{{
+			ID:      "test",
+			Status:  storage.OrderStatusCancelled,
+			Refunds: []storage.Refund{{ID: "notmade", AmountCents: 30, Pending: true}},
+		}}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancellationFailed, storage.OrderStatusCancelled, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.DeleteRefundID == "notmade" && ch.Event.RefundID == "notmade"
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverRefunds(ctx, stor, chgServ)
+		assert.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestRecoverFulfillments(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	// the fulfillment service fails for the "broken" order
+	var sent []string
+	fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/fulfill", r.URL.Path)
+		require.Equal(t, http.MethodPut, r.Method)
+		var args fulfillmentServiceFulfillArgs
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+		if args.OrderID == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		// we are fulfilling for the first time so set to true and continue to
-		// incrementing
-		fulfilledItems[key] = true
-		atomic.AddInt64(&fulfillments, 1)
+		sent = append(sent, args.OrderID+"/"+args.Description)
 		w.WriteHeader(http.StatusOK)
 	}))
+	fulfilling := storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusFulfilling}}
+	lineItems := func(fulfilled ...bool) []storage.LineItem {
+		var lis []storage.LineItem
+		for n, f := range fulfilled {
+			li := storage.LineItem{Description: fmt.Sprintf("item %d", n+1), Quantity: 1, PriceCents: 100}
+			if f {
+				li.FulfillmentStatus = storage.LineItemStatusFulfilled
+				li.FulfilledQuantity = 1
+			}
+			lis = append(lis, li)
+		}
+		return lis
+	}
+
+	// should send the fulfilled line items again and move each order out of
+	// fulfilling depending on how many of its line items were fulfilled
+	{
+		sent = nil
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, fulfilling, storage.Page{}).Return([]storage.Order{
+			{ID: "done", Status: storage.OrderStatusFulfilling, LineItems: lineItems(true, true)},
+			{ID: "partial", Status: storage.OrderStatusFulfilling, LineItems: lineItems(true, false)},
+			{ID: "none", Status: storage.OrderStatusFulfilling, LineItems: lineItems(false, false)},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "done" && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfillmentFailed, storage.OrderStatusFulfilling, storage.OrderStatusPartiallyFulfilled, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "partial" && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfillmentFailed, storage.OrderStatusFulfilling, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Event.OrderID == "none" && ch.Event.Actor == systemActor
+		})).Return(appliedEvent, nil).Once()
+		err := RecoverFulfillments(ctx, stor, fulfillServ)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"done/item 1", "done/item 2", "partial/item 1"}, sent)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave orders fulfilling if the fulfillment service errors but still
+	// recover the rest
+	{
+		sent = nil
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, fulfilling, storage.Page{}).Return([]storage.Order{
+			{ID: "broken", Status: storage.OrderStatusFulfilling, LineItems: lineItems(true)},
+			{ID: "done", Status: storage.OrderStatusFulfilling, LineItems: lineItems(true)},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled)).Return(appliedEvent, nil).Once()
+		err := RecoverFulfillments(ctx, stor, fulfillServ)
+		assert.Error(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// should return an error if a recovered order couldn't be updated
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, fulfilling, storage.Page{}).Return([]storage.Order{
+			{ID: "done", Status: storage.OrderStatusFulfilling, LineItems: lineItems(true)},
+		}, "", nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled)).Return(storage.OrderEvent{}, errors.New("database down")).Once()
+		err := RecoverFulfillments(ctx, stor, fulfillServ)
+		assert.Error(t, err)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostCancelOrder(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	var refundedCents int64
+	var lastRefund chargeServiceChargeArgs
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/charge", r.URL.Path)
+		require.Equal(t, http.MethodPost, r.Method)
+
+		var args chargeServiceChargeArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		require.NoError(t, err)
+
+		// refunds are charges with a negative amount
+		require.True(t, args.AmountCents < 0, "amountCents must be less than 0: %v", args.AmountCents)
+		atomic.AddInt64(&refundedCents, -args.AmountCents)
+		lastRefund = args
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"re_1"}`))
+	}))
+
+	newOrder := func(status storage.OrderStatus) storage.Order {
+		return storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    2,
+					PriceCents:  100,
+				},
+			},
+			Status: status,
+		}
+	}
+
+	// these braces form a new scope so we don't end up polluting the top-level
+	// function with our recorder, request, etc
+	// they also visually break up the inner tests
+
+	// should cancel a pending order without refunding
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusPending)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusPending, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Refund == nil
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, order.ID, res.OrderID)
+			assert.EqualValues(t, 0, res.RefundedCents)
+			assert.EqualValues(t, 0, refundedCents)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should cancel and refund a charged order
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		// the refund is recorded along with the cancellation
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Refund != nil && ch.Refund.ID != "" && ch.Refund.AmountCents == 200 && ch.RefundLimitCents == 200
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 200, res.RefundedCents)
+			assert.EqualValues(t, 200, refundedCents)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should refund the recorded payment referencing the original charge
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		order.Payment = &storage.Payment{
+			CardToken:   "amex",
+			ChargeID:    "ch_1",
+			AmountCents: 150,
+			ChargedAt:   time.Now(),
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Refund != nil && ch.RefundLimitCents == 150
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 150, res.RefundedCents)
+			assert.EqualValues(t, 150, refundedCents)
+			assert.Equal(t, "amex", lastRefund.CardToken)
+			assert.Equal(t, "ch_1", lastRefund.ChargeID)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error and skip refunding if another request cancelled first
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled)).Return(storage.OrderEvent{}, storage.ErrOrderStatusMismatch).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
 
-	// these 2 lines are strictly to prevent Go from complaining that we didn't use
-	// these variables and you should delete these lines once you add the tests
-	_ = ctx
-	_ = fulfillServ
-	// TODO: add tests
+	// should put the order back to charged if the charge service rejects the
+	// refund
+	{
+		order := newOrder(storage.OrderStatusCharged)
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusPaymentRequired)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		var refundID string
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			if ch.Refund == nil || ch.RefundLimitCents != 200 {
+				return false
+			}
+			refundID = ch.Refund.ID
+			return true
+		})).Return(appliedEvent, nil).Once()
+		// the refund is removed in the same change that moves the order back
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancellationFailed, storage.OrderStatusCancelled, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.DeleteRefundID != "" && ch.DeleteRefundID == refundID && ch.PendingRefundID == ""
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave the order cancelled with the refund pending if it's unknown
+	// whether the charge service made it
+	{
+		order := newOrder(storage.OrderStatusCharged)
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		var refundID string
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			if ch.Refund == nil {
+				return false
+			}
+			refundID = ch.Refund.ID
+			return true
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefundFailed, storage.OrderStatusCancelled, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.PendingRefundID != "" && ch.PendingRefundID == refundID && ch.DeleteRefundID == ""
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should make the cancellation conditional on the version in If-Match
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusPending)
+		order.Version = 4
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusPending, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Version == 4
+		})).Return(storage.OrderEvent{}, storage.ErrOrderVersionMismatch).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", `"4"`)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		stor.AssertExpectations(t)
+	}
 
+	// should only refund what's left after partial refunds
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		order.Refunds = []storage.Refund{{ID: "re_1", AmountCents: 50}}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Refund != nil && ch.Refund.AmountCents == 150 && ch.RefundLimitCents == 200
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 150, res.RefundedCents)
+			assert.EqualValues(t, 150, refundedCents)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error on fulfilled orders
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusFulfilled)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, chgServ)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostFulfillOrder(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	// keep track of which items have already been fulfilled so we can ignore ones
+	// that have already been requested
+	fulfilledItems := map[string]bool{}
+	var fulfilledItemsLock sync.Mutex
+	// fulfillments will only be incremented if the fulfillment happened for the
+	// first time so this can be used to test for deduplication of the actual
+	// fulfillment service
+	var fulfillments int64
+	fulfillHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// make sure the URL is /fulfill and the method is PUT since that's the only
+		// endpoint the fufillment service has
+		require.Equal(t, "/fulfill", r.URL.Path)
+		require.Equal(t, http.MethodPut, r.Method)
+
+		// decode the body as a fulfillmentServiceFulfillArgs
+		var args fulfillmentServiceFulfillArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		require.NoError(t, err)
+
+		// make sure the args are sane
+		require.NotEmpty(t, args.Description)
+		require.True(t, args.Quantity > 0, "quantity must be more than 0: %v", args.Quantity)
+		require.NotEmpty(t, args.OrderID)
+
+		// we need to lock around a map since the map isn't safe for concurrent
+		// reads/writes
+		fulfilledItemsLock.Lock()
+		// we want to make sure we ALWAYS unlock no matter
+		defer fulfilledItemsLock.Unlock()
+
+		// the "key" in the fulfilledItems map is the orderID and the description
+		// this could probably be more complicated but that seems unnecessary
+		key := args.OrderID + args.Description
+		// if the map already contains a true value for that key then we can
+		// immediately return since we've already fulfilled
+		if fulfilledItems[key] {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// we are fulfilling for the first time so set to true and continue to
+		// incrementing
+		fulfilledItems[key] = true
+		atomic.AddInt64(&fulfillments, 1)
+		w.WriteHeader(http.StatusOK)
+	})
+	fulfillServ := mocks.NewMockedService(fulfillHandler)
+
+	// these braces form a new scope so we don't end up polluting the top-level
+	// function with our recorder, request, etc
+	// they also visually break up the inner tests
+
+	// should fulfill every line item and update order status
+	{
+		fulfillments = 0
+		order := storage.Order{
+			ID:            "test1",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+				{
+					Description: "item 2",
+					Quantity:    3,
+					PriceCents:  200,
+				},
+				{
+					Description: "#1 customer discount",
+					Quantity:    1,
+					PriceCents:  -100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusCharged, storage.OrderStatusFulfilling)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(0, 0, 1)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(1, 0, 3)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled)).Return(appliedEvent, nil).Once()
+		// no need to pass along a charge service since we know we're only calling
+		// storage and fulfillment service
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Contains(t, w.HeaderMap.Get("Content-Type"), "application/json")
+			var res fulfillOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			// the discount shouldn't have been sent to the fulfillment service
+			assert.EqualValues(t, 2, res.FulfilledLineItems)
+			assert.EqualValues(t, 2, fulfillments)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error and skip fulfilling if not charged yet
+	{
+		fulfillments = 0
+		order := storage.Order{
+			ID:            "test2",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should error and skip fulfilling if already fulfilled
+	{
+		fulfillments = 0
+		order := storage.Order{
+			ID:            "test3",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusFulfilled,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should skip line items that were already fulfilled
+	{
+		fulfillments = 0
+		order := storage.Order{
+			ID:            "test4",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description:       "item 1",
+					Quantity:          1,
+					PriceCents:        100,
+					FulfillmentStatus: storage.LineItemStatusFulfilled,
+					FulfilledQuantity: 1,
+				},
+				{
+					Description: "item 2",
+					Quantity:    2,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPartiallyFulfilled,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusPartiallyFulfilled, storage.OrderStatusFulfilling)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(1, 0, 2)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled)).Return(appliedEvent, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res fulfillOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, res.FulfilledLineItems)
+			assert.EqualValues(t, 1, fulfillments)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should leave the order partially fulfilled on a failure and only retry the
+	// remaining line items
+	{
+		fulfillments = 0
+		order := storage.Order{
+			ID:            "test5",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+				{
+					Description: "item 2",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		// this is what storage would return after the first attempt recorded the
+		// first line item as fulfilled
+		retryOrder := order
+		retryOrder.LineItems = []storage.LineItem{
+			{
+				Description:       "item 1",
+				Quantity:          1,
+				PriceCents:        100,
+				FulfillmentStatus: storage.LineItemStatusFulfilled,
+				FulfilledQuantity: 1,
+			},
+			order.LineItems[1],
+		}
+		retryOrder.Status = storage.OrderStatusPartiallyFulfilled
+
+		// wrap the fulfillment handler so that the first request for the second
+		// item fails after the first item has already been fulfilled
+		var failed, requests int64
+		flakyServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests, 1)
+			var args fulfillmentServiceFulfillArgs
+			byts, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(byts, &args))
+			if args.Description == "item 2" && atomic.CompareAndSwapInt64(&failed, 0, 1) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(byts))
+			fulfillHandler.ServeHTTP(w, r)
+		}))
+
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusCharged, storage.OrderStatusFulfilling)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(0, 0, 1)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(1, 0, 1)).Return(appliedEvent, nil).Once()
+		// the failed line item is recorded as unfulfilled again
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfillmentFailed, storage.OrderStatusFulfilling, storage.OrderStatusPartiallyFulfilled, func(ch storage.OrderChange) bool {
+			return assert.ObjectsAreEqual([]storage.LineItemFulfillment{{LineItem: 1, From: 1, Quantity: 0}}, ch.Fulfillments)
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, flakyServ, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.EqualValues(t, 1, fulfillments)
+		assert.EqualValues(t, 2, requests)
+		stor.AssertExpectations(t)
+
+		// retrying should only result in the remaining item being sent
+		stor.On("GetOrder", ctx, order.ID).Return(retryOrder, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusPartiallyFulfilled, storage.OrderStatusFulfilling)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(1, 0, 1)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled)).Return(appliedEvent, nil).Once()
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(retryOrder))
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.EqualValues(t, 2, fulfillments)
+		assert.EqualValues(t, 3, requests)
+		stor.AssertExpectations(t)
+	}
+
+	newOrder := func(id string) storage.Order {
+		return storage.Order{
+			ID:            id,
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+				{
+					Description: "item 2",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:  storage.OrderStatusCharged,
+			Version: 3,
+		}
+	}
+	fulfillIfMatch := func(h http.Handler, order storage.Order, ifMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "fulfill"), nil).WithContext(ctx)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// should only mark the order as fulfilling if it's still at the version in
+	// If-Match
+	{
+		fulfillments = 0
+		order := newOrder("test6")
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfillmentStarted, storage.OrderStatusCharged, storage.OrderStatusFulfilling, func(ch storage.OrderChange) bool {
+			return ch.Version == 3
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventPartiallyFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilling, func(ch storage.OrderChange) bool {
+			return ch.Version == 0
+		})).Return(appliedEvent, nil).Twice()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfilled, storage.OrderStatusFulfilling, storage.OrderStatusFulfilled, func(ch storage.OrderChange) bool {
+			return ch.Version == 0
+		})).Return(appliedEvent, nil).Once()
+		w := fulfillIfMatch(Handler(stor, fulfillServ, nil), order, `"3"`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.EqualValues(t, 2, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should require If-Match with the order's version
+	for _, ifMatch := range []string{"", "*"} {
+		fulfillments = 0
+		order := newOrder("test7")
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := fulfillIfMatch(Handler(stor, fulfillServ, nil), order, ifMatch)
+		if assert.Equal(t, http.StatusPreconditionRequired, w.Code, ifMatch) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeIfMatchRequired, res.Code)
+		}
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 412 without fulfilling if If-Match doesn't match the current
+	// version
+	for _, ifMatch := range []string{`"2"`, `W/"3"`} {
+		fulfillments = 0
+		order := newOrder("test8")
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := fulfillIfMatch(Handler(stor, fulfillServ, nil), order, ifMatch)
+		if assert.Equal(t, http.StatusPreconditionFailed, w.Code, ifMatch) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeVersionMismatch, res.Code)
+		}
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 409 without fulfilling anything if another request changed
+	// the order's status before it could be marked as fulfilling
+	{
+		fulfillments = 0
+		order := newOrder("test9")
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusCharged, storage.OrderStatusFulfilling)).Return(storage.OrderEvent{}, storage.ErrOrderStatusMismatch).Once()
+		w := fulfillIfMatch(Handler(stor, fulfillServ, nil), order, orderETag(order))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 409 without sending a line item that's no longer at the
+	// fulfilled quantity we fetched and move the order back
+	{
+		fulfillments = 0
+		order := newOrder("test10")
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventFulfillmentStarted, storage.OrderStatusCharged, storage.OrderStatusFulfilling)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isFulfillment(0, 0, 1)).Return(storage.OrderEvent{}, storage.ErrLineItemFulfillmentMismatch).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventFulfillmentFailed, storage.OrderStatusFulfilling, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Fulfillments == nil
+		})).Return(appliedEvent, nil).Once()
+		w := fulfillIfMatch(Handler(stor, fulfillServ, nil), order, orderETag(order))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, fulfillments)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostRefundOrder(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	var refundedCents int64
+	var lastRefund chargeServiceChargeArgs
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/charge", r.URL.Path)
+		require.Equal(t, http.MethodPost, r.Method)
+
+		var args chargeServiceChargeArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		require.NoError(t, err)
+
+		// refunds are charges with a negative amount
+		require.True(t, args.AmountCents < 0, "amountCents must be less than 0: %v", args.AmountCents)
+		atomic.AddInt64(&refundedCents, -args.AmountCents)
+		lastRefund = args
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"re_1"}`))
+	}))
+
+	newOrder := func(status storage.OrderStatus) storage.Order {
+		return storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    2,
+					PriceCents:  100,
+				},
+				{
+					Description: "discount",
+					Quantity:    1,
+					PriceCents:  -50,
+				},
+			},
+			Status: status,
+			Payment: &storage.Payment{
+				CardToken:   "amex",
+				ChargeID:    "ch_1",
+				AmountCents: 150,
+			},
+			Version: 3,
+		}
+	}
+
+	refundIfMatch := func(h http.Handler, order storage.Order, ifMatch, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "refunds"), bytes.NewReader([]byte(body))).WithContext(ctx)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+	refund := func(h http.Handler, order storage.Order, body string) *httptest.ResponseRecorder {
+		return refundIfMatch(h, order, orderETag(order), body)
+	}
+
+	// should refund an arbitrary amount against the original charge
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusFulfilled)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusFulfilled, storage.OrderStatusFulfilled, func(ch storage.OrderChange) bool {
+			r := ch.Refund
+			return r != nil && r.ID != "" && r.AmountCents == 30 && r.Reason == "late" && len(r.LineItems) == 0 &&
+				ch.RefundLimitCents == 150 && ch.Version == 3
+		})).Return(appliedEvent, nil).Once()
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		w := refund(Handler(stor, nil, chgServ, WithClock(func() time.Time { return now })), order, `{"amountCents":30,"reason":"late"}`)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res refundOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 30, res.Refund.AmountCents)
+			assert.True(t, now.Equal(res.Refund.CreatedAt), "%v", res.Refund.CreatedAt)
+			assert.EqualValues(t, 30, res.RefundedCents)
+			assert.EqualValues(t, 30, refundedCents)
+			assert.Equal(t, "amex", lastRefund.CardToken)
+			assert.Equal(t, "ch_1", lastRefund.ChargeID)
+			assert.Equal(t, order.ID, lastRefund.OrderID)
+			assert.Equal(t, res.Refund.ID, lastRefund.RefundID)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should refund line items and include earlier refunds in the total
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		order.Refunds = []storage.Refund{{
+			ID:          "re_0",
+			AmountCents: 100,
+			LineItems:   []storage.RefundLineItem{{LineItem: 0, Quantity: 1}},
+		}}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			r := ch.Refund
+			return r != nil && r.AmountCents == 100 && len(r.LineItems) == 1 && r.LineItems[0] == storage.RefundLineItem{LineItem: 0, Quantity: 1} &&
+				ch.RefundLimitCents == 150
+		})).Return(appliedEvent, nil).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"lineItems":[{"lineItem":0,"quantity":1}]}`)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res refundOrderRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 100, res.Refund.AmountCents)
+			assert.EqualValues(t, 200, res.RefundedCents)
+			assert.EqualValues(t, 100, refundedCents)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should reject invalid refunds without touching storage
+	for _, body := range []string{
+		`{}`,
+		`{"amountCents":-10}`,
+		`{"amountCents":10,"lineItems":[{"lineItem":0,"quantity":1}]}`,
+		`{"lineItems":[{"lineItem":5,"quantity":1}]}`,
+		`{"lineItems":[{"lineItem":0,"quantity":0}]}`,
+		`{"lineItems":[{"lineItem":0,"quantity":3}]}`,
+		`{"lineItems":[{"lineItem":0,"quantity":1},{"lineItem":0,"quantity":2}]}`,
+		`{"lineItems":[{"lineItem":1,"quantity":1}]}`,
+	} {
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := refund(Handler(stor, nil, chgServ), order, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.EqualValues(t, 0, refundedCents, body)
+		stor.AssertExpectations(t)
+	}
+
+	// should error on orders that weren't charged
+	for _, status := range []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusCharging, storage.OrderStatusCancelled} {
+		refundedCents = 0
+		order := newOrder(status)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"amountCents":10}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
+
+	// should error without refunding if it would exceed the charge
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged)).Return(storage.OrderEvent{}, storage.ErrRefundExceedsCharge).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"amountCents":200}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.EqualValues(t, 0, refundedCents)
+		var res errorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		require.NoError(t, err)
+		assert.Equal(t, ErrCodeRefundExceedsCharge, res.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should remove the refund if the charge service rejects it
+	{
+		order := newOrder(storage.OrderStatusCharged)
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusPaymentRequired)
+		}))
+		var refundID string
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			if ch.Refund == nil {
+				return false
+			}
+			refundID = ch.Refund.ID
+			return true
+		})).Return(appliedEvent, nil).Once()
+		// the refund is removed in the same change that records the failure
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefundFailed, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.DeleteRefundID != "" && ch.DeleteRefundID == refundID && ch.Event.RefundID == refundID &&
+				ch.PendingRefundID == ""
+		})).Return(appliedEvent, nil).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"amountCents":10}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should leave the refund pending if it's unknown whether the charge service
+	// made it
+	{
+		order := newOrder(storage.OrderStatusCharged)
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		var refundID string
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			if ch.Refund == nil {
+				return false
+			}
+			refundID = ch.Refund.ID
+			return true
+		})).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefundFailed, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.PendingRefundID != "" && ch.PendingRefundID == refundID && ch.Event.RefundID == refundID &&
+				ch.DeleteRefundID == ""
+		})).Return(appliedEvent, nil).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"amountCents":10}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should require If-Match with the order's version
+	for _, ifMatch := range []string{"", "*"} {
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := refundIfMatch(Handler(stor, nil, chgServ), order, ifMatch, `{"amountCents":10}`)
+		if assert.Equal(t, http.StatusPreconditionRequired, w.Code, ifMatch) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeIfMatchRequired, res.Code)
+		}
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 412 without refunding if If-Match doesn't match the current
+	// version
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		w := refundIfMatch(Handler(stor, nil, chgServ), order, `"2"`, `{"amountCents":10}`)
+		if assert.Equal(t, http.StatusPreconditionFailed, w.Code) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, ErrCodeVersionMismatch, res.Code)
+		}
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
+
+	// should return 412 without refunding if the order changed after it was
+	// fetched
+	{
+		refundedCents = 0
+		order := newOrder(storage.OrderStatusCharged)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Version == 3
+		})).Return(storage.OrderEvent{}, storage.ErrOrderVersionMismatch).Once()
+		w := refund(Handler(stor, nil, chgServ), order, `{"amountCents":10}`)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		assert.EqualValues(t, 0, refundedCents)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestOrderEvents(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := WithClock(func() time.Time {
+		return now
+	})
+
+	order := storage.Order{
+		ID:            "test",
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  100,
+			},
+		},
+		Status: storage.OrderStatusPending,
+	}
+
+	// the charge service charges any positive amount and refunds fail if they're
+	// for more than 50 cents
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args chargeServiceChargeArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		require.NoError(t, err)
+		if args.AmountCents < -50 {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"ch_1"}`))
+	}))
+
+	// these braces form a new scope so we don't end up polluting the top-level
+	// function with our recorder, request, etc
+	// they also visually break up the inner tests
+
+	// should return the order's events
+	{
+		events := []storage.OrderEvent{
+			{
+				ID:          1,
+				OrderID:     order.ID,
+				Type:        storage.OrderEventCreated,
+				Actor:       "alice",
+				RequestID:   "req1",
+				AmountCents: 100,
+				CreatedAt:   now,
+			},
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		evs := new(mocks.MockEventStorage)
+		evs.On("GetOrderEvents", ctx, order.ID).Return(events, nil).Once()
+		h := Handler(stor, nil, nil, WithEventStorage(evs))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test/events", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrderEventsRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, events, res.Events)
+		}
+		stor.AssertExpectations(t)
+		evs.AssertExpectations(t)
+	}
+
+	// should 404 if the order doesn't exist
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, "missing").Return(storage.Order{}, storage.ErrOrderNotFound).Once()
+		evs := new(mocks.MockEventStorage)
+		h := Handler(stor, nil, nil, WithEventStorage(evs))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/missing/events", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+		evs.AssertExpectations(t)
+	}
+
+	// should not have the endpoint without event storage
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test/events", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should record creation by an anonymous caller with a generated request ID
+	{
+		stor := new(mocks.MockStorageInstance)
+		// new orders are inserted without an ID
+		insertedOrder := order
+		insertedOrder.ID = ""
+		// the event is stored along with the order
+		var recorded storage.OrderEvent
+		stor.On("ApplyOrderChange", ctx, isInsert(insertedOrder)).Run(func(args mock.Arguments) {
+			recorded = args.Get(1).(storage.OrderChange).Event
+		}).Return(insertedEvent(order.ID), nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, nil, clock)
+		byts, err := json.Marshal(postOrderArgs{
+			CustomerEmail: order.CustomerEmail,
+			LineItems:     order.LineItems,
+		})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			requestID := w.HeaderMap.Get("X-Request-ID")
+			assert.NotEmpty(t, requestID)
+			// the storage fills in the order's ID and status when it's inserted
+			assert.Equal(t, storage.OrderEvent{
+				Type:        storage.OrderEventCreated,
+				Actor:       anonymousActor,
+				RequestID:   requestID,
+				AmountCents: 100,
+				CreatedAt:   now,
+			}, recorded)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should record the charge attempt and its result for the request
+	// without trusting the unauthenticated caller's X-Actor
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventChargeAttempted,
+				Actor:       anonymousActor,
+				RequestID:   "req1",
+				OldStatus:   storage.OrderStatusPending,
+				NewStatus:   storage.OrderStatusCharging,
+				AmountCents: 100,
+				CreatedAt:   now,
+			},
+		}).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, storage.OrderChange{
+			Payment: &storage.Payment{
+				CardToken:   "amex",
+				ChargeID:    "ch_1",
+				AmountCents: 100,
+				ChargedAt:   now,
+			},
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventCharged,
+				Actor:       anonymousActor,
+				RequestID:   "req1",
+				OldStatus:   storage.OrderStatusCharging,
+				NewStatus:   storage.OrderStatusCharged,
+				AmountCents: 100,
+				ChargeID:    "ch_1",
+				CreatedAt:   now,
+			},
+		}).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ, clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders/test/charge", bytes.NewReader([]byte(`{"cardToken":"amex"}`))).WithContext(ctx)
+		r.Header.Set("X-Actor", "alice")
+		r.Header.Set("X-Request-ID", "req1")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "req1", w.HeaderMap.Get("X-Request-ID"))
+		stor.AssertExpectations(t)
+	}
+
+	// should record a failed refund and still respond if it can't be stored
+	{
+		charged := order
+		charged.Status = storage.OrderStatusCharged
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(charged, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChange(storage.OrderEventRefunded, storage.OrderStatusCharged, storage.OrderStatusCharged)).Return(appliedEvent, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventRefundFailed, storage.OrderStatusCharged, storage.OrderStatusCharged, func(ch storage.OrderChange) bool {
+			return ch.Event.AmountCents == 60 && ch.Event.RefundID != "" && ch.Event.Actor == anonymousActor
+		})).Return(storage.OrderEvent{}, errors.New("database down")).Once()
+		h := Handler(stor, nil, chgServ, clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders/test/refunds", bytes.NewReader([]byte(`{"amountCents":60}`))).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(charged))
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should record the refunded amount when cancelling a charged order
+	{
+		charged := order
+		charged.Status = storage.OrderStatusCharged
+		charged.Payment = &storage.Payment{ChargeID: "ch_1", AmountCents: 40}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(charged, nil).Once()
+		stor.On("ApplyOrderChange", ctx, isChangeWhere(storage.OrderEventCancelled, storage.OrderStatusCharged, storage.OrderStatusCancelled, func(ch storage.OrderChange) bool {
+			return ch.Event.AmountCents == 40 && ch.Refund != nil && ch.Event.RefundID == ch.Refund.ID
+		})).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, chgServ, clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders/test/cancel", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := WithClock(func() time.Time {
+		return now
+	})
+
+	sub := storage.WebhookSubscription{
+		ID:         "sub1",
+		URL:        "https://example.com/hook",
+		Secret:     "secret",
+		EventTypes: []storage.OrderEventType{storage.OrderEventCharged},
+		CreatedAt:  now,
+	}
+
+	// the endpoints don't exist without webhook storage
+	{
+		h := Handler(new(mocks.MockStorageInstance), nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	// should list the subscriptions without their secrets
+	{
+		whs := new(mocks.MockWebhookStorage)
+		whs.On("GetWebhookSubscriptions", ctx).Return([]storage.WebhookSubscription{sub}, nil).Once()
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.NotContains(t, w.Body.String(), "secret")
+			var res getWebhooksRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			expected := sub
+			expected.Secret = ""
+			assert.Equal(t, []storage.WebhookSubscription{expected}, res.Subscriptions)
+		}
+		whs.AssertExpectations(t)
+	}
+
+	// should create a subscription and return its secret
+	{
+		whs := new(mocks.MockWebhookStorage)
+		whs.On("InsertWebhookSubscription", ctx, storage.WebhookSubscription{
+			URL:        sub.URL,
+			Secret:     sub.Secret,
+			EventTypes: sub.EventTypes,
+			CreatedAt:  now,
+		}).Return(sub, nil).Once()
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs), clock)
+		w := httptest.NewRecorder()
+		body := `{"url":"https://example.com/hook","eventTypes":["charged"],"secret":"secret"}`
+		r := httptest.NewRequest("POST", "/webhooks", bytes.NewBufferString(body)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res postWebhooksRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, "sub1", res.Subscription.ID)
+			assert.Equal(t, "secret", res.Secret)
+		}
+		whs.AssertExpectations(t)
+	}
+
+	// should generate a secret if one isn't sent
+	{
+		whs := new(mocks.MockWebhookStorage)
+		whs.On("InsertWebhookSubscription", ctx, mock.MatchedBy(func(s storage.WebhookSubscription) bool {
+			return s.URL == "http://example.com" && len(s.Secret) == 64 && len(s.EventTypes) == 0
+		})).Return(func(ctx context.Context, s storage.WebhookSubscription) storage.WebhookSubscription {
+			s.ID = "sub2"
+			return s
+		}, nil).Once()
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs), clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/webhooks", bytes.NewBufferString(`{"url":"http://example.com"}`)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res postWebhooksRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Len(t, res.Secret, 64)
+		}
+		whs.AssertExpectations(t)
+	}
+
+	// should reject bad urls and event types
+	for body, code := range map[string]string{
+		`{"url":"ftp://example.com"}`:                                     ErrCodeInvalidWebhookURL,
+		`{"url":"/hook"}`:                                                 ErrCodeInvalidWebhookURL,
+		`{"url":"http://example.com","eventTypes":["shipped"]}`:           ErrCodeInvalidEventTypes,
+		`{"url":"http://example.com","eventTypes":["charged","charged"]}`: ErrCodeInvalidEventTypes,
+		`{"url":`: ErrCodeInvalidJSON,
+	} {
+		whs := new(mocks.MockWebhookStorage)
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/webhooks", bytes.NewBufferString(body)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, body) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, code, res.Code, body)
+		}
+		whs.AssertExpectations(t)
+	}
+
+	// should delete a subscription
+	{
+		whs := new(mocks.MockWebhookStorage)
+		whs.On("DeleteWebhookSubscription", ctx, "sub1").Return(nil).Once()
+		whs.On("DeleteWebhookSubscription", ctx, "missing").Return(storage.ErrWebhookSubscriptionNotFound).Once()
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/webhooks/sub1", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("DELETE", "/webhooks/missing", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		whs.AssertExpectations(t)
+	}
+
+	// should list the dead letters and retry them
+	{
+		dead := storage.WebhookDelivery{
+			ID:             7,
+			SubscriptionID: sub.ID,
+			Event:          storage.OrderEvent{ID: 3, OrderID: "test", Type: storage.OrderEventCharged, CreatedAt: now},
+			Status:         storage.WebhookDeliveryDead,
+			Attempts:       8,
+			NextAttemptAt:  now,
+			LastError:      "webhook rejected: 500",
+			CreatedAt:      now,
+		}
+		whs := new(mocks.MockWebhookStorage)
+		whs.On("GetWebhookDeliveries", ctx, storage.WebhookDeliveryQuery{Status: storage.WebhookDeliveryDead}).
+			Return([]storage.WebhookDelivery{dead}, nil).Once()
+		retried := storage.WebhookDelivery{ID: 7, Status: storage.WebhookDeliveryPending, NextAttemptAt: now}
+		whs.On("UpdateWebhookDelivery", ctx, retried, storage.WebhookDeliveryDead).Return(nil).Once()
+		retried.ID = 8
+		whs.On("UpdateWebhookDelivery", ctx, retried, storage.WebhookDeliveryDead).Return(storage.ErrWebhookDeliveryStatusMismatch).Once()
+		retried.ID = 9
+		whs.On("UpdateWebhookDelivery", ctx, retried, storage.WebhookDeliveryDead).Return(storage.ErrWebhookDeliveryNotFound).Once()
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithWebhookStorage(whs), clock)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/dead-letters", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getWebhookDeadLettersRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, []storage.WebhookDelivery{dead}, res.Deliveries)
+		}
+
+		for path, code := range map[string]int{
+			"/webhooks/dead-letters/7/retry":   http.StatusNoContent,
+			"/webhooks/dead-letters/8/retry":   http.StatusConflict,
+			"/webhooks/dead-letters/9/retry":   http.StatusNotFound,
+			"/webhooks/dead-letters/abc/retry": http.StatusNotFound,
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", path, nil).WithContext(ctx)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, code, w.Code, path)
+		}
+		whs.AssertExpectations(t)
+	}
+
+	// an order created through the API is delivered to a subscription by the
+	// dispatcher
+	{
+		var received []webhooks.Payload
+		receiver := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.NoError(t, webhooks.Verify("secret", r.Header.Get(webhooks.SignatureHeader), body, 0, time.Time{}))
+			var payload webhooks.Payload
+			require.NoError(t, json.Unmarshal(body, &payload))
+			received = append(received, payload)
+		}))
+
+		stor := storage.NewMemory()
+		h := Handler(stor, nil, nil, WithEventStorage(stor), WithWebhookStorage(stor))
+		w := httptest.NewRecorder()
+		body := `{"url":"https://example.com/hook","eventTypes":["created"],"secret":"secret"}`
+		r := httptest.NewRequest("POST", "/webhooks", bytes.NewBufferString(body)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		w = httptest.NewRecorder()
+		body = `{"customerEmail":"test@test","lineItems":[{"description":"item 1","quantity":1,"priceCents":100}]}`
+		r = httptest.NewRequest("POST", "/orders", bytes.NewBufferString(body)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var res postOrderRes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+
+		n, err := webhooks.New(stor, receiver).DeliverDue(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, storage.OrderEventCreated, received[0].Event.Type)
+			assert.Equal(t, res.Order.ID, received[0].Event.OrderID)
+		}
+	}
+}
+
+// sseEvent is a single Server-Sent Event read by readSSE
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// readSSE reads the next event from a stream, skipping any comments
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev != (sseEvent{}) {
+				return ev
+			}
+		case strings.HasPrefix(line, "id:"):
+			ev.id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			ev.event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			ev.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func TestStreamOrders(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	// should reject invalid filters and event IDs before streaming
+	for path, code := range map[string]string{
+		"/orders/stream?status=shipped":     ErrCodeInvalidStatus,
+		"/orders/stream?last_event_id=abc":  ErrCodeInvalidLastEventID,
+		"/orders/stream?last_event_id=-1":   ErrCodeInvalidLastEventID,
+		"/orders/stream?status=pending,bad": ErrCodeInvalidStatus,
+	} {
+		h := Handler(new(mocks.MockStorageInstance), nil, nil, WithStream(stream.NewBroker(10)))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code, path) {
+			var res errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, code, res.Code, path)
+		}
+	}
+
+	// streaming needs to read the response while it's still being written so
+	// these tests use a real server
+	broker := stream.NewBroker(3)
+	stor := storage.NewMemory()
+	srv := httptest.NewServer(Handler(stor, nil, nil, WithStream(broker)))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	// open starts streaming from path with the Last-Event-ID header if it isn't
+	// empty
+	open := func(path, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream;charset=utf-8", resp.Header.Get("Content-Type"))
+		return resp, bufio.NewReader(resp.Body)
+	}
+	send := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// should stream creations and status changes made by the handlers to the
+	// clients whose filters match
+	{
+		allResp, all := open("/orders/stream", "")
+		defer allResp.Body.Close()
+		cancelledResp, cancelled := open("/orders/stream?status=cancelled", "")
+		defer cancelledResp.Body.Close()
+		otherResp, other := open("/orders/stream?order_id=other", "")
+		defer otherResp.Body.Close()
+
+		resp := send("POST", "/orders", `{"customerEmail":"test@test","lineItems":[{"description":"item 1","quantity":1,"priceCents":100}]}`)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		orders, _, err := stor.GetOrders(ctx, storage.OrderQuery{}, storage.Page{})
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		id := orders[0].ID
+		// editing doesn't change the status so it isn't streamed
+		resp = send("PUT", "/orders/"+id, `{"lineItems":[{"description":"item 1","quantity":2,"priceCents":100}]}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = send("POST", "/orders/"+id+"/cancel", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		broker.Publish(storage.OrderEvent{OrderID: "other", Type: storage.OrderEventCancelled, NewStatus: storage.OrderStatusCancelled})
+
+		ev := readSSE(t, all)
+		assert.Equal(t, "1", ev.id)
+		assert.Equal(t, "created", ev.event)
+		var event storage.OrderEvent
+		require.NoError(t, json.Unmarshal([]byte(ev.data), &event))
+		assert.Equal(t, id, event.OrderID)
+		assert.Equal(t, storage.OrderEventCreated, event.Type)
+		ev = readSSE(t, all)
+		assert.Equal(t, "2", ev.id)
+		assert.Equal(t, "status_changed", ev.event)
+		require.NoError(t, json.Unmarshal([]byte(ev.data), &event))
+		assert.Equal(t, storage.OrderEventCancelled, event.Type)
+		assert.Equal(t, storage.OrderStatusPending, event.OldStatus)
+		assert.Equal(t, storage.OrderStatusCancelled, event.NewStatus)
+		assert.Equal(t, "3", readSSE(t, all).id)
+
+		assert.Equal(t, "2", readSSE(t, cancelled).id)
+		assert.Equal(t, "3", readSSE(t, cancelled).id)
+		assert.Equal(t, "3", readSSE(t, other).id)
+	}
+
+	// should resume after the Last-Event-ID from the buffer
+	{
+		resp, r := open("/orders/stream", "1")
+		assert.Equal(t, "2", readSSE(t, r).id)
+		assert.Equal(t, "3", readSSE(t, r).id)
+		resp.Body.Close()
+
+		// the query parameter works too and the filters apply to the buffer
+		resp, r = open("/orders/stream?last_event_id=1&order_id=other", "")
+		assert.Equal(t, "3", readSSE(t, r).id)
+		resp.Body.Close()
+	}
+
+	// should tell the client to reload if it missed changes that are no longer
+	// buffered
+	{
+		broker.Publish(storage.OrderEvent{OrderID: "other", Type: storage.OrderEventCreated})
+		broker.Publish(storage.OrderEvent{OrderID: "other", Type: storage.OrderEventCreated})
+		resp, r := open("/orders/stream", "1")
+		assert.Equal(t, "reset", readSSE(t, r).event)
+		assert.Equal(t, "3", readSSE(t, r).id)
+		assert.Equal(t, "4", readSSE(t, r).id)
+		assert.Equal(t, "5", readSSE(t, r).id)
+		resp.Body.Close()
+	}
+
+	// should end the streams when the broker is closed for a shutdown
+	{
+		resp, r := open("/orders/stream", "")
+		broker.Close()
+		_, err := r.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+		resp.Body.Close()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestAuthentication(t *testing.T) {
+	// the context just needs to be something static so we can include it in the
+	// mocked arguments
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	keys, err := auth.NewAPIKeys([]auth.APIKey{
+		{Subject: "checkout", SHA256: auth.HashAPIKey("key1"), Roles: []string{RoleCharge}},
+	})
+	require.NoError(t, err)
+	jwt, err := auth.NewJWT([]byte(strings.Repeat("s", auth.MinJWTSecretLength)),
+		auth.WithClock(func() time.Time { return now }),
+	)
+	require.NoError(t, err)
+	authn := WithAuthenticator(auth.Chain(keys, jwt))
+	clock := WithClock(func() time.Time { return now })
+
+	order := storage.Order{
+		ID:            "test",
+		CustomerEmail: "test@test",
+		LineItems:     []storage.LineItem{},
+		Status:        storage.OrderStatusPending,
+	}
+
+	// these braces form a new scope so we don't end up polluting the top-level
+	// function with our recorder, request, etc
+	// they also visually break up the inner tests
+
+	// should leave the health check public
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil, authn)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/healthz", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should reject requests without valid credentials before they reach the
+	// handler
+	expired, err := jwt.Sign(auth.Claims{Subject: "alice@test", ExpiresAt: now.Add(-time.Minute).Unix()})
+	require.NoError(t, err)
+	other, err := auth.NewJWT([]byte(strings.Repeat("o", auth.MinJWTSecretLength)))
+	require.NoError(t, err)
+	forged, err := other.Sign(auth.Claims{Subject: "alice@test", ExpiresAt: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	for _, header := range []string{"", "Bearer key2", "Basic a2V5MQ==", "Bearer " + expired, "Bearer " + forged} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil, authn)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test", nil).WithContext(ctx)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusUnauthorized, w.Code, header) {
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+			var res errorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, ErrCodeUnauthorized, res.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should accept an API key
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, nil, authn)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test", nil).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer key1")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should record the caller's subject as the actor
+	{
+		token, err := jwt.Sign(auth.Claims{Subject: "alice@test", ExpiresAt: now.Add(time.Hour).Unix(), Roles: []string{RoleSupport}})
+		require.NoError(t, err)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ApplyOrderChange", ctx, storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventCancelled,
+				Actor:     "alice@test",
+				RequestID: "req1",
+				OldStatus: storage.OrderStatusPending,
+				NewStatus: storage.OrderStatusCancelled,
+				CreatedAt: now,
+			},
+		}).Return(appliedEvent, nil).Once()
+		h := Handler(stor, nil, nil, authn, clock)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders/test/cancel", nil).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Actor", "mallory")
+		r.Header.Set("X-Request-ID", "req1")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should keep each caller's idempotency keys separate
+	{
+		byts := []byte(`{"customerEmail":"test@test","lineItems":[{"description":"item 1","quantity":1,"priceCents":1000}]}`)
+		hash := sha256.Sum256(byts)
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		key := storage.IdempotencyKey{
+			Key:         "checkout:abc",
+			Route:       "POST /orders",
+			RequestHash: hex.EncodeToString(hash[:]),
+			ExpiresAt:   now.Add(DefaultIdempotencyLockTimeout),
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ApplyOrderChange", ctx, mock.Anything).Return(insertedEvent("random"), nil).Once()
+		stor.On("GetOrder", ctx, "random").Return(order, nil).Once()
+		idem := new(mocks.MockIdempotencyStorage)
+		idem.On("InsertIdempotencyKey", ctx, key).Return(key, nil).Once()
+		idem.On("CompleteIdempotencyKey", ctx, key.Key, key.Route, http.StatusCreated, mock.Anything, now.Add(DefaultIdempotencyKeyTTL)).Return(nil).Once()
+		h := Handler(stor, nil, nil, authn, WithIdempotencyStorage(idem), WithClock(func() time.Time { return now }))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer key1")
+		r.Header.Set("Idempotency-Key", "abc")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		stor.AssertExpectations(t)
+		idem.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestAuthorization(t *testing.T) {
+	ctx := context.Background()
+
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"re_1"}`))
+	}))
+
+	var apiKeys []auth.APIKey
+	for _, key := range []struct {
+		subject string
+		roles   []string
+	}{
+		{"alice@test", []string{RoleCustomer}},
+		{"checkout", []string{RoleCharge}},
+		{"support", []string{RoleSupport}},
+		{"warehouse", []string{RoleWarehouse}},
+		{"prometheus", []string{RoleMetrics}},
+		{"nobody", nil},
+		{"bob@test", []string{RoleCustomer, RoleWarehouse}},
+	} {
+		apiKeys = append(apiKeys, auth.APIKey{
+			Subject: key.subject,
+			SHA256:  auth.HashAPIKey(key.subject),
+			Roles:   key.roles,
+		})
+	}
+	keys, err := auth.NewAPIKeys(apiKeys)
+	require.NoError(t, err)
+
+	// setup returns a handler backed by memory storage with a pending order for
+	// alice and a charged order for bob
+	setup := func() http.Handler {
+		stor := storage.NewMemory()
+		for _, order := range []storage.Order{
+			{ID: "alice1", CustomerEmail: "Alice@test", LineItems: []storage.LineItem{{Description: "item", Quantity: 1, PriceCents: 100}}, Status: storage.OrderStatusPending},
+			{ID: "bob1", CustomerEmail: "bob@test", LineItems: []storage.LineItem{{Description: "item", Quantity: 1, PriceCents: 100}}, Status: storage.OrderStatusCharged},
+		} {
+			_, err := stor.ApplyOrderChange(ctx, storage.OrderChange{
+				Insert: &order,
+				Event:  storage.OrderEvent{Type: storage.OrderEventCreated},
+			})
+			require.NoError(t, err)
+		}
+		return Handler(stor, nil, chgServ, WithEventStorage(stor), WithAuthenticator(keys), WithMetrics(prometheus.NewRegistry()))
+	}
+
+	tests := []struct {
+		subject string
+		method  string
+		path    string
+		code    int
+	}{
+		// customers can only read their own orders
+		{"alice@test", "GET", "/orders/alice1", http.StatusOK},
+		{"alice@test", "GET", "/orders/alice1/events", http.StatusOK},
+		{"alice@test", "GET", "/orders/bob1", http.StatusForbidden},
+		{"alice@test", "GET", "/orders/bob1/events", http.StatusForbidden},
+		{"alice@test", "GET", "/orders?email=bob@test", http.StatusForbidden},
+		{"alice@test", "GET", "/orders?email=ALICE@test", http.StatusOK},
+		{"alice@test", "POST", "/orders/alice1/cancel", http.StatusForbidden},
+		// a customer's other roles still apply to other customers' orders
+		{"bob@test", "GET", "/orders/alice1", http.StatusOK},
+		{"bob@test", "GET", "/orders/alice1/events", http.StatusForbidden},
+
+		// only support can cancel charged orders
+		{"checkout", "POST", "/orders/bob1/cancel", http.StatusForbidden},
+		{"warehouse", "POST", "/orders/bob1/cancel", http.StatusForbidden},
+		{"support", "POST", "/orders/bob1/cancel", http.StatusOK},
+		{"checkout", "POST", "/orders/alice1/cancel", http.StatusOK},
+
+		// service roles are limited to the routes they need
+		{"warehouse", "GET", "/orders", http.StatusOK},
+		{"warehouse", "POST", "/orders/alice1/refunds", http.StatusForbidden},
+		{"checkout", "GET", "/orders/alice1/events", http.StatusForbidden},
+		{"support", "GET", "/orders/alice1/events", http.StatusOK},
+		{"nobody", "GET", "/orders", http.StatusForbidden},
+		{"nobody", "GET", "/orders/alice1", http.StatusForbidden},
+
+		// the metrics include every caller's requests so only prometheus and
+		// support can read them, and prometheus can't read anything else
+		{"prometheus", "GET", "/metrics", http.StatusOK},
+		{"support", "GET", "/metrics", http.StatusOK},
+		{"alice@test", "GET", "/metrics", http.StatusForbidden},
+		{"checkout", "GET", "/metrics", http.StatusForbidden},
+		{"prometheus", "GET", "/orders", http.StatusForbidden},
+		{"", "GET", "/metrics", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		h := setup()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, test.path, nil).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer "+test.subject)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, test.code, w.Code, "%s %s %s", test.subject, test.method, test.path) && test.code == http.StatusForbidden {
+			var res errorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, ErrCodeForbidden, res.Code)
+		}
+	}
+
+	// customers should only get their own orders when listing
+	{
+		h := setup()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer alice@test")
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrdersRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			if assert.Len(t, res.Orders, 1) {
+				assert.Equal(t, "alice1", res.Orders[0].ID)
+			}
+		}
+	}
+
+	// every registered route should be in the policy so that it isn't
+	// accidentally forbidden to everyone
+	{
+		stor := storage.NewMemory()
+		h := Handler(stor, nil, nil,
+			WithEventStorage(stor),
+			WithWebhookStorage(stor),
+			WithStream(stream.NewBroker(1)),
+			WithAuthenticator(keys),
+			WithMetrics(prometheus.NewRegistry()),
+		).(*instance)
+		for _, route := range h.router.Routes() {
+			if route.Path == "/healthz" {
+				continue
+			}
+			assert.Contains(t, policy, route.Method+" "+route.Path)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	newLimiter := func() *ratelimit.Limiter {
+		l, err := ratelimit.New(ratelimit.Rate{Requests: 2, Per: time.Minute}, ratelimit.WithClock(func() time.Time { return now }))
+		require.NoError(t, err)
+		return l
+	}
+	request := func(h http.Handler, method, path, ip, authz string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil).WithContext(ctx)
+		r.RemoteAddr = ip + ":1234"
+		if authz != "" {
+			r.Header.Set("Authorization", authz)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// should limit each IP address separately and describe the limit in headers
+	{
+		h := Handler(storage.NewMemory(), nil, nil, WithRateLimit(RateLimitRead, newLimiter()), WithMetrics(prometheus.NewRegistry()))
+		for _, remaining := range []string{"1", "0"} {
+			w := request(h, "GET", "/orders", "10.0.0.1", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, remaining, w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+		}
+		w := request(h, "GET", "/orders", "10.0.0.1", "")
+		if assert.Equal(t, http.StatusTooManyRequests, w.Code) {
+			assert.Equal(t, "30", w.Header().Get("Retry-After"))
+			assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+			var res errorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, ErrCodeRateLimited, res.Code)
+		}
+
+		// other IP addresses and route groups aren't affected
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.2", "").Code)
+		w = request(h, "POST", "/orders", "10.0.0.1", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+		// the limit is refilled over time
+		now = now.Add(30 * time.Second)
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.1", "").Code)
+
+		// the metrics aren't in the read group so they aren't limited by it
+		w = request(h, "GET", "/metrics", "10.0.0.1", "")
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+			assert.Contains(t, w.Body.String(), `order_up_rate_limited_requests_total{group="read"} 1`+"\n")
+		}
+	}
+
+	// should limit authenticated callers by their identity rather than their IP
+	// address
+	{
+		keys, err := auth.NewAPIKeys([]auth.APIKey{
+			{Subject: "support", SHA256: auth.HashAPIKey("key1"), Roles: []string{RoleSupport}},
+		})
+		require.NoError(t, err)
+		h := Handler(storage.NewMemory(), nil, nil, WithAuthenticator(keys), WithRateLimit(RateLimitRead, newLimiter()))
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.1", "Bearer key1").Code)
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.2", "Bearer key1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(h, "GET", "/orders", "10.0.0.3", "Bearer key1").Code)
+	}
+
+	// should limit each IP address before authenticating and then each caller
+	// after
+	{
+		keys, err := auth.NewAPIKeys([]auth.APIKey{
+			{Subject: "support", SHA256: auth.HashAPIKey("key1"), Roles: []string{RoleSupport}},
+			{Subject: "prometheus", SHA256: auth.HashAPIKey("key2"), Roles: []string{RoleMetrics}},
+		})
+		require.NoError(t, err)
+		ipLimiter, err := ratelimit.New(ratelimit.Rate{Requests: 3, Per: time.Minute}, ratelimit.WithClock(func() time.Time { return now }))
+		require.NoError(t, err)
+		h := Handler(storage.NewMemory(), nil, nil, WithAuthenticator(keys),
+			WithRateLimit(RateLimitIP, ipLimiter), WithRateLimit(RateLimitRead, newLimiter()), WithMetrics(prometheus.NewRegistry()))
+
+		// callers without valid credentials are limited by their IP address
+		for i := 0; i < 3; i++ {
+			w := request(h, "GET", "/orders", "10.0.0.1", "Bearer wrong")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+		}
+		w := request(h, "GET", "/orders", "10.0.0.1", "Bearer wrong")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(h, "GET", "/orders", "10.0.0.1", "").Code)
+		// which includes valid callers at the same address
+		assert.Equal(t, http.StatusTooManyRequests, request(h, "GET", "/orders", "10.0.0.1", "Bearer key1").Code)
+
+		// an authenticated caller is still limited by their identity across
+		// addresses
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.2", "Bearer key1").Code)
+		assert.Equal(t, http.StatusOK, request(h, "GET", "/orders", "10.0.0.3", "Bearer key1").Code)
+		w = request(h, "GET", "/orders", "10.0.0.4", "Bearer key1")
+		if assert.Equal(t, http.StatusTooManyRequests, w.Code) {
+			assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		}
+
+		w = request(h, "GET", "/metrics", "10.0.0.5", "Bearer key2")
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Contains(t, w.Body.String(), `order_up_rate_limited_requests_total{group="ip"} 3`+"\n")
+			assert.Contains(t, w.Body.String(), `order_up_rate_limited_requests_total{group="read"} 1`+"\n")
+		}
+	}
+
+	// should ignore X-Forwarded-For unless the request came from a trusted proxy
+	// so callers can't get around the IP limit by making up addresses
+	{
+		forwarded := func(h http.Handler, forwardedFor string) int {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+			h.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		h := Handler(storage.NewMemory(), nil, nil, WithRateLimit(RateLimitIP, newLimiter()))
+		for i, code := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+			assert.Equal(t, code, forwarded(h, fmt.Sprintf("192.0.2.%d", i)), i)
+		}
+
+		h = Handler(storage.NewMemory(), nil, nil, WithRateLimit(RateLimitIP, newLimiter()), WithTrustedProxies([]string{"10.0.0.0/8"}))
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusOK, forwarded(h, fmt.Sprintf("192.0.2.%d", i)), i)
+		}
+	}
+}
+
+func TestChargeConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	// the charge service blocks until it's released so we can have a charge in
+	// flight while making other requests
+	called := make(chan struct{})
+	release := make(chan struct{})
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"ch_1"}`))
+	}))
+
+	stor := storage.NewMemory()
+	for _, id := range []string{"order1", "order2"} {
+		_, err := stor.ApplyOrderChange(ctx, storage.OrderChange{
+			Insert: &storage.Order{
+				ID:            id,
+				CustomerEmail: "test@test",
+				LineItems:     []storage.LineItem{{Description: "item", Quantity: 1, PriceCents: 100}},
+			},
+			Event: storage.OrderEvent{Type: storage.OrderEventCreated},
+		})
+		require.NoError(t, err)
+	}
+	registry := prometheus.NewRegistry()
+	h := Handler(stor, nil, chgServ, WithChargeConcurrency(1), WithMetrics(registry))
+	charge := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", id, "charge"), strings.NewReader(`{"cardToken":"amex"}`)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		return w
+	}
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- charge("order1") }()
+	<-called
+	assert.Contains(t, scrape(), "order_up_charge_service_in_flight_requests 1\n")
+
+	// should reject retrying a charge that's still in flight even though the
+	// order is charging
+	assert.Equal(t, http.StatusConflict, charge("order1").Code)
+
+	// should reject charges over the limit without changing the order
+	w := charge("order2")
+	if assert.Equal(t, http.StatusServiceUnavailable, w.Code) {
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		var res errorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, ErrCodeChargeServiceBusy, res.Code)
+	}
+	order, err := stor.GetOrder(ctx, "order2")
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusPending, order.Status)
+	assert.Contains(t, scrape(), "order_up_charge_service_rejected_requests_total 1\n")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	assert.Contains(t, scrape(), "order_up_charge_service_in_flight_requests 0\n")
+
+	// the slot is free again once the charge finishes
+	go func() { <-called }()
+	assert.Equal(t, http.StatusOK, charge("order2").Code)
+}
+
+func TestFulfillConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	// the fulfillment service counts how many times each line item was sent and
+	// blocks while block is set so a fulfillment can be held in flight
+	var sentLock sync.Mutex
+	sent := map[string]int{}
+	var block atomic.Value
+	block.Store(false)
+	called := make(chan struct{})
+	release := make(chan struct{})
+	fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args fulfillmentServiceFulfillArgs
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+		sentLock.Lock()
+		sent[args.OrderID+"/"+args.Description]++
+		sentLock.Unlock()
+		if block.Load().(bool) {
+			called <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	sentCount := func(id, description string) int {
+		sentLock.Lock()
+		defer sentLock.Unlock()
+		return sent[id+"/"+description]
+	}
+
+	stor := storage.NewMemory()
+	insert := func(id string) storage.Order {
+		_, err := stor.ApplyOrderChange(ctx, storage.OrderChange{
+			Insert: &storage.Order{
+				ID:            id,
+				CustomerEmail: "test@test",
+				LineItems: []storage.LineItem{
+					{Description: "item 1", Quantity: 1, PriceCents: 100},
+					{Description: "item 2", Quantity: 2, PriceCents: 100},
+				},
+				Status: storage.OrderStatusCharged,
+			},
+			Event: storage.OrderEvent{Type: storage.OrderEventCreated},
+		})
+		require.NoError(t, err)
+		order, err := stor.GetOrder(ctx, id)
+		require.NoError(t, err)
+		return order
+	}
+	// cancelling a charged order refunds it
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"re_1"}`))
+	}))
+	h := Handler(stor, fulfillServ, chgServ)
+	post := func(order storage.Order, action string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, action), nil).WithContext(ctx)
+		r.Header.Set("If-Match", orderETag(order))
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// race runs fn n times at once and returns the response codes
+	race := func(n int, fn func(int) *httptest.ResponseRecorder) []int {
+		codes := make([]int, n)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < n; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+				codes[j] = fn(j).Code
+			}(j)
+		}
+		close(start)
+		wg.Wait()
+		return codes
+	}
+
+	// concurrent fulfills should only send each line item once
+	for n := 0; n < 10; n++ {
+		order := insert(fmt.Sprintf("fulfill%d", n))
+		codes := race(5, func(int) *httptest.ResponseRecorder { return post(order, "fulfill") })
+		var ok int
+		for _, code := range codes {
+			if code == http.StatusOK {
+				ok++
+			} else {
+				assert.Contains(t, []int{http.StatusConflict, http.StatusPreconditionFailed}, code)
+			}
+		}
+		assert.Equal(t, 1, ok, codes)
+		assert.Equal(t, 1, sentCount(order.ID, "item 1"))
+		assert.Equal(t, 1, sentCount(order.ID, "item 2"))
+		got, err := stor.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+	}
+
+	// a fulfill racing a cancel should either ship everything and reject the
+	// cancel or ship nothing and cancel the order
+	for n := 0; n < 10; n++ {
+		order := insert(fmt.Sprintf("race%d", n))
+		codes := race(2, func(j int) *httptest.ResponseRecorder {
+			if j == 0 {
+				return post(order, "fulfill")
+			}
+			return post(order, "cancel")
+		})
+		got, err := stor.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		if codes[0] == http.StatusOK {
+			assert.Contains(t, []int{http.StatusConflict, http.StatusPreconditionFailed}, codes[1])
+			assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+			assert.Equal(t, 1, sentCount(order.ID, "item 1"))
+			assert.Equal(t, 1, sentCount(order.ID, "item 2"))
+		} else {
+			assert.Equal(t, http.StatusOK, codes[1])
+			assert.Contains(t, []int{http.StatusConflict, http.StatusPreconditionFailed}, codes[0])
+			assert.Equal(t, storage.OrderStatusCancelled, got.Status)
+			assert.Equal(t, 0, sentCount(order.ID, "item 1")+sentCount(order.ID, "item 2"))
+		}
+	}
+
+	// a cancel made while a line item is being sent should be rejected
+	order := insert("inflight")
+	block.Store(true)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post(order, "fulfill") }()
+	<-called
+	got, err := stor.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilling, got.Status)
+	assert.Equal(t, storage.LineItemStatusFulfilled, got.LineItems[0].FulfillmentStatus)
+	assert.Equal(t, http.StatusConflict, post(got, "cancel").Code)
+	assert.Equal(t, http.StatusConflict, post(got, "fulfill").Code)
+	block.Store(false)
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	got, err = stor.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+	assert.Equal(t, 1, sentCount(order.ID, "item 1"))
+	assert.Equal(t, 1, sentCount(order.ID, "item 2"))
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	// the charge service declines the "declined" card and accepts everything else
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args chargeServiceChargeArgs
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+		if args.CardToken == "declined" {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"ch_1"}`))
+	}))
+	fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	stor := storage.NewMemory()
+	h := Handler(stor, fulfillServ, chgServ, WithMetrics(prometheus.NewRegistry()))
+	requestIfMatch := func(method, path, ifMatch, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		return requestIfMatch(method, path, "", body)
+	}
+	// etag reads the order straight from storage so the request metrics only
+	// include the requests being tested
+	etag := func(id string) string {
+		order, err := stor.GetOrder(ctx, id)
+		require.NoError(t, err)
+		return orderETag(order)
+	}
+	createOrder := func(priceCents int64) string {
+		w := request("POST", "/orders", fmt.Sprintf(`{"customerEmail":"test@test","lineItems":[{"description":"item","quantity":1,"priceCents":%d}]}`, priceCents))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var res postOrderRes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Order.ID
+	}
+
+	// the first order is declined once before it's charged and fulfilled
+	order1 := createOrder(1000)
+	assert.Equal(t, http.StatusInternalServerError, request("POST", path.Join("/orders", order1, "charge"), `{"cardToken":"declined"}`).Code)
+	assert.Equal(t, http.StatusOK, request("POST", path.Join("/orders", order1, "charge"), `{"cardToken":"amex"}`).Code)
+	assert.Equal(t, http.StatusOK, requestIfMatch("POST", path.Join("/orders", order1, "fulfill"), etag(order1), "").Code)
+
+	// the second order is partially refunded and then cancelled which refunds
+	// the rest
+	order2 := createOrder(500)
+	assert.Equal(t, http.StatusOK, request("POST", path.Join("/orders", order2, "charge"), `{"cardToken":"amex"}`).Code)
+	assert.Equal(t, http.StatusCreated, requestIfMatch("POST", path.Join("/orders", order2, "refunds"), etag(order2), `{"amountCents":200,"reason":"damaged"}`).Code)
+	assert.Equal(t, http.StatusOK, request("POST", path.Join("/orders", order2, "cancel"), "").Code)
+
+	assert.Equal(t, http.StatusNotFound, request("GET", "/orders/missing", "").Code)
+	assert.Equal(t, http.StatusNotFound, request("GET", "/missing", "").Code)
+	// methods we don't know about share a label
+	assert.Equal(t, http.StatusNotFound, request("FOO", "/orders", "").Code)
+	assert.Equal(t, http.StatusNotFound, request("BAR", "/orders", "").Code)
+
+	w := request("GET", "/metrics", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	for _, line := range []string{
+		// requests are labelled by their route rather than their path
+		`order_up_http_requests_total{method="POST",route="/orders",status="201"} 2`,
+		`order_up_http_requests_total{method="POST",route="/orders/:id/charge",status="200"} 2`,
+		`order_up_http_requests_total{method="POST",route="/orders/:id/charge",status="500"} 1`,
+		`order_up_http_requests_total{method="GET",route="/orders/:id",status="404"} 1`,
+		`order_up_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`order_up_http_requests_total{method="other",route="unmatched",status="404"} 2`,
+		`order_up_http_request_duration_seconds_count{method="POST",route="/orders",status="201"} 2`,
+		`order_up_http_request_duration_seconds_bucket{method="POST",route="/orders",status="201",le="+Inf"} 2`,
+
+		"order_up_orders_created_total 2",
+		"order_up_orders_charged_total 2",
+		"order_up_orders_cancelled_total 1",
+		"order_up_refunded_cents_total 500",
+
+		`order_up_dependency_requests_total{operation="charge",result="error",service="charge"} 1`,
+		`order_up_dependency_requests_total{operation="charge",result="success",service="charge"} 2`,
+		`order_up_dependency_requests_total{operation="refund",result="success",service="charge"} 2`,
+		`order_up_dependency_requests_total{operation="fulfill",result="success",service="fulfillment"} 1`,
+		`order_up_dependency_request_duration_seconds_count{operation="charge",service="charge"} 3`,
+		`order_up_dependency_request_duration_seconds_count{operation="fulfill",service="fulfillment"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
 }
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// APIKey is a static key that a caller sends as "Authorization: Bearer <key>".
+// Only the key's hash is configured so the keys file doesn't need to be kept
+// secret.
+type APIKey struct {
+	// Subject identifies the caller using the key
+	Subject string `json:"subject"`
+	// SHA256 is the hex-encoded SHA-256 hash of the key, see HashAPIKey
+	SHA256 string `json:"sha256"`
+	// Roles are what the caller using the key is allowed to do
+	Roles []string `json:"roles,omitempty"`
+}
+
+// HashAPIKey returns the hex-encoded SHA-256 hash of key, which is what's
+// stored in an APIKey. Keys should be long random strings, like 32 random bytes
+// encoded as hex, so a fast hash is enough to keep them from being guessed.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeys is an Authenticator for a set of static API keys. Bearer tokens that
+// look like JSON Web Tokens are left for another Authenticator so API keys
+// can't contain exactly 2 periods.
+type APIKeys struct {
+	// keys are the configured keys by their hash
+	keys map[string]APIKey
+}
+
+// NewAPIKeys returns an Authenticator for the keys
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	a := &APIKeys{keys: make(map[string]APIKey, len(keys))}
+	for i, key := range keys {
+		if key.Subject == "" {
+			return nil, fmt.Errorf("api key %d is missing a subject", i)
+		}
+		b, err := hex.DecodeString(key.SHA256)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api key for %q has an invalid sha256 hash", key.Subject)
+		}
+		// re-encoding the hash lower cases it like HashAPIKey does
+		hash := hex.EncodeToString(b)
+		if existing, ok := a.keys[hash]; ok {
+			return nil, fmt.Errorf("api keys for %q and %q have the same hash", existing.Subject, key.Subject)
+		}
+		a.keys[hash] = key
+	}
+	return a, nil
+}
+
+// LoadAPIKeys returns an Authenticator for the keys in the JSON file at path,
+// which contains an array of APIKeys like:
+//
+//	[{"subject": "warehouse", "sha256": "9f86d081...", "roles": ["warehouse"]}]
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading api keys: %w", err)
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("error decoding api keys: %w", err)
+	}
+	return NewAPIKeys(keys)
+}
+
+// Authenticate implements the Authenticator interface
+func (a *APIKeys) Authenticate(r *http.Request) (Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok || isJWT(token) {
+		return Identity{}, ErrNoCredentials
+	}
+	// looking up the hash, rather than the key, means how long the lookup takes
+	// doesn't tell the caller anything about the configured keys
+	key, ok := a.keys[HashAPIKey(token)]
+	if !ok {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{
+		Subject: key.Subject,
+		Method:  MethodAPIKey,
+		Roles:   key.Roles,
+	}, nil
+}
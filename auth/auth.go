@@ -0,0 +1,97 @@
+// Package auth identifies the callers of the API using either static API keys
+// or HS256-signed JSON Web Tokens sent in the Authorization header
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request doesn't
+	// have any credentials it understands
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned by an Authenticator when the request's
+	// credentials are malformed, unknown or have a bad signature
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrExpiredCredentials is returned by an Authenticator when the request's
+	// credentials were valid but have expired or aren't valid yet
+	ErrExpiredCredentials = errors.New("expired credentials")
+)
+
+// Method is how a caller was authenticated
+type Method string
+
+const (
+	// MethodAPIKey means the caller sent one of the configured API keys
+	MethodAPIKey Method = "api_key"
+
+	// MethodJWT means the caller sent a JSON Web Token signed with the configured
+	// secret
+	MethodJWT Method = "jwt"
+)
+
+// Identity is who an authenticated caller is
+type Identity struct {
+	// Subject identifies the caller, like the name of their API key or the sub
+	// claim of their token, and is what's recorded as the actor of their changes
+	Subject string `json:"subject"`
+	// Method is how the caller was authenticated
+	Method Method `json:"method"`
+	// Roles are what the caller's API key or token says they're allowed to do
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Authenticator identifies the caller that made a request. If the request
+// doesn't have any credentials the Authenticator understands then it returns
+// ErrNoCredentials so that another Authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// chain is an Authenticator that tries each of its Authenticators in order
+type chain []Authenticator
+
+// Chain returns an Authenticator that tries each of the authenticators in order
+// and returns the first identity one of them returns. If none of them do then
+// the first error that isn't ErrNoCredentials is returned, or ErrNoCredentials
+// if none of them understood the request's credentials.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+// Authenticate implements the Authenticator interface
+func (c chain) Authenticate(r *http.Request) (Identity, error) {
+	err := ErrNoCredentials
+	for _, a := range c {
+		id, aerr := a.Authenticate(r)
+		if aerr == nil {
+			return id, nil
+		}
+		if errors.Is(err, ErrNoCredentials) {
+			err = aerr
+		}
+	}
+	return Identity{}, err
+}
+
+// bearerToken returns the token in the request's "Authorization: Bearer"
+// header and false if there isn't one
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	// the scheme is case-insensitive
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// isJWT returns true if the token looks like a JSON Web Token, which always have
+// 3 parts separated by periods, rather than an API key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
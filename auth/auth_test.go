@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = []byte(strings.Repeat("s", MinJWTSecretLength))
+
+// request returns a request with the Authorization header set to header if it
+// isn't empty
+func request(header string) *http.Request {
+	r, _ := http.NewRequest("GET", "/orders", nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	return r
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := NewAPIKeys([]APIKey{
+		{Subject: "warehouse", SHA256: HashAPIKey("key1"), Roles: []string{"warehouse"}},
+		{Subject: "support", SHA256: strings.ToUpper(HashAPIKey("key2"))},
+	})
+	require.NoError(t, err)
+
+	id, err := keys.Authenticate(request("Bearer key1"))
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Subject: "warehouse", Method: MethodAPIKey, Roles: []string{"warehouse"}}, id)
+	// the scheme is case-insensitive and upper case hashes are accepted
+	id, err = keys.Authenticate(request("bearer key2"))
+	require.NoError(t, err)
+	assert.Equal(t, "support", id.Subject)
+
+	_, err = keys.Authenticate(request("Bearer key3"))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = keys.Authenticate(request(""))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	_, err = keys.Authenticate(request("Basic a2V5MQ=="))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	_, err = keys.Authenticate(request("Bearer a.b.c"))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	_, err = NewAPIKeys([]APIKey{{SHA256: HashAPIKey("key1")}})
+	assert.Error(t, err)
+	_, err = NewAPIKeys([]APIKey{{Subject: "warehouse", SHA256: "key1"}})
+	assert.Error(t, err)
+	_, err = NewAPIKeys([]APIKey{
+		{Subject: "warehouse", SHA256: HashAPIKey("key1")},
+		{Subject: "support", SHA256: HashAPIKey("key1")},
+	})
+	assert.Error(t, err)
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"subject":"warehouse","sha256":"`+HashAPIKey("key1")+`","roles":["warehouse"]}]`), 0600))
+
+	keys, err := LoadAPIKeys(path)
+	require.NoError(t, err)
+	id, err := keys.Authenticate(request("Bearer key1"))
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Subject: "warehouse", Method: MethodAPIKey, Roles: []string{"warehouse"}}, id)
+
+	_, err = LoadAPIKeys(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0600))
+	_, err = LoadAPIKeys(path)
+	assert.Error(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	j, err := NewJWT(testSecret,
+		WithIssuer("issuer"),
+		WithAudience("order-up"),
+		WithLeeway(time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+	require.NoError(t, err)
+
+	valid := Claims{
+		Subject:   "alice@test",
+		Issuer:    "issuer",
+		Audience:  Audience{"other", "order-up"},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		Roles:     []string{"support"},
+	}
+	token, err := j.Sign(valid)
+	require.NoError(t, err)
+	id, err := j.Authenticate(request("Bearer " + token))
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Subject: "alice@test", Method: MethodJWT, Roles: []string{"support"}}, id)
+
+	_, err = j.Authenticate(request("Bearer key1"))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	// a single audience can be sent as a string
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","iss":"issuer","aud":"order-up","exp":1700003600}`))
+	claims, err := j.Verify(signingInput + "." + j.sign(signingInput))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", claims.Subject)
+
+	tests := []struct {
+		name   string
+		change func(*Claims)
+		err    error
+	}{
+		{"missing subject", func(c *Claims) { c.Subject = "" }, ErrInvalidCredentials},
+		{"missing expiry", func(c *Claims) { c.ExpiresAt = 0 }, ErrInvalidCredentials},
+		{"wrong issuer", func(c *Claims) { c.Issuer = "other" }, ErrInvalidCredentials},
+		{"wrong audience", func(c *Claims) { c.Audience = Audience{"other"} }, ErrInvalidCredentials},
+		{"expired", func(c *Claims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }, ErrExpiredCredentials},
+		{"not yet valid", func(c *Claims) { c.NotBefore = now.Add(2 * time.Minute).Unix() }, ErrExpiredCredentials},
+		{"expired within leeway", func(c *Claims) { c.ExpiresAt = now.Add(-time.Second).Unix() }, nil},
+		{"not yet valid within leeway", func(c *Claims) { c.NotBefore = now.Add(time.Second).Unix() }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := valid
+			test.change(&claims)
+			token, err := j.Sign(claims)
+			require.NoError(t, err)
+			_, err = j.Verify(token)
+			if test.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, test.err)
+			}
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		other, err := NewJWT([]byte(strings.Repeat("o", MinJWTSecretLength)))
+		require.NoError(t, err)
+		token, err := other.Sign(valid)
+		require.NoError(t, err)
+		_, err = j.Verify(token)
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+		// changing the claims invalidates the signature
+		token, err = j.Sign(valid)
+		require.NoError(t, err)
+		parts := strings.Split(token, ".")
+		forged := valid
+		forged.Subject = "mallory"
+		forgedToken, err := j.Sign(forged)
+		require.NoError(t, err)
+		_, err = j.Verify(parts[0] + "." + strings.Split(forgedToken, ".")[1] + "." + parts[2])
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":1700003600}`)) + "."
+		_, err := j.Verify(token)
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	_, err = NewJWT([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestChain(t *testing.T) {
+	keys, err := NewAPIKeys([]APIKey{{Subject: "warehouse", SHA256: HashAPIKey("key1")}})
+	require.NoError(t, err)
+	j, err := NewJWT(testSecret)
+	require.NoError(t, err)
+	a := Chain(keys, j)
+
+	id, err := a.Authenticate(request("Bearer key1"))
+	require.NoError(t, err)
+	assert.Equal(t, MethodAPIKey, id.Method)
+
+	token, err := j.Sign(Claims{Subject: "alice@test", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	id, err = a.Authenticate(request("Bearer " + token))
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Subject: "alice@test", Method: MethodJWT}, id)
+
+	token, err = j.Sign(Claims{Subject: "alice@test", ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+	require.NoError(t, err)
+	_, err = a.Authenticate(request("Bearer " + token))
+	assert.ErrorIs(t, err, ErrExpiredCredentials)
+
+	_, err = a.Authenticate(request("Bearer key2"))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = a.Authenticate(request(""))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MinJWTSecretLength is the fewest bytes a JWT secret can have. HS256 secrets
+// should be at least as long as the hash they're used with.
+const MinJWTSecretLength = sha256.Size
+
+// Audience is the aud claim of a token which is either a single string or an
+// array of strings
+type Audience []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*a = Audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Claims are the claims of a token that are used to authenticate the caller.
+// Times are in seconds since the Unix epoch.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	// Roles aren't a registered claim but they're what the caller is allowed to
+	// do like the Roles of an APIKey
+	Roles []string `json:"roles,omitempty"`
+}
+
+// jwtHeader is the header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// JWT is an Authenticator for JSON Web Tokens sent as "Authorization: Bearer
+// <token>" and signed with HMAC-SHA256 (HS256) using a shared secret. Tokens
+// must have sub and exp claims and tokens signed with any other algorithm,
+// including "none", are rejected.
+type JWT struct {
+	secret   []byte
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// JWTOption configures optional checks on the tokens accepted by a JWT
+type JWTOption func(*JWT)
+
+// WithIssuer only accepts tokens whose iss claim is issuer
+func WithIssuer(issuer string) JWTOption {
+	return func(j *JWT) {
+		j.issuer = issuer
+	}
+}
+
+// WithAudience only accepts tokens whose aud claim includes audience
+func WithAudience(audience string) JWTOption {
+	return func(j *JWT) {
+		j.audience = audience
+	}
+}
+
+// WithLeeway accepts tokens up to leeway after they expire, or before they're
+// valid, to allow for the issuer's clock being different from ours
+func WithLeeway(leeway time.Duration) JWTOption {
+	return func(j *JWT) {
+		j.leeway = leeway
+	}
+}
+
+// WithClock replaces the clock used to check when tokens expire, which is useful
+// for tests
+func WithClock(now func() time.Time) JWTOption {
+	return func(j *JWT) {
+		j.now = now
+	}
+}
+
+// NewJWT returns an Authenticator for tokens signed with secret, which must be
+// at least MinJWTSecretLength bytes
+func NewJWT(secret []byte, opts ...JWTOption) (*JWT, error) {
+	if len(secret) < MinJWTSecretLength {
+		return nil, fmt.Errorf("jwt secret must be at least %d bytes", MinJWTSecretLength)
+	}
+	j := &JWT{
+		secret: secret,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j, nil
+}
+
+// sign returns the base64-encoded HMAC of the token's header and claims
+func (j *JWT) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns a token for the claims signed with the secret, which is mostly
+// useful for tests since tokens are typically issued by another service
+func (j *JWT) Sign(claims Claims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("error encoding claims: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + j.sign(signingInput), nil
+}
+
+// Verify checks that the token was signed with the secret and that its claims
+// are valid now and returns the claims if they are
+func (j *JWT) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Claims{}, ErrInvalidCredentials
+	}
+	// the signature is checked before the claims are even decoded so nothing the
+	// caller sent is trusted until we know we issued it
+	if !hmac.Equal([]byte(parts[2]), []byte(j.sign(parts[0]+"."+parts[1]))) {
+		return Claims{}, ErrInvalidCredentials
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidCredentials
+	}
+
+	if claims.Subject == "" || claims.ExpiresAt == 0 {
+		return Claims{}, ErrInvalidCredentials
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return Claims{}, ErrInvalidCredentials
+	}
+	if j.audience != "" && !claims.Audience.contains(j.audience) {
+		return Claims{}, ErrInvalidCredentials
+	}
+	now := j.now()
+	if !now.Before(time.Unix(claims.ExpiresAt, 0).Add(j.leeway)) {
+		return Claims{}, ErrExpiredCredentials
+	}
+	if claims.NotBefore != 0 && now.Add(j.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return Claims{}, ErrExpiredCredentials
+	}
+	return claims, nil
+}
+
+// Authenticate implements the Authenticator interface
+func (j *JWT) Authenticate(r *http.Request) (Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok || !isJWT(token) {
+		return Identity{}, ErrNoCredentials
+	}
+	claims, err := j.Verify(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{
+		Subject: claims.Subject,
+		Method:  MethodJWT,
+		Roles:   claims.Roles,
+	}, nil
+}
+
+// contains returns true if aud is one of the audiences
+func (a Audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes the base64-encoded JSON of a token's header or claims
+// into v
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -5,21 +5,212 @@ package main
 import (
 	"context"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/order-up/api"
+	"github.com/levenlabs/order-up/auth"
 	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/ratelimit"
 	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/stream"
+	"github.com/levenlabs/order-up/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
 	// flag.String returns a pointer to a string value that is set after
 	// flag.Parse() is called
 	addr := flag.String("listen-addr", "localhost:8888", "the address to listen on for API requests")
+	storageType := flag.String("storage", "memory", "where orders are stored, either memory, sqlite or postgres")
+	dbPath := flag.String("db-path", storage.DefaultPath, "the path to the SQLite database when -storage is sqlite")
+	postgresDSN := flag.String("postgres-dsn", "", "the URL or key=value settings of the Postgres database when -storage is postgres")
+	dbBusyTimeout := flag.Duration("db-busy-timeout", storage.DefaultBusyTimeout, "how long SQLite or Postgres queries wait for another write to finish")
+	dbMaxOpenConns := flag.Int("db-max-open-conns", storage.DefaultMaxOpenConns, "the most connections to open to the SQLite or Postgres database")
+	memoryDir := flag.String("memory-dir", "", "the directory to journal orders to when -storage is memory, orders are lost on restart if empty")
+	memorySnapshotEvery := flag.Int("memory-snapshot-every", storage.DefaultSnapshotEvery, "how many changes are journaled before a new snapshot is written when -memory-dir is set")
+	webhookPollInterval := flag.Duration("webhook-poll-interval", webhooks.DefaultPollInterval, "how often pending webhook deliveries are looked for")
+	webhookMaxAttempts := flag.Int("webhook-max-attempts", webhooks.DefaultMaxAttempts, "how many times a webhook is attempted before it's dead-lettered")
+	streamBuffer := flag.Int("stream-buffer", stream.DefaultBufferSize, "how many order changes are kept for GET /orders/stream clients resuming with Last-Event-ID")
+	apiKeysFile := flag.String("api-keys-file", "", "the path to a JSON file of hashed API keys that callers can authenticate with")
+	jwtSecretFile := flag.String("jwt-secret-file", "", "the path to a file containing the secret that HS256 tokens callers authenticate with are signed with")
+	jwtIssuer := flag.String("jwt-issuer", "", "only accept tokens with this iss claim when -jwt-secret-file is set")
+	jwtAudience := flag.String("jwt-audience", "", "only accept tokens with this aud claim when -jwt-secret-file is set")
+	rateLimitRead := flag.String("rate-limit-read", "50/s", "how often each caller can read orders and webhooks, like 50/s, or empty for no limit")
+	rateLimitWrite := flag.String("rate-limit-write", "10/s", "how often each caller can change orders and webhooks, other than -rate-limit-charge, or empty for no limit")
+	rateLimitCharge := flag.String("rate-limit-charge", "5/s", "how often each caller can charge, cancel or refund orders, or empty for no limit")
+	rateLimitIP := flag.String("rate-limit-ip", "100/s", "how often each IP address can make requests, checked before authenticating them, or empty for no limit")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated IP addresses or CIDR ranges of proxies whose X-Forwarded-For header is trusted for the caller's IP address")
+	chargeConcurrency := flag.Int("charge-concurrency", 10, "how many requests can be calling, or waiting to call, the charge service at once, or 0 for no limit")
+	chargeRetryAfter := flag.Duration("charge-retry-after", 0, "how long an order has to have been left charging before its charge can be retried, set this longer than a charge can take when several instances share -storage postgres")
+	idempotencyLockTimeout := flag.Duration("idempotency-lock-timeout", api.DefaultIdempotencyLockTimeout, "how long a request holds its Idempotency-Key before another request with the key can take it over, set this longer than any request can take")
+	idempotencyKeyTTL := flag.Duration("idempotency-key-ttl", api.DefaultIdempotencyKeyTTL, "how long a response is replayed to requests with the same Idempotency-Key")
+	idempotencyPruneInterval := flag.Duration("idempotency-prune-interval", time.Hour, "how often expired idempotency keys are deleted")
 	flag.Parse()
 
+	// order-up migrate manages the database's migrations instead of starting the
+	// service
+	if flag.Arg(0) == "migrate" {
+		defaults := migrateDefaults{storage: *storageType, dbPath: *dbPath, postgresDSN: *postgresDSN}
+		os.Exit(runMigrate(flag.Args()[1:], defaults, os.Stdout))
+	}
+
+	var stor storageInstance
+	switch *storageType {
+	case "memory":
+		if *memoryDir == "" {
+			stor = storage.NewMemory()
+			break
+		}
+		inst, err := storage.OpenMemory(*memoryDir, storage.WithSnapshotEvery(*memorySnapshotEvery))
+		if err != nil {
+			llog.Fatal("failed to open memory storage", llog.KV{"memory_dir": *memoryDir}, llog.ErrKV(err))
+		}
+		// closing writes a final snapshot so the next start doesn't need to replay
+		// the journal
+		defer inst.Close()
+		stor = inst
+	case "sqlite":
+		inst, err := storage.New(*dbPath,
+			storage.WithBusyTimeout(*dbBusyTimeout),
+			storage.WithMaxOpenConns(*dbMaxOpenConns),
+		)
+		if err != nil {
+			llog.Fatal("failed to open sqlite storage", llog.KV{"db_path": *dbPath}, llog.ErrKV(err))
+		}
+		// the deferred Close happens after the server is shutdown since defers
+		// run in the reverse order
+		defer inst.Close()
+		stor = inst
+	case "postgres":
+		inst, err := storage.NewPostgres(*postgresDSN,
+			storage.WithBusyTimeout(*dbBusyTimeout),
+			storage.WithMaxOpenConns(*dbMaxOpenConns),
+		)
+		if err != nil {
+			// the DSN isn't logged since it might contain a password
+			llog.Fatal("failed to open postgres storage", llog.ErrKV(err))
+		}
+		defer inst.Close()
+		stor = inst
+	default:
+		llog.Fatal("unknown storage type", llog.KV{"storage": *storageType})
+	}
+	llog.Info("using storage", llog.KV{"storage": *storageType})
+
+	// we would replace these with actual clients that talk to the underlying services
+	// but for this contrived service we just iuggno
+	fulfillmentService := mocks.NewMockedService(unimplementedHandler)
+	chargeService := mocks.NewMockedService(unimplementedHandler)
+
+	// the handler's metrics, like requests and calls to the charge service, are
+	// served at GET /metrics and include the charges recovered below
+	registry := prometheus.NewRegistry()
+
+	// before we start handling requests we need to resolve any orders that were
+	// left mid-charge, mid-refund or mid-fulfillment the last time the service
+	// stopped
+	// we only give this 30 seconds so a slow charge or fulfillment service can't
+	// block startup forever and any orders that couldn't be resolved will be
+	// retried next start
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := api.RecoverCharges(ctx, stor, chargeService, api.WithMetrics(registry)); err != nil {
+		llog.Error("failed to recover charging orders", llog.ErrKV(err))
+	}
+	if err := api.RecoverRefunds(ctx, stor, chargeService, api.WithMetrics(registry)); err != nil {
+		llog.Error("failed to recover pending refunds", llog.ErrKV(err))
+	}
+	if err := api.RecoverFulfillments(ctx, stor, fulfillmentService, api.WithMetrics(registry)); err != nil {
+		llog.Error("failed to recover fulfilling orders", llog.ErrKV(err))
+	}
+	cancel()
+
+	// callers can authenticate with either an API key or a token and if neither
+	// is configured then anyone who can reach the service can make any change
+	var authenticators []auth.Authenticator
+	if *apiKeysFile != "" {
+		keys, err := auth.LoadAPIKeys(*apiKeysFile)
+		if err != nil {
+			llog.Fatal("failed to load api keys", llog.KV{"api_keys_file": *apiKeysFile}, llog.ErrKV(err))
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if *jwtSecretFile != "" {
+		secret, err := os.ReadFile(*jwtSecretFile)
+		if err != nil {
+			llog.Fatal("failed to read jwt secret", llog.KV{"jwt_secret_file": *jwtSecretFile}, llog.ErrKV(err))
+		}
+		// editors like to leave a trailing newline in the file
+		jwt, err := auth.NewJWT([]byte(strings.TrimSpace(string(secret))),
+			auth.WithIssuer(*jwtIssuer),
+			auth.WithAudience(*jwtAudience),
+			auth.WithLeeway(time.Minute),
+		)
+		if err != nil {
+			llog.Fatal("invalid jwt secret", llog.KV{"jwt_secret_file": *jwtSecretFile}, llog.ErrKV(err))
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	apiOpts := []api.Option{
+		api.WithIdempotencyStorage(stor),
+		api.WithIdempotencyLockTimeout(*idempotencyLockTimeout),
+		api.WithIdempotencyKeyTTL(*idempotencyKeyTTL),
+		api.WithEventStorage(stor),
+		api.WithWebhookStorage(stor),
+	}
+	for _, limit := range []struct {
+		group api.RateLimitGroup
+		rate  string
+	}{
+		{api.RateLimitRead, *rateLimitRead},
+		{api.RateLimitWrite, *rateLimitWrite},
+		{api.RateLimitCharge, *rateLimitCharge},
+		{api.RateLimitIP, *rateLimitIP},
+	} {
+		if limit.rate == "" {
+			continue
+		}
+		rate, err := ratelimit.ParseRate(limit.rate)
+		if err != nil {
+			llog.Fatal("invalid rate limit", llog.KV{"group": limit.group}, llog.ErrKV(err))
+		}
+		limiter, err := ratelimit.New(rate)
+		if err != nil {
+			llog.Fatal("invalid rate limit", llog.KV{"group": limit.group}, llog.ErrKV(err))
+		}
+		apiOpts = append(apiOpts, api.WithRateLimit(limit.group, limiter))
+	}
+	if *trustedProxies != "" {
+		proxies := strings.Split(*trustedProxies, ",")
+		for _, proxy := range proxies {
+			if net.ParseIP(proxy) == nil {
+				if _, _, err := net.ParseCIDR(proxy); err != nil {
+					llog.Fatal("invalid trusted proxy", llog.KV{"trusted_proxy": proxy}, llog.ErrKV(err))
+				}
+			}
+		}
+		apiOpts = append(apiOpts, api.WithTrustedProxies(proxies))
+	}
+	if *chargeConcurrency > 0 {
+		apiOpts = append(apiOpts, api.WithChargeConcurrency(*chargeConcurrency))
+	}
+	apiOpts = append(apiOpts, api.WithChargeRetryAfter(*chargeRetryAfter))
+	apiOpts = append(apiOpts, api.WithMetrics(registry))
+	if len(authenticators) > 0 {
+		apiOpts = append(apiOpts, api.WithAuthenticator(auth.Chain(authenticators...)))
+	} else {
+		llog.Warn("authentication is disabled, set -api-keys-file or -jwt-secret-file to require it")
+	}
+
+	// the broker is fed order changes by the handlers and streams them to GET
+	// /orders/stream clients
+	broker := stream.NewBroker(*streamBuffer)
+
 	server := new(http.Server)
 	// we dereference the address flag and set it on the server so the
 	// ListenAndServe call later knows what address to Listen on
@@ -27,13 +218,44 @@ func main() {
 	// here we're calling the api package's Handler() function to get an instance of
 	// an http.Handler that we can set as the server's Handler
 	// on every HTTP request the server will call the handler's ServeHTTP function
-	server.Handler = api.Handler(
-		storage.NewMemory(),
-		// we would replace these with actual clients that talk to the underlying services
-		// but for this contrived service we just iuggno
-		mocks.NewMockedService(unimplementedHandler),
-		mocks.NewMockedService(unimplementedHandler),
+	server.Handler = api.Handler(stor, fulfillmentService, chargeService,
+		append(apiOpts, api.WithStream(broker))...,
 	)
+	// Shutdown waits for every request to finish, which streams never do on their
+	// own, so they're ended when it starts
+	server.RegisterOnShutdown(broker.Close)
+
+	// the dispatcher sends the webhooks for the order events recorded by the
+	// handlers until main returns, and we wait for it to stop so that the storage
+	// isn't closed in the middle of a delivery
+	dispatcherCtx, stopDispatcher := context.WithCancel(context.Background())
+	dispatcher := webhooks.New(stor, &http.Client{},
+		webhooks.WithPollInterval(*webhookPollInterval),
+		webhooks.WithMaxAttempts(*webhookMaxAttempts),
+	)
+	dispatcherDone := make(chan struct{})
+	go func() {
+		dispatcher.Run(dispatcherCtx)
+		close(dispatcherDone)
+	}()
+	defer func() {
+		stopDispatcher()
+		<-dispatcherDone
+	}()
+
+	// expired idempotency keys are deleted in the background too so they don't
+	// pile up forever, and like the dispatcher it's stopped before the storage is
+	// closed
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	pruneDone := make(chan struct{})
+	go func() {
+		pruneIdempotencyKeys(pruneCtx, stor, *idempotencyPruneInterval)
+		close(pruneDone)
+	}()
+	defer func() {
+		stopPruning()
+		<-pruneDone
+	}()
 
 	// if we just called ListenAndServe directly then we would never return since
 	// ListenAndServe starts listening for HTTP requests and blocks until the
@@ -48,13 +270,43 @@ func main() {
 	// if main returns then the process stops running so we instead wait for an
 	// interrupt signal (Ctrl+C) by creating a channel, passing it to the signal
 	// package and then waiting to receive something from the channel
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	// once we receive something over this channel we will continue the function
 	// and end up returning, causing the process to stop
 	<-ch
 }
 
+// pruneIdempotencyKeys deletes the expired idempotency keys in idem every
+// interval until ctx is cancelled
+func pruneIdempotencyKeys(ctx context.Context, idem mocks.IdempotencyStorage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := idem.DeleteExpiredIdempotencyKeys(ctx)
+		if err != nil {
+			llog.Error("failed to delete expired idempotency keys", llog.ErrKV(err))
+			continue
+		}
+		if n > 0 {
+			llog.Info("deleted expired idempotency keys", llog.KV{"deleted": n})
+		}
+	}
+}
+
+// storageInstance is implemented by every storage backend
+type storageInstance interface {
+	mocks.StorageInstance
+	mocks.IdempotencyStorage
+	mocks.EventStorage
+	mocks.WebhookStorage
+}
+
 var unimplementedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "not implemented", http.StatusNotImplemented)
 })
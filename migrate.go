@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/levenlabs/order-up/storage"
+)
+
+// migrateUsage is printed when the migrate command is used incorrectly
+const migrateUsage = `usage: order-up migrate [flags] status|up
+
+  status  lists every migration and when it was applied
+  up      applies the migrations that haven't been applied yet
+
+The SQLite database at -db-path is migrated unless -storage is postgres, in
+which case the Postgres database at -postgres-dsn is. The storage flags can
+also be given before migrate like they are when starting the service.
+
+flags:
+`
+
+// migrateDefaults are the storage flags given before "migrate" which the
+// migrate command's own flags default to
+type migrateDefaults struct {
+	storage     string
+	dbPath      string
+	postgresDSN string
+}
+
+// migrator is implemented by the storage backends that have migrations
+type migrator interface {
+	Migrations(ctx context.Context) ([]storage.MigrationStatus, error)
+	Migrate(ctx context.Context, target int) ([]storage.MigrationStatus, error)
+	Close() error
+}
+
+// runMigrate runs the migrate command with the arguments after "migrate" and
+// returns the process's exit code. Normally the migrations are applied when the
+// service starts but this lets them be inspected or applied ahead of time.
+func runMigrate(args []string, defaults migrateDefaults, out io.Writer) int {
+	// the memory storage doesn't have migrations so the default of the service
+	// means SQLite here
+	if defaults.storage != "postgres" {
+		defaults.storage = "sqlite"
+	}
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	storageType := fs.String("storage", defaults.storage, "the database to migrate, either sqlite or postgres")
+	dbPath := fs.String("db-path", defaults.dbPath, "the path to the SQLite database when -storage is sqlite")
+	postgresDSN := fs.String("postgres-dsn", defaults.postgresDSN, "the URL or key=value settings of the Postgres database when -storage is postgres")
+	to := fs.Int("to", 0, "the version to migrate up to, defaults to the latest version")
+	fs.Usage = func() {
+		fmt.Fprint(out, migrateUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	// migrations could take a while on a large database but they shouldn't
+	// take forever
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var stor migrator
+	var err error
+	switch *storageType {
+	case "sqlite":
+		stor, err = storage.Open(*dbPath)
+	case "postgres":
+		if *postgresDSN == "" {
+			fmt.Fprintln(out, "-postgres-dsn is required when -storage is postgres")
+			return 2
+		}
+		stor, err = storage.OpenPostgres(*postgresDSN)
+	default:
+		fmt.Fprintf(out, "unknown storage: %s\n", *storageType)
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(out, "error opening database: %v\n", err)
+		return 1
+	}
+	defer stor.Close()
+
+	switch fs.Arg(0) {
+	case "status":
+		statuses, err := stor.Migrations(ctx)
+		if err != nil {
+			fmt.Fprintf(out, "error getting migrations: %v\n", err)
+			return 1
+		}
+		printMigrations(out, statuses)
+	case "up":
+		applied, err := stor.Migrate(ctx, *to)
+		// any migrations that were applied before the error are still printed
+		printMigrations(out, applied)
+		if err != nil {
+			fmt.Fprintf(out, "error migrating: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(out, "no migrations to apply")
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// printMigrations writes the migrations as a table
+func printMigrations(out io.Writer, statuses []storage.MigrationStatus) {
+	if len(statuses) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	w.Flush()
+}
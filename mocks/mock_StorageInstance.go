@@ -14,6 +14,27 @@ type MockStorageInstance struct {
 	mock.Mock
 }
 
+// ApplyOrderChange provides a mock function with given fields: ctx, change
+func (_m *MockStorageInstance) ApplyOrderChange(ctx context.Context, change storage.OrderChange) (storage.OrderEvent, error) {
+	ret := _m.Called(ctx, change)
+
+	var r0 storage.OrderEvent
+	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderChange) storage.OrderEvent); ok {
+		r0 = rf(ctx, change)
+	} else {
+		r0 = ret.Get(0).(storage.OrderEvent)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.OrderChange) error); ok {
+		r1 = rf(ctx, change)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetOrder provides a mock function with given fields: ctx, id
 func (_m *MockStorageInstance) GetOrder(ctx context.Context, id string) (storage.Order, error) {
 	ret := _m.Called(ctx, id)
@@ -35,60 +56,32 @@ func (_m *MockStorageInstance) GetOrder(ctx context.Context, id string) (storage
 	return r0, r1
 }
 
-// GetOrders provides a mock function with given fields: ctx, status
-func (_m *MockStorageInstance) GetOrders(ctx context.Context, status storage.OrderStatus) ([]storage.Order, error) {
-	ret := _m.Called(ctx, status)
+// GetOrders provides a mock function with given fields: ctx, query, page
+func (_m *MockStorageInstance) GetOrders(ctx context.Context, query storage.OrderQuery, page storage.Page) ([]storage.Order, string, error) {
+	ret := _m.Called(ctx, query, page)
 
 	var r0 []storage.Order
-	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderStatus) []storage.Order); ok {
-		r0 = rf(ctx, status)
+	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderQuery, storage.Page) []storage.Order); ok {
+		r0 = rf(ctx, query, page)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]storage.Order)
 		}
 	}
 
-	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, storage.OrderStatus) error); ok {
-		r1 = rf(ctx, status)
-	} else {
-		r1 = ret.Error(1)
-	}
-
-	return r0, r1
-}
-
-// InsertOrder provides a mock function with given fields: ctx, order
-func (_m *MockStorageInstance) InsertOrder(ctx context.Context, order storage.Order) (string, error) {
-	ret := _m.Called(ctx, order)
-
-	var r0 string
-	if rf, ok := ret.Get(0).(func(context.Context, storage.Order) string); ok {
-		r0 = rf(ctx, order)
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, storage.OrderQuery, storage.Page) string); ok {
+		r1 = rf(ctx, query, page)
 	} else {
-		r0 = ret.Get(0).(string)
+		r1 = ret.Get(1).(string)
 	}
 
-	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, storage.Order) error); ok {
-		r1 = rf(ctx, order)
-	} else {
-		r1 = ret.Error(1)
-	}
-
-	return r0, r1
-}
-
-// SetOrderStatus provides a mock function with given fields: ctx, id, status
-func (_m *MockStorageInstance) SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus) error {
-	ret := _m.Called(ctx, id, status)
-
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, storage.OrderStatus) error); ok {
-		r0 = rf(ctx, id, status)
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, storage.OrderQuery, storage.Page) error); ok {
+		r2 = rf(ctx, query, page)
 	} else {
-		r0 = ret.Error(0)
+		r2 = ret.Error(2)
 	}
 
-	return r0
+	return r0, r1, r2
 }
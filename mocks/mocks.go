@@ -3,3 +3,6 @@
 package mocks
 
 //go:generate go run github.com/vektra/mockery/v2@latest --name=StorageInstance --inpackage
+//go:generate go run github.com/vektra/mockery/v2@latest --name=IdempotencyStorage --inpackage
+//go:generate go run github.com/vektra/mockery/v2@latest --name=EventStorage --inpackage
+//go:generate go run github.com/vektra/mockery/v2@latest --name=WebhookStorage --inpackage
@@ -4,6 +4,7 @@ package mocks
 
 import (
 	"context"
+	"time"
 
 	"github.com/levenlabs/order-up/storage"
 )
@@ -13,15 +14,74 @@ type StorageInstance interface {
 	// GetOrder should return the order with the given ID. If that ID isn't found then
 	// the special ErrOrderNotFound error should be returned.
 	GetOrder(ctx context.Context, id string) (storage.Order, error)
-	// GetOrders should return all orders with the given status. If status is the
-	// special -1 value then it should return all orders regardless of their status.
-	GetOrders(ctx context.Context, status storage.OrderStatus) ([]storage.Order, error)
-	// SetOrderStatus should update the order with the given ID and set the status
-	// field. If that ID isn't found then the special ErrOrderNotFound error should
-	// be returned.
-	SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus) error
-	// InsertOrder should fill in the order's ID with a unique identifier if it's not
-	// already set and then insert it into the database. It should return the order's
-	// ID. If the order already exists then ErrOrderExists should be returned.
-	InsertOrder(ctx context.Context, order storage.Order) (string, error)
+	// GetOrders should return the orders matching the query, limited to the given
+	// page, along with the cursor for the next page. The next cursor is empty if
+	// there are no more orders and if the page's cursor isn't valid then
+	// ErrInvalidCursor should be returned.
+	GetOrders(ctx context.Context, query storage.OrderQuery, page storage.Page) ([]storage.Order, string, error)
+	// ApplyOrderChange should make the change to the order with the ID in
+	// change.Event.OrderID and insert the change's event along with a pending
+	// webhook delivery of it to every webhook subscription that matches it, all in
+	// a single transaction. It should return the event as it was stored. If the
+	// order isn't found then the special ErrOrderNotFound error should be returned
+	// and if any of the change's conditions aren't met then the error describing
+	// which one wasn't should be returned and nothing should be changed.
+	// If change.Insert is set then it should be inserted instead, with its ID
+	// filled in with a unique identifier if it's not already set and its version
+	// starting at 1 if it's not already set. If the order already exists then
+	// ErrOrderExists should be returned.
+	ApplyOrderChange(ctx context.Context, change storage.OrderChange) (storage.OrderEvent, error)
+}
+
+// IdempotencyStorage allows us to mock the idempotency key methods on
+// *storage.Instance in the api package
+type IdempotencyStorage interface {
+	// InsertIdempotencyKey should store the key as an in-progress request that
+	// expires at key.ExpiresAt. If a record for the same key and route already
+	// exists, and hasn't expired, then it should be returned along with the special
+	// ErrIdempotencyKeyExists error. An expired record is replaced.
+	InsertIdempotencyKey(ctx context.Context, key storage.IdempotencyKey) (storage.IdempotencyKey, error)
+	// CompleteIdempotencyKey should record the response for the key and route so it
+	// can be replayed to future requests with the same key until expiresAt.
+	CompleteIdempotencyKey(ctx context.Context, key, route string, statusCode int, body []byte, expiresAt time.Time) error
+	// DeleteIdempotencyKey should remove the key and route so the request can be
+	// tried again. Deleting a key that doesn't exist is not an error.
+	DeleteIdempotencyKey(ctx context.Context, key, route string) error
+	// DeleteExpiredIdempotencyKeys should remove every key that has expired and
+	// return how many were removed.
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
+}
+
+// EventStorage allows us to mock the order event methods on *storage.Instance in
+// the api package
+type EventStorage interface {
+	// GetOrderEvents should return the events of the order with the given ID in
+	// the order they were inserted. An order without any events, or that doesn't
+	// exist, has an empty slice of events.
+	GetOrderEvents(ctx context.Context, orderID string) ([]storage.OrderEvent, error)
+}
+
+// WebhookStorage allows us to mock the webhook methods on *storage.Instance in
+// the api and webhooks packages
+type WebhookStorage interface {
+	// InsertWebhookSubscription should store the subscription, filling in its ID
+	// with a unique identifier if it's not already set and, if it's not set, its
+	// CreatedAt, and return it.
+	InsertWebhookSubscription(ctx context.Context, sub storage.WebhookSubscription) (storage.WebhookSubscription, error)
+	// GetWebhookSubscriptions should return every subscription, oldest first.
+	GetWebhookSubscriptions(ctx context.Context) ([]storage.WebhookSubscription, error)
+	// DeleteWebhookSubscription should remove the subscription with the given ID
+	// along with all of its deliveries. If that ID isn't found then the special
+	// ErrWebhookSubscriptionNotFound error should be returned.
+	DeleteWebhookSubscription(ctx context.Context, id string) error
+	// GetWebhookDeliveries should return the deliveries matching the query in the
+	// order they were created.
+	GetWebhookDeliveries(ctx context.Context, query storage.WebhookDeliveryQuery) ([]storage.WebhookDelivery, error)
+	// UpdateWebhookDelivery should replace the status, attempts, next attempt,
+	// last error and delivered time of the delivery with the same ID as delivery
+	// but only if its current status is from. If that ID isn't found then the
+	// special ErrWebhookDeliveryNotFound error should be returned and if the
+	// current status isn't from then ErrWebhookDeliveryStatusMismatch should be
+	// returned.
+	UpdateWebhookDelivery(ctx context.Context, delivery storage.WebhookDelivery, from storage.WebhookDeliveryStatus) error
 }
@@ -0,0 +1,174 @@
+// Package ratelimit limits how often each client can make requests using a
+// token bucket per client
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is how many requests a client can make in a period. Each client's bucket
+// holds Requests tokens, which are all available at first, and is refilled at
+// Requests tokens every Per, so a client can burst up to Requests requests at
+// once but can't average more than that over time.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRate parses a rate like "10/s", "100/m" or "5/30s" which is a number of
+// requests followed by either a unit of s, m or h or a duration
+func ParseRate(str string) (Rate, error) {
+	parts := strings.SplitN(str, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("rate %q must look like 10/s", str)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return Rate{}, fmt.Errorf("rate %q must have a positive number of requests", str)
+	}
+	per := parts[1]
+	// a bare unit like "s" means 1 of it
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("rate %q must have a positive period", str)
+	}
+	return Rate{Requests: requests, Per: d}, nil
+}
+
+// String implements the fmt.Stringer interface
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Requests, r.Per)
+}
+
+// interval is how long it takes to refill a single token
+func (r Rate) interval() time.Duration {
+	return r.Per / time.Duration(r.Requests)
+}
+
+// Result is whether a request was allowed and the state of the client's bucket
+// afterwards, which is typically sent back in the response's headers
+type Result struct {
+	// Allowed is true if the request can be made
+	Allowed bool
+	// Limit is the most requests the client can make at once
+	Limit int
+	// Remaining is how many more requests the client can make right now
+	Remaining int
+	// Reset is how long until the client's bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the client can make another request and is 0
+	// if the request was allowed
+	RetryAfter time.Duration
+}
+
+// bucket is a single client's token bucket
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter limits each client, identified by a key like their API key or IP
+// address, to a Rate
+type Limiter struct {
+	rate Rate
+	now  func() time.Time
+
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// Option configures optional functionality on a Limiter
+type Option func(*Limiter)
+
+// WithClock replaces the clock used to refill buckets, which is useful for
+// tests
+func WithClock(now func() time.Time) Option {
+	return func(l *Limiter) {
+		l.now = now
+	}
+}
+
+// New returns a Limiter that limits each client to rate
+func New(rate Rate, opts ...Option) (*Limiter, error) {
+	if rate.Requests < 1 || rate.Per <= 0 {
+		return nil, errors.New("rate must have a positive number of requests and period")
+	}
+	l := &Limiter{
+		rate:    rate,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.lastSweep = l.now()
+	return l, nil
+}
+
+// Rate returns the rate the Limiter limits each client to
+func (l *Limiter) Rate() Rate {
+	return l.rate
+}
+
+// refill adds the tokens the bucket earned since it was last updated
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.updated)
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(l.rate.Requests), b.tokens+float64(elapsed)/float64(l.rate.interval()))
+	b.updated = now
+}
+
+// sweep forgets the buckets that are full since they're the same as a bucket
+// that was never used. It only looks at most once per period so that the cost
+// is spread across many requests.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.rate.Per {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.rate.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow takes a token from the client's bucket, if there's one left, and
+// returns whether the request was allowed
+func (l *Limiter) Allow(key string) Result {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Requests), updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	res := Result{Limit: l.rate.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(l.rate.interval()))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(l.rate.Requests) - b.tokens) * float64(l.rate.interval()))
+	return res
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for str, exp := range map[string]Rate{
+		"10/s":    {Requests: 10, Per: time.Second},
+		"100/m":   {Requests: 100, Per: time.Minute},
+		"5/30s":   {Requests: 5, Per: 30 * time.Second},
+		"1000/1h": {Requests: 1000, Per: time.Hour},
+	} {
+		rate, err := ParseRate(str)
+		if assert.NoError(t, err, str) {
+			assert.Equal(t, exp, rate, str)
+		}
+	}
+	for _, str := range []string{"", "10", "0/s", "-1/s", "a/s", "10/", "10/x", "10/0s", "10/-1s"} {
+		_, err := ParseRate(str)
+		assert.Error(t, err, str)
+	}
+	assert.Equal(t, "5/30s", Rate{Requests: 5, Per: 30 * time.Second}.String())
+}
+
+func TestAllow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, err := New(Rate{Requests: 2, Per: time.Second}, WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+
+	// the first requests can burst up to the limit
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}, l.Allow("a"))
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}, l.Allow("a"))
+	assert.Equal(t, Result{Limit: 2, Reset: time.Second, RetryAfter: 500 * time.Millisecond}, l.Allow("a"))
+
+	// other clients have their own bucket
+	assert.True(t, l.Allow("b").Allowed)
+
+	// tokens are refilled over time
+	now = now.Add(250 * time.Millisecond)
+	assert.Equal(t, Result{Limit: 2, Reset: 750 * time.Millisecond, RetryAfter: 250 * time.Millisecond}, l.Allow("a"))
+	now = now.Add(250 * time.Millisecond)
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}, l.Allow("a"))
+
+	// but never past the limit
+	now = now.Add(time.Hour)
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}, l.Allow("a"))
+
+	// full buckets are forgotten
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	assert.Len(t, l.buckets, 1)
+
+	_, err = New(Rate{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package storage
+
+import "time"
+
+// LineItemFulfillment changes how much of a single line item was fulfilled
+type LineItemFulfillment struct {
+	// LineItem is the index of the line item in the order's LineItems
+	LineItem int `json:"lineItem"`
+	// From is the line item's fulfilled quantity before the change. The change is
+	// only made if the line item is still at it.
+	From int64 `json:"from"`
+	// Quantity is the line item's new fulfilled quantity
+	Quantity int64 `json:"quantity"`
+}
+
+// OrderChange is a change to a single order along with the event that records
+// it. ApplyOrderChange stores the change, the event and the event's webhook
+// deliveries in a single transaction so an event is stored if, and only if, the
+// change it records is. Fields that aren't set leave that part of the order
+// alone and a change that only sets Event just records the event.
+type OrderChange struct {
+	// Event records the change. Its OrderID is the order that's changed. If its
+	// OldStatus and NewStatus are different then the order must currently be at
+	// OldStatus and its status is changed to NewStatus. Otherwise the order's
+	// status is left alone and both are set to the order's current status.
+	Event OrderEvent
+	// RequireStatus requires the order to currently be at Event.OldStatus even
+	// though the change leaves its status alone
+	RequireStatus bool
+	// Version, if it isn't 0, is the version the order must currently be at
+	Version int64
+
+	// Insert, if set, is inserted as a new order rather than changing an existing
+	// order and Event.OrderID is set to its ID. Its ID is generated if it's not
+	// set and its version starts at 1.
+	Insert *Order
+	// LineItems, if set, replace the order's line items
+	LineItems []LineItem
+	// Payment, if set, is recorded as the order's payment
+	Payment *Payment
+	// Refund, if set, is added to the order's refunds as long as the order's
+	// total refunds, including it, don't exceed RefundLimitCents
+	Refund           *Refund
+	RefundLimitCents int64
+	// DeleteRefundID, if set, is the ID of a refund that's removed from the order
+	DeleteRefundID string
+	// PendingRefundID, if set, is the ID of a refund that's marked as pending
+	// and ResolveRefundID, if set, is the ID of a pending refund that was made and
+	// is no longer pending
+	PendingRefundID string
+	ResolveRefundID string
+	// Fulfillments change how much of each of their line items was fulfilled
+	Fulfillments []LineItemFulfillment
+}
+
+// changesOrder returns true if the change does anything to an existing order
+// other than recording the event
+func (c OrderChange) changesOrder() bool {
+	return c.Event.OldStatus != c.Event.NewStatus || c.LineItems != nil ||
+		c.Payment != nil || c.Refund != nil || c.DeleteRefundID != "" ||
+		c.PendingRefundID != "" || c.ResolveRefundID != "" || len(c.Fulfillments) > 0
+}
+
+// changesLineItems returns true if the change replaces or fulfills any of the
+// order's line items
+func (c OrderChange) changesLineItems() bool {
+	return c.LineItems != nil || len(c.Fulfillments) > 0
+}
+
+// insert returns the order the change inserts, with the fields that are set when
+// it's inserted filled in, and the event that records it
+func (c OrderChange) insert(now time.Time, newID func() string) (Order, OrderEvent) {
+	// copy the order so the caller can't modify the stored order
+	order := prepareInsert(c.Insert.clone(), now, newID)
+	event := c.Event
+	event.OrderID = order.ID
+	event.OldStatus = order.Status
+	event.NewStatus = order.Status
+	return order, event
+}
+
+// apply makes the change to order, which is the existing order's current state,
+// at now and returns the event that records it. The order is changed in place so it
+// must be a copy of the stored order. If any of the change's conditions aren't
+// met then ErrOrderVersionMismatch or ErrOrderStatusMismatch is returned and if
+// the refunds or line items it changes can't be then ErrRefundExceedsCharge,
+// ErrRefundNotFound or ErrLineItemNotFound is returned.
+func (c OrderChange) apply(order *Order, now time.Time) (OrderEvent, error) {
+	event := c.Event
+	if c.Version != 0 && order.Version != c.Version {
+		return OrderEvent{}, ErrOrderVersionMismatch
+	}
+	if (c.RequireStatus || event.OldStatus != event.NewStatus) && order.Status != event.OldStatus {
+		return OrderEvent{}, ErrOrderStatusMismatch
+	}
+	if event.OldStatus == event.NewStatus {
+		event.OldStatus = order.Status
+		event.NewStatus = order.Status
+	}
+	if !c.changesOrder() {
+		return event, nil
+	}
+
+	if c.LineItems != nil {
+		// copy the line items so the caller can't modify the stored order
+		order.LineItems = append([]LineItem{}, c.LineItems...)
+	}
+	if c.Payment != nil {
+		payment := *c.Payment
+		order.Payment = &payment
+	}
+	if c.Refund != nil {
+		if order.RefundedCents()+c.Refund.AmountCents > c.RefundLimitCents {
+			return OrderEvent{}, ErrRefundExceedsCharge
+		}
+		refund := *c.Refund
+		refund.LineItems = append([]RefundLineItem(nil), refund.LineItems...)
+		order.Refunds = append(order.Refunds, refund)
+	}
+	if c.DeleteRefundID != "" {
+		idx := findRefund(order.Refunds, c.DeleteRefundID)
+		if idx < 0 {
+			return OrderEvent{}, ErrRefundNotFound
+		}
+		order.Refunds = append(order.Refunds[:idx], order.Refunds[idx+1:]...)
+		if len(order.Refunds) == 0 {
+			order.Refunds = nil
+		}
+	}
+	if c.PendingRefundID != "" {
+		if err := setRefundPending(order.Refunds, c.PendingRefundID, true); err != nil {
+			return OrderEvent{}, err
+		}
+	}
+	if c.ResolveRefundID != "" {
+		if err := setRefundPending(order.Refunds, c.ResolveRefundID, false); err != nil {
+			return OrderEvent{}, err
+		}
+	}
+	for _, f := range c.Fulfillments {
+		if f.LineItem < 0 || f.LineItem >= len(order.LineItems) {
+			return OrderEvent{}, ErrLineItemNotFound
+		}
+		if order.LineItems[f.LineItem].FulfilledQuantity != f.From {
+			return OrderEvent{}, ErrLineItemFulfillmentMismatch
+		}
+		order.LineItems[f.LineItem].setFulfilledQuantity(f.Quantity)
+	}
+
+	if order.Status != event.NewStatus {
+		order.setStatus(event.NewStatus, now)
+	} else {
+		order.touch(now)
+	}
+	return event, nil
+}
+
+// findRefund returns the index of the refund with the ID or -1 if there isn't one
+func findRefund(refunds []Refund, id string) int {
+	for n, r := range refunds {
+		if r.ID == id {
+			return n
+		}
+	}
+	return -1
+}
+
+// setRefundPending marks the refund with the ID as pending or not, returning
+// ErrRefundNotFound if there isn't one
+func setRefundPending(refunds []Refund, id string, pending bool) error {
+	idx := findRefund(refunds, id)
+	if idx < 0 {
+		return ErrRefundNotFound
+	}
+	refunds[idx].Pending = pending
+	return nil
+}
+
+// prepareInsert fills in the fields of a new order that are set when it's
+// inserted if they aren't already, generating its ID with newID
+func prepareInsert(order Order, now time.Time, newID func() string) Order {
+	if order.ID == "" {
+		order.ID = newID()
+	}
+	// every order starts at the first version
+	if order.Version == 0 {
+		order.Version = 1
+	}
+	if order.CreatedAt.IsZero() {
+		order.CreatedAt = now
+	}
+	if order.UpdatedAt.IsZero() {
+		order.UpdatedAt = order.CreatedAt
+	}
+	return order
+}
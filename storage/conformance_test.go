@@ -0,0 +1,49 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformanceSQLite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Instance {
+		inst, err := storage.New(filepath.Join(t.TempDir(), "orders.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			inst.Close()
+		})
+		return inst
+	})
+}
+
+func TestConformanceMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Instance {
+		return storage.NewMemory()
+	})
+}
+
+func TestConformanceDurableMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Instance {
+		// snapshots are written often so they happen in the middle of the tests
+		inst, err := storage.OpenMemory(t.TempDir(), storage.WithSnapshotEvery(5))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			inst.Close()
+		})
+		return inst
+	})
+}
+
+func TestConformancePostgres(t *testing.T) {
+	if os.Getenv(postgresDSNEnv) == "" {
+		t.Skipf("%s isn't set", postgresDSNEnv)
+	}
+	storagetest.Run(t, func(t *testing.T) storagetest.Instance {
+		return newPostgres(t)
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -16,26 +18,265 @@ var (
 	// ErrOrderExists is returned when a new order is being inserted but an order
 	// with the same ID already exists
 	ErrOrderExists = errors.New("order already exists")
+
+	// ErrOrderStatusMismatch is returned when an order's status is being changed
+	// conditionally but the order's current status isn't the expected one
+	ErrOrderStatusMismatch = errors.New("order status mismatch")
+
+	// ErrOrderVersionMismatch is returned when an order is being changed
+	// conditionally on its version but the order's current version isn't the
+	// expected one
+	ErrOrderVersionMismatch = errors.New("order version mismatch")
+
+	// ErrRefundExceedsCharge is returned when a refund is being added to an order
+	// but the order's total refunds would be more than the allowed limit
+	ErrRefundExceedsCharge = errors.New("refund exceeds charged amount")
+
+	// ErrRefundNotFound is returned when the specified refund cannot be found
+	ErrRefundNotFound = errors.New("refund not found")
+
+	// ErrLineItemNotFound is returned when the specified line item index is out
+	// of range for the order's line items
+	ErrLineItemNotFound = errors.New("line item not found")
+
+	// ErrLineItemFulfillmentMismatch is returned when a line item's fulfilled
+	// quantity is being changed but it isn't at the expected quantity anymore
+	ErrLineItemFulfillmentMismatch = errors.New("line item fulfillment mismatch")
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// GetOrder should return the order with the given ID. If that ID isn't found then
-// the special ErrOrderNotFound error should be returned.
-func (i *Instance) GetOrder(ctx context.Context, id string) (Order, error) {
-	// TODO: get order from DB based on the id
-	var order Order
-	var lineItemsJSON string
+// orderColumns are the columns selected for every order so that scanOrder can
+// be used for any query that returns orders. The line items are stored in their
+// own table and are loaded separately with loadLineItems.
+const orderColumns = `id, customer_email, status,
+	payment_card_token, payment_charge_id, payment_amount_cents, payment_charged_at,
+	refunds, version, created_at, updated_at, charged_at, fulfilled_at, cancelled_at`
+
+// timeFormat is how the order timestamps are stored. Unlike time.RFC3339Nano it
+// always includes every digit of the fraction, and the times are always stored
+// in UTC, so the stored strings sort and compare the same as the times do.
+const timeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// formatTime formats t for storing in one of the timestamp columns
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
 
-	query := `SELECT id, customer_email, line_items, status FROM orders WHERE id = ?`
+// parseTime parses a nullable timestamp column and returns nil if it was NULL
+func parseTime(ns sql.NullString) (*time.Time, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(timeFormat, ns.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// nullTime formats t for storing in one of the nullable timestamp columns
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
 
-	// Execute the query and scan the results into variables
-	err := i.db.QueryRowContext(ctx, query, id).Scan(
+// queryer is implemented by both *sql.DB and *sql.Tx so the helpers can be used
+// inside and outside of transactions
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// lineItemColumns are the columns selected for every line item
+const lineItemColumns = `order_id, position, description, price_cents, quantity,
+	fulfillment_status, fulfilled_quantity`
+
+// lineItemsBatchSize is the most orders loadLineItems loads the line items for
+// in a single query which keeps it under SQLite's limit on the number of
+// arguments in a query
+const lineItemsBatchSize = 500
+
+// loadLineItems fills in the LineItems of each of the orders. Rather than
+// querying for each order separately the line items for a batch of orders are
+// loaded at once.
+func loadLineItems(ctx context.Context, q queryer, orders []Order) error {
+	byID := make(map[string]*Order, len(orders))
+	for idx := range orders {
+		// orders without any line items should still have an empty slice
+		orders[idx].LineItems = []LineItem{}
+		byID[orders[idx].ID] = &orders[idx]
+	}
+
+	for start := 0; start < len(orders); start += lineItemsBatchSize {
+		end := start + lineItemsBatchSize
+		if end > len(orders) {
+			end = len(orders)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, order := range orders[start:end] {
+			args = append(args, order.ID)
+		}
+		query := `SELECT ` + lineItemColumns + ` FROM order_line_items
+			WHERE order_id IN (?` + strings.Repeat(`, ?`, len(args)-1) + `)
+			ORDER BY order_id, position`
+		if err := scanLineItems(ctx, q, query, args, byID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanLineItems runs the query and appends each of the resulting line items to
+// its order. The query must return the line items of each order in position
+// order.
+func scanLineItems(ctx context.Context, q queryer, query string, args []interface{}, byID map[string]*Order) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID string
+		var position int
+		var li LineItem
+		err := rows.Scan(
+			&orderID,
+			&position,
+			&li.Description,
+			&li.PriceCents,
+			&li.Quantity,
+			&li.FulfillmentStatus,
+			&li.FulfilledQuantity,
+		)
+		if err != nil {
+			return err
+		}
+		if order, ok := byID[orderID]; ok {
+			order.LineItems = append(order.LineItems, li)
+		}
+	}
+	return rows.Err()
+}
+
+// insertLineItems inserts the line items for the order with the given ID with
+// their positions matching their index in lineItems
+func insertLineItems(ctx context.Context, tx *sql.Tx, id string, lineItems []LineItem) error {
+	query := `INSERT INTO order_line_items (` + lineItemColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	for position, li := range lineItems {
+		_, err := tx.ExecContext(ctx, query, id, position, li.Description, li.PriceCents, li.Quantity,
+			li.FulfillmentStatus, li.FulfilledQuantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanOrder scans a single row selected with orderColumns into an Order
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	// the payment columns are all NULL until the order is charged
+	var cardToken, chargeID, paymentChargedAt sql.NullString
+	var amountCents sql.NullInt64
+	// refunds is NULL until the first refund is made
+	var refundsJSON sql.NullString
+	// the created and updated times are only NULL for orders created before they
+	// were recorded and the others are NULL until the order's status changes
+	var createdAt, updatedAt, chargedAt, fulfilledAt, cancelledAt sql.NullString
+
+	err := row.Scan(
 		&order.ID,
 		&order.CustomerEmail,
-		&lineItemsJSON,
 		&order.Status,
+		&cardToken,
+		&chargeID,
+		&amountCents,
+		&paymentChargedAt,
+		&refundsJSON,
+		&order.Version,
+		&createdAt,
+		&updatedAt,
+		&chargedAt,
+		&fulfilledAt,
+		&cancelledAt,
 	)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if createdAt.Valid {
+		order.CreatedAt, err = time.Parse(timeFormat, createdAt.String)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+	if updatedAt.Valid {
+		order.UpdatedAt, err = time.Parse(timeFormat, updatedAt.String)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+	order.ChargedAt, err = parseTime(chargedAt)
+	if err != nil {
+		return Order{}, err
+	}
+	order.FulfilledAt, err = parseTime(fulfilledAt)
+	if err != nil {
+		return Order{}, err
+	}
+	order.CancelledAt, err = parseTime(cancelledAt)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if refundsJSON.Valid {
+		err = json.Unmarshal([]byte(refundsJSON.String), &order.Refunds)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+
+	paidAt, err := parseTime(paymentChargedAt)
+	if err != nil {
+		return Order{}, err
+	}
+	if paidAt != nil {
+		order.Payment = &Payment{
+			CardToken:   cardToken.String,
+			ChargeID:    chargeID.String,
+			AmountCents: amountCents.Int64,
+			ChargedAt:   *paidAt,
+		}
+	}
+
+	return order, nil
+}
+
+// GetOrder should return the order with the given ID. If that ID isn't found then
+// the special ErrOrderNotFound error should be returned.
+func (i *Instance) GetOrder(ctx context.Context, id string) (Order, error) {
+	// the order and its line items are read in a transaction so we don't return
+	// line items from a different version of the order
+	tx, err := i.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Order{}, err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE id = ?`
+
+	// Execute the query and scan the results into an order
+	order, err := scanOrder(tx.QueryRowContext(ctx, query, id))
 
 	// Handle the result
 	if err != nil {
@@ -47,125 +288,676 @@ func (i *Instance) GetOrder(ctx context.Context, id string) (Order, error) {
 		return Order{}, err
 	}
 
-	// Parse the JSON line items back into the LineItems slice
-	err = json.Unmarshal([]byte(lineItemsJSON), &order.LineItems)
-	if err != nil {
+	orders := []Order{order}
+	if err := loadLineItems(ctx, tx, orders); err != nil {
 		return Order{}, err
 	}
 
-	return order, nil
+	return orders[0], tx.Commit()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// GetOrders should return all orders with the given status. If status is the
-// special -1 value then it should return all orders regardless of their status.
-func (i *Instance) GetOrders(ctx context.Context, status OrderStatus) ([]Order, error) {
-	var orders []Order
+// lineItemsTotalSQL sums the order's line items so orders can be filtered by
+// their total like Order.TotalCents
+const lineItemsTotalSQL = `(SELECT COALESCE(SUM(li.price_cents * li.quantity), 0) FROM order_line_items AS li WHERE li.order_id = orders.id)`
+
+// likeEscaper escapes the wildcards in a LIKE pattern so they match literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// queryWhere returns the conditions and their arguments for the filters that
+// were set in the query. The emails and descriptions are compared using
+// lower() which only folds ASCII but that's all we expect in emails and product
+// IDs.
+func queryWhere(query OrderQuery) ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if len(query.Statuses) > 0 {
+		where = append(where, `status IN (?`+strings.Repeat(`, ?`, len(query.Statuses)-1)+`)`)
+		for _, s := range query.Statuses {
+			args = append(args, s)
+		}
+	}
+	if query.CustomerEmail != "" {
+		where = append(where, `lower(customer_email) = ?`)
+		args = append(args, strings.ToLower(query.CustomerEmail))
+	}
+	if query.CustomerEmailDomain != "" {
+		where = append(where, `lower(customer_email) LIKE ? ESCAPE '\'`)
+		args = append(args, `%@`+likeEscaper.Replace(strings.ToLower(query.CustomerEmailDomain)))
+	}
+	if query.MinTotalCents != nil {
+		where = append(where, lineItemsTotalSQL+` >= ?`)
+		args = append(args, *query.MinTotalCents)
+	}
+	if query.MaxTotalCents != nil {
+		where = append(where, lineItemsTotalSQL+` <= ?`)
+		args = append(args, *query.MaxTotalCents)
+	}
+	if query.LineItemDescription != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM order_line_items AS li WHERE li.order_id = orders.id AND instr(lower(li.description), ?) > 0)`)
+		args = append(args, strings.ToLower(query.LineItemDescription))
+	}
+	if query.PendingRefunds {
+		where = append(where, `EXISTS (SELECT 1 FROM json_each(orders.refunds) WHERE json_extract(value, '$.pending'))`)
+	}
+	// the timestamps are stored in a format that compares the same as the times
+	if !query.Created.After.IsZero() {
+		where = append(where, `created_at > ?`)
+		args = append(args, formatTime(query.Created.After))
+	}
+	if !query.Created.Before.IsZero() {
+		where = append(where, `created_at < ?`)
+		args = append(args, formatTime(query.Created.Before))
+	}
+	return where, args
+}
 
-	// Get the rows from the database based on status sent, unless status is -1
-	var query string
-	if status == -1 {
-		query = `SELECT id, customer_email, line_items, status FROM orders`
-	} else {
-		query = `SELECT id, customer_email, line_items, status FROM orders WHERE status = ?`
+// GetOrders should return the orders matching the query, limited to the given
+// page, along with the cursor for the next page. The next cursor is empty if
+// there are no more orders and if the page's cursor isn't valid then
+// ErrInvalidCursor should be returned.
+func (i *Instance) GetOrders(ctx context.Context, query OrderQuery, page Page) ([]Order, string, error) {
+	// orders is never nil so callers get an empty slice if nothing matched
+	orders := []Order{}
+
+	// Build up the conditions based on the filters that were set in the query
+	where, args := queryWhere(query)
+	// rather than using OFFSET, which has to skip over every earlier row, we start
+	// right after the last order of the previous page which can use the
+	// (created_at, id) index no matter how deep the page is
+	if page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, `(created_at < ? OR (created_at = ? AND id < ?))`)
+		args = append(args, formatTime(c.CreatedAt), formatTime(c.CreatedAt), c.ID)
+	}
+	stmt := `SELECT ` + orderColumns + ` FROM orders`
+	if len(where) > 0 {
+		stmt += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	stmt += ` ORDER BY created_at DESC, id DESC`
+	// we ask for one more order than the limit so we know if there's a next page
+	if page.Limit > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, page.Limit+1)
 	}
 
-	rows, err := i.db.QueryContext(ctx, query, status)
+	// just like GetOrder the orders and their line items are read in a single
+	// transaction
+	tx, err := i.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	// Loop through the rows and add the orders to the orders slice
 	for rows.Next() {
-		var order Order
-		var lineItemsJSON string
-		err = rows.Scan(
-			&order.ID,
-			&order.CustomerEmail,
-			&lineItemsJSON,
-			&order.Status,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// Parse the JSON line items back into the LineItems slice
-		err = json.Unmarshal([]byte(lineItemsJSON), &order.LineItems)
+		order, err := scanOrder(rows)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		// Add the order to the orders slice
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	// the rows need to be closed before the transaction can be used again
+	rows.Close()
 
-	return orders, nil
+	var next string
+	if page.Limit > 0 && len(orders) > page.Limit {
+		orders = orders[:page.Limit]
+		next = encodeCursor(orders[len(orders)-1])
+	}
+	if err := loadLineItems(ctx, tx, orders); err != nil {
+		return nil, "", err
+	}
+	return orders, next, tx.Commit()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// SetOrderStatus should update the order with the given ID and set the status
-// field. If that ID isn't found then the special ErrOrderNotFound error should
-// be returned.
-func (i *Instance) SetOrderStatus(ctx context.Context, id string, status OrderStatus) error {
-	// TODO: update the order's status field to status for the id
+// insertOrder inserts the order, which must already have its ID, version and
+// timestamps, and its line items inside of the transaction. If the order
+// already exists then ErrOrderExists is returned.
+func insertOrder(ctx context.Context, tx *sql.Tx, order Order) error {
+	// Check if order already exists
+	var exists int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE id = ?`, order.ID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		// Order already exists
+		return ErrOrderExists
+	}
+
+	// Insert the order into the database
+	query := `INSERT INTO orders (id, customer_email, status,
+		payment_card_token, payment_charge_id, payment_amount_cents, payment_charged_at,
+		refunds, version, created_at, updated_at, charged_at, fulfilled_at, cancelled_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	payment, refundsJSON, err := orderValues(order)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{order.ID, order.CustomerEmail, order.Status}
+	args = append(args, payment...)
+	args = append(args, refundsJSON, order.Version,
+		formatTime(order.CreatedAt), formatTime(order.UpdatedAt),
+		nullTime(order.ChargedAt), nullTime(order.FulfilledAt), nullTime(order.CancelledAt))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return insertLineItems(ctx, tx, order.ID, order.LineItems)
+}
 
-	// Update the order's status field to status for the id
-	query := `UPDATE orders SET status = ? WHERE id = ?`
+// orderValues returns the values of the order's payment columns, in the order
+// they're listed in orderColumns, and of its refunds column
+func orderValues(order Order) ([]interface{}, sql.NullString, error) {
+	// the payment columns are left NULL if the order doesn't have a payment
+	var cardToken, chargeID, chargedAt sql.NullString
+	var amountCents sql.NullInt64
+	if order.Payment != nil {
+		cardToken = sql.NullString{String: order.Payment.CardToken, Valid: true}
+		chargeID = sql.NullString{String: order.Payment.ChargeID, Valid: true}
+		amountCents = sql.NullInt64{Int64: order.Payment.AmountCents, Valid: true}
+		chargedAt = nullTime(&order.Payment.ChargedAt)
+	}
 
-	result, err := i.db.ExecContext(ctx, query, status, id)
+	// refunds are left NULL if there aren't any
+	var refundsJSON sql.NullString
+	if len(order.Refunds) > 0 {
+		byts, err := json.Marshal(order.Refunds)
+		if err != nil {
+			return nil, sql.NullString{}, err
+		}
+		refundsJSON = sql.NullString{String: string(byts), Valid: true}
+	}
+	return []interface{}{cardToken, chargeID, amountCents, chargedAt}, refundsJSON, nil
+}
 
+////////////////////////////////////////////////////////////////////////////////
+
+// ApplyOrderChange should make the change to the order with the ID in
+// change.Event.OrderID, or insert change.Insert, and insert the change's event
+// along with a pending webhook delivery of it for every subscription that
+// matches its type, all in a single transaction. It should return the event as it was stored. If the order isn't
+// found then the special ErrOrderNotFound error should be returned and if any of
+// the change's conditions aren't met then the error describing which one wasn't
+// should be returned and nothing should be changed.
+func (i *Instance) ApplyOrderChange(ctx context.Context, change OrderChange) (OrderEvent, error) {
+	now := i.now()
+
+	// transactions take the write lock when they begin so the order can't change
+	// between reading it and writing it back
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return OrderEvent{}, err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	var event OrderEvent
+	if change.Insert != nil {
+		var order Order
+		order, event = change.insert(now, uuid.NewString)
+		if err := insertOrder(ctx, tx, order); err != nil {
+			return OrderEvent{}, err
+		}
+	} else {
+		order, err := scanOrder(tx.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = ?`,
+			change.Event.OrderID))
+		if err == sql.ErrNoRows {
+			return OrderEvent{}, ErrOrderNotFound
+		} else if err != nil {
+			return OrderEvent{}, err
+		}
+		orders := []Order{order}
+		if err := loadLineItems(ctx, tx, orders); err != nil {
+			return OrderEvent{}, err
+		}
+		order = orders[0]
+
+		if event, err = change.apply(&order, now); err != nil {
+			return OrderEvent{}, err
+		}
+		if change.changesOrder() {
+			if err := saveOrder(ctx, tx, order, change.changesLineItems()); err != nil {
+				return OrderEvent{}, err
+			}
+		}
+	}
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = now
+	}
+	if event, err = insertOrderEvent(ctx, tx, event, now); err != nil {
+		return OrderEvent{}, err
+	}
+	return event, tx.Commit()
+}
+
+// saveOrder writes every column of the order, which must already exist, inside
+// of the transaction and replaces its line items if lineItems is true
+func saveOrder(ctx context.Context, tx *sql.Tx, order Order, lineItems bool) error {
+	payment, refundsJSON, err := orderValues(order)
 	if err != nil {
 		return err
 	}
+	query := `UPDATE orders SET customer_email = ?, status = ?,
+		payment_card_token = ?, payment_charge_id = ?, payment_amount_cents = ?, payment_charged_at = ?,
+		refunds = ?, version = ?, updated_at = ?, charged_at = ?, fulfilled_at = ?, cancelled_at = ?
+		WHERE id = ?`
+	args := []interface{}{order.CustomerEmail, order.Status}
+	args = append(args, payment...)
+	args = append(args, refundsJSON, order.Version, formatTime(order.UpdatedAt),
+		nullTime(order.ChargedAt), nullTime(order.FulfilledAt), nullTime(order.CancelledAt), order.ID)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	if !lineItems {
+		return nil
+	}
 
-	// Check if any rows were affected
-	rowsAffected, err := result.RowsAffected()
+	_, err = tx.ExecContext(ctx, `DELETE FROM order_line_items WHERE order_id = ?`, order.ID)
 	if err != nil {
 		return err
 	}
+	return insertLineItems(ctx, tx, order.ID, order.LineItems)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// InsertIdempotencyKey should store the key as an in-progress request that
+// expires at key.ExpiresAt. If a record for the same key and route already
+// exists, and hasn't expired, then it should be returned along with the special
+// ErrIdempotencyKeyExists error. An expired record is replaced.
+func (i *Instance) InsertIdempotencyKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, error) {
+	// the upsert lets the primary key decide atomically which request gets to use
+	// the key, or take over an expired one, so we don't need to check for it first
+	query := `INSERT INTO idempotency_keys (key, route, request_hash, completed, status_code, body, expires_at)
+		VALUES (?, ?, ?, 0, 0, NULL, ?) ON CONFLICT (key, route) DO UPDATE SET
+		request_hash = excluded.request_hash, completed = 0, status_code = 0, body = NULL, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at IS NOT NULL AND idempotency_keys.expires_at <= ?`
+
+	expiresAt := nullTime(expiresAtPointer(key.ExpiresAt))
+	result, err := i.db.ExecContext(ctx, query, key.Key, key.Route, key.RequestHash, expiresAt, formatTime(i.now()))
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if rowsAffected > 0 {
+		// return the key as it was stored rather than what the caller passed in
+		return IdempotencyKey{Key: key.Key, Route: key.Route, RequestHash: key.RequestHash, ExpiresAt: key.ExpiresAt}, nil
+	}
+
+	// the key already exists so return what's there to the caller
+	var existing IdempotencyKey
+	var existingExpiresAt sql.NullString
+	err = i.db.QueryRowContext(ctx,
+		`SELECT key, route, request_hash, completed, status_code, body, expires_at FROM idempotency_keys WHERE key = ? AND route = ?`,
+		key.Key, key.Route,
+	).Scan(
+		&existing.Key,
+		&existing.Route,
+		&existing.RequestHash,
+		&existing.Completed,
+		&existing.StatusCode,
+		&existing.Body,
+		&existingExpiresAt,
+	)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	t, err := parseTime(existingExpiresAt)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if t != nil {
+		existing.ExpiresAt = *t
+	}
+	return existing, ErrIdempotencyKeyExists
+}
+
+// CompleteIdempotencyKey should record the response for the key and route so it
+// can be replayed to future requests with the same key until expiresAt.
+func (i *Instance) CompleteIdempotencyKey(ctx context.Context, key, route string, statusCode int, body []byte, expiresAt time.Time) error {
+	query := `UPDATE idempotency_keys SET completed = 1, status_code = ?, body = ?, expires_at = ? WHERE key = ? AND route = ?`
+	_, err := i.db.ExecContext(ctx, query, statusCode, body, nullTime(expiresAtPointer(expiresAt)), key, route)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys should remove every key that has expired and
+// return how many were removed.
+func (i *Instance) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	result, err := i.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= ?`, formatTime(i.now()))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// DeleteIdempotencyKey should remove the key and route so the request can be
+// tried again. Deleting a key that doesn't exist is not an error.
+func (i *Instance) DeleteIdempotencyKey(ctx context.Context, key, route string) error {
+	_, err := i.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = ? AND route = ?`, key, route)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// insertOrderEvent inserts the event, which must already have its CreatedAt,
+// and a pending webhook delivery of it, created at now, for every subscription
+// that matches its type inside of the transaction. It returns the event with its
+// ID set.
+func insertOrderEvent(ctx context.Context, tx *sql.Tx, event OrderEvent, now time.Time) (OrderEvent, error) {
+	// selecting the values from the order means nothing is inserted if the order
+	// doesn't exist which we can tell apart from other errors, unlike a foreign
+	// key failure
+	query := `INSERT INTO order_events (order_id, type, actor, request_id, old_status, new_status,
+		amount_cents, charge_id, refund_id, detail, created_at)
+		SELECT id, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM orders WHERE id = ?`
+
+	result, err := tx.ExecContext(ctx, query, event.Type, event.Actor, event.RequestID,
+		event.OldStatus, event.NewStatus, event.AmountCents, event.ChargeID, event.RefundID,
+		event.Detail, formatTime(event.CreatedAt), event.OrderID)
+	if err != nil {
+		return OrderEvent{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return OrderEvent{}, err
+	}
 	if rowsAffected == 0 {
-		return ErrOrderNotFound
+		return OrderEvent{}, ErrOrderNotFound
+	}
+	event.ID, err = result.LastInsertId()
+	if err != nil {
+		return OrderEvent{}, err
 	}
 
-	return nil
+	// the deliveries are inserted in the order the subscriptions were created so
+	// their IDs are assigned in that order
+	createdAt := formatTime(now)
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (subscription_id, event_id,
+		status, attempts, next_attempt_at, last_error, created_at)
+		SELECT id, ?, ?, 0, ?, '', ? FROM webhook_subscriptions
+		WHERE event_types = '[]' OR EXISTS (SELECT 1 FROM json_each(event_types) WHERE value = ?)
+		ORDER BY created_at, id`,
+		event.ID, WebhookDeliveryPending, createdAt, createdAt, event.Type)
+	if err != nil {
+		return OrderEvent{}, err
+	}
+
+	// return the time as it was stored, which is always in UTC
+	event.CreatedAt = event.CreatedAt.UTC()
+	return event, nil
+}
+
+// GetOrderEvents should return the events of the order with the given ID in
+// the order they were inserted. An order without any events, or that doesn't
+// exist, has an empty slice of events.
+func (i *Instance) GetOrderEvents(ctx context.Context, orderID string) ([]OrderEvent, error) {
+	rows, err := i.db.QueryContext(ctx, `SELECT id, order_id, type, actor, request_id, old_status,
+		new_status, amount_cents, charge_id, refund_id, detail, created_at
+		FROM order_events WHERE order_id = ? ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	// we need to make sure we close the rows otherwise the connection is never
+	// released back to the pool
+	defer rows.Close()
+
+	// events is never nil so callers get an empty slice if there aren't any
+	events := []OrderEvent{}
+	for rows.Next() {
+		var event OrderEvent
+		var createdAt string
+		err := rows.Scan(
+			&event.ID,
+			&event.OrderID,
+			&event.Type,
+			&event.Actor,
+			&event.RequestID,
+			&event.OldStatus,
+			&event.NewStatus,
+			&event.AmountCents,
+			&event.ChargeID,
+			&event.RefundID,
+			&event.Detail,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.CreatedAt, err = time.Parse(timeFormat, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// InsertOrder should fill in the order's ID with a unique identifier if it's not
-// already set and then insert it into the database. It should return the order's
-// ID. If the order already exists then ErrOrderExists should be returned.
-func (i *Instance) InsertOrder(ctx context.Context, order Order) (string, error) {
-	// TODO: if the order's ID field is empty, generate a random ID, then insert
-	// into the database
+// InsertWebhookSubscription should store the subscription with a newly
+// generated ID and return it with its ID and, if it wasn't set, its CreatedAt
+// filled in.
+func (i *Instance) InsertWebhookSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	sub = sub.clone()
+	sub.ID = uuid.New().String()
+	if sub.CreatedAt.IsZero() {
+		sub.CreatedAt = i.now()
+	}
+	eventTypes, err := json.Marshal(sub.EventTypes)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	_, err = i.db.ExecContext(ctx, `INSERT INTO webhook_subscriptions (id, url, secret, event_types, created_at)
+		VALUES (?, ?, ?, ?, ?)`, sub.ID, sub.URL, sub.Secret, string(eventTypes), formatTime(sub.CreatedAt))
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	// return the time as it was stored, which is always in UTC
+	sub.CreatedAt = sub.CreatedAt.UTC()
+	return sub, nil
+}
 
-	// Generate a random ID if the order's ID field is empty
-	if order.ID == "" {
-		order.ID = uuid.New().String()
+// GetWebhookSubscriptions should return every subscription, oldest first.
+func (i *Instance) GetWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := i.db.QueryContext(ctx, `SELECT id, url, secret, event_types, created_at
+		FROM webhook_subscriptions ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Check if order already exists
-	_, err := i.GetOrder(ctx, order.ID)
-	if err == nil {
-		// Order already exists
-		return "", ErrOrderExists
+	// subs is never nil so callers get an empty slice if there aren't any
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		var eventTypes, createdAt string
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.Secret, &eventTypes, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(eventTypes), &sub.EventTypes); err != nil {
+			return nil, err
+		}
+		sub.CreatedAt, err = time.Parse(timeFormat, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
 	}
+	return subs, rows.Err()
+}
 
-	// Insert the order into the database
-	query := `INSERT INTO orders (id, customer_email, line_items, status) VALUES (?, ?, ?, ?)`
+// DeleteWebhookSubscription should remove the subscription with the given ID
+// along with all of its deliveries. If the subscription isn't found then the
+// special ErrWebhookSubscriptionNotFound error should be returned.
+func (i *Instance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	// the deliveries are removed by the foreign key's ON DELETE CASCADE
+	result, err := i.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookSubscriptionNotFound
+	}
+	return nil
+}
+
+// webhookDeliveryColumns are the columns selected for every delivery so that
+// scanWebhookDelivery can be used for any query that returns deliveries. The
+// delivery's event is joined as e.
+const webhookDeliveryColumns = `d.id, d.subscription_id, d.status, d.attempts, d.next_attempt_at,
+	d.last_error, d.created_at, d.delivered_at,
+	e.id, e.order_id, e.type, e.actor, e.request_id, e.old_status, e.new_status,
+	e.amount_cents, e.charge_id, e.refund_id, e.detail, e.created_at`
+
+// scanWebhookDelivery scans a row of webhookDeliveryColumns into a delivery
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var nextAttemptAt, createdAt, eventCreatedAt string
+	var deliveredAt sql.NullString
+	err := row.Scan(
+		&d.ID,
+		&d.SubscriptionID,
+		&d.Status,
+		&d.Attempts,
+		&nextAttemptAt,
+		&d.LastError,
+		&createdAt,
+		&deliveredAt,
+		&d.Event.ID,
+		&d.Event.OrderID,
+		&d.Event.Type,
+		&d.Event.Actor,
+		&d.Event.RequestID,
+		&d.Event.OldStatus,
+		&d.Event.NewStatus,
+		&d.Event.AmountCents,
+		&d.Event.ChargeID,
+		&d.Event.RefundID,
+		&d.Event.Detail,
+		&eventCreatedAt,
+	)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if d.NextAttemptAt, err = time.Parse(timeFormat, nextAttemptAt); err != nil {
+		return WebhookDelivery{}, err
+	}
+	if d.CreatedAt, err = time.Parse(timeFormat, createdAt); err != nil {
+		return WebhookDelivery{}, err
+	}
+	if d.Event.CreatedAt, err = time.Parse(timeFormat, eventCreatedAt); err != nil {
+		return WebhookDelivery{}, err
+	}
+	if d.DeliveredAt, err = parseTime(deliveredAt); err != nil {
+		return WebhookDelivery{}, err
+	}
+	return d, nil
+}
+
+// GetWebhookDeliveries should return the deliveries matching the query in the
+// order they were created.
+func (i *Instance) GetWebhookDeliveries(ctx context.Context, query WebhookDeliveryQuery) ([]WebhookDelivery, error) {
+	var where []string
+	var args []interface{}
+	if query.Status != "" {
+		where = append(where, `d.status = ?`)
+		args = append(args, query.Status)
+	}
+	if !query.DueBy.IsZero() {
+		where = append(where, `d.next_attempt_at <= ?`)
+		args = append(args, formatTime(query.DueBy))
+	}
 
-	orderLineItemsJSON, err := json.Marshal(order.LineItems)
+	q := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries AS d
+		JOIN order_events AS e ON e.id = d.event_id`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	q += ` ORDER BY d.id`
+	if query.Limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	rows, err := i.db.QueryContext(ctx, q, args...)
 	if err != nil {
-		return order.ID, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = i.db.ExecContext(ctx, query, order.ID, order.CustomerEmail, orderLineItemsJSON, order.Status)
+	// deliveries is never nil so callers get an empty slice if nothing matched
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateWebhookDelivery should replace the status, attempts, next attempt, last
+// error and delivered time of the delivery with delivery.ID, but only if its
+// current status is from. If the delivery isn't found then the special
+// ErrWebhookDeliveryNotFound error should be returned and if its status isn't
+// from then the special ErrWebhookDeliveryStatusMismatch error should be
+// returned.
+func (i *Instance) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery, from WebhookDeliveryStatus) error {
+	result, err := i.db.ExecContext(ctx, `UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, delivered_at = ?
+		WHERE id = ? AND status = ?`,
+		delivery.Status, delivery.Attempts, formatTime(delivery.NextAttemptAt), delivery.LastError,
+		nullTime(delivery.DeliveredAt), delivery.ID, from)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return order.ID, err
+		return err
+	}
+	if rowsAffected > 0 {
+		return nil
 	}
 
-	return order.ID, nil
+	// nothing was updated so either the delivery doesn't exist or its status
+	// wasn't what we expected
+	var status WebhookDeliveryStatus
+	err = i.db.QueryRowContext(ctx, `SELECT status FROM webhook_deliveries WHERE id = ?`, delivery.ID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ErrWebhookDeliveryStatusMismatch
 }
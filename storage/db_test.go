@@ -3,9 +3,11 @@ package storage
 import (
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,9 +23,88 @@ func randomDatabase() string {
 		// is just in tests anyways it's easier to just panic
 		panic(err)
 	}
-	// return a random database name prefixed with orders_test_ and suffixed with
+	// return a random database path prefixed with orders_test_ and suffixed with
 	// the hexadecimal formatting of the random bytes
-	return fmt.Sprintf("orders_test_%x", b)
+	return fmt.Sprintf("orders_test_%x.db", b)
+}
+
+// mustNew returns a new instance for the database at dbPath and fails the test
+// if it can't be opened
+func mustNew(t *testing.T, dbPath string) *Instance {
+	inst, err := New(dbPath)
+	require.NoError(t, err)
+	// closing the instance also checkpoints the WAL back into the database
+	t.Cleanup(func() {
+		inst.Close()
+	})
+	return inst
+}
+
+// testNow is the time returned by testClock so tests can compare the
+// timestamps set on orders
+var testNow = time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+
+// testClock always returns testNow
+func testClock() time.Time {
+	return testNow
+}
+
+// orderChanger is implemented by both *Instance and *MemoryInstance so the tests
+// can share the helpers below
+type orderChanger interface {
+	ApplyOrderChange(ctx context.Context, change OrderChange) (OrderEvent, error)
+}
+
+// insertTestOrder inserts the order along with its created event and returns
+// its ID
+func insertTestOrder(ctx context.Context, inst orderChanger, order Order) (string, error) {
+	event, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Insert: &order,
+		Event:  OrderEvent{Type: OrderEventCreated},
+	})
+	return event.OrderID, err
+}
+
+// changeTestStatus changes the order's status from one status to another along
+// with an event of the given type
+func changeTestStatus(ctx context.Context, inst orderChanger, id string, typ OrderEventType, from, to OrderStatus) error {
+	_, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{OrderID: id, Type: typ, OldStatus: from, NewStatus: to},
+	})
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestNew(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+
+	// errors rather than exiting if the database can't be opened
+	_, err := New("does_not_exist/" + randomDatabase())
+	assert.Error(t, err)
+
+	inst, err := New(randomDatabase(), WithBusyTimeout(time.Second), WithMaxOpenConns(2))
+	require.NoError(t, err)
+	defer inst.Close()
+
+	// every connection has the pragmas set so check a few of them
+	conns := make([]*sql.Conn, 2)
+	for idx := range conns {
+		conns[idx], err = inst.db.Conn(ctx)
+		require.NoError(t, err)
+		defer conns[idx].Close()
+
+		var journalMode string
+		var busyTimeout, foreignKeys int
+		require.NoError(t, conns[idx].QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&journalMode))
+		require.NoError(t, conns[idx].QueryRowContext(ctx, `PRAGMA busy_timeout`).Scan(&busyTimeout))
+		require.NoError(t, conns[idx].QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&foreignKeys))
+		assert.Equal(t, "wal", journalMode)
+		assert.Equal(t, 1000, busyTimeout)
+		assert.Equal(t, 1, foreignKeys)
+	}
+	assert.Equal(t, 2, inst.db.Stats().MaxOpenConnections)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -33,7 +114,7 @@ func TestGetOrder(t *testing.T) {
 	ctx := context.Background()
 	// make a new instance with a random database so this test is isolated from
 	// the others
-	inst := New(randomDatabase())
+	inst := mustNew(t, randomDatabase())
 	order := Order{
 		ID:            "test",
 		CustomerEmail: "test@test",
@@ -49,9 +130,13 @@ func TestGetOrder(t *testing.T) {
 				PriceCents:  5000,
 			},
 		},
-		Status: OrderStatusCharged,
+		Status:    OrderStatusCharged,
+		Version:   1,
+		CreatedAt: testNow,
+		UpdatedAt: testNow,
+		ChargedAt: &testNow,
 	}
-	id, err := inst.InsertOrder(ctx, order)
+	id, err := insertTestOrder(ctx, inst, order)
 	// the require package fails the whole test immediately if this fails which is
 	// useful for unexpected errors since the rest of the test will presumably fail
 	// if we can't do this
@@ -79,7 +164,7 @@ func TestGetOrders(t *testing.T) {
 	ctx := context.Background()
 	// make a new instance with a random database so this test is isolated from
 	// the others
-	inst := New(randomDatabase())
+	inst := mustNew(t, randomDatabase())
 	order1 := Order{
 		ID:            "test1",
 		CustomerEmail: "test@test",
@@ -95,9 +180,12 @@ func TestGetOrders(t *testing.T) {
 				PriceCents:  5000,
 			},
 		},
-		Status: OrderStatusCharged,
+		Status:    OrderStatusCharged,
+		Version:   1,
+		CreatedAt: testNow,
+		UpdatedAt: testNow,
 	}
-	_, err := inst.InsertOrder(ctx, order1)
+	_, err := insertTestOrder(ctx, inst, order1)
 	// the require package fails the whole test immediately if this fails which is
 	// useful for unexpected errors since the rest of the test will presumably fail
 	// if we can't do this
@@ -105,7 +193,7 @@ func TestGetOrders(t *testing.T) {
 
 	order2 := Order{
 		ID:            "test2",
-		CustomerEmail: "test@test",
+		CustomerEmail: "Bob@Example.com",
 		LineItems: []LineItem{
 			{
 				Description: "item 3",
@@ -118,13 +206,17 @@ func TestGetOrders(t *testing.T) {
 				PriceCents:  1000,
 			},
 		},
-		Status: OrderStatusFulfilled,
+		Status:  OrderStatusFulfilled,
+		Version: 1,
+		// order2 was created a day after order1
+		CreatedAt: testNow.Add(24 * time.Hour),
+		UpdatedAt: testNow.Add(24 * time.Hour),
 	}
-	_, err = inst.InsertOrder(ctx, order2)
+	_, err = insertTestOrder(ctx, inst, order2)
 	require.NoError(t, err)
 
-	// returns all if -1 is sent
-	got, err := inst.GetOrders(ctx, -1)
+	// returns all if the query is empty
+	got, _, err := inst.GetOrders(ctx, OrderQuery{}, Page{})
 	require.NoError(t, err)
 	// assert.Equal returns true if the assertion passes so we can use that as
 	// a conditional around dependent tests so we don't end up having a bunch of
@@ -135,34 +227,211 @@ func TestGetOrders(t *testing.T) {
 	}
 
 	// only returns the matching status
-	got, err = inst.GetOrders(ctx, OrderStatusCharged)
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Statuses: []OrderStatus{OrderStatusCharged}}, Page{})
 	require.NoError(t, err)
 	if assert.Len(t, got, 1) {
 		assert.Contains(t, got, order1)
 	}
 
 	// only returns the matching status
-	got, err = inst.GetOrders(ctx, OrderStatusFulfilled)
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Statuses: []OrderStatus{OrderStatusFulfilled}}, Page{})
 	require.NoError(t, err)
 	if assert.Len(t, got, 1) {
 		assert.Contains(t, got, order2)
 	}
 
 	// returns none and no error if none match
-	got, err = inst.GetOrders(ctx, OrderStatusPending)
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Statuses: []OrderStatus{OrderStatusPending}}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// only returns orders created after the start of the range
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Created: TimeRange{After: testNow}}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+
+	// only returns orders created before the end of the range
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Created: TimeRange{Before: testNow.Add(time.Hour)}}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order1)
+	}
+
+	// returns both orders if both are in the range even in a different time zone
+	est := time.FixedZone("EST", -5*60*60)
+	got, _, err = inst.GetOrders(ctx, OrderQuery{Created: TimeRange{
+		After:  testNow.Add(-time.Nanosecond).In(est),
+		Before: testNow.Add(48 * time.Hour).In(est),
+	}}, Page{})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	// returns none if none were created in the range
+	got, _, err = inst.GetOrders(ctx, OrderQuery{
+		Statuses: []OrderStatus{OrderStatusCharged},
+		Created:  TimeRange{After: testNow.Add(time.Hour)},
+	}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// returns orders matching any of the statuses
+	got, _, err = inst.GetOrders(ctx, OrderQuery{
+		Statuses: []OrderStatus{OrderStatusPending, OrderStatusFulfilled},
+	}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+
+	// matches the exact email ignoring case
+	got, _, err = inst.GetOrders(ctx, OrderQuery{CustomerEmail: "bob@example.com"}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+	got, _, err = inst.GetOrders(ctx, OrderQuery{CustomerEmail: "bob@example"}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// matches the email's domain ignoring case
+	got, _, err = inst.GetOrders(ctx, OrderQuery{CustomerEmailDomain: "EXAMPLE.com"}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+	// the domain has to be the whole domain and wildcards aren't wildcards
+	for _, domain := range []string{"ample.com", "%", "example_com"} {
+		got, _, err = inst.GetOrders(ctx, OrderQuery{CustomerEmailDomain: domain}, Page{})
+		require.NoError(t, err)
+		assert.Empty(t, got, domain)
+	}
+
+	// filters by the order's total, inclusive
+	total := order2.TotalCents()
+	got, _, err = inst.GetOrders(ctx, OrderQuery{MaxTotalCents: &total}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+	total++
+	got, _, err = inst.GetOrders(ctx, OrderQuery{MinTotalCents: &total}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order1)
+	}
+	maxTotal := order1.TotalCents() - 1
+	got, _, err = inst.GetOrders(ctx, OrderQuery{MinTotalCents: &total, MaxTotalCents: &maxTotal}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// matches any line item's description ignoring case
+	got, _, err = inst.GetOrders(ctx, OrderQuery{LineItemDescription: "ITEM 4"}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Contains(t, got, order2)
+	}
+	got, _, err = inst.GetOrders(ctx, OrderQuery{LineItemDescription: "item"}, Page{})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	got, _, err = inst.GetOrders(ctx, OrderQuery{LineItemDescription: "item 5"}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// every filter has to match
+	got, _, err = inst.GetOrders(ctx, OrderQuery{
+		CustomerEmailDomain: "example.com",
+		LineItemDescription: "item 1",
+	}, Page{})
 	require.NoError(t, err)
 	assert.Empty(t, got)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func TestSetOrderStatus(t *testing.T) {
+func TestGetOrdersPages(t *testing.T) {
 	// the context isn't meaningful for these tests so we just use a new one
 	ctx := context.Background()
 	// make a new instance with a random database so this test is isolated from
 	// the others
-	inst := New(randomDatabase())
-	id, err := inst.InsertOrder(ctx, Order{
+	inst := mustNew(t, randomDatabase())
+
+	// insert 5 orders where the last 2 were created at the same time so they're
+	// sorted by their ID
+	var ids []string
+	for n, created := range []time.Time{
+		testNow,
+		testNow.Add(time.Minute),
+		testNow.Add(2 * time.Minute),
+		testNow.Add(3 * time.Minute),
+		testNow.Add(3 * time.Minute),
+	} {
+		id, err := insertTestOrder(ctx, inst, Order{
+			ID:            fmt.Sprintf("test%d", n),
+			CustomerEmail: "test@test",
+			LineItems:     []LineItem{},
+			Status:        OrderStatusPending,
+			CreatedAt:     created,
+		})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	// newest first and then by ID descending for the 2 created at the same time
+	expected := []string{ids[4], ids[3], ids[2], ids[1], ids[0]}
+
+	// pages through all of the orders 2 at a time
+	var got []string
+	var cursor string
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 3, "too many pages")
+		orders, next, err := inst.GetOrders(ctx, OrderQuery{}, Page{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+		assert.True(t, len(orders) <= 2)
+		for _, o := range orders {
+			got = append(got, o.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, expected, got)
+
+	// an exact final page doesn't return a next cursor
+	orders, next, err := inst.GetOrders(ctx, OrderQuery{}, Page{Limit: 5})
+	require.NoError(t, err)
+	assert.Len(t, orders, 5)
+	assert.Empty(t, next)
+
+	// the cursor is combined with the other filters
+	orders, next, err = inst.GetOrders(ctx, OrderQuery{Created: TimeRange{After: testNow}}, Page{Limit: 3})
+	require.NoError(t, err)
+	assert.Len(t, orders, 3)
+	require.NotEmpty(t, next)
+	orders, next, err = inst.GetOrders(ctx, OrderQuery{Created: TimeRange{After: testNow}}, Page{Limit: 3, Cursor: next})
+	require.NoError(t, err)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, ids[1], orders[0].ID)
+	}
+	assert.Empty(t, next)
+
+	// returns invalid cursor
+	_, _, err = inst.GetOrders(ctx, OrderQuery{}, Page{Cursor: "not a cursor"})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrInvalidCursor), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestChangeOrderStatus(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	id, err := insertTestOrder(ctx, inst, Order{
 		ID:            "test1",
 		CustomerEmail: "test@test",
 		LineItems: []LineItem{
@@ -184,8 +453,7 @@ func TestSetOrderStatus(t *testing.T) {
 	// if we can't do this
 	require.NoError(t, err)
 
-	// returns all if -1 is sent
-	err = inst.SetOrderStatus(ctx, id, OrderStatusFulfilled)
+	err = changeTestStatus(ctx, inst, id, OrderEventFulfilled, OrderStatusCharged, OrderStatusFulfilled)
 	require.NoError(t, err)
 
 	got, err := inst.GetOrder(ctx, id)
@@ -193,7 +461,7 @@ func TestSetOrderStatus(t *testing.T) {
 	assert.Equal(t, OrderStatusFulfilled, got.Status)
 
 	// returns not found
-	err = inst.SetOrderStatus(ctx, "not found", OrderStatusFulfilled)
+	err = changeTestStatus(ctx, inst, "not found", OrderEventFulfilled, OrderStatusCharged, OrderStatusFulfilled)
 	// assert.Equal returns true if the assertion passes so we can use that as
 	// a conditional around dependent tests so we don't end up having a bunch of
 	// failed assertions
@@ -204,12 +472,406 @@ func TestSetOrderStatus(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+func TestChangeOrderStatusConditions(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	inst.SetClock(testClock)
+	id, err := insertTestOrder(ctx, inst, Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+		},
+		Status: OrderStatusPending,
+	})
+	require.NoError(t, err)
+	// chargeAtVersion charges the order if it's at the version and is charging
+	chargeAtVersion := func(id string, version int64, from OrderStatus) error {
+		_, err := inst.ApplyOrderChange(ctx, OrderChange{
+			Version: version,
+			Event:   OrderEvent{OrderID: id, Type: OrderEventCharged, OldStatus: from, NewStatus: OrderStatusCharged},
+		})
+		return err
+	}
+
+	// updates if the status matches
+	err = changeTestStatus(ctx, inst, id, OrderEventChargeAttempted, OrderStatusPending, OrderStatusCharging)
+	require.NoError(t, err)
+
+	got, err := inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusCharging, got.Status)
+	assert.EqualValues(t, 2, got.Version)
+
+	// returns mismatch and leaves the status alone if the status doesn't match
+	err = changeTestStatus(ctx, inst, id, OrderEventChargeAttempted, OrderStatusPending, OrderStatusCharging)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderStatusMismatch), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusCharging, got.Status)
+
+	// returns not found
+	err = changeTestStatus(ctx, inst, "not found", OrderEventChargeAttempted, OrderStatusPending, OrderStatusCharging)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+
+	// returns version mismatch if the version doesn't match even if the status does
+	err = chargeAtVersion(id, 1, OrderStatusCharging)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderVersionMismatch), "%#v", err)
+	}
+
+	// returns status mismatch if only the status doesn't match
+	err = chargeAtVersion(id, 2, OrderStatusPending)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderStatusMismatch), "%#v", err)
+	}
+
+	// updates if both match
+	err = chargeAtVersion(id, 2, OrderStatusCharging)
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusCharged, got.Status)
+	assert.EqualValues(t, 3, got.Version)
+	// charging the order records when it was charged
+	if assert.NotNil(t, got.ChargedAt) {
+		assert.Equal(t, testNow, *got.ChargedAt)
+	}
+	assert.Equal(t, testNow, got.UpdatedAt)
+	assert.Nil(t, got.CancelledAt)
+
+	// returns not found
+	err = chargeAtVersion("not found", 1, OrderStatusCharging)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestChangeLineItems(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	inst.SetClock(testClock)
+	order := Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+		},
+		Status:    OrderStatusPending,
+		CreatedAt: testNow.Add(-time.Hour),
+	}
+	_, err := insertTestOrder(ctx, inst, order)
+	require.NoError(t, err)
+	// edit replaces the line items of the order if it's at the version, unless
+	// it's 0, and has the status
+	edit := func(id string, version int64, status OrderStatus, lineItems []LineItem) error {
+		_, err := inst.ApplyOrderChange(ctx, OrderChange{
+			LineItems:     lineItems,
+			RequireStatus: true,
+			Version:       version,
+			Event:         OrderEvent{OrderID: id, Type: OrderEventEdited, OldStatus: status, NewStatus: status},
+		})
+		return err
+	}
+
+	// updates if the status matches
+	order.LineItems = []LineItem{
+		{
+			Description: "item 2",
+			Quantity:    3,
+			PriceCents:  200,
+		},
+	}
+	err = edit(order.ID, 0, OrderStatusPending, order.LineItems)
+	require.NoError(t, err)
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	// the insert was version 1 and the update bumped it and set the updated time
+	order.Version = 2
+	order.UpdatedAt = testNow
+	assert.Equal(t, order, got)
+
+	// returns mismatch and leaves the order alone if the status doesn't match
+	err = edit(order.ID, 0, OrderStatusCharged, []LineItem{})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderStatusMismatch), "%#v", err)
+	}
+
+	// returns mismatch and leaves the order alone if the version doesn't match
+	err = edit(order.ID, 1, OrderStatusPending, []LineItem{})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderVersionMismatch), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	// updates if the version matches
+	err = edit(order.ID, 2, OrderStatusPending, []LineItem{})
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Empty(t, got.LineItems)
+	assert.EqualValues(t, 3, got.Version)
+
+	// returns not found
+	err = edit("not found", 0, OrderStatusPending, []LineItem{})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestChangePayment(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	id, err := insertTestOrder(ctx, inst, Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+		},
+		Status: OrderStatusCharging,
+	})
+	require.NoError(t, err)
+
+	// orders don't have a payment until one is set
+	got, err := inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Nil(t, got.Payment)
+
+	payment := Payment{
+		CardToken:   "amex",
+		ChargeID:    "ch_1",
+		AmountCents: 1000,
+		// the time is stored as UTC so we need to make sure the location matches
+		// when comparing
+		ChargedAt: time.Now().UTC(),
+	}
+	setPayment := func(id string) error {
+		_, err := inst.ApplyOrderChange(ctx, OrderChange{
+			Payment: &payment,
+			Event:   OrderEvent{OrderID: id, Type: OrderEventCharged},
+		})
+		return err
+	}
+	err = setPayment(id)
+	require.NoError(t, err)
+
+	got, err = inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	if assert.NotNil(t, got.Payment) {
+		assert.Equal(t, payment, *got.Payment)
+	}
+
+	// returns not found
+	err = setPayment("not found")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestOrderRefunds(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	id, err := insertTestOrder(ctx, inst, Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    2,
+				PriceCents:  500,
+			},
+		},
+		Status: OrderStatusCharged,
+	})
+	require.NoError(t, err)
+
+	// addRefund adds the refund as long as the order's refunds don't add up to
+	// more than 1000 cents and deleteRefund removes it
+	addRefund := func(id string, refund Refund) error {
+		_, err := inst.ApplyOrderChange(ctx, OrderChange{
+			Refund:           &refund,
+			RefundLimitCents: 1000,
+			Event:            OrderEvent{OrderID: id, Type: OrderEventRefunded, RefundID: refund.ID},
+		})
+		return err
+	}
+	deleteRefund := func(id, refundID string) error {
+		_, err := inst.ApplyOrderChange(ctx, OrderChange{
+			DeleteRefundID: refundID,
+			Event:          OrderEvent{OrderID: id, Type: OrderEventRefundFailed, RefundID: refundID},
+		})
+		return err
+	}
+
+	refund1 := Refund{
+		ID:          "re_1",
+		AmountCents: 500,
+		LineItems:   []RefundLineItem{{LineItem: 0, Quantity: 1}},
+		Reason:      "damaged",
+		CreatedAt:   time.Now().UTC(),
+	}
+	err = addRefund(id, refund1)
+	require.NoError(t, err)
+
+	refund2 := Refund{
+		ID:          "re_2",
+		AmountCents: 300,
+		CreatedAt:   time.Now().UTC(),
+	}
+	err = addRefund(id, refund2)
+	require.NoError(t, err)
+
+	got, err := inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, []Refund{refund1, refund2}, got.Refunds)
+	assert.EqualValues(t, 800, got.RefundedCents())
+
+	// refunds can't add up to more than the limit
+	err = addRefund(id, Refund{ID: "re_3", AmountCents: 201})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrRefundExceedsCharge), "%#v", err)
+	}
+
+	// deleting a refund frees up the amount again
+	err = deleteRefund(id, refund1.ID)
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, []Refund{refund2}, got.Refunds)
+
+	err = deleteRefund(id, refund1.ID)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrRefundNotFound), "%#v", err)
+	}
+
+	// returns not found
+	err = addRefund("not found", refund1)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+	err = deleteRefund("not found", refund1.ID)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestChangeLineItemFulfillment(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	id, err := insertTestOrder(ctx, inst, Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+			{
+				Description: "item 2",
+				Quantity:    10,
+				PriceCents:  5000,
+			},
+		},
+		Status: OrderStatusCharged,
+	})
+	require.NoError(t, err)
+
+	// fully fulfills the first line item
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Fulfillments: []LineItemFulfillment{{LineItem: 0, Quantity: 1}},
+		Event:        OrderEvent{OrderID: id, Type: OrderEventPartiallyFulfilled},
+	})
+	require.NoError(t, err)
+	// partially fulfills the second line item
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Fulfillments: []LineItemFulfillment{{LineItem: 1, Quantity: 4}},
+		Event:        OrderEvent{OrderID: id, Type: OrderEventPartiallyFulfilled},
+	})
+	require.NoError(t, err)
+
+	got, err := inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	if assert.Len(t, got.LineItems, 2) {
+		assert.Equal(t, LineItemStatusFulfilled, got.LineItems[0].FulfillmentStatus)
+		assert.EqualValues(t, 1, got.LineItems[0].FulfilledQuantity)
+		assert.Equal(t, LineItemStatusPartiallyFulfilled, got.LineItems[1].FulfillmentStatus)
+		assert.EqualValues(t, 4, got.LineItems[1].FulfilledQuantity)
+	}
+	// the rest of the order should be untouched
+	assert.Equal(t, OrderStatusCharged, got.Status)
+	assert.Equal(t, "item 2", got.LineItems[1].Description)
+
+	// returns line item not found
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Fulfillments: []LineItemFulfillment{{LineItem: 2, Quantity: 1}},
+		Event:        OrderEvent{OrderID: id, Type: OrderEventPartiallyFulfilled},
+	})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrLineItemNotFound), "%#v", err)
+	}
+
+	// returns not found
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Fulfillments: []LineItemFulfillment{{LineItem: 0, Quantity: 1}},
+		Event:        OrderEvent{OrderID: "not found", Type: OrderEventPartiallyFulfilled},
+	})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 func TestInsertOrder(t *testing.T) {
 	// the context isn't meaningful for these tests so we just use a new one
 	ctx := context.Background()
 	// make a new instance with a random database so this test is isolated from
 	// the others
-	inst := New(randomDatabase())
+	inst := mustNew(t, randomDatabase())
+	inst.SetClock(testClock)
 	order1 := Order{
 		ID:            "test1",
 		CustomerEmail: "test@test",
@@ -227,7 +889,7 @@ func TestInsertOrder(t *testing.T) {
 		},
 		Status: OrderStatusCharged,
 	}
-	id, err := inst.InsertOrder(ctx, order1)
+	id, err := insertTestOrder(ctx, inst, order1)
 	// the require package fails the whole test immediately if this fails which is
 	// useful for unexpected errors since the rest of the test will presumably fail
 	// if we can't do this
@@ -235,7 +897,7 @@ func TestInsertOrder(t *testing.T) {
 	assert.Equal(t, order1.ID, id)
 
 	// returns exists
-	_, err = inst.InsertOrder(ctx, order1)
+	_, err = insertTestOrder(ctx, inst, order1)
 	// assert.Equal returns true if the assertion passes so we can use that as
 	// a conditional around dependent tests so we don't end up having a bunch of
 	// failed assertions
@@ -248,13 +910,69 @@ func TestInsertOrder(t *testing.T) {
 		CustomerEmail: "test@test",
 		Status:        OrderStatusCharged,
 	}
-	id, err = inst.InsertOrder(ctx, order2)
+	id, err = insertTestOrder(ctx, inst, order2)
 	require.NoError(t, err)
 	if assert.NotEmpty(t, id) {
 		order2.ID = id
+		// orders always come back with a non-nil slice of line items
+		order2.LineItems = []LineItem{}
+		// new orders start at the first version and are created now
+		order2.Version = 1
+		order2.CreatedAt = testNow
+		order2.UpdatedAt = testNow
 
 		got, err := inst.GetOrder(ctx, id)
 		require.NoError(t, err)
 		assert.Equal(t, order2, got)
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestIdempotencyKeys(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// make a new instance with a random database so this test is isolated from
+	// the others
+	inst := mustNew(t, randomDatabase())
+	key := IdempotencyKey{
+		Key:         "key1",
+		Route:       "POST /orders",
+		RequestHash: "hash",
+	}
+
+	// inserts a new key
+	got, err := inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	// returns the in-progress key if it already exists
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrIdempotencyKeyExists), "%#v", err)
+	}
+	assert.Equal(t, key, got)
+
+	// the same key on a different route is a different key
+	other := key
+	other.Route = "POST /orders/test/charge"
+	_, err = inst.InsertIdempotencyKey(ctx, other)
+	require.NoError(t, err)
+
+	// returns the completed response if it already exists
+	err = inst.CompleteIdempotencyKey(ctx, key.Key, key.Route, 201, []byte(`{"order":{}}`), time.Time{})
+	require.NoError(t, err)
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrIdempotencyKeyExists), "%#v", err)
+	}
+	assert.True(t, got.Completed)
+	assert.Equal(t, 201, got.StatusCode)
+	assert.Equal(t, `{"order":{}}`, string(got.Body))
+
+	// can be inserted again after being deleted
+	err = inst.DeleteIdempotencyKey(ctx, key.Key, key.Route)
+	require.NoError(t, err)
+	_, err = inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+}
@@ -0,0 +1,117 @@
+package storage
+
+import "time"
+
+// OrderEventType describes what happened to an order in an OrderEvent
+type OrderEventType string
+
+const (
+	// OrderEventCreated means the order was created
+	OrderEventCreated OrderEventType = "created"
+
+	// OrderEventEdited means the order's line items were replaced while it was
+	// pending
+	OrderEventEdited OrderEventType = "edited"
+
+	// OrderEventChargeAttempted means the order was marked as charging right
+	// before the charge service was called
+	OrderEventChargeAttempted OrderEventType = "charge_attempted"
+
+	// OrderEventCharged means the customer was charged, or there was nothing to
+	// charge, and the order was marked as charged
+	OrderEventCharged OrderEventType = "charged"
+
+	// OrderEventChargeFailed means the charge service failed to charge the
+	// customer. If the charge service rejected the charge with a 4xx then the
+	// order is moved back to pending but if we don't know whether the customer was
+	// charged then it's left as charging.
+	OrderEventChargeFailed OrderEventType = "charge_failed"
+
+	// OrderEventCancelled means the order was cancelled. A charged order's refund
+	// is recorded along with the cancellation before the charge service is
+	// called.
+	OrderEventCancelled OrderEventType = "cancelled"
+
+	// OrderEventCancellationFailed means refunding a cancelled order failed so its
+	// refund was removed and the order was moved back to charged
+	OrderEventCancellationFailed OrderEventType = "cancellation_failed"
+
+	// OrderEventRefunded means some or all of the order's payment was refunded.
+	// It's recorded along with the refund before the charge service is called.
+	OrderEventRefunded OrderEventType = "refunded"
+
+	// OrderEventRefundFailed means the charge service failed to refund the
+	// customer so the refund was removed from the order
+	OrderEventRefundFailed OrderEventType = "refund_failed"
+
+	// OrderEventFulfillmentStarted means the order was marked as fulfilling
+	// before any of its line items were sent to the fulfillment service
+	OrderEventFulfillmentStarted OrderEventType = "fulfillment_started"
+
+	// OrderEventPartiallyFulfilled means one of the order's line items was
+	// recorded as fulfilled right before it was sent to the fulfillment service
+	OrderEventPartiallyFulfilled OrderEventType = "partially_fulfilled"
+
+	// OrderEventFulfillmentFailed means the fulfillment service failed to fulfill
+	// a line item so the line item was recorded as unfulfilled again and the
+	// order was moved back to charged or partially fulfilled
+	OrderEventFulfillmentFailed OrderEventType = "fulfillment_failed"
+
+	// OrderEventFulfilled means every line item was sent to the fulfillment
+	// service, or there were none left to fulfill, and the order was marked as
+	// fulfilled
+	OrderEventFulfilled OrderEventType = "fulfilled"
+)
+
+// OrderEventTypes are all of the types of order events
+var OrderEventTypes = []OrderEventType{
+	OrderEventCreated,
+	OrderEventEdited,
+	OrderEventChargeAttempted,
+	OrderEventCharged,
+	OrderEventChargeFailed,
+	OrderEventCancelled,
+	OrderEventCancellationFailed,
+	OrderEventRefunded,
+	OrderEventRefundFailed,
+	OrderEventFulfillmentStarted,
+	OrderEventPartiallyFulfilled,
+	OrderEventFulfillmentFailed,
+	OrderEventFulfilled,
+}
+
+// OrderEvent records a single change made to an order, and who made it, so an
+// order's history can be audited. Events are only ever appended and never
+// changed once they're stored.
+type OrderEvent struct {
+	// ID is assigned when the event is stored and is larger for every event
+	// stored after it, across all orders
+	ID int64 `json:"id"`
+	// OrderID is the ID of the order that was changed
+	OrderID string `json:"orderId"`
+	// Type is what happened to the order
+	Type OrderEventType `json:"type"`
+	// Actor is who made the change
+	Actor string `json:"actor"`
+	// RequestID is the X-Request-ID of the request that made the change and is
+	// empty for changes that weren't made by a request
+	RequestID string `json:"requestId,omitempty"`
+	// OldStatus and NewStatus are the order's status before and after the change
+	// which are the same if the change didn't affect the status
+	OldStatus OrderStatus `json:"oldStatus"`
+	NewStatus OrderStatus `json:"newStatus"`
+	// AmountCents is the money involved in the change. It's the order's total for
+	// creations, edits and charges, the amount refunded for refunds and
+	// cancellations and 0 if no money was involved.
+	AmountCents int64 `json:"amountCents"`
+	// ChargeID is the charge service's ID for the charge if the event was for a
+	// successful charge
+	ChargeID string `json:"chargeId,omitempty"`
+	// RefundID is the ID of the order's refund if the event was for a refund
+	RefundID string `json:"refundId,omitempty"`
+	// Detail optionally describes why the change happened, like the error for a
+	// failed charge
+	Detail string `json:"detail,omitempty"`
+	// CreatedAt is when the change was made
+	CreatedAt time.Time `json:"createdAt"`
+}
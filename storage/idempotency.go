@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIdempotencyKeyExists is returned when an idempotency key is being inserted
+// but a record for the same key and route already exists
+var ErrIdempotencyKeyExists = errors.New("idempotency key already exists")
+
+// IdempotencyKey records the first request made with a given Idempotency-Key
+// header on a route so that retries of that request can be answered with the
+// original response instead of being processed again
+type IdempotencyKey struct {
+	// Key is the value the client sent in the Idempotency-Key header
+	Key string
+	// Route is the method and path the key was used on so the same key can be
+	// reused across different routes
+	Route string
+	// RequestHash is a hash of the original request body so we can detect a
+	// client reusing a key for a different request
+	RequestHash string
+	// Completed is false while the original request is still being processed
+	Completed bool
+	// StatusCode is the HTTP status code of the original response
+	StatusCode int
+	// Body is the body of the original response
+	Body []byte
+	// ExpiresAt is when the key stops being used, which for a key that's still in
+	// progress is when another request can take it over in case the original
+	// request never finished and for a completed key is when its response stops
+	// being replayed and it can be deleted. The key never expires if it's zero.
+	ExpiresAt time.Time
+}
+
+// expired returns true if the key has expired at now
+func (k IdempotencyKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !k.ExpiresAt.After(now)
+}
+
+// expiresAtPointer returns a pointer to the expiry for storing in a nullable
+// column, which is NULL if the key never expires
+func expiresAtPointer(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// journalFile is the name of the journal in a durable MemoryInstance's
+	// directory
+	journalFile = "journal.log"
+	// snapshotFile is the name of the latest snapshot in a durable
+	// MemoryInstance's directory
+	snapshotFile = "snapshot.json"
+	// journalHeaderSize is the size of the length and checksum that come before
+	// every record in the journal
+	journalHeaderSize = 8
+)
+
+// ErrJournalCorrupt is returned when opening a durable MemoryInstance whose
+// journal has a damaged record that isn't at the end of the journal, which a
+// crash can't cause
+var ErrJournalCorrupt = errors.New("journal is corrupt")
+
+// durableOrder is how orders are written to the journal and snapshots. An
+// Order's JSON leaves out the card token so it's never returned to API callers
+// but it still needs to survive a restart.
+type durableOrder struct {
+	Order
+	CardToken string `json:"cardToken,omitempty"`
+}
+
+// newDurableOrder returns the order ready to be written to the journal or a
+// snapshot
+func newDurableOrder(order Order) durableOrder {
+	d := durableOrder{Order: order}
+	if order.Payment != nil {
+		d.CardToken = order.Payment.CardToken
+	}
+	return d
+}
+
+// order returns the order that was written to the journal or a snapshot
+func (d durableOrder) order() Order {
+	order := d.Order.clone()
+	if order.Payment != nil {
+		order.Payment.CardToken = d.CardToken
+	}
+	return order
+}
+
+// durableWebhookSubscription is how webhook subscriptions are written to the
+// journal and snapshots. A WebhookSubscription's JSON leaves out the secret for
+// the same reason an Order's leaves out the card token.
+type durableWebhookSubscription struct {
+	WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+// newDurableWebhookSubscription returns the subscription ready to be written to
+// the journal or a snapshot
+func newDurableWebhookSubscription(sub WebhookSubscription) durableWebhookSubscription {
+	return durableWebhookSubscription{WebhookSubscription: sub, Secret: sub.Secret}
+}
+
+// subscription returns the subscription that was written to the journal or a
+// snapshot
+func (d durableWebhookSubscription) subscription() WebhookSubscription {
+	sub := d.WebhookSubscription.clone()
+	sub.Secret = d.Secret
+	return sub
+}
+
+// journalEntry is a single record in the journal. Exactly one of the fields is
+// set, other than WebhookDeliveries which are only set alongside Event and Order
+// which can be set alongside Event when they were changed together. Entries hold
+// the whole order or key after the change rather than the change itself so that
+// replaying an entry more than once is harmless.
+type journalEntry struct {
+	// Order is an order after it was inserted or changed
+	Order *durableOrder `json:"order,omitempty"`
+	// IdempotencyKey is a key after it was inserted or completed
+	IdempotencyKey *IdempotencyKey `json:"idempotencyKey,omitempty"`
+	// DeletedIdempotencyKey is a key that was deleted and only has its Key and
+	// Route set
+	DeletedIdempotencyKey *IdempotencyKey `json:"deletedIdempotencyKey,omitempty"`
+	// Event is an order event that was inserted. Events are never changed so
+	// replaying one that was already applied is detected by its ID.
+	Event *OrderEvent `json:"event,omitempty"`
+	// WebhookDeliveries are the deliveries created for Event
+	WebhookDeliveries []WebhookDelivery `json:"webhookDeliveries,omitempty"`
+	// WebhookSubscription is a webhook subscription after it was inserted
+	WebhookSubscription *durableWebhookSubscription `json:"webhookSubscription,omitempty"`
+	// DeletedWebhookSubscription is the ID of a webhook subscription that was
+	// deleted along with its deliveries
+	DeletedWebhookSubscription string `json:"deletedWebhookSubscription,omitempty"`
+	// WebhookDelivery is a webhook delivery after it was updated
+	WebhookDelivery *WebhookDelivery `json:"webhookDelivery,omitempty"`
+}
+
+// snapshot is every order, idempotency key, order event and webhook at the time
+// it was written
+type snapshot struct {
+	Orders          []durableOrder   `json:"orders"`
+	IdempotencyKeys []IdempotencyKey `json:"idempotencyKeys"`
+	// Events are in the order they were inserted
+	Events               []OrderEvent                 `json:"events"`
+	WebhookSubscriptions []durableWebhookSubscription `json:"webhookSubscriptions"`
+	WebhookDeliveries    []WebhookDelivery            `json:"webhookDeliveries"`
+	// LastWebhookDeliveryID is kept separately since the latest delivery might
+	// have been deleted and its ID mustn't be reused
+	LastWebhookDeliveryID int64 `json:"lastWebhookDeliveryId"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// journal is an append-only file of the changes made since the last snapshot.
+// Every record is a big-endian uint32 length and CRC-32 checksum of the payload
+// followed by the payload, which is a JSON-encoded journalEntry.
+type journal struct {
+	f *os.File
+	// size is the offset just past the last complete record
+	size int64
+	// records is how many records are in the journal
+	records int
+}
+
+// openJournal opens the journal at path, creating it if it doesn't exist, and
+// calls fn with every entry in it. A record at the end of the journal that was
+// only partly written when the process crashed is ignored and removed so that
+// new records aren't appended after it.
+func openJournal(path string, fn func(journalEntry)) (*journal, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	j := &journal{f: f}
+	fileSize, err := j.replay(fn)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	var dropped int64
+	if fileSize > j.size {
+		dropped = fileSize - j.size
+		if err := j.truncate(j.size); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	return j, dropped, nil
+}
+
+// replay reads every complete record from the start of the journal, setting
+// size and records as it goes, and returns the size of the file
+func (j *journal) replay(fn func(journalEntry)) (int64, error) {
+	info, err := j.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := info.Size()
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(j.f)
+	header := make([]byte, journalHeaderSize)
+	for {
+		// a header or payload that runs past the end of the file was cut off by a
+		// crash
+		if j.size+journalHeaderSize > fileSize {
+			return fileSize, nil
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		end := j.size + journalHeaderSize + length
+		if end > fileSize {
+			return fileSize, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, err
+		}
+
+		var entry journalEntry
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) || json.Unmarshal(payload, &entry) != nil {
+			// the file's size can be updated before the payload is so the last
+			// record might be the right length but hold garbage
+			if end == fileSize {
+				return fileSize, nil
+			}
+			return 0, fmt.Errorf("%w: bad record at offset %d", ErrJournalCorrupt, j.size)
+		}
+		fn(entry)
+		j.size = end
+		j.records++
+	}
+}
+
+// append writes the entry to the end of the journal and waits for it to reach
+// the disk
+func (j *journal) append(entry journalEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[journalHeaderSize:], payload)
+
+	if _, err := j.f.Write(record); err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		// a partly written record would end up in the middle of the journal once
+		// the next record is appended so it's removed
+		if terr := j.truncate(j.size); terr != nil {
+			return fmt.Errorf("error removing partial journal record after %v: %w", err, terr)
+		}
+		return fmt.Errorf("error writing journal record: %w", err)
+	}
+	j.size += int64(len(record))
+	j.records++
+	return nil
+}
+
+// truncate cuts the journal off at size
+func (j *journal) truncate(size int64) error {
+	if err := j.f.Truncate(size); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.size = size
+	return nil
+}
+
+// reset removes every record from the journal once they're in a snapshot
+func (j *journal) reset() error {
+	if err := j.truncate(0); err != nil {
+		return err
+	}
+	j.records = 0
+	return nil
+}
+
+// Close closes the journal's file
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// readSnapshot reads the snapshot in dir. If there isn't one then an empty
+// snapshot is returned.
+func readSnapshot(dir string) (snapshot, error) {
+	var snap snapshot
+	b, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	} else if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return snap, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// writeSnapshot replaces the snapshot in dir. The snapshot is written to a
+// temporary file that's renamed over the old one so a crash never leaves a
+// partly written snapshot behind.
+func writeSnapshot(dir string, snap snapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// the rename itself isn't durable until the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
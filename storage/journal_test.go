@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mustOpenMemory opens a durable memory instance in dir that's closed when the
+// test ends unless crash was called on it
+func mustOpenMemory(t *testing.T, dir string, opts ...MemoryOption) *MemoryInstance {
+	inst, err := OpenMemory(dir, opts...)
+	require.NoError(t, err)
+	inst.SetClock(testClock)
+	t.Cleanup(func() {
+		inst.Close()
+	})
+	return inst
+}
+
+// crash closes the instance's journal without writing a snapshot, like the
+// process was killed
+func crash(t *testing.T, inst *MemoryInstance) {
+	inst.m.Lock()
+	defer inst.m.Unlock()
+	require.NoError(t, inst.journal.Close())
+	inst.journal = nil
+}
+
+// journalSize returns the size of the journal in dir
+func journalSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, journalFile))
+	require.NoError(t, err)
+	return info.Size()
+}
+
+// testJournalOrder returns a new order for the journal tests
+func testJournalOrder(id string) Order {
+	return Order{
+		ID:            id,
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+		},
+		Status: OrderStatusPending,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestOpenMemory(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "memory")
+
+	inst := mustOpenMemory(t, dir)
+	_, err := insertTestOrder(ctx, inst, testJournalOrder("test1"))
+	require.NoError(t, err)
+	// the card token isn't in an order's JSON but still has to be kept
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Payment: &Payment{
+			CardToken:   "token",
+			ChargeID:    "charge1",
+			AmountCents: 1000,
+			ChargedAt:   testNow,
+		},
+		Event: OrderEvent{OrderID: "test1", Type: OrderEventCharged, OldStatus: OrderStatusPending, NewStatus: OrderStatusCharged},
+	})
+	require.NoError(t, err)
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Fulfillments: []LineItemFulfillment{{LineItem: 0, Quantity: 1}},
+		Event:        OrderEvent{OrderID: "test1", Type: OrderEventFulfilled, OldStatus: OrderStatusCharged, NewStatus: OrderStatusFulfilled},
+	})
+	require.NoError(t, err)
+	_, err = insertTestOrder(ctx, inst, testJournalOrder("test2"))
+	require.NoError(t, err)
+
+	key := IdempotencyKey{Key: "key1", Route: "POST /orders", RequestHash: "hash"}
+	_, err = inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	expiresAt := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, inst.CompleteIdempotencyKey(ctx, key.Key, key.Route, 201, []byte("body"), expiresAt))
+	deleted := IdempotencyKey{Key: "key2", Route: "POST /orders", RequestHash: "hash"}
+	_, err = inst.InsertIdempotencyKey(ctx, deleted)
+	require.NoError(t, err)
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, deleted.Key, deleted.Route))
+
+	expected1, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	expected2, err := inst.GetOrder(ctx, "test2")
+	require.NoError(t, err)
+	crash(t, inst)
+
+	// everything is replayed from the journal
+	inst = mustOpenMemory(t, dir)
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected1, got)
+	assert.Equal(t, "token", got.Payment.CardToken)
+	got, err = inst.GetOrder(ctx, "test2")
+	require.NoError(t, err)
+	assert.Equal(t, expected2, got)
+
+	gotKey, err := inst.InsertIdempotencyKey(ctx, key)
+	assert.True(t, errors.Is(err, ErrIdempotencyKeyExists), "%#v", err)
+	assert.Equal(t, IdempotencyKey{
+		Key:         key.Key,
+		Route:       key.Route,
+		RequestHash: key.RequestHash,
+		Completed:   true,
+		StatusCode:  201,
+		Body:        []byte("body"),
+		ExpiresAt:   expiresAt,
+	}, gotKey)
+	_, err = inst.InsertIdempotencyKey(ctx, deleted)
+	assert.NoError(t, err)
+
+	// the replayed journal was compacted into a snapshot when it was opened
+	assert.FileExists(t, filepath.Join(dir, snapshotFile))
+
+	// closing writes a snapshot so the journal is empty and the next open only
+	// needs the snapshot
+	require.NoError(t, inst.Close())
+	assert.Equal(t, int64(0), journalSize(t, dir))
+	inst = mustOpenMemory(t, dir)
+	got, err = inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected1, got)
+}
+
+func TestOpenMemorySnapshots(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir, WithSnapshotEvery(3))
+	for _, id := range []string{"test1", "test2", "test3"} {
+		_, err := insertTestOrder(ctx, inst, testJournalOrder(id))
+		require.NoError(t, err)
+	}
+	// the third change wrote a snapshot and emptied the journal
+	assert.FileExists(t, filepath.Join(dir, snapshotFile))
+	assert.Equal(t, int64(0), journalSize(t, dir))
+
+	require.NoError(t, changeTestStatus(ctx, inst, "test1", OrderEventCancelled, OrderStatusPending, OrderStatusCancelled))
+	_, err := insertTestOrder(ctx, inst, testJournalOrder("test4"))
+	require.NoError(t, err)
+	assert.NotEqual(t, int64(0), journalSize(t, dir))
+	crash(t, inst)
+
+	// the journal is replayed on top of the snapshot
+	inst = mustOpenMemory(t, dir)
+	orders, _, err := inst.GetOrders(ctx, OrderQuery{}, Page{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 4)
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusCancelled, got.Status)
+	assert.Equal(t, int64(2), got.Version)
+}
+
+func TestOpenMemoryEvents(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir)
+	order := testJournalOrder("test1")
+	created, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Insert: &order,
+		Event:  OrderEvent{Type: OrderEventCreated, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	edited, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{OrderID: "test1", Type: OrderEventEdited, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	expected := []OrderEvent{created, edited}
+
+	// a crash after the snapshot was written but before the journal was emptied
+	// leaves the events in both and they shouldn't be replayed twice
+	journal, err := os.ReadFile(filepath.Join(dir, journalFile))
+	require.NoError(t, err)
+	require.NoError(t, inst.Snapshot())
+	crash(t, inst)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, journalFile), journal, 0o644))
+	inst = mustOpenMemory(t, dir)
+	events, err := inst.GetOrderEvents(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, events)
+
+	// IDs keep increasing after a restart
+	event, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{OrderID: "test1", Type: OrderEventEdited, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	assert.Greater(t, event.ID, expected[len(expected)-1].ID)
+	expected = append(expected, event)
+	require.NoError(t, inst.Close())
+
+	inst = mustOpenMemory(t, dir)
+	events, err = inst.GetOrderEvents(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, events)
+}
+
+func TestOpenMemoryOrderChanges(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir)
+	order := testJournalOrder("test1")
+	created, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Insert: &order,
+		Event:  OrderEvent{Type: OrderEventCreated, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	charging, err := inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{
+			OrderID:   "test1",
+			Type:      OrderEventChargeAttempted,
+			Actor:     "alice",
+			OldStatus: OrderStatusPending,
+			NewStatus: OrderStatusCharging,
+		},
+	})
+	require.NoError(t, err)
+	expected, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+
+	// the order and its events are journaled together so replaying the journal
+	// restores both
+	crash(t, inst)
+	inst = mustOpenMemory(t, dir)
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+	assert.Equal(t, OrderStatusCharging, got.Status)
+	events, err := inst.GetOrderEvents(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, []OrderEvent{created, charging}, events)
+}
+
+func TestOpenMemoryWebhooks(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir)
+	_, err := insertTestOrder(ctx, inst, testJournalOrder("test1"))
+	require.NoError(t, err)
+	sub1, err := inst.InsertWebhookSubscription(ctx, WebhookSubscription{URL: "http://localhost/1", Secret: "secret1"})
+	require.NoError(t, err)
+	sub2, err := inst.InsertWebhookSubscription(ctx, WebhookSubscription{URL: "http://localhost/2", Secret: "secret2"})
+	require.NoError(t, err)
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{OrderID: "test1", Type: OrderEventEdited, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	deliveries, err := inst.GetWebhookDeliveries(ctx, WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	deliveries[0].Status = WebhookDeliveryDead
+	deliveries[0].Attempts = 3
+	require.NoError(t, inst.UpdateWebhookDelivery(ctx, deliveries[0], WebhookDeliveryPending))
+
+	// the secrets and deliveries survive replaying the journal, even though
+	// they're left out of the subscriptions' JSON
+	crash(t, inst)
+	inst = mustOpenMemory(t, dir)
+	subs, err := inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []WebhookSubscription{sub1, sub2}, subs)
+	got, err := inst.GetWebhookDeliveries(ctx, WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, deliveries, got)
+
+	// deleting the subscription with the latest delivery doesn't let its ID be
+	// reused after a restart
+	latest := deliveries[1]
+	sub := sub1
+	if latest.SubscriptionID == sub1.ID {
+		sub = sub2
+	}
+	require.NoError(t, inst.DeleteWebhookSubscription(ctx, latest.SubscriptionID))
+	require.NoError(t, inst.Close())
+
+	inst = mustOpenMemory(t, dir)
+	subs, err = inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []WebhookSubscription{sub}, subs)
+	_, err = inst.ApplyOrderChange(ctx, OrderChange{
+		Event: OrderEvent{OrderID: "test1", Type: OrderEventEdited, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	got, err = inst.GetWebhookDeliveries(ctx, WebhookDeliveryQuery{Status: WebhookDeliveryPending})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Greater(t, got[0].ID, latest.ID)
+		assert.Equal(t, sub.ID, got[0].SubscriptionID)
+	}
+}
+
+func TestOpenMemoryTruncatedJournal(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+
+	// cut is how many bytes are cut off the end of the second record
+	for _, cut := range []int64{1, 10, -journalHeaderSize + 1, -1} {
+		dir := t.TempDir()
+		inst := mustOpenMemory(t, dir)
+		_, err := insertTestOrder(ctx, inst, testJournalOrder("test1"))
+		require.NoError(t, err)
+		firstSize := journalSize(t, dir)
+		_, err = insertTestOrder(ctx, inst, testJournalOrder("test2"))
+		require.NoError(t, err)
+		crash(t, inst)
+
+		size := journalSize(t, dir)
+		if cut < 0 {
+			// a negative cut leaves -cut bytes of the second record
+			require.NoError(t, os.Truncate(filepath.Join(dir, journalFile), firstSize-cut))
+		} else {
+			require.NoError(t, os.Truncate(filepath.Join(dir, journalFile), size-cut))
+		}
+
+		// the partial record is ignored
+		inst = mustOpenMemory(t, dir)
+		_, err = inst.GetOrder(ctx, "test1")
+		assert.NoError(t, err, "cut %d", cut)
+		_, err = inst.GetOrder(ctx, "test2")
+		assert.True(t, errors.Is(err, ErrOrderNotFound), "cut %d: %#v", cut, err)
+
+		// and new records aren't lost behind it
+		_, err = insertTestOrder(ctx, inst, testJournalOrder("test3"))
+		require.NoError(t, err)
+		crash(t, inst)
+		inst = mustOpenMemory(t, dir)
+		_, err = inst.GetOrder(ctx, "test3")
+		assert.NoError(t, err, "cut %d", cut)
+	}
+}
+
+func TestOpenMemoryCorruptJournal(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir)
+	_, err := insertTestOrder(ctx, inst, testJournalOrder("test1"))
+	require.NoError(t, err)
+	firstSize := journalSize(t, dir)
+	_, err = insertTestOrder(ctx, inst, testJournalOrder("test2"))
+	require.NoError(t, err)
+	crash(t, inst)
+
+	path := filepath.Join(dir, journalFile)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// garbage in the last record is from a torn write and is ignored
+	b[len(b)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0o644))
+	inst = mustOpenMemory(t, dir)
+	_, err = inst.GetOrder(ctx, "test1")
+	assert.NoError(t, err)
+	_, err = inst.GetOrder(ctx, "test2")
+	assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+	crash(t, inst)
+
+	// garbage in an earlier record can't be from a crash so opening fails rather
+	// than silently losing the records after it
+	record := append([]byte(nil), b[:firstSize]...)
+	b = append([]byte(nil), record...)
+	b[firstSize-2] ^= 0xff
+	b = append(b, record...)
+	require.NoError(t, os.WriteFile(path, b, 0o644))
+	_, err = OpenMemory(dir)
+	assert.True(t, errors.Is(err, ErrJournalCorrupt), "%#v", err)
+}
+
+func TestOpenMemoryClosed(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	inst := mustOpenMemory(t, dir)
+	_, err := insertTestOrder(ctx, inst, testJournalOrder("test1"))
+	require.NoError(t, err)
+	require.NoError(t, inst.Close())
+
+	// changes after closing would only be made in memory so they're refused
+	_, err = insertTestOrder(ctx, inst, testJournalOrder("test2"))
+	assert.True(t, errors.Is(err, ErrClosed), "%#v", err)
+	_, err = inst.InsertIdempotencyKey(ctx, IdempotencyKey{Key: "key1", Route: "POST /orders"})
+	assert.True(t, errors.Is(err, ErrClosed), "%#v", err)
+	_, err = inst.GetOrder(ctx, "test2")
+	assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+
+	// closing again does nothing
+	assert.NoError(t, inst.Close())
+	inst = mustOpenMemory(t, dir)
+	_, err = inst.GetOrder(ctx, "test1")
+	assert.NoError(t, err)
+	_, err = inst.GetOrder(ctx, "test2")
+	assert.True(t, errors.Is(err, ErrOrderNotFound), "%#v", err)
+}
@@ -2,22 +2,331 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/levenlabs/go-llog"
 )
 
+// ErrClosed is returned when a MemoryInstance is changed after it was closed
+var ErrClosed = errors.New("storage is closed")
+
 // MemoryInstance is an in-memory implementation of the StorageInstance interface.
+// Orders are copied going in and coming out so callers can never change a stored
+// order without going through one of the methods. Orders are lost when the
+// process stops unless the instance was opened with OpenMemory.
 type MemoryInstance struct {
-	m      sync.RWMutex
-	orders map[string]Order
+	m               sync.RWMutex
+	orders          map[string]Order
+	idempotencyKeys map[idempotencyKeyID]IdempotencyKey
+	now             Clock
+
+	// events are the order events for each order ID in the order they were
+	// inserted and lastEventID is the ID of the most recently inserted event
+	events      map[string][]OrderEvent
+	lastEventID int64
+
+	// subscriptions and deliveries are the webhook subscriptions and deliveries
+	// by their IDs and lastDeliveryID is the ID of the most recently created
+	// delivery
+	subscriptions  map[string]WebhookSubscription
+	deliveries     map[int64]WebhookDelivery
+	lastDeliveryID int64
+
+	// dir and journal are only set if the instance was opened with OpenMemory in
+	// which case every change is appended to the journal before it's made
+	dir           string
+	journal       *journal
+	snapshotEvery int
+
+	// closed is set by Close after which changes return ErrClosed
+	closed bool
+}
+
+// idempotencyKeyID is the map key for idempotencyKeys since keys are unique per
+// route
+type idempotencyKeyID struct {
+	key   string
+	route string
 }
 
 // NewMemory returns a new in-memory storage instance.
 func NewMemory() *MemoryInstance {
 	return &MemoryInstance{
-		orders: make(map[string]Order),
+		orders:          make(map[string]Order),
+		idempotencyKeys: make(map[idempotencyKeyID]IdempotencyKey),
+		now:             time.Now,
+		events:          make(map[string][]OrderEvent),
+		subscriptions:   make(map[string]WebhookSubscription),
+		deliveries:      make(map[int64]WebhookDelivery),
+	}
+}
+
+// DefaultSnapshotEvery is how many changes a durable MemoryInstance journals
+// before it writes a new snapshot and empties the journal
+const DefaultSnapshotEvery = 1000
+
+// memoryOptions holds the settings that can be changed with a MemoryOption
+type memoryOptions struct {
+	snapshotEvery int
+}
+
+// MemoryOption changes how OpenMemory persists changes
+type MemoryOption func(*memoryOptions)
+
+// WithSnapshotEvery sets how many changes are journaled before a new snapshot is
+// written and the journal is emptied. The default is DefaultSnapshotEvery.
+// Every read and change waits for a snapshot to be written, which takes longer
+// the more the instance holds, so a lower n bounds how long the journal gets, and
+// how long opening takes, at the cost of those waits happening more often.
+func WithSnapshotEvery(n int) MemoryOption {
+	return func(o *memoryOptions) {
+		o.snapshotEvery = n
+	}
+}
+
+// OpenMemory returns an in-memory storage instance whose changes survive
+// restarts. Every change is appended to a journal in dir, and synced to disk,
+// before it's made and every so often the journal is compacted into a snapshot.
+// Opening loads the latest snapshot and then replays the journal on top of it.
+// The directory is created if it doesn't exist and must only be used by one
+// instance at a time.
+func OpenMemory(dir string, opts ...MemoryOption) (*MemoryInstance, error) {
+	o := memoryOptions{
+		snapshotEvery: DefaultSnapshotEvery,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating memory directory: %w", err)
+	}
+	snap, err := readSnapshot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot in %s: %w", dir, err)
+	}
+
+	i := NewMemory()
+	i.dir = dir
+	i.snapshotEvery = o.snapshotEvery
+	for _, d := range snap.Orders {
+		i.orders[d.ID] = d.order()
+	}
+	for _, key := range snap.IdempotencyKeys {
+		i.idempotencyKeys[idempotencyKeyID{key: key.Key, route: key.Route}] = key
+	}
+	for _, event := range snap.Events {
+		i.appendEvent(event)
+	}
+	for _, d := range snap.WebhookSubscriptions {
+		i.subscriptions[d.ID] = d.subscription()
+	}
+	for _, delivery := range snap.WebhookDeliveries {
+		i.putDelivery(delivery)
+	}
+	if snap.LastWebhookDeliveryID > i.lastDeliveryID {
+		i.lastDeliveryID = snap.LastWebhookDeliveryID
+	}
+
+	j, dropped, err := openJournal(filepath.Join(dir, journalFile), i.applyJournalEntry)
+	if err != nil {
+		return nil, fmt.Errorf("error replaying journal in %s: %w", dir, err)
+	}
+	if dropped > 0 {
+		llog.Warn("ignored partly written journal record", llog.KV{"dir": dir, "bytes": dropped})
+	}
+	i.journal = j
+
+	// starting with an empty journal means the journal only ever has to be
+	// replayed once
+	if j.records > 0 {
+		if err := i.Snapshot(); err != nil {
+			j.Close()
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// applyJournalEntry makes the change recorded in the entry
+func (i *MemoryInstance) applyJournalEntry(entry journalEntry) {
+	// an order can be journaled alongside the event that records its change
+	if entry.Order != nil {
+		i.orders[entry.Order.ID] = entry.Order.order()
+	}
+	switch {
+	case entry.IdempotencyKey != nil:
+		key := *entry.IdempotencyKey
+		i.idempotencyKeys[idempotencyKeyID{key: key.Key, route: key.Route}] = key
+	case entry.DeletedIdempotencyKey != nil:
+		key := *entry.DeletedIdempotencyKey
+		delete(i.idempotencyKeys, idempotencyKeyID{key: key.Key, route: key.Route})
+	case entry.Event != nil:
+		// the journal isn't emptied until after a snapshot is written so the event
+		// might already be in the snapshot
+		if entry.Event.ID > i.lastEventID {
+			i.putEvent(*entry.Event, entry.WebhookDeliveries)
+		}
+	case entry.WebhookSubscription != nil:
+		i.subscriptions[entry.WebhookSubscription.ID] = entry.WebhookSubscription.subscription()
+	case entry.DeletedWebhookSubscription != "":
+		i.deleteSubscription(entry.DeletedWebhookSubscription)
+	case entry.WebhookDelivery != nil:
+		i.putDelivery(*entry.WebhookDelivery)
+	}
+}
+
+// appendEvent stores the event, which must have a larger ID than every stored
+// event, without journaling it
+func (i *MemoryInstance) appendEvent(event OrderEvent) {
+	i.events[event.OrderID] = append(i.events[event.OrderID], event)
+	i.lastEventID = event.ID
+}
+
+// putDelivery stores the webhook delivery without journaling it
+func (i *MemoryInstance) putDelivery(delivery WebhookDelivery) {
+	i.deliveries[delivery.ID] = delivery
+	if delivery.ID > i.lastDeliveryID {
+		i.lastDeliveryID = delivery.ID
+	}
+}
+
+// deleteSubscription removes the webhook subscription and its deliveries without
+// journaling it
+func (i *MemoryInstance) deleteSubscription(id string) {
+	delete(i.subscriptions, id)
+	for deliveryID, delivery := range i.deliveries {
+		if delivery.SubscriptionID == id {
+			delete(i.deliveries, deliveryID)
+		}
+	}
+}
+
+// Snapshot writes every order, idempotency key, order event and webhook to a new
+// snapshot and empties the journal. It does nothing unless the instance was opened with
+// OpenMemory.
+func (i *MemoryInstance) Snapshot() error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.snapshot()
+}
+
+// snapshot is Snapshot but expects the caller to hold the lock. The lock has to
+// be held until the journal is emptied, so no change is made that's in neither
+// the snapshot nor the journal, which means every other read and change waits
+// for the whole snapshot to be encoded and synced to disk. How long that takes is
+// logged so it can be watched as the instance grows.
+func (i *MemoryInstance) snapshot() error {
+	if i.journal == nil {
+		return nil
+	}
+	start := time.Now()
+
+	snap := snapshot{
+		Orders:                make([]durableOrder, 0, len(i.orders)),
+		IdempotencyKeys:       make([]IdempotencyKey, 0, len(i.idempotencyKeys)),
+		WebhookSubscriptions:  make([]durableWebhookSubscription, 0, len(i.subscriptions)),
+		WebhookDeliveries:     make([]WebhookDelivery, 0, len(i.deliveries)),
+		LastWebhookDeliveryID: i.lastDeliveryID,
+	}
+	for _, order := range i.orders {
+		snap.Orders = append(snap.Orders, newDurableOrder(order))
+	}
+	for _, key := range i.idempotencyKeys {
+		snap.IdempotencyKeys = append(snap.IdempotencyKeys, key)
+	}
+	for _, events := range i.events {
+		snap.Events = append(snap.Events, events...)
+	}
+	// the events need to be loaded in the order they were inserted
+	sort.Slice(snap.Events, func(a, b int) bool {
+		return snap.Events[a].ID < snap.Events[b].ID
+	})
+	for _, sub := range i.subscriptions {
+		snap.WebhookSubscriptions = append(snap.WebhookSubscriptions, newDurableWebhookSubscription(sub))
+	}
+	for _, delivery := range i.deliveries {
+		snap.WebhookDeliveries = append(snap.WebhookDeliveries, delivery)
+	}
+	if err := writeSnapshot(i.dir, snap); err != nil {
+		return fmt.Errorf("error writing snapshot in %s: %w", i.dir, err)
+	}
+	// if we crash before the journal is emptied then its entries are replayed on
+	// top of the new snapshot, which is harmless since they're already in it
+	if err := i.journal.reset(); err != nil {
+		return fmt.Errorf("error emptying journal in %s: %w", i.dir, err)
 	}
+	llog.Info("wrote snapshot", llog.KV{
+		"dir":      i.dir,
+		"orders":   len(snap.Orders),
+		"duration": time.Since(start).String(),
+	})
+	return nil
+}
+
+// Close writes a final snapshot and closes the journal if the instance was
+// opened with OpenMemory. Changes made after it's closed return ErrClosed.
+func (i *MemoryInstance) Close() error {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	i.closed = true
+	if i.journal == nil {
+		return nil
+	}
+	err := i.snapshot()
+	if cerr := i.journal.Close(); err == nil {
+		err = cerr
+	}
+	i.journal = nil
+	return err
+}
+
+// record appends the entry to the journal, if there is one, and then calls apply
+// to make the change in memory so a change is never visible before it's
+// durable. Once enough entries are journaled a new snapshot is written.
+func (i *MemoryInstance) record(entry journalEntry, apply func()) error {
+	// without the journal the change would only be made in memory and then lost
+	if i.closed {
+		return ErrClosed
+	}
+	if i.journal == nil {
+		apply()
+		return nil
+	}
+	if err := i.journal.append(entry); err != nil {
+		return err
+	}
+	apply()
+	if i.snapshotEvery > 0 && i.journal.records >= i.snapshotEvery {
+		// the entry is already durable so failing to compact the journal doesn't
+		// fail the change and we'll try again after the next one
+		if err := i.snapshot(); err != nil {
+			llog.Error("failed to write snapshot", llog.ErrKV(err))
+		}
+	}
+	return nil
+}
+
+// putIdempotencyKey journals the key and then stores it
+func (i *MemoryInstance) putIdempotencyKey(key IdempotencyKey) error {
+	return i.record(journalEntry{IdempotencyKey: &key}, func() {
+		i.idempotencyKeys[idempotencyKeyID{key: key.Key, route: key.Route}] = key
+	})
+}
+
+// SetClock replaces the clock used to set the timestamps on orders.
+func (i *MemoryInstance) SetClock(now Clock) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.now = now
 }
 
 // GetOrder retrieves an order by its ID.
@@ -29,54 +338,316 @@ func (i *MemoryInstance) GetOrder(ctx context.Context, id string) (Order, error)
 	if !ok {
 		return Order{}, ErrOrderNotFound
 	}
-	return order, nil
+	return order.clone(), nil
 }
 
-// GetOrders retrieves all orders, optionally filtered by status.
-func (i *MemoryInstance) GetOrders(ctx context.Context, status OrderStatus) ([]Order, error) {
+// GetOrders retrieves a page of the orders matching the query, newest first.
+func (i *MemoryInstance) GetOrders(ctx context.Context, query OrderQuery, page Page) ([]Order, string, error) {
+	var after *cursor
+	if page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &c
+	}
+
 	i.m.RLock()
 	defer i.m.RUnlock()
 
-	var orders []Order
+	// orders is never nil so callers get an empty slice if nothing matched
+	orders := []Order{}
 	for _, order := range i.orders {
-		if status == -1 || order.Status == status {
-			orders = append(orders, order)
+		if !query.matches(order) {
+			continue
 		}
+		if after != nil && !after.after(order) {
+			continue
+		}
+		orders = append(orders, order.clone())
 	}
-	return orders, nil
+
+	// maps are iterated in a random order so we need to sort them the same way
+	// the SQLite instance does
+	sort.Slice(orders, func(a, b int) bool {
+		if !orders[a].CreatedAt.Equal(orders[b].CreatedAt) {
+			return orders[a].CreatedAt.After(orders[b].CreatedAt)
+		}
+		return orders[a].ID > orders[b].ID
+	})
+
+	var next string
+	if page.Limit > 0 && len(orders) > page.Limit {
+		orders = orders[:page.Limit]
+		next = encodeCursor(orders[len(orders)-1])
+	}
+	return orders, next, nil
 }
 
-// SetOrderStatus updates the status of an order.
-func (i *MemoryInstance) SetOrderStatus(ctx context.Context, id string, status OrderStatus) error {
+// InsertIdempotencyKey stores the key as an in-progress request unless the key
+// already exists for the route and hasn't expired.
+func (i *MemoryInstance) InsertIdempotencyKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, error) {
 	i.m.Lock()
 	defer i.m.Unlock()
 
-	order, ok := i.orders[id]
+	id := idempotencyKeyID{key: key.Key, route: key.Route}
+	if existing, ok := i.idempotencyKeys[id]; ok && !existing.expired(i.now()) {
+		// copy the body so the caller can't modify the stored key
+		existing.Body = append([]byte(nil), existing.Body...)
+		return existing, ErrIdempotencyKeyExists
+	}
+	key.Completed = false
+	key.StatusCode = 0
+	key.Body = nil
+	if err := i.putIdempotencyKey(key); err != nil {
+		return IdempotencyKey{}, err
+	}
+	return key, nil
+}
+
+// CompleteIdempotencyKey records the response for the key until expiresAt.
+func (i *MemoryInstance) CompleteIdempotencyKey(ctx context.Context, key, route string, statusCode int, body []byte, expiresAt time.Time) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	id := idempotencyKeyID{key: key, route: route}
+	existing, ok := i.idempotencyKeys[id]
 	if !ok {
-		return ErrOrderNotFound
+		return nil
 	}
-	order.Status = status
-	i.orders[id] = order
-	return nil
+	existing.Completed = true
+	existing.StatusCode = statusCode
+	existing.Body = append([]byte(nil), body...)
+	existing.ExpiresAt = expiresAt
+	return i.putIdempotencyKey(existing)
+}
+
+// DeleteExpiredIdempotencyKeys removes every key that has expired.
+func (i *MemoryInstance) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	now := i.now()
+	var deleted int
+	for id, key := range i.idempotencyKeys {
+		if !key.expired(now) {
+			continue
+		}
+		err := i.record(journalEntry{DeletedIdempotencyKey: &IdempotencyKey{Key: key.Key, Route: key.Route}}, func() {
+			delete(i.idempotencyKeys, id)
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
 }
 
-// InsertOrder adds a new order to the store.
-func (i *MemoryInstance) InsertOrder(ctx context.Context, order Order) (string, error) {
+// DeleteIdempotencyKey removes the key.
+func (i *MemoryInstance) DeleteIdempotencyKey(ctx context.Context, key, route string) error {
 	i.m.Lock()
 	defer i.m.Unlock()
 
-	if order.ID == "" {
-		b := make([]byte, 16)
-		if _, err := rand.Read(b); err != nil {
-			return "", err
+	id := idempotencyKeyID{key: key, route: route}
+	if _, ok := i.idempotencyKeys[id]; !ok {
+		return nil
+	}
+	return i.record(journalEntry{DeletedIdempotencyKey: &IdempotencyKey{Key: key, Route: route}}, func() {
+		delete(i.idempotencyKeys, id)
+	})
+}
+
+// ApplyOrderChange makes the change to its order and records its event, along
+// with a pending webhook delivery of the event for every subscription that
+// matches its type, all at once.
+func (i *MemoryInstance) ApplyOrderChange(ctx context.Context, change OrderChange) (OrderEvent, error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	now := i.now()
+	var order Order
+	var event OrderEvent
+	if change.Insert != nil {
+		order, event = change.insert(now, uuid.NewString)
+		if _, ok := i.orders[order.ID]; ok {
+			return OrderEvent{}, ErrOrderExists
+		}
+	} else {
+		existing, ok := i.orders[change.Event.OrderID]
+		if !ok {
+			return OrderEvent{}, ErrOrderNotFound
+		}
+		// the order is changed in place so it's changed on a copy in case the
+		// change can't be made or journaled
+		order = existing.clone()
+		var err error
+		if event, err = change.apply(&order, now); err != nil {
+			return OrderEvent{}, err
+		}
+	}
+	event, deliveries := i.newEvent(event, now)
+
+	// the order is journaled in the same entry as the event so that a change is
+	// never stored without the event that records it
+	entry := journalEntry{Event: &event, WebhookDeliveries: deliveries}
+	changed := change.Insert != nil || change.changesOrder()
+	if changed {
+		d := newDurableOrder(order)
+		entry.Order = &d
+	}
+	if err := i.record(entry, func() {
+		if changed {
+			i.orders[order.ID] = order
 		}
-		order.ID = hex.EncodeToString(b)
+		i.putEvent(event, deliveries)
+	}); err != nil {
+		return OrderEvent{}, err
 	}
+	return event, nil
+}
 
-	if _, ok := i.orders[order.ID]; ok {
-		return "", ErrOrderExists
+// newEvent assigns the event the next ID, and its creation time if it doesn't
+// have one, and returns it along with a pending webhook delivery of it for every
+// subscription that matches its type. Neither is stored.
+func (i *MemoryInstance) newEvent(event OrderEvent, now time.Time) (OrderEvent, []WebhookDelivery) {
+	event.ID = i.lastEventID + 1
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = now
 	}
 
-	i.orders[order.ID] = order
-	return order.ID, nil
+	var deliveries []WebhookDelivery
+	for _, sub := range i.subscriptions {
+		if sub.Matches(event.Type) {
+			deliveries = append(deliveries, newWebhookDelivery(sub, event, now))
+		}
+	}
+	// the subscriptions are iterated in a random order so the IDs are assigned
+	// in the order the subscriptions were created
+	sort.Slice(deliveries, func(a, b int) bool {
+		return subscriptionLess(i.subscriptions[deliveries[a].SubscriptionID], i.subscriptions[deliveries[b].SubscriptionID])
+	})
+	for idx := range deliveries {
+		deliveries[idx].ID = i.lastDeliveryID + int64(idx) + 1
+	}
+	return event, deliveries
+}
+
+// putEvent stores the event and its webhook deliveries without journaling them
+func (i *MemoryInstance) putEvent(event OrderEvent, deliveries []WebhookDelivery) {
+	i.appendEvent(event)
+	for _, delivery := range deliveries {
+		i.putDelivery(delivery)
+	}
+}
+
+// GetOrderEvents retrieves an order's events, oldest first.
+func (i *MemoryInstance) GetOrderEvents(ctx context.Context, orderID string) ([]OrderEvent, error) {
+	i.m.RLock()
+	defer i.m.RUnlock()
+
+	// the events are copied so the caller can't modify the stored ones and the
+	// slice is never nil, just like GetOrders
+	return append([]OrderEvent{}, i.events[orderID]...), nil
+}
+
+// InsertWebhookSubscription stores a new webhook subscription.
+func (i *MemoryInstance) InsertWebhookSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	sub = sub.clone()
+	sub.ID = uuid.New().String()
+	if sub.CreatedAt.IsZero() {
+		sub.CreatedAt = i.now()
+	}
+	d := newDurableWebhookSubscription(sub)
+	if err := i.record(journalEntry{WebhookSubscription: &d}, func() {
+		i.subscriptions[sub.ID] = sub
+	}); err != nil {
+		return WebhookSubscription{}, err
+	}
+	return sub.clone(), nil
+}
+
+// GetWebhookSubscriptions retrieves every webhook subscription, oldest first.
+func (i *MemoryInstance) GetWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	i.m.RLock()
+	defer i.m.RUnlock()
+
+	subs := make([]WebhookSubscription, 0, len(i.subscriptions))
+	for _, sub := range i.subscriptions {
+		subs = append(subs, sub.clone())
+	}
+	sort.Slice(subs, func(a, b int) bool {
+		return subscriptionLess(subs[a], subs[b])
+	})
+	return subs, nil
+}
+
+// subscriptionLess returns true if a is sorted before b, which is the same
+// order the SQL instances return them in
+func subscriptionLess(a, b WebhookSubscription) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+// DeleteWebhookSubscription removes a webhook subscription and its deliveries.
+func (i *MemoryInstance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	if _, ok := i.subscriptions[id]; !ok {
+		return ErrWebhookSubscriptionNotFound
+	}
+	return i.record(journalEntry{DeletedWebhookSubscription: id}, func() {
+		i.deleteSubscription(id)
+	})
+}
+
+// GetWebhookDeliveries retrieves the webhook deliveries matching the query in
+// the order they were created.
+func (i *MemoryInstance) GetWebhookDeliveries(ctx context.Context, query WebhookDeliveryQuery) ([]WebhookDelivery, error) {
+	i.m.RLock()
+	defer i.m.RUnlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range i.deliveries {
+		if query.matches(delivery) {
+			deliveries = append(deliveries, delivery.clone())
+		}
+	}
+	sort.Slice(deliveries, func(a, b int) bool {
+		return deliveries[a].ID < deliveries[b].ID
+	})
+	if query.Limit > 0 && len(deliveries) > query.Limit {
+		deliveries = deliveries[:query.Limit]
+	}
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery replaces the status, attempts, next attempt, last error
+// and delivered time of a webhook delivery only if its current status is from.
+func (i *MemoryInstance) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery, from WebhookDeliveryStatus) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	existing, ok := i.deliveries[delivery.ID]
+	if !ok {
+		return ErrWebhookDeliveryNotFound
+	}
+	if existing.Status != from {
+		return ErrWebhookDeliveryStatusMismatch
+	}
+	existing.Status = delivery.Status
+	existing.Attempts = delivery.Attempts
+	existing.NextAttemptAt = delivery.NextAttemptAt
+	existing.LastError = delivery.LastError
+	// copy the delivered time so the caller can't modify the stored delivery
+	existing.DeliveredAt = delivery.clone().DeliveredAt
+	return i.record(journalEntry{WebhookDelivery: &existing}, func() {
+		i.putDelivery(existing)
+	})
 }
@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// migration is a single numbered change to the schema. Each migration is applied
+// inside of its own transaction, along with recording that it was applied, so a
+// migration that fails doesn't leave the schema half changed.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order and must only ever be appended to since
+// databases record the version of every migration that was applied to them.
+//
+// The first 6 migrations existed before schema_migrations did, as a single
+// ensureSchema function, so they might be applied to databases that already
+// have some or all of their changes and they're written to do nothing in that
+// case. Newer migrations don't need to be.
+var migrations = []migration{
+	{1, "create_orders", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS orders (
+			id TEXT PRIMARY KEY,
+			customer_email TEXT NOT NULL,
+			line_items TEXT NOT NULL,
+			status INTEGER NOT NULL
+		)`)
+		return err
+	}},
+	{2, "create_idempotency_keys", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key TEXT NOT NULL,
+			route TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			completed INTEGER NOT NULL DEFAULT 0,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			body BLOB,
+			PRIMARY KEY (key, route)
+		)`)
+		return err
+	}},
+	{3, "add_order_payments_and_refunds", func(ctx context.Context, tx *sql.Tx) error {
+		return addColumns(ctx, tx, "orders", []columnDefinition{
+			{"payment_card_token", "TEXT"},
+			{"payment_charge_id", "TEXT"},
+			{"payment_amount_cents", "INTEGER"},
+			{"payment_charged_at", "TEXT"},
+			{"refunds", "TEXT"},
+		})
+	}},
+	{4, "add_order_versions", func(ctx context.Context, tx *sql.Tx) error {
+		return addColumns(ctx, tx, "orders", []columnDefinition{
+			{"version", "INTEGER NOT NULL DEFAULT 1"},
+		})
+	}},
+	{5, "add_order_timestamps", func(ctx context.Context, tx *sql.Tx) error {
+		err := addColumns(ctx, tx, "orders", []columnDefinition{
+			{"created_at", "TEXT"},
+			{"updated_at", "TEXT"},
+			{"charged_at", "TEXT"},
+			{"fulfilled_at", "TEXT"},
+			{"cancelled_at", "TEXT"},
+		})
+		if err != nil {
+			return err
+		}
+
+		// orders created before created_at existed would otherwise have a NULL
+		// created_at, which breaks the comparisons used for paging, so they're
+		// given the zero time which is what GetOrder already returned for them
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET created_at = ? WHERE created_at IS NULL`, formatTime(time.Time{}))
+		if err != nil {
+			return err
+		}
+
+		// the index includes the id so GetOrders can page through orders using it
+		_, err = tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS orders_created_at_id ON orders (created_at, id)`)
+		return err
+	}},
+	{6, "create_order_line_items", func(ctx context.Context, tx *sql.Tx) error {
+		// line items are identified by their position in the order's LineItems
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS order_line_items (
+			order_id TEXT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			description TEXT NOT NULL,
+			price_cents INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			fulfillment_status INTEGER NOT NULL DEFAULT 0,
+			fulfilled_quantity INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (order_id, position)
+		)`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS order_line_items_description ON order_line_items (description)`)
+		if err != nil {
+			return err
+		}
+
+		// the line items used to be stored as a JSON blob in the orders table and
+		// if that column is still around they need to be moved over
+		exists, err := columnExists(ctx, tx, "orders", "line_items")
+		if err != nil || !exists {
+			return err
+		}
+		// json_each returns the index of each line item as the key which becomes
+		// the line item's position
+		_, err = tx.ExecContext(ctx, `INSERT INTO order_line_items
+			(order_id, position, description, price_cents, quantity, fulfillment_status, fulfilled_quantity)
+			SELECT o.id, li.key,
+				COALESCE(json_extract(li.value, '$.description'), ''),
+				COALESCE(json_extract(li.value, '$.priceCents'), 0),
+				COALESCE(json_extract(li.value, '$.quantity'), 0),
+				COALESCE(json_extract(li.value, '$.fulfillmentStatus'), 0),
+				COALESCE(json_extract(li.value, '$.fulfilledQuantity'), 0)
+			FROM orders AS o, json_each(o.line_items) AS li`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `ALTER TABLE orders DROP COLUMN line_items`)
+		return err
+	}},
+	{7, "create_order_events", func(ctx context.Context, tx *sql.Tx) error {
+		// AUTOINCREMENT guarantees an id is never reused so every event's id is
+		// larger than the ids of the events inserted before it
+		_, err := tx.ExecContext(ctx, `CREATE TABLE order_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id TEXT NOT NULL REFERENCES orders (id),
+			type TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			request_id TEXT NOT NULL,
+			old_status INTEGER NOT NULL,
+			new_status INTEGER NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			charge_id TEXT NOT NULL,
+			refund_id TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		)`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `CREATE INDEX order_events_order_id ON order_events (order_id, id)`)
+		return err
+	}},
+	{8, "create_webhooks", func(ctx context.Context, tx *sql.Tx) error {
+		// event_types is a JSON array of the subscribed event types which is empty
+		// if every type is subscribed to
+		_, err := tx.ExecContext(ctx, `CREATE TABLE webhook_subscriptions (
+			id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			event_types TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		)`)
+		if err != nil {
+			return err
+		}
+		// webhook_deliveries is the outbox the dispatcher reads from so its rows are
+		// inserted in the same transaction as their event
+		_, err = tx.ExecContext(ctx, `CREATE TABLE webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+			event_id INTEGER NOT NULL REFERENCES order_events (id),
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			next_attempt_at TEXT NOT NULL,
+			last_error TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			delivered_at TEXT
+		)`)
+		if err != nil {
+			return err
+		}
+		// the dispatcher looks for pending deliveries that are due
+		_, err = tx.ExecContext(ctx, `CREATE INDEX webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at, id)`)
+		if err != nil {
+			return err
+		}
+		// without an index the cascade would scan every delivery
+		_, err = tx.ExecContext(ctx, `CREATE INDEX webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id)`)
+		return err
+	}},
+	{9, "format_payment_charged_at", func(ctx context.Context, tx *sql.Tx) error {
+		// payments used to be stored with time.RFC3339Nano, which drops trailing
+		// zeros from the fraction, so they're reformatted like every other
+		// timestamp
+		rows, err := tx.QueryContext(ctx, `SELECT id, payment_charged_at FROM orders WHERE payment_charged_at IS NOT NULL`)
+		if err != nil {
+			return err
+		}
+		chargedAts := map[string]time.Time{}
+		for rows.Next() {
+			var id, chargedAt string
+			if err := rows.Scan(&id, &chargedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			t, err := time.Parse(time.RFC3339Nano, chargedAt)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("error parsing payment_charged_at of order %s: %w", id, err)
+			}
+			chargedAts[id] = t
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, t := range chargedAts {
+			_, err := tx.ExecContext(ctx, `UPDATE orders SET payment_charged_at = ? WHERE id = ?`, formatTime(t), id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{10, "add_idempotency_key_expiry", func(ctx context.Context, tx *sql.Tx) error {
+		// keys stored before they could expire are left never expiring
+		_, err := tx.ExecContext(ctx, `ALTER TABLE idempotency_keys ADD COLUMN expires_at TEXT`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at)`)
+		return err
+	}},
+}
+
+// columnDefinition is a column that addColumns should add to a table
+type columnDefinition struct {
+	name       string
+	definition string
+}
+
+// columnExists returns true if the table has the column
+func columnExists(ctx context.Context, q queryer, table, column string) (bool, error) {
+	var count int
+	err := q.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addColumns adds each of the columns to the table that it doesn't already have
+func addColumns(ctx context.Context, tx *sql.Tx, table string, columns []columnDefinition) error {
+	for _, col := range columns {
+		exists, err := columnExists(ctx, tx, table, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+col.name+` `+col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// MigrationStatus describes a migration and whether it was applied to the
+// database
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is when the migration was applied and is nil if it hasn't been
+	AppliedAt *time.Time
+}
+
+// ensureMigrationsTable creates the table that records the applied migrations
+func (i *Instance) ensureMigrationsTable(ctx context.Context) error {
+	_, err := i.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+// Migrations returns every migration, sorted by version, along with when each
+// was applied. Migrations that were applied to the database by a newer version
+// of the service are included even though this version doesn't know about them.
+func (i *Instance) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	if err := i.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedAt sql.NullString
+		if err := rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		status.AppliedAt, err = parseTime(appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[status.Version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return migrationStatuses(migrations, applied), nil
+}
+
+// migrationStatuses returns the status of every migration in known along with
+// any that were applied but aren't known, sorted by version
+func migrationStatuses(known []migration, applied map[int]MigrationStatus) []MigrationStatus {
+	statuses := make([]MigrationStatus, 0, len(known))
+	for _, m := range known {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			status.AppliedAt = a.AppliedAt
+			delete(applied, m.version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, a := range applied {
+		statuses = append(statuses, a)
+	}
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].Version < statuses[b].Version
+	})
+	return statuses
+}
+
+// Migrate applies, in order, every migration up to and including the target
+// version that hasn't been applied yet. A target of 0 applies every migration.
+// It returns the migrations that were applied.
+func (i *Instance) Migrate(ctx context.Context, target int) ([]MigrationStatus, error) {
+	if target < 0 || target > len(migrations) {
+		return nil, fmt.Errorf("unknown migration version: %d", target)
+	}
+	if err := i.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var applied []MigrationStatus
+	for _, m := range migrations {
+		if target != 0 && m.version > target {
+			break
+		}
+		now := i.now().UTC()
+		ok, err := i.applyMigration(ctx, m, now)
+		if err != nil {
+			return applied, fmt.Errorf("error applying migration %d %s: %w", m.version, m.name, err)
+		}
+		if ok {
+			applied = append(applied, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: &now})
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration applies the migration if it hasn't been already, recording that
+// it was applied at now, and returns true if it was applied
+func (i *Instance) applyMigration(ctx context.Context, m migration, now time.Time) (bool, error) {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	// checking inside of the transaction means that if another process applied
+	// the migration since we last checked we won't apply it twice
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if err := m.up(ctx, tx); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, formatTime(now))
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appliedVersions returns the versions of the migrations that were applied
+func appliedVersions(t *testing.T, inst *Instance) []int {
+	statuses, err := inst.Migrations(context.Background())
+	require.NoError(t, err)
+	var versions []int
+	for _, s := range statuses {
+		if s.AppliedAt != nil {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+// allVersions returns the version of every migration
+func allVersions() []int {
+	var versions []int
+	for _, m := range migrations {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestMigrate(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// Open doesn't apply any migrations so we can apply them ourselves
+	inst, err := Open(randomDatabase())
+	require.NoError(t, err)
+	defer inst.Close()
+	inst.SetClock(testClock)
+
+	// nothing has been applied yet
+	statuses, err := inst.Migrations(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, statuses, len(migrations)) {
+		for idx, s := range statuses {
+			assert.Equal(t, migrations[idx].version, s.Version)
+			assert.Equal(t, migrations[idx].name, s.Name)
+			assert.Nil(t, s.AppliedAt)
+		}
+	}
+
+	// only applies up to the target
+	applied, err := inst.Migrate(ctx, 3)
+	require.NoError(t, err)
+	assert.Len(t, applied, 3)
+	assert.Equal(t, []int{1, 2, 3}, appliedVersions(t, inst))
+
+	// applies the rest
+	applied, err = inst.Migrate(ctx, 0)
+	require.NoError(t, err)
+	if assert.Len(t, applied, len(migrations)-3) {
+		assert.Equal(t, 4, applied[0].Version)
+		assert.Equal(t, testNow, *applied[0].AppliedAt)
+	}
+	assert.Equal(t, allVersions(), appliedVersions(t, inst))
+
+	// applying again doesn't do anything
+	applied, err = inst.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// errors on an unknown target
+	_, err = inst.Migrate(ctx, len(migrations)+1)
+	assert.Error(t, err)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestMigrateRollsBack(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	inst := mustNew(t, randomDatabase())
+
+	// add a migration that fails part way through and put the real ones back
+	// once we're done
+	defer func(orig []migration) {
+		migrations = orig
+	}(migrations)
+	failErr := errors.New("failed")
+	version := len(migrations) + 1
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version: version,
+		name:    "fails",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE fails (id TEXT)`)
+			require.NoError(t, err)
+			return failErr
+		},
+	})
+
+	_, err := inst.Migrate(ctx, 0)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, failErr), "%#v", err)
+	}
+
+	// the table it created was rolled back and it wasn't recorded
+	var count int
+	err = inst.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'fails'`).Scan(&count)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.NotContains(t, appliedVersions(t, inst), version)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestMigrateExistingSchema(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	database := randomDatabase()
+
+	// create a database the way it was before migrations were recorded, when
+	// the whole schema was created at once
+	db, err := sql.Open("sqlite", database)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE orders (
+			id TEXT PRIMARY KEY,
+			customer_email TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			payment_card_token TEXT,
+			payment_charge_id TEXT,
+			payment_amount_cents INTEGER,
+			payment_charged_at TEXT,
+			refunds TEXT,
+			version INTEGER NOT NULL DEFAULT 1,
+			created_at TEXT,
+			updated_at TEXT,
+			charged_at TEXT,
+			fulfilled_at TEXT,
+			cancelled_at TEXT
+		)`,
+		`CREATE TABLE order_line_items (
+			order_id TEXT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			description TEXT NOT NULL,
+			price_cents INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			fulfillment_status INTEGER NOT NULL DEFAULT 0,
+			fulfilled_quantity INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (order_id, position)
+		)`,
+		`CREATE INDEX order_line_items_description ON order_line_items (description)`,
+		`CREATE TABLE idempotency_keys (
+			key TEXT NOT NULL,
+			route TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			completed INTEGER NOT NULL DEFAULT 0,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			body BLOB,
+			PRIMARY KEY (key, route)
+		)`,
+		`CREATE INDEX orders_created_at_id ON orders (created_at, id)`,
+		`INSERT INTO orders (id, customer_email, status, version, created_at, updated_at)
+			VALUES ('test1', 'test@test', 1, 3, '2024-01-02T03:04:05.000000006Z', '2024-01-02T03:04:05.000000006Z')`,
+		`INSERT INTO order_line_items (order_id, position, description, price_cents, quantity)
+			VALUES ('test1', 0, 'item 1', 1000, 2)`,
+	} {
+		_, err = db.ExecContext(ctx, stmt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	// every migration is recorded even though none of them changed anything
+	inst := mustNew(t, database)
+	assert.Equal(t, allVersions(), appliedVersions(t, inst))
+
+	// the existing order is untouched
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Order{
+		ID:            "test1",
+		CustomerEmail: "test@test",
+		LineItems: []LineItem{
+			{
+				Description: "item 1",
+				PriceCents:  1000,
+				Quantity:    2,
+			},
+		},
+		Status:    OrderStatusCharged,
+		Version:   3,
+		CreatedAt: testNow,
+		UpdatedAt: testNow,
+	}, got)
+
+	// and new orders can still be inserted
+	_, err = insertTestOrder(ctx, inst, Order{
+		ID:            "test2",
+		CustomerEmail: "test@test",
+		LineItems:     []LineItem{{Description: "item 2", PriceCents: 500, Quantity: 1}},
+	})
+	require.NoError(t, err)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestMigrateLineItems(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	database := randomDatabase()
+
+	// create a database the way it was before line items had their own table
+	// when they were stored as JSON in the orders table
+	db, err := sql.Open("sqlite", database)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `CREATE TABLE orders (
+		id TEXT PRIMARY KEY,
+		customer_email TEXT NOT NULL,
+		line_items TEXT NOT NULL,
+		status INTEGER NOT NULL
+	)`)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `INSERT INTO orders (id, customer_email, line_items, status) VALUES
+		('test1', 'test@test', '[{"description":"item 1","priceCents":1000,"quantity":2},{"description":"item 2","priceCents":-500,"quantity":1}]', 1),
+		('test2', 'test@test', '[]', 0)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	inst := mustNew(t, database)
+
+	// the line items were moved over in the same order
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, []LineItem{
+		{
+			Description: "item 1",
+			PriceCents:  1000,
+			Quantity:    2,
+		},
+		{
+			Description: "item 2",
+			PriceCents:  -500,
+			Quantity:    1,
+		},
+	}, got.LineItems)
+
+	got, err = inst.GetOrder(ctx, "test2")
+	require.NoError(t, err)
+	assert.Equal(t, []LineItem{}, got.LineItems)
+
+	// the JSON column is gone so it won't be migrated again
+	exists, err := columnExists(ctx, inst.db, "orders", "line_items")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// opening the database again doesn't change anything
+	inst = mustNew(t, database)
+	got, err = inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Len(t, got.LineItems, 2)
+
+	// the migrated line items can be searched like any others
+	orders, _, err := inst.GetOrders(ctx, OrderQuery{LineItemDescription: "item 2"}, Page{})
+	require.NoError(t, err)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, "test1", orders[0].ID)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestMigratePaymentChargedAt(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	inst, err := Open(randomDatabase())
+	require.NoError(t, err)
+	defer inst.Close()
+	inst.SetClock(testClock)
+
+	// insert a payment the way it was stored before it used timeFormat, which
+	// has no fraction since it's all zeros
+	_, err = inst.Migrate(ctx, 8)
+	require.NoError(t, err)
+	_, err = inst.db.ExecContext(ctx, `INSERT INTO orders (id, customer_email, status,
+		payment_charge_id, payment_amount_cents, payment_charged_at, created_at)
+		VALUES ('test1', 'test@test', 1, 'charge1', 100, '2024-01-02T03:04:05Z', ?)`, formatTime(testNow))
+	require.NoError(t, err)
+
+	_, err = inst.Migrate(ctx, 0)
+	require.NoError(t, err)
+
+	var chargedAt string
+	err = inst.db.QueryRowContext(ctx, `SELECT payment_charged_at FROM orders WHERE id = 'test1'`).Scan(&chargedAt)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-02T03:04:05.000000000Z", chargedAt)
+
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	if assert.NotNil(t, got.Payment) {
+		assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), got.Payment.ChargedAt)
+	}
+}
@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 // OrderStatus describes the current status of the order
 type OrderStatus int64
 
@@ -16,6 +18,35 @@ const (
 
 	// OrderStatusCancelled means the order has been cancelled
 	OrderStatusCancelled OrderStatus = 3
+
+	// OrderStatusPartiallyFulfilled means we've fulfilled some, but not all, of
+	// the line items on a charged order
+	OrderStatusPartiallyFulfilled OrderStatus = 4
+
+	// OrderStatusCharging means we've started charging the customer but haven't
+	// heard back from the charge service yet
+	OrderStatusCharging OrderStatus = 5
+
+	// OrderStatusFulfilling means we've started sending the order's line items to
+	// the fulfillment service but haven't finished yet
+	OrderStatusFulfilling OrderStatus = 6
+)
+
+// LineItemStatus describes how much of a line item has been fulfilled
+type LineItemStatus int64
+
+const (
+	// LineItemStatusUnfulfilled means none of the line item's quantity has been
+	// sent to the fulfillment service yet
+	LineItemStatusUnfulfilled LineItemStatus = 0
+
+	// LineItemStatusPartiallyFulfilled means some, but not all, of the line
+	// item's quantity has been fulfilled
+	LineItemStatusPartiallyFulfilled LineItemStatus = 1
+
+	// LineItemStatusFulfilled means the line item's entire quantity has been
+	// fulfilled
+	LineItemStatusFulfilled LineItemStatus = 2
 )
 
 // LineItem is a single charge on an order. The product of the PriceCents and
@@ -28,6 +59,65 @@ type LineItem struct {
 	PriceCents int64 `json:"priceCents"`
 	// Quantity is how many descriptions this line item represents
 	Quantity int64 `json:"quantity"`
+	// FulfillmentStatus tracks whether this line item has been fulfilled so a
+	// fulfillment that was interrupted can pick up where it left off
+	FulfillmentStatus LineItemStatus `json:"fulfillmentStatus"`
+	// FulfilledQuantity is how much of Quantity has been fulfilled so far
+	FulfilledQuantity int64 `json:"fulfilledQuantity"`
+}
+
+// setFulfilledQuantity updates the fulfilled quantity on the line item and
+// derives the matching FulfillmentStatus
+func (li *LineItem) setFulfilledQuantity(quantity int64) {
+	li.FulfilledQuantity = quantity
+	switch {
+	case quantity <= 0:
+		li.FulfillmentStatus = LineItemStatusUnfulfilled
+	case quantity < li.Quantity:
+		li.FulfillmentStatus = LineItemStatusPartiallyFulfilled
+	default:
+		li.FulfillmentStatus = LineItemStatusFulfilled
+	}
+}
+
+// Payment records the charge that was made for an order so that refunds can
+// reference the original charge
+type Payment struct {
+	// CardToken is the token the customer was charged with. It's never returned
+	// to API callers since it could be used to charge the customer again.
+	CardToken string `json:"-"`
+	// ChargeID is the identifier the charge service returned for the charge
+	ChargeID string `json:"chargeId"`
+	// AmountCents is how much was charged
+	AmountCents int64 `json:"amountCents"`
+	// ChargedAt is when the charge service confirmed the charge
+	ChargedAt time.Time `json:"chargedAt"`
+}
+
+// RefundLineItem is a quantity of a single line item that was refunded
+type RefundLineItem struct {
+	// LineItem is the index of the line item in the order's LineItems
+	LineItem int `json:"lineItem"`
+	// Quantity is how much of the line item's quantity was refunded
+	Quantity int64 `json:"quantity"`
+}
+
+// Refund records money that was given back to the customer for an order
+type Refund struct {
+	// ID uniquely identifies the refund on the order
+	ID string `json:"id"`
+	// AmountCents is how much was refunded
+	AmountCents int64 `json:"amountCents"`
+	// LineItems are the line items that were refunded if the refund was for
+	// specific line items rather than an arbitrary amount
+	LineItems []RefundLineItem `json:"lineItems,omitempty"`
+	// Reason is an optional description of why the refund was made
+	Reason string `json:"reason,omitempty"`
+	// CreatedAt is when the refund was made
+	CreatedAt time.Time `json:"createdAt"`
+	// Pending is true if it's unknown whether the charge service made the refund.
+	// It still counts towards the order's refunds until it's resolved.
+	Pending bool `json:"pending,omitempty"`
 }
 
 // Order represents a single order for one or more products
@@ -40,8 +130,102 @@ type Order struct {
 	// LineItems holds the actual products, or discounts, that apply to the order
 	LineItems []LineItem `json:"lineItems"`
 	// Status represents the current state of the order throughout the
-	// pending->charged->fulfilled lifecycle
+	// pending->charging->charged->partially fulfilled->fulfilled lifecycle
 	Status OrderStatus `json:"status"`
+	// Payment is the charge that was made for the order and is nil until the
+	// order has been charged
+	Payment *Payment `json:"payment,omitempty"`
+	// Refunds are all of the refunds made for the order
+	Refunds []Refund `json:"refunds,omitempty"`
+	// Version starts at 1 and is incremented every time the order is changed so
+	// callers can detect that the order changed since they last read it
+	Version int64 `json:"version"`
+	// CreatedAt is when the order was inserted
+	CreatedAt time.Time `json:"createdAt"`
+	// UpdatedAt is the last time the order was changed
+	UpdatedAt time.Time `json:"updatedAt"`
+	// ChargedAt, FulfilledAt and CancelledAt are when the order's status was last
+	// changed to charged, fulfilled or cancelled and are nil until then
+	ChargedAt   *time.Time `json:"chargedAt,omitempty"`
+	FulfilledAt *time.Time `json:"fulfilledAt,omitempty"`
+	CancelledAt *time.Time `json:"cancelledAt,omitempty"`
+}
+
+// clone returns a deep copy of the order so that changing the copy's line items,
+// refunds or payment doesn't change the original. The copy always has a non-nil
+// slice of line items and a nil slice of refunds if there aren't any, which is
+// also how the SQLite instance returns orders.
+func (o Order) clone() Order {
+	o.LineItems = append(make([]LineItem, 0, len(o.LineItems)), o.LineItems...)
+	if len(o.Refunds) > 0 {
+		refunds := make([]Refund, len(o.Refunds))
+		for idx, r := range o.Refunds {
+			r.LineItems = append([]RefundLineItem(nil), r.LineItems...)
+			refunds[idx] = r
+		}
+		o.Refunds = refunds
+	} else {
+		o.Refunds = nil
+	}
+	if o.Payment != nil {
+		payment := *o.Payment
+		o.Payment = &payment
+	}
+	o.ChargedAt = cloneTime(o.ChargedAt)
+	o.FulfilledAt = cloneTime(o.FulfilledAt)
+	o.CancelledAt = cloneTime(o.CancelledAt)
+	return o
+}
+
+// cloneTime returns a pointer to a copy of the time or nil if t is nil
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// touch records that the order was changed at now
+func (o *Order) touch(now time.Time) {
+	o.Version++
+	o.UpdatedAt = now
+}
+
+// setStatus changes the order's status and records when it was changed
+func (o *Order) setStatus(status OrderStatus, now time.Time) {
+	o.Status = status
+	switch status {
+	case OrderStatusCharged:
+		o.ChargedAt = &now
+	case OrderStatusFulfilled:
+		o.FulfilledAt = &now
+	case OrderStatusCancelled:
+		o.CancelledAt = &now
+	}
+	o.touch(now)
+}
+
+// Clock returns the current time and is used by the storage instances to set the
+// timestamps on orders so tests can control them
+type Clock func() time.Time
+
+// TimeRange limits orders to those created after After and before Before. Either
+// can be left as the zero time to leave that side of the range open.
+type TimeRange struct {
+	After  time.Time
+	Before time.Time
+}
+
+// contains returns true if t is within the range
+func (r TimeRange) contains(t time.Time) bool {
+	if !r.After.IsZero() && !t.After(r.After) {
+		return false
+	}
+	if !r.Before.IsZero() && !t.Before(r.Before) {
+		return false
+	}
+	return true
 }
 
 // TotalCents is a helper function that loops over each line item and totals up
@@ -53,3 +237,23 @@ func (o Order) TotalCents() int64 {
 	}
 	return total
 }
+
+// ChargedCents is how much the customer was charged for the order. Orders that
+// were charged before payments were recorded fall back to the order's total so
+// this should only be called on orders that are known to have been charged.
+func (o Order) ChargedCents() int64 {
+	if o.Payment != nil {
+		return o.Payment.AmountCents
+	}
+	return o.TotalCents()
+}
+
+// RefundedCents is a helper function that totals up all of the refunds made for
+// the order
+func (o Order) RefundedCents() int64 {
+	var total int64
+	for _, r := range o.Refunds {
+		total += r.AmountCents
+	}
+	return total
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrInvalidCursor is returned when the cursor sent to GetOrders wasn't one that
+// GetOrders returned
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page limits the orders returned by GetOrders. Orders are always sorted by when
+// they were created, newest first, and then by their ID so that the order is
+// stable even if orders were created at the same time.
+type Page struct {
+	// Limit is the most orders to return and 0 means there's no limit
+	Limit int
+	// Cursor is the next cursor returned by GetOrders for the previous page or
+	// empty for the first page
+	Cursor string
+}
+
+// cursor is the position of the last order on a page which is encoded into the
+// opaque string that's returned to callers
+type cursor struct {
+	CreatedAt time.Time `json:"c"`
+	ID        string    `json:"i"`
+}
+
+// encodeCursor returns the cursor for the page after the given order
+func encodeCursor(order Order) string {
+	// marshaling a struct of a time and a string can't fail
+	byts, _ := json.Marshal(cursor{CreatedAt: order.CreatedAt, ID: order.ID})
+	return base64.RawURLEncoding.EncodeToString(byts)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor
+func decodeCursor(str string) (cursor, error) {
+	byts, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(byts, &c); err != nil || c.ID == "" {
+		return cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// after returns true if the order sorts after the cursor which means it belongs
+// on the next page
+func (c cursor) after(order Order) bool {
+	if !order.CreatedAt.Equal(c.CreatedAt) {
+		return order.CreatedAt.Before(c.CreatedAt)
+	}
+	return order.ID < c.ID
+}
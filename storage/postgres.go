@@ -0,0 +1,1096 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/levenlabs/go-llog"
+	"github.com/lib/pq"
+	"github.com/lib/pq/pqerror"
+)
+
+// PostgresInstance is a StorageInstance backed by a PostgreSQL database. Unlike
+// SQLite, Postgres lets many transactions write at once so every change to an
+// existing order first locks the order's row with SELECT ... FOR UPDATE and
+// concurrent changes to the same order wait for each other.
+//
+// Postgres only stores timestamps to the microsecond so the times on orders are
+// rounded to the nearest microsecond.
+type PostgresInstance struct {
+	db *sql.DB
+	// now is used to set the timestamps on orders
+	now Clock
+}
+
+// NewPostgres connects to the Postgres database described by dsn, which can be
+// a URL or a list of key=value settings, and applies any migrations that
+// haven't been applied to it yet. WithBusyTimeout sets the lock_timeout of every
+// connection and WithMaxOpenConns limits the number of connections.
+func NewPostgres(dsn string, opts ...Option) (*PostgresInstance, error) {
+	inst, err := OpenPostgres(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// give the migrations only 15 seconds to complete
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	applied, err := inst.Migrate(ctx, 0)
+	if err != nil {
+		inst.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+	for _, m := range applied {
+		llog.Info("applied migration", llog.KV{"version": m.Version, "name": m.Name})
+	}
+	return inst, nil
+}
+
+// OpenPostgres connects to the Postgres database like NewPostgres but without
+// applying any migrations so that they can be inspected or applied with
+// Migrations and Migrate. Most callers want NewPostgres.
+func OpenPostgres(dsn string, opts ...Option) (*PostgresInstance, error) {
+	o := options{
+		busyTimeout:  DefaultBusyTimeout,
+		maxOpenConns: DefaultMaxOpenConns,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cfg, err := pq.NewConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing postgres dsn: %w", err)
+	}
+	if cfg.Runtime == nil {
+		cfg.Runtime = map[string]string{}
+	}
+	// the runtime parameters are set on every connection
+	cfg.Runtime["lock_timeout"] = strconv.FormatInt(o.busyTimeout.Milliseconds(), 10)
+	cfg.Runtime["timezone"] = "UTC"
+	connector, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(o.maxOpenConns)
+	db.SetMaxIdleConns(o.maxOpenConns)
+	inst := &PostgresInstance{db: db, now: time.Now}
+
+	// give the connection only 15 seconds to complete
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+	return inst, nil
+}
+
+// Close closes the connections to the database
+func (p *PostgresInstance) Close() error {
+	return p.db.Close()
+}
+
+// SetClock replaces the clock used to set the timestamps on orders. It should be
+// called before the instance is used.
+func (p *PostgresInstance) SetClock(now Clock) {
+	p.now = now
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// postgresMigrations are applied in order just like the SQLite migrations and
+// must only ever be appended to. The ids are compared with the "C" collation so
+// they sort by their bytes, the same as the other instances sort them.
+var postgresMigrations = []migration{
+	{1, "create_orders", func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range []string{
+			`CREATE TABLE orders (
+				id TEXT COLLATE "C" PRIMARY KEY,
+				customer_email TEXT NOT NULL,
+				status BIGINT NOT NULL,
+				payment_card_token TEXT,
+				payment_charge_id TEXT,
+				payment_amount_cents BIGINT,
+				payment_charged_at TIMESTAMPTZ,
+				refunds JSONB,
+				version BIGINT NOT NULL DEFAULT 1,
+				created_at TIMESTAMPTZ NOT NULL,
+				updated_at TIMESTAMPTZ NOT NULL,
+				charged_at TIMESTAMPTZ,
+				fulfilled_at TIMESTAMPTZ,
+				cancelled_at TIMESTAMPTZ
+			)`,
+			// the index includes the id so GetOrders can page through orders using it
+			`CREATE INDEX orders_created_at_id ON orders (created_at, id)`,
+			// line items are identified by their position in the order's LineItems
+			`CREATE TABLE order_line_items (
+				order_id TEXT COLLATE "C" NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				description TEXT NOT NULL,
+				price_cents BIGINT NOT NULL,
+				quantity BIGINT NOT NULL,
+				fulfillment_status BIGINT NOT NULL DEFAULT 0,
+				fulfilled_quantity BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (order_id, position)
+			)`,
+			`CREATE TABLE idempotency_keys (
+				key TEXT NOT NULL,
+				route TEXT NOT NULL,
+				request_hash TEXT NOT NULL,
+				completed BOOLEAN NOT NULL DEFAULT FALSE,
+				status_code INTEGER NOT NULL DEFAULT 0,
+				body BYTEA,
+				PRIMARY KEY (key, route)
+			)`,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "create_order_events", func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range []string{
+			`CREATE TABLE order_events (
+				id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+				order_id TEXT COLLATE "C" NOT NULL REFERENCES orders (id),
+				type TEXT NOT NULL,
+				actor TEXT NOT NULL,
+				request_id TEXT NOT NULL,
+				old_status BIGINT NOT NULL,
+				new_status BIGINT NOT NULL,
+				amount_cents BIGINT NOT NULL,
+				charge_id TEXT NOT NULL,
+				refund_id TEXT NOT NULL,
+				detail TEXT NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE INDEX order_events_order_id ON order_events (order_id, id)`,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{3, "create_webhooks", func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range []string{
+			// event_types is empty if every type is subscribed to
+			`CREATE TABLE webhook_subscriptions (
+				id TEXT COLLATE "C" PRIMARY KEY,
+				url TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				event_types TEXT[] NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE TABLE webhook_deliveries (
+				id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+				subscription_id TEXT COLLATE "C" NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+				event_id BIGINT NOT NULL REFERENCES order_events (id),
+				status TEXT NOT NULL,
+				attempts BIGINT NOT NULL,
+				next_attempt_at TIMESTAMPTZ NOT NULL,
+				last_error TEXT NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				delivered_at TIMESTAMPTZ
+			)`,
+			`CREATE INDEX webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at, id)`,
+			`CREATE INDEX webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id)`,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "add_idempotency_key_expiry", func(ctx context.Context, tx *sql.Tx) error {
+		// keys stored before they could expire are left never expiring
+		for _, stmt := range []string{
+			`ALTER TABLE idempotency_keys ADD COLUMN expires_at TIMESTAMPTZ`,
+			`CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at)`,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// postgresMigrationLock is the key of the advisory lock held while applying a
+// migration so that instances starting at the same time apply each one once
+const postgresMigrationLock = 7_285_194_417
+
+// Migrations returns every migration, sorted by version, along with when each
+// was applied. Migrations that were applied to the database by a newer version
+// of the service are included even though this version doesn't know about them.
+func (p *PostgresInstance) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	applied := map[int]MigrationStatus{}
+	// schema_migrations is only created while holding the migration lock so we
+	// check whether it exists rather than creating it here
+	var exists bool
+	err := p.db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := p.db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var status MigrationStatus
+			var appliedAt sql.NullTime
+			if err := rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+				return nil, err
+			}
+			status.AppliedAt = timePointer(appliedAt)
+			applied[status.Version] = status
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return migrationStatuses(postgresMigrations, applied), nil
+}
+
+// Migrate applies, in order, every migration up to and including the target
+// version that hasn't been applied yet. A target of 0 applies every migration.
+// It returns the migrations that were applied.
+func (p *PostgresInstance) Migrate(ctx context.Context, target int) ([]MigrationStatus, error) {
+	if target < 0 || target > len(postgresMigrations) {
+		return nil, fmt.Errorf("unknown migration version: %d", target)
+	}
+
+	var applied []MigrationStatus
+	for _, m := range postgresMigrations {
+		if target != 0 && m.version > target {
+			break
+		}
+		now := p.now().UTC()
+		ok, err := p.applyMigration(ctx, m, now)
+		if err != nil {
+			return applied, fmt.Errorf("error applying migration %d %s: %w", m.version, m.name, err)
+		}
+		if ok {
+			applied = append(applied, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: &now})
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration applies the migration if it hasn't been already, recording that
+// it was applied at now, and returns true if it was applied
+func (p *PostgresInstance) applyMigration(ctx context.Context, m migration, now time.Time) (bool, error) {
+	var ok bool
+	err := p.inTx(ctx, func(tx *sql.Tx) error {
+		// the lock is released when the transaction ends
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)`)
+		if err != nil {
+			return err
+		}
+
+		var count int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, m.version).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+		if err := m.up(ctx, tx); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			m.version, m.name, now)
+		ok = err == nil
+		return err
+	})
+	return ok, err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// pgArgs collects the arguments of a query. Postgres placeholders are numbered
+// so add returns the placeholder for the argument it added.
+type pgArgs []interface{}
+
+// add appends the argument and returns its placeholder
+func (a *pgArgs) add(arg interface{}) string {
+	*a = append(*a, arg)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// inTx calls fn inside of a transaction which is committed if fn returns nil
+// and rolled back otherwise
+func (p *PostgresInstance) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readTx begins a read-only transaction in which every query sees the database
+// as it was when the first query ran, so an order and its line items are always
+// read from the same version of the order. By default each query in a Postgres
+// transaction sees every change committed before the query started.
+func (p *PostgresInstance) readTx(ctx context.Context) (*sql.Tx, error) {
+	return p.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+}
+
+// isUniqueViolation returns true if Postgres rejected a row because another row
+// already has the same primary key
+func isUniqueViolation(err error) bool {
+	return pq.As(err, pqerror.UniqueViolation) != nil
+}
+
+// nullTimeValue returns t for storing in one of the nullable timestamp columns
+func nullTimeValue(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// timePointer returns the UTC time in a nullable timestamp column or nil if it
+// was NULL
+func timePointer(nt sql.NullTime) *time.Time {
+	if !nt.Valid {
+		return nil
+	}
+	t := nt.Time.UTC()
+	return &t
+}
+
+// scanPostgresOrder scans a single row selected with orderColumns into an Order
+func scanPostgresOrder(row rowScanner) (Order, error) {
+	var order Order
+	// the payment columns are all NULL until the order is charged
+	var cardToken, chargeID sql.NullString
+	var amountCents sql.NullInt64
+	var paymentChargedAt sql.NullTime
+	// refunds is NULL if the order doesn't have any
+	var refundsJSON []byte
+	var chargedAt, fulfilledAt, cancelledAt sql.NullTime
+
+	err := row.Scan(
+		&order.ID,
+		&order.CustomerEmail,
+		&order.Status,
+		&cardToken,
+		&chargeID,
+		&amountCents,
+		&paymentChargedAt,
+		&refundsJSON,
+		&order.Version,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+		&chargedAt,
+		&fulfilledAt,
+		&cancelledAt,
+	)
+	if err != nil {
+		return Order{}, err
+	}
+
+	order.CreatedAt = order.CreatedAt.UTC()
+	order.UpdatedAt = order.UpdatedAt.UTC()
+	order.ChargedAt = timePointer(chargedAt)
+	order.FulfilledAt = timePointer(fulfilledAt)
+	order.CancelledAt = timePointer(cancelledAt)
+	if refundsJSON != nil {
+		if err := json.Unmarshal(refundsJSON, &order.Refunds); err != nil {
+			return Order{}, err
+		}
+	}
+	if paymentChargedAt.Valid {
+		order.Payment = &Payment{
+			CardToken:   cardToken.String,
+			ChargeID:    chargeID.String,
+			AmountCents: amountCents.Int64,
+			ChargedAt:   paymentChargedAt.Time.UTC(),
+		}
+	}
+	return order, nil
+}
+
+// refundsValue returns the refunds for storing in the refunds column which is
+// left NULL if there aren't any
+func refundsValue(refunds []Refund) (interface{}, error) {
+	if len(refunds) == 0 {
+		return nil, nil
+	}
+	byts, err := json.Marshal(refunds)
+	if err != nil {
+		return nil, err
+	}
+	return string(byts), nil
+}
+
+// loadPostgresLineItems fills in the LineItems of each of the orders with a
+// single query
+func loadPostgresLineItems(ctx context.Context, q queryer, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Order, len(orders))
+	ids := make([]string, len(orders))
+	for idx := range orders {
+		// orders without any line items should still have an empty slice
+		orders[idx].LineItems = []LineItem{}
+		byID[orders[idx].ID] = &orders[idx]
+		ids[idx] = orders[idx].ID
+	}
+	query := `SELECT ` + lineItemColumns + ` FROM order_line_items
+		WHERE order_id = ANY($1) ORDER BY order_id, position`
+	return scanLineItems(ctx, q, query, []interface{}{pq.Array(ids)}, byID)
+}
+
+// insertPostgresLineItems inserts the line items for the order with the given ID
+// with their positions matching their index in lineItems. They're inserted in
+// batches to stay well under Postgres's limit on the number of arguments.
+func insertPostgresLineItems(ctx context.Context, tx *sql.Tx, id string, lineItems []LineItem) error {
+	for start := 0; start < len(lineItems); start += lineItemsBatchSize {
+		end := start + lineItemsBatchSize
+		if end > len(lineItems) {
+			end = len(lineItems)
+		}
+		var args pgArgs
+		values := make([]string, 0, end-start)
+		for position := start; position < end; position++ {
+			li := lineItems[position]
+			values = append(values, `(`+strings.Join([]string{
+				args.add(id),
+				args.add(position),
+				args.add(li.Description),
+				args.add(li.PriceCents),
+				args.add(li.Quantity),
+				args.add(li.FulfillmentStatus),
+				args.add(li.FulfilledQuantity),
+			}, `, `)+`)`)
+		}
+		query := `INSERT INTO order_line_items (` + lineItemColumns + `) VALUES ` + strings.Join(values, `, `)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetOrder should return the order with the given ID. If that ID isn't found then
+// the special ErrOrderNotFound error should be returned.
+func (p *PostgresInstance) GetOrder(ctx context.Context, id string) (Order, error) {
+	tx, err := p.readTx(ctx)
+	if err != nil {
+		return Order{}, err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	order, err := scanPostgresOrder(tx.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Order{}, ErrOrderNotFound
+		}
+		return Order{}, err
+	}
+
+	orders := []Order{order}
+	if err := loadPostgresLineItems(ctx, tx, orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], tx.Commit()
+}
+
+// postgresQueryWhere returns the conditions for the filters that were set in the
+// query and adds their arguments to args
+func postgresQueryWhere(query OrderQuery, args *pgArgs) []string {
+	var where []string
+	if len(query.Statuses) > 0 {
+		placeholders := make([]string, len(query.Statuses))
+		for idx, s := range query.Statuses {
+			placeholders[idx] = args.add(s)
+		}
+		where = append(where, `status IN (`+strings.Join(placeholders, `, `)+`)`)
+	}
+	if query.CustomerEmail != "" {
+		where = append(where, `lower(customer_email) = `+args.add(strings.ToLower(query.CustomerEmail)))
+	}
+	if query.CustomerEmailDomain != "" {
+		pattern := `%@` + likeEscaper.Replace(strings.ToLower(query.CustomerEmailDomain))
+		where = append(where, `lower(customer_email) LIKE `+args.add(pattern)+` ESCAPE '\'`)
+	}
+	if query.MinTotalCents != nil {
+		where = append(where, lineItemsTotalSQL+` >= `+args.add(*query.MinTotalCents))
+	}
+	if query.MaxTotalCents != nil {
+		where = append(where, lineItemsTotalSQL+` <= `+args.add(*query.MaxTotalCents))
+	}
+	if query.LineItemDescription != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM order_line_items AS li WHERE li.order_id = orders.id
+			AND strpos(lower(li.description), `+args.add(strings.ToLower(query.LineItemDescription))+`) > 0)`)
+	}
+	if query.PendingRefunds {
+		where = append(where, `refunds @> '[{"pending": true}]'`)
+	}
+	if !query.Created.After.IsZero() {
+		where = append(where, `created_at > `+args.add(query.Created.After))
+	}
+	if !query.Created.Before.IsZero() {
+		where = append(where, `created_at < `+args.add(query.Created.Before))
+	}
+	return where
+}
+
+// GetOrders should return the orders matching the query, limited to the given
+// page, along with the cursor for the next page. The next cursor is empty if
+// there are no more orders and if the page's cursor isn't valid then
+// ErrInvalidCursor should be returned.
+func (p *PostgresInstance) GetOrders(ctx context.Context, query OrderQuery, page Page) ([]Order, string, error) {
+	// orders is never nil so callers get an empty slice if nothing matched
+	orders := []Order{}
+
+	var args pgArgs
+	where := postgresQueryWhere(query, &args)
+	// just like the SQLite instance we start right after the last order of the
+	// previous page rather than using OFFSET
+	if page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, `(created_at, id) < (`+args.add(c.CreatedAt)+`, `+args.add(c.ID)+`)`)
+	}
+	stmt := `SELECT ` + orderColumns + ` FROM orders`
+	if len(where) > 0 {
+		stmt += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	stmt += ` ORDER BY created_at DESC, id DESC`
+	// we ask for one more order than the limit so we know if there's a next page
+	if page.Limit > 0 {
+		stmt += ` LIMIT ` + args.add(page.Limit+1)
+	}
+
+	tx, err := p.readTx(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	// Rollback is a no-op if the transaction was already committed
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		order, err := scanPostgresOrder(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	// the rows need to be closed before the transaction can be used again
+	rows.Close()
+
+	var next string
+	if page.Limit > 0 && len(orders) > page.Limit {
+		orders = orders[:page.Limit]
+		next = encodeCursor(orders[len(orders)-1])
+	}
+	if err := loadPostgresLineItems(ctx, tx, orders); err != nil {
+		return nil, "", err
+	}
+	return orders, next, tx.Commit()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// insertPostgresOrder inserts the order, which must already have its ID, version
+// and timestamps, and its line items inside of the transaction. If the order
+// already exists then ErrOrderExists is returned.
+func insertPostgresOrder(ctx context.Context, tx *sql.Tx, order Order) error {
+	cardToken, chargeID, amountCents, chargedAt := paymentValues(order.Payment)
+	refunds, err := refundsValue(order.Refunds)
+	if err != nil {
+		return err
+	}
+
+	// rather than checking if the order exists first we let the primary key
+	// reject it which also handles two inserts of the same order at once
+	_, err = tx.ExecContext(ctx, `INSERT INTO orders (`+orderColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		order.ID, order.CustomerEmail, order.Status,
+		cardToken, chargeID, amountCents, chargedAt, refunds, order.Version,
+		order.CreatedAt, order.UpdatedAt,
+		nullTimeValue(order.ChargedAt), nullTimeValue(order.FulfilledAt), nullTimeValue(order.CancelledAt))
+	if isUniqueViolation(err) {
+		return ErrOrderExists
+	}
+	if err != nil {
+		return err
+	}
+	return insertPostgresLineItems(ctx, tx, order.ID, order.LineItems)
+}
+
+// paymentValues returns the values of the payment columns which are left NULL
+// if the order doesn't have a payment
+func paymentValues(payment *Payment) (sql.NullString, sql.NullString, sql.NullInt64, sql.NullTime) {
+	if payment == nil {
+		return sql.NullString{}, sql.NullString{}, sql.NullInt64{}, sql.NullTime{}
+	}
+	return sql.NullString{String: payment.CardToken, Valid: true},
+		sql.NullString{String: payment.ChargeID, Valid: true},
+		sql.NullInt64{Int64: payment.AmountCents, Valid: true},
+		sql.NullTime{Time: payment.ChargedAt, Valid: true}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ApplyOrderChange should make the change to the order with the ID in
+// change.Event.OrderID, or insert change.Insert, and insert the change's event
+// along with a pending webhook delivery of it for every subscription that
+// matches its type, all in a single transaction. It should return the event as it was stored. If the order isn't
+// found then the special ErrOrderNotFound error should be returned and if any of
+// the change's conditions aren't met then the error describing which one wasn't
+// should be returned and nothing should be changed.
+func (p *PostgresInstance) ApplyOrderChange(ctx context.Context, change OrderChange) (OrderEvent, error) {
+	now := p.now()
+	var event OrderEvent
+	err := p.inTx(ctx, func(tx *sql.Tx) error {
+		if change.Insert != nil {
+			var order Order
+			order, event = change.insert(now, uuid.NewString)
+			if err := insertPostgresOrder(ctx, tx, order); err != nil {
+				return err
+			}
+		} else {
+			// the order is locked so it can't change between reading it and writing
+			// it back
+			order, err := scanPostgresOrder(tx.QueryRowContext(ctx,
+				`SELECT `+orderColumns+` FROM orders WHERE id = $1 FOR UPDATE`, change.Event.OrderID))
+			if err == sql.ErrNoRows {
+				return ErrOrderNotFound
+			} else if err != nil {
+				return err
+			}
+			orders := []Order{order}
+			if err := loadPostgresLineItems(ctx, tx, orders); err != nil {
+				return err
+			}
+			order = orders[0]
+
+			if event, err = change.apply(&order, now); err != nil {
+				return err
+			}
+			if change.changesOrder() {
+				if err := savePostgresOrder(ctx, tx, order, change.changesLineItems()); err != nil {
+					return err
+				}
+			}
+		}
+
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = now
+		}
+		var err error
+		event, err = insertPostgresOrderEvent(ctx, tx, event, now)
+		return err
+	})
+	if err != nil {
+		return OrderEvent{}, err
+	}
+	return event, nil
+}
+
+// savePostgresOrder writes every column of the order, which must already exist,
+// inside of the transaction and replaces its line items if lineItems is true
+func savePostgresOrder(ctx context.Context, tx *sql.Tx, order Order, lineItems bool) error {
+	cardToken, chargeID, amountCents, chargedAt := paymentValues(order.Payment)
+	refunds, err := refundsValue(order.Refunds)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET customer_email = $1, status = $2,
+		payment_card_token = $3, payment_charge_id = $4, payment_amount_cents = $5, payment_charged_at = $6,
+		refunds = $7, version = $8, updated_at = $9, charged_at = $10, fulfilled_at = $11, cancelled_at = $12
+		WHERE id = $13`,
+		order.CustomerEmail, order.Status, cardToken, chargeID, amountCents, chargedAt, refunds,
+		order.Version, order.UpdatedAt,
+		nullTimeValue(order.ChargedAt), nullTimeValue(order.FulfilledAt), nullTimeValue(order.CancelledAt),
+		order.ID)
+	if err != nil {
+		return err
+	}
+	if !lineItems {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM order_line_items WHERE order_id = $1`, order.ID)
+	if err != nil {
+		return err
+	}
+	return insertPostgresLineItems(ctx, tx, order.ID, order.LineItems)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// InsertIdempotencyKey should store the key as an in-progress request that
+// expires at key.ExpiresAt. If a record for the same key and route already
+// exists, and hasn't expired, then it should be returned along with the special
+// ErrIdempotencyKeyExists error. An expired record is replaced.
+func (p *PostgresInstance) InsertIdempotencyKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, error) {
+	// ON CONFLICT waits for any other transaction inserting the same key and then
+	// lets the primary key decide which request gets to use it, or take over an
+	// expired one
+	expiresAt := nullTimeValue(expiresAtPointer(key.ExpiresAt))
+	result, err := p.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key, route, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (key, route) DO UPDATE SET
+		request_hash = excluded.request_hash, completed = FALSE, status_code = 0, body = NULL, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= $5`, key.Key, key.Route, key.RequestHash, expiresAt, p.now())
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if rowsAffected > 0 {
+		// return the key as it was stored rather than what the caller passed in
+		return IdempotencyKey{Key: key.Key, Route: key.Route, RequestHash: key.RequestHash, ExpiresAt: key.ExpiresAt}, nil
+	}
+
+	// the key already exists so return what's there to the caller
+	var existing IdempotencyKey
+	var existingExpiresAt sql.NullTime
+	err = p.db.QueryRowContext(ctx,
+		`SELECT key, route, request_hash, completed, status_code, body, expires_at FROM idempotency_keys WHERE key = $1 AND route = $2`,
+		key.Key, key.Route,
+	).Scan(
+		&existing.Key,
+		&existing.Route,
+		&existing.RequestHash,
+		&existing.Completed,
+		&existing.StatusCode,
+		&existing.Body,
+		&existingExpiresAt,
+	)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if t := timePointer(existingExpiresAt); t != nil {
+		existing.ExpiresAt = *t
+	}
+	return existing, ErrIdempotencyKeyExists
+}
+
+// CompleteIdempotencyKey should record the response for the key and route so it
+// can be replayed to future requests with the same key until expiresAt.
+func (p *PostgresInstance) CompleteIdempotencyKey(ctx context.Context, key, route string, statusCode int, body []byte, expiresAt time.Time) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE idempotency_keys SET completed = TRUE, status_code = $1, body = $2, expires_at = $3
+		WHERE key = $4 AND route = $5`, statusCode, body, nullTimeValue(expiresAtPointer(expiresAt)), key, route)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys should remove every key that has expired and
+// return how many were removed.
+func (p *PostgresInstance) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	result, err := p.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, p.now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// DeleteIdempotencyKey should remove the key and route so the request can be
+// tried again. Deleting a key that doesn't exist is not an error.
+func (p *PostgresInstance) DeleteIdempotencyKey(ctx context.Context, key, route string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND route = $2`, key, route)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// insertPostgresOrderEvent inserts the event, which must already have its
+// CreatedAt, and a pending webhook delivery of it, created at now, for every
+// subscription that matches its type inside of the transaction. It returns the
+// event with its ID set and its CreatedAt as it was stored.
+func insertPostgresOrderEvent(ctx context.Context, tx *sql.Tx, event OrderEvent, now time.Time) (OrderEvent, error) {
+	// just like the SQLite instance the values are selected from the order so
+	// nothing is inserted if it doesn't exist
+	err := tx.QueryRowContext(ctx, `INSERT INTO order_events (order_id, type, actor, request_id,
+		old_status, new_status, amount_cents, charge_id, refund_id, detail, created_at)
+		SELECT id, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10 FROM orders WHERE id = $11
+		RETURNING id, created_at`,
+		event.Type, event.Actor, event.RequestID, event.OldStatus, event.NewStatus,
+		event.AmountCents, event.ChargeID, event.RefundID, event.Detail, event.CreatedAt,
+		event.OrderID,
+	).Scan(&event.ID, &event.CreatedAt)
+	if err == sql.ErrNoRows {
+		return OrderEvent{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return OrderEvent{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (subscription_id, event_id,
+		status, attempts, next_attempt_at, last_error, created_at)
+		SELECT id, $1, $2, 0, $3, '', $3 FROM webhook_subscriptions
+		WHERE cardinality(event_types) = 0 OR $4 = ANY (event_types)
+		ORDER BY created_at, id`,
+		event.ID, WebhookDeliveryPending, now, event.Type)
+	if err != nil {
+		return OrderEvent{}, err
+	}
+	// return the time as it was stored, which Postgres rounds to microseconds
+	event.CreatedAt = event.CreatedAt.UTC()
+	return event, nil
+}
+
+// GetOrderEvents should return the events of the order with the given ID in
+// the order they were inserted. An order without any events, or that doesn't
+// exist, has an empty slice of events.
+func (p *PostgresInstance) GetOrderEvents(ctx context.Context, orderID string) ([]OrderEvent, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT id, order_id, type, actor, request_id, old_status,
+		new_status, amount_cents, charge_id, refund_id, detail, created_at
+		FROM order_events WHERE order_id = $1 ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// events is never nil so callers get an empty slice if there aren't any
+	events := []OrderEvent{}
+	for rows.Next() {
+		var event OrderEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.OrderID,
+			&event.Type,
+			&event.Actor,
+			&event.RequestID,
+			&event.OldStatus,
+			&event.NewStatus,
+			&event.AmountCents,
+			&event.ChargeID,
+			&event.RefundID,
+			&event.Detail,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.CreatedAt = event.CreatedAt.UTC()
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// eventTypesValue returns the event types for storing in a TEXT[] column
+func eventTypesValue(types []OrderEventType) interface{} {
+	strs := make([]string, len(types))
+	for idx, t := range types {
+		strs[idx] = string(t)
+	}
+	return pq.Array(strs)
+}
+
+// InsertWebhookSubscription should store the subscription with a newly
+// generated ID and return it with its ID and, if it wasn't set, its CreatedAt
+// filled in.
+func (p *PostgresInstance) InsertWebhookSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	sub = sub.clone()
+	sub.ID = uuid.New().String()
+	if sub.CreatedAt.IsZero() {
+		sub.CreatedAt = p.now()
+	}
+	err := p.db.QueryRowContext(ctx, `INSERT INTO webhook_subscriptions (id, url, secret, event_types, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING created_at`,
+		sub.ID, sub.URL, sub.Secret, eventTypesValue(sub.EventTypes), sub.CreatedAt,
+	).Scan(&sub.CreatedAt)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	sub.CreatedAt = sub.CreatedAt.UTC()
+	return sub, nil
+}
+
+// GetWebhookSubscriptions should return every subscription, oldest first.
+func (p *PostgresInstance) GetWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT id, url, secret, event_types, created_at
+		FROM webhook_subscriptions ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// subs is never nil so callers get an empty slice if there aren't any
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		var eventTypes []string
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.Secret, pq.Array(&eventTypes), &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		sub.EventTypes = make([]OrderEventType, len(eventTypes))
+		for idx, t := range eventTypes {
+			sub.EventTypes[idx] = OrderEventType(t)
+		}
+		sub.CreatedAt = sub.CreatedAt.UTC()
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteWebhookSubscription should remove the subscription with the given ID
+// along with all of its deliveries. If the subscription isn't found then the
+// special ErrWebhookSubscriptionNotFound error should be returned.
+func (p *PostgresInstance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	// the deliveries are removed by the foreign key's ON DELETE CASCADE
+	result, err := p.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookSubscriptionNotFound
+	}
+	return nil
+}
+
+// scanPostgresWebhookDelivery scans a row of webhookDeliveryColumns into a
+// delivery
+func scanPostgresWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var deliveredAt sql.NullTime
+	err := row.Scan(
+		&d.ID,
+		&d.SubscriptionID,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&d.LastError,
+		&d.CreatedAt,
+		&deliveredAt,
+		&d.Event.ID,
+		&d.Event.OrderID,
+		&d.Event.Type,
+		&d.Event.Actor,
+		&d.Event.RequestID,
+		&d.Event.OldStatus,
+		&d.Event.NewStatus,
+		&d.Event.AmountCents,
+		&d.Event.ChargeID,
+		&d.Event.RefundID,
+		&d.Event.Detail,
+		&d.Event.CreatedAt,
+	)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.NextAttemptAt = d.NextAttemptAt.UTC()
+	d.CreatedAt = d.CreatedAt.UTC()
+	d.Event.CreatedAt = d.Event.CreatedAt.UTC()
+	d.DeliveredAt = timePointer(deliveredAt)
+	return d, nil
+}
+
+// GetWebhookDeliveries should return the deliveries matching the query in the
+// order they were created.
+func (p *PostgresInstance) GetWebhookDeliveries(ctx context.Context, query WebhookDeliveryQuery) ([]WebhookDelivery, error) {
+	var args pgArgs
+	var where []string
+	if query.Status != "" {
+		where = append(where, `d.status = `+args.add(query.Status))
+	}
+	if !query.DueBy.IsZero() {
+		where = append(where, `d.next_attempt_at <= `+args.add(query.DueBy))
+	}
+
+	q := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries AS d
+		JOIN order_events AS e ON e.id = d.event_id`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	q += ` ORDER BY d.id`
+	if query.Limit > 0 {
+		q += ` LIMIT ` + args.add(query.Limit)
+	}
+
+	rows, err := p.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// deliveries is never nil so callers get an empty slice if nothing matched
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanPostgresWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateWebhookDelivery should replace the status, attempts, next attempt, last
+// error and delivered time of the delivery with delivery.ID, but only if its
+// current status is from. If the delivery isn't found then the special
+// ErrWebhookDeliveryNotFound error should be returned and if its status isn't
+// from then the special ErrWebhookDeliveryStatusMismatch error should be
+// returned.
+func (p *PostgresInstance) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery, from WebhookDeliveryStatus) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		var status WebhookDeliveryStatus
+		err := tx.QueryRowContext(ctx, `SELECT status FROM webhook_deliveries WHERE id = $1 FOR UPDATE`, delivery.ID).
+			Scan(&status)
+		if err == sql.ErrNoRows {
+			return ErrWebhookDeliveryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status != from {
+			return ErrWebhookDeliveryStatusMismatch
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE webhook_deliveries
+			SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, delivered_at = $5
+			WHERE id = $6`,
+			delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastError,
+			nullTimeValue(delivery.DeliveredAt), delivery.ID)
+		return err
+	})
+}
@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postgresDSNEnv is the environment variable holding the DSN of the Postgres
+// database the Postgres tests use. They're skipped if it's not set. Each test
+// gets its own schema in the database which is dropped when the test ends.
+const postgresDSNEnv = "ORDER_UP_TEST_POSTGRES_DSN"
+
+// postgresSchema creates a new schema for the test and returns a DSN whose
+// connections use it
+func postgresSchema(t *testing.T) string {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", postgresDSNEnv)
+	}
+
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	schema := fmt.Sprintf("order_up_test_%x", b)
+
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		db.Close()
+	})
+
+	// search_path is passed through to every connection
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		require.NoError(t, err)
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// newPostgres returns a new instance in its own schema that's closed when the
+// test ends
+func newPostgres(t *testing.T) *storage.PostgresInstance {
+	inst, err := storage.NewPostgres(postgresSchema(t))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		inst.Close()
+	})
+	return inst
+}
+
+func TestNewPostgres(t *testing.T) {
+	dsn := postgresSchema(t)
+
+	// instances starting at the same time only apply the migrations once
+	var wg sync.WaitGroup
+	insts := make([]*storage.PostgresInstance, 4)
+	errs := make([]error, len(insts))
+	for idx := range insts {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			insts[idx], errs[idx] = storage.NewPostgres(dsn)
+		}(idx)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if assert.NoError(t, err) {
+			insts[idx].Close()
+		}
+	}
+
+	inst, err := storage.OpenPostgres(dsn)
+	require.NoError(t, err)
+	defer inst.Close()
+	statuses, err := inst.Migrations(context.Background())
+	require.NoError(t, err)
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	var count int
+	require.NoError(t, db.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM schema_migrations`).Scan(&count))
+	assert.Equal(t, len(statuses), count)
+
+	// returns an error if the database can't be reached
+	_, err = storage.NewPostgres("postgres://localhost:1/order_up?sslmode=disable&connect_timeout=1")
+	assert.Error(t, err)
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	// OpenPostgres doesn't apply any migrations so we can apply them ourselves
+	inst, err := storage.OpenPostgres(postgresSchema(t))
+	require.NoError(t, err)
+	defer inst.Close()
+
+	// nothing has been applied yet
+	statuses, err := inst.Migrations(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, statuses)
+	for idx, s := range statuses {
+		assert.Equal(t, idx+1, s.Version)
+		assert.Nil(t, s.AppliedAt)
+	}
+
+	// only applies up to the target
+	applied, err := inst.Migrate(ctx, 1)
+	require.NoError(t, err)
+	if assert.Len(t, applied, 1) {
+		assert.Equal(t, 1, applied[0].Version)
+	}
+
+	// applies the rest
+	applied, err = inst.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(statuses)-1)
+	statuses, err = inst.Migrations(ctx)
+	require.NoError(t, err)
+	for _, s := range statuses {
+		assert.NotNil(t, s.AppliedAt, "version %d", s.Version)
+	}
+
+	// applying again doesn't do anything
+	applied, err = inst.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// errors on an unknown target
+	_, err = inst.Migrate(ctx, len(statuses)+1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import "strings"
+
+// OrderQuery filters the orders returned by GetOrders. Every filter that's set
+// must match for an order to be returned and the zero value matches every order.
+type OrderQuery struct {
+	// Statuses limits the orders to those with any of the statuses, or any status
+	// if it's empty
+	Statuses []OrderStatus
+	// CustomerEmail limits the orders to those whose customer email exactly
+	// matches, ignoring case
+	CustomerEmail string
+	// CustomerEmailDomain limits the orders to those whose customer email is at
+	// the domain, ignoring case, so "example.com" matches "bob@example.com" but
+	// not "bob@sub.example.com"
+	CustomerEmailDomain string
+	// MinTotalCents and MaxTotalCents limit the orders to those whose total is at
+	// least or at most the amount. They're pointers since discounts mean 0 and
+	// negative totals are meaningful bounds.
+	MinTotalCents *int64
+	MaxTotalCents *int64
+	// LineItemDescription limits the orders to those with at least one line item
+	// whose description contains the string, ignoring case
+	LineItemDescription string
+	// Created limits the orders to those created within the range
+	Created TimeRange
+	// PendingRefunds limits the orders to those with at least one pending refund
+	PendingRefunds bool
+}
+
+// matches returns true if the order passes every filter in the query
+func (q OrderQuery) matches(order Order) bool {
+	if len(q.Statuses) > 0 {
+		var found bool
+		for _, s := range q.Statuses {
+			if order.Status == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	email := strings.ToLower(order.CustomerEmail)
+	if q.CustomerEmail != "" && email != strings.ToLower(q.CustomerEmail) {
+		return false
+	}
+	if q.CustomerEmailDomain != "" && !strings.HasSuffix(email, "@"+strings.ToLower(q.CustomerEmailDomain)) {
+		return false
+	}
+	if q.MinTotalCents != nil || q.MaxTotalCents != nil {
+		total := order.TotalCents()
+		if q.MinTotalCents != nil && total < *q.MinTotalCents {
+			return false
+		}
+		if q.MaxTotalCents != nil && total > *q.MaxTotalCents {
+			return false
+		}
+	}
+	if q.LineItemDescription != "" {
+		desc := strings.ToLower(q.LineItemDescription)
+		var found bool
+		for _, li := range order.LineItems {
+			if strings.Contains(strings.ToLower(li.Description), desc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.PendingRefunds {
+		var found bool
+		for _, r := range order.Refunds {
+			if r.Pending {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return q.Created.contains(order.CreatedAt)
+}
@@ -5,6 +5,8 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"net/url"
 	"time"
 
 	"github.com/levenlabs/go-llog"
@@ -13,72 +15,145 @@ import (
 
 // Instance holds a database connection for use in the storage methods
 type Instance struct {
-	// database is the name of the database within the storage engine and being a
-	// variable we'll randomize this in tests so we don't need to wipe the database
-	// between every test run
-	// you should use this as the database name for all of your methods to simplify
-	// testing
-	database string
+	// path is the path to the SQLite database file and being a variable we'll
+	// randomize this in tests so we don't need to wipe the database between every
+	// test run
+	path string
 	// this is where you'd store any database connections like a *mongo.Client or
 	db *sql.DB
+	// now is used to set the timestamps on orders
+	now Clock
 }
 
-func New(overrideDatabase string) *Instance {
-	// create a pointer to an Instance that we will return after initialization
-	inst := &Instance{}
-	// if they sent overrideDatabase then use that, like for tests, otherwise
-	// fallback to a static name for production, staging, etc
-	// you might have some environmental variables or flags instead to do this but
-	// for this project this is sufficient
-	if overrideDatabase != "" {
-		inst.database = overrideDatabase
-	} else {
-		inst.database = "order_up"
+const (
+	// DefaultPath is the database file used if an empty path is sent to New
+	DefaultPath = "order_up.db"
+	// DefaultBusyTimeout is how long a query waits for another connection's
+	// write to finish before failing with a "database is locked" error
+	DefaultBusyTimeout = 5 * time.Second
+	// DefaultMaxOpenConns is the most connections that are opened to the database
+	// at once. SQLite only allows a single writer at a time so more connections
+	// only help concurrent reads.
+	DefaultMaxOpenConns = 8
+)
+
+// options holds the settings that can be changed with an Option
+type options struct {
+	busyTimeout  time.Duration
+	maxOpenConns int
+}
+
+// Option changes how New, Open and NewPostgres connect to the database
+type Option func(*options)
+
+// WithBusyTimeout sets how long a query waits for another connection's write to
+// finish before failing. The default is DefaultBusyTimeout. For Postgres it sets
+// lock_timeout.
+func WithBusyTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.busyTimeout = timeout
 	}
+}
 
-	// code for connecting to the database and storing the connected driver
-	// instance on inst
-	dbPath := inst.database + ".db"
-	db, err := sql.Open("sqlite", dbPath)
+// WithMaxOpenConns sets the most connections that are opened to the database at
+// once. The default is DefaultMaxOpenConns.
+func WithMaxOpenConns(n int) Option {
+	return func(o *options) {
+		o.maxOpenConns = n
+	}
+}
+
+// New opens the database at dbPath, creating it if it doesn't exist, and applies
+// any migrations that haven't been applied to it yet. If dbPath is empty then
+// DefaultPath is used.
+func New(dbPath string, opts ...Option) (*Instance, error) {
+	inst, err := Open(dbPath, opts...)
 	if err != nil {
-		llog.Fatal("failed to open database", llog.ErrKV(err))
+		return nil, err
 	}
-	inst.db = db
 
-	// give the ensureSchema function only 15 seconds to complete
+	// give the migrations only 15 seconds to complete
 	// after 15 seconds the context will return DeadlineExceeded errors which should
 	// cause any functions downstream to error out
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	// if we don't call cancel then the ctx will leak so we make sure that cancel
 	// is called no matter what when we're done
 	defer cancel()
-	// we want to make sure the database is ready to accept requests and if that
-	// fails we need to fatal
-	if err := inst.ensureSchema(ctx); err != nil {
-		llog.Fatal("failed to ensure schema", llog.ErrKV(err))
+	// we want to make sure the database is ready to accept requests before we
+	// return it
+	applied, err := inst.Migrate(ctx, 0)
+	if err != nil {
+		inst.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
 	}
-	return inst
+	for _, m := range applied {
+		llog.Info("applied migration", llog.KV{"version": m.Version, "name": m.Name})
+	}
+	return inst, nil
 }
 
-func (i *Instance) ensureSchema(ctx context.Context) error {
-	// TODO: this is where you'll do any schema setup (CREATE DATABASE or CREATE
-	// TABLE), if necessary, and since this will be called every time the service
-	// starts or every time you run tests, it should not fail if the schema is
-	// already setup
-	// for example you might need to add a unique index on the order's ID field ;)
-
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS orders (
-		id TEXT PRIMARY KEY,
-		customer_email TEXT NOT NULL,
-		line_items TEXT NOT NULL,
-		status INTEGER NOT NULL
-	)`
-
-	_, err := i.db.ExecContext(ctx, createTableSQL)
+// Open opens the database at dbPath without applying any migrations so that they
+// can be inspected or applied with Migrations and Migrate. Most callers want New.
+func Open(dbPath string, opts ...Option) (*Instance, error) {
+	o := options{
+		busyTimeout:  DefaultBusyTimeout,
+		maxOpenConns: DefaultMaxOpenConns,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// create a pointer to an Instance that we will return after initialization
+	inst := &Instance{now: time.Now}
+	// if they sent dbPath then use that, like for tests, otherwise fallback to a
+	// static path
+	if dbPath != "" {
+		inst.path = dbPath
+	} else {
+		inst.path = DefaultPath
+	}
+
+	// the pragmas have to be set on every connection, which the driver does for
+	// us when they're in the DSN
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.busyTimeout.Milliseconds()))
+	// foreign keys are off by default in SQLite
+	params.Add("_pragma", "foreign_keys(1)")
+	// WAL lets reads happen at the same time as a write instead of waiting for it
+	params.Add("_pragma", "journal_mode(WAL)")
+	// write transactions take the write lock immediately rather than when they
+	// first write, otherwise two transactions that both read first can't both
+	// upgrade and one fails without waiting for the busy timeout
+	params.Set("_txlock", "immediate")
+
+	// code for connecting to the database and storing the connected driver
+	// instance on inst
+	db, err := sql.Open("sqlite", inst.path+"?"+params.Encode())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error opening database: %w", err)
 	}
+	db.SetMaxOpenConns(o.maxOpenConns)
+	db.SetMaxIdleConns(o.maxOpenConns)
+	inst.db = db
+
+	// sql.Open doesn't actually connect so we ping to find out now if the
+	// database can't be opened rather than on the first request
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database %s: %w", inst.path, err)
+	}
+	return inst, nil
+}
+
+// Close closes the connections to the database
+func (i *Instance) Close() error {
+	return i.db.Close()
+}
 
-	return nil
+// SetClock replaces the clock used to set the timestamps on orders. It should be
+// called before the instance is used.
+func (i *Instance) SetClock(now Clock) {
+	i.now = now
 }
@@ -0,0 +1,1708 @@
+// Package storagetest contains a conformance suite that every implementation of
+// mocks.StorageInstance should pass so that the implementations behave the same
+// and the api package doesn't need to care which one it's using
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Instance is what an implementation needs to satisfy to run the suite
+type Instance interface {
+	mocks.StorageInstance
+	mocks.IdempotencyStorage
+	mocks.EventStorage
+	mocks.WebhookStorage
+	// SetClock replaces the clock used to set the timestamps on orders
+	SetClock(now storage.Clock)
+}
+
+// Now is the time returned by the clock that the suite sets on every instance.
+// It's a whole number of microseconds since that's as precise as Postgres
+// stores timestamps.
+var Now = time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+// concurrency is how many goroutines the concurrency tests use
+const concurrency = 10
+
+// Run runs the whole suite against the implementation. newInstance is called
+// at the start of every test and must return a new, empty, instance that
+// doesn't share any orders with the instances returned by earlier calls.
+func Run(t *testing.T, newInstance func(t *testing.T) Instance) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, inst Instance)
+	}{
+		{"InsertOrder", testInsertOrder},
+		{"GeneratedIDs", testGeneratedIDs},
+		{"GetOrder", testGetOrder},
+		{"Isolation", testIsolation},
+		{"GetOrders", testGetOrders},
+		{"GetOrdersQuery", testGetOrdersQuery},
+		{"GetOrdersPages", testGetOrdersPages},
+		{"OrderStatuses", testOrderStatuses},
+		{"OrderVersions", testOrderVersions},
+		{"ChangeLineItems", testChangeLineItems},
+		{"OrderPayment", testOrderPayment},
+		{"OrderRefunds", testOrderRefunds},
+		{"PendingRefunds", testPendingRefunds},
+		{"LineItemFulfillments", testLineItemFulfillments},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"IdempotencyKeyExpiry", testIdempotencyKeyExpiry},
+		{"OrderEvents", testOrderEvents},
+		{"ApplyOrderChange", testApplyOrderChange},
+		{"WebhookSubscriptions", testWebhookSubscriptions},
+		{"WebhookDeliveries", testWebhookDeliveries},
+		{"ConcurrentInsertOrder", testConcurrentInsertOrder},
+		{"ConcurrentOrderVersions", testConcurrentOrderVersions},
+		{"ConcurrentLineItemFulfillments", testConcurrentLineItemFulfillments},
+		{"ConcurrentIdempotencyKeys", testConcurrentIdempotencyKeys},
+		{"ConcurrentOrderEvents", testConcurrentOrderEvents},
+		{"ConcurrentApplyOrderChange", testConcurrentApplyOrderChange},
+		{"ConcurrentUpdateWebhookDelivery", testConcurrentUpdateWebhookDelivery},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			inst := newInstance(t)
+			inst.SetClock(func() time.Time {
+				return Now
+			})
+			test.fn(t, inst)
+		})
+	}
+
+	// instances should never share orders
+	t.Run("SeparateInstances", func(t *testing.T) {
+		ctx := context.Background()
+		inst1 := newInstance(t)
+		inst2 := newInstance(t)
+		_, err := insertOrder(ctx, inst1, newOrder("test1"))
+		require.NoError(t, err)
+		_, err = inst2.GetOrder(ctx, "test1")
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	})
+}
+
+// newOrder returns a pending order with the ID and 2 line items
+func newOrder(id string) storage.Order {
+	return storage.Order{
+		ID:            id,
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+			{
+				Description: "item 2",
+				Quantity:    10,
+				PriceCents:  5000,
+			},
+		},
+		Status: storage.OrderStatusPending,
+	}
+}
+
+// inserted returns the order as it should be returned after it was inserted
+// with the suite's clock
+func inserted(order storage.Order) storage.Order {
+	if order.LineItems == nil {
+		order.LineItems = []storage.LineItem{}
+	}
+	order.Version = 1
+	order.CreatedAt = Now
+	order.UpdatedAt = Now
+	return order
+}
+
+// insertOrder inserts the order along with its created event and returns its ID
+func insertOrder(ctx context.Context, inst Instance, order storage.Order) (string, error) {
+	event, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Insert: &order,
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated},
+	})
+	return event.OrderID, err
+}
+
+// insert inserts the order and fails the test if it can't be
+func insert(t *testing.T, inst Instance, order storage.Order) storage.Order {
+	id, err := insertOrder(context.Background(), inst, order)
+	require.NoError(t, err)
+	order.ID = id
+	return inserted(order)
+}
+
+// changeStatus changes the order's status from one status to another along with
+// an event of the given type
+func changeStatus(ctx context.Context, inst Instance, id string, typ storage.OrderEventType, from, to storage.OrderStatus) error {
+	_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   id,
+			Type:      typ,
+			OldStatus: from,
+			NewStatus: to,
+		},
+	})
+	return err
+}
+
+// assertErrorIs asserts that err wraps target
+func assertErrorIs(t *testing.T, err, target error) bool {
+	t.Helper()
+	if !assert.Error(t, err) {
+		return false
+	}
+	return assert.True(t, errors.Is(err, target), "expected %v but got %#v", target, err)
+}
+
+// runConcurrently calls fn from concurrency goroutines at once and returns the
+// errors they returned
+func runConcurrently(fn func(n int) error) []error {
+	errs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	// start is closed once every goroutine is ready so they all start together
+	start := make(chan struct{})
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			<-start
+			errs[n] = fn(n)
+		}(n)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+// countErrors returns how many of the errors were nil and how many wrapped
+// target. Any other errors fail the test.
+func countErrors(t *testing.T, errs []error, target error) (int, int) {
+	var succeeded, matched int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, target):
+			matched++
+		default:
+			assert.NoError(t, err)
+		}
+	}
+	return succeeded, matched
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testInsertOrder(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	order := newOrder("test1")
+	id, err := insertOrder(ctx, inst, order)
+	require.NoError(t, err)
+	assert.Equal(t, order.ID, id)
+
+	got, err := inst.GetOrder(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, inserted(order), got)
+
+	// returns exists
+	_, err = insertOrder(ctx, inst, order)
+	assertErrorIs(t, err, storage.ErrOrderExists)
+
+	// keeps the version and timestamps if they're set
+	order = newOrder("test2")
+	order.Status = storage.OrderStatusCharged
+	order.Version = 5
+	order.CreatedAt = Now.Add(-time.Hour)
+	order.UpdatedAt = Now.Add(-time.Minute)
+	chargedAt := Now.Add(-30 * time.Minute)
+	order.ChargedAt = &chargedAt
+	_, err = insertOrder(ctx, inst, order)
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	// orders without line items still get a non-nil slice
+	order = storage.Order{ID: "test3", CustomerEmail: "test@test"}
+	_, err = insertOrder(ctx, inst, order)
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.LineItem{}, got.LineItems)
+}
+
+func testGeneratedIDs(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// generated IDs are unique UUIDs
+	seen := map[string]bool{}
+	for n := 0; n < 20; n++ {
+		order := newOrder("")
+		id, err := insertOrder(ctx, inst, order)
+		require.NoError(t, err)
+		_, err = uuid.Parse(id)
+		assert.NoError(t, err, "id %q isn't a UUID", id)
+		assert.False(t, seen[id], "id %q was generated twice", id)
+		seen[id] = true
+
+		got, err := inst.GetOrder(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, id, got.ID)
+	}
+}
+
+func testGetOrder(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// returns not found
+	_, err := inst.GetOrder(ctx, "missing")
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+
+	order := insert(t, inst, newOrder("test1"))
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	// IDs are case sensitive
+	_, err = inst.GetOrder(ctx, "TEST1")
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+}
+
+func testIsolation(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// changing the order after inserting it doesn't change the stored order
+	order := newOrder("test1")
+	_, err := insertOrder(ctx, inst, order)
+	require.NoError(t, err)
+	expected := inserted(newOrder("test1"))
+	order.LineItems[0].Description = "changed"
+
+	got, err := inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+
+	// changing a returned order doesn't change the stored order
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Payment: &storage.Payment{ChargeID: "charge1", AmountCents: 100, ChargedAt: Now},
+		Refund: &storage.Refund{
+			ID:          "refund1",
+			AmountCents: 50,
+			LineItems:   []storage.RefundLineItem{{LineItem: 0, Quantity: 1}},
+			CreatedAt:   Now,
+		},
+		RefundLimitCents: 100,
+		Event:            storage.OrderEvent{OrderID: "test1", Type: storage.OrderEventRefunded},
+	})
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	got.LineItems[0].Description = "changed"
+	got.Payment.ChargeID = "changed"
+	got.Refunds[0].AmountCents = 1
+	got.Refunds[0].LineItems[0].Quantity = 5
+
+	got, err = inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, "item 1", got.LineItems[0].Description)
+	assert.Equal(t, "charge1", got.Payment.ChargeID)
+	assert.Equal(t, int64(50), got.Refunds[0].AmountCents)
+	assert.Equal(t, int64(1), got.Refunds[0].LineItems[0].Quantity)
+	expected = got
+
+	orders, _, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	orders[0].LineItems[0].Description = "changed"
+	orders[0].Refunds[0].LineItems[0].Quantity = 5
+	got, err = inst.GetOrder(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+
+	// changing the line items of a change after it's applied doesn't change the
+	// stored order
+	insert(t, inst, newOrder("test2"))
+	lineItems := []storage.LineItem{{Description: "item 3", Quantity: 1, PriceCents: 10}}
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		LineItems: lineItems,
+		Event:     storage.OrderEvent{OrderID: "test2", Type: storage.OrderEventEdited},
+	})
+	require.NoError(t, err)
+	lineItems[0].Description = "changed"
+	got, err = inst.GetOrder(ctx, "test2")
+	require.NoError(t, err)
+	assert.Equal(t, "item 3", got.LineItems[0].Description)
+
+	// changing a returned idempotency key's body doesn't change the stored one
+	key := storage.IdempotencyKey{Key: "abc", Route: "POST /orders", RequestHash: "hash"}
+	_, err = inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	body := []byte("body")
+	require.NoError(t, inst.CompleteIdempotencyKey(ctx, key.Key, key.Route, 201, body, time.Time{}))
+	body[0] = 'x'
+	existing, err := inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, "body", string(existing.Body))
+	existing.Body[0] = 'x'
+	existing, err = inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, "body", string(existing.Body))
+}
+
+func testGetOrders(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// returns an empty, non-nil, slice if there aren't any orders
+	orders, next, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{})
+	require.NoError(t, err)
+	assert.NotNil(t, orders)
+	assert.Empty(t, orders)
+	assert.Empty(t, next)
+
+	order1 := insert(t, inst, newOrder("test1"))
+	order2 := newOrder("test2")
+	order2.Status = storage.OrderStatusCharged
+	order2.CreatedAt = Now.Add(time.Hour)
+	_, err = insertOrder(ctx, inst, order2)
+	require.NoError(t, err)
+	order2.Version = 1
+	order2.UpdatedAt = order2.CreatedAt
+
+	// returns every order newest first
+	orders, next, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Order{order2, order1}, orders)
+	assert.Empty(t, next)
+
+	// returns an empty, non-nil, slice if nothing matches
+	orders, _, err = inst.GetOrders(ctx, storage.OrderQuery{
+		Statuses: []storage.OrderStatus{storage.OrderStatusCancelled},
+	}, storage.Page{})
+	require.NoError(t, err)
+	assert.NotNil(t, orders)
+	assert.Empty(t, orders)
+}
+
+func testGetOrdersQuery(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// each order is created an hour after the previous one
+	orders := make([]storage.Order, 4)
+	for idx, o := range []struct {
+		email     string
+		status    storage.OrderStatus
+		lineItems []storage.LineItem
+	}{
+		{"bob@example.com", storage.OrderStatusPending, []storage.LineItem{{Description: "Widget", PriceCents: 1000, Quantity: 2}}},
+		{"Alice@Example.com", storage.OrderStatusCharged, []storage.LineItem{{Description: "gadget", PriceCents: 500, Quantity: 1}}},
+		{"carol@sub.example.com", storage.OrderStatusFulfilled, []storage.LineItem{
+			{Description: "widget pro", PriceCents: 5000, Quantity: 1},
+			{Description: "discount", PriceCents: -6000, Quantity: 1},
+		}},
+		{"dave@example_com", storage.OrderStatusCancelled, []storage.LineItem{{Description: "100% cotton", PriceCents: 0, Quantity: 1}}},
+	} {
+		order := storage.Order{
+			ID:            fmt.Sprintf("test%d", idx),
+			CustomerEmail: o.email,
+			LineItems:     o.lineItems,
+			Status:        o.status,
+			CreatedAt:     Now.Add(time.Duration(idx) * time.Hour),
+		}
+		_, err := insertOrder(ctx, inst, order)
+		require.NoError(t, err)
+		orders[idx] = order
+	}
+
+	int64p := func(n int64) *int64 {
+		return &n
+	}
+	for _, test := range []struct {
+		name     string
+		query    storage.OrderQuery
+		expected []int
+	}{
+		{"everything", storage.OrderQuery{}, []int{3, 2, 1, 0}},
+		{"one status", storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharged}}, []int{1}},
+		{"many statuses", storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusFulfilled}}, []int{2, 0}},
+		{"email", storage.OrderQuery{CustomerEmail: "alice@example.com"}, []int{1}},
+		{"partial email", storage.OrderQuery{CustomerEmail: "alice"}, nil},
+		{"email domain", storage.OrderQuery{CustomerEmailDomain: "EXAMPLE.COM"}, []int{1, 0}},
+		{"subdomain", storage.OrderQuery{CustomerEmailDomain: "sub.example.com"}, []int{2}},
+		{"email domain wildcard", storage.OrderQuery{CustomerEmailDomain: "example_com"}, []int{3}},
+		{"min total", storage.OrderQuery{MinTotalCents: int64p(500)}, []int{1, 0}},
+		{"max total", storage.OrderQuery{MaxTotalCents: int64p(0)}, []int{3, 2}},
+		{"negative total", storage.OrderQuery{MaxTotalCents: int64p(-1)}, []int{2}},
+		{"total range", storage.OrderQuery{MinTotalCents: int64p(0), MaxTotalCents: int64p(500)}, []int{3, 1}},
+		{"description", storage.OrderQuery{LineItemDescription: "WIDGET"}, []int{2, 0}},
+		{"description on second line item", storage.OrderQuery{LineItemDescription: "discount"}, []int{2}},
+		{"description wildcard", storage.OrderQuery{LineItemDescription: "0%"}, []int{3}},
+		{"created after", storage.OrderQuery{Created: storage.TimeRange{After: Now.Add(time.Hour)}}, []int{3, 2}},
+		{"created before", storage.OrderQuery{Created: storage.TimeRange{Before: Now.Add(time.Hour)}}, []int{0}},
+		{"everything matches", storage.OrderQuery{
+			Statuses:            []storage.OrderStatus{storage.OrderStatusPending},
+			CustomerEmailDomain: "example.com",
+			MinTotalCents:       int64p(2000),
+			MaxTotalCents:       int64p(2000),
+			LineItemDescription: "widget",
+			Created:             storage.TimeRange{Before: Now.Add(time.Minute)},
+		}, []int{0}},
+		{"one doesn't match", storage.OrderQuery{
+			Statuses:            []storage.OrderStatus{storage.OrderStatusPending},
+			LineItemDescription: "gadget",
+		}, nil},
+	} {
+		got, _, err := inst.GetOrders(ctx, test.query, storage.Page{})
+		require.NoError(t, err, test.name)
+		var ids []string
+		for _, o := range got {
+			ids = append(ids, o.ID)
+		}
+		var expected []string
+		for _, idx := range test.expected {
+			expected = append(expected, orders[idx].ID)
+		}
+		assert.Equal(t, expected, ids, test.name)
+	}
+}
+
+func testGetOrdersPages(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// the last 2 orders were created at the same time so they're sorted by ID
+	for n, created := range []time.Time{Now, Now.Add(time.Minute), Now.Add(2 * time.Minute), Now.Add(2 * time.Minute)} {
+		order := newOrder(fmt.Sprintf("test%d", n))
+		order.CreatedAt = created
+		_, err := insertOrder(ctx, inst, order)
+		require.NoError(t, err)
+	}
+	expected := []string{"test3", "test2", "test1", "test0"}
+
+	for _, limit := range []int{1, 2, 3, 4, 5} {
+		var got []string
+		var cursor string
+		for pages := 0; ; pages++ {
+			require.True(t, pages <= len(expected), "too many pages")
+			orders, next, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{Limit: limit, Cursor: cursor})
+			require.NoError(t, err)
+			assert.True(t, len(orders) <= limit)
+			for _, o := range orders {
+				got = append(got, o.ID)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		assert.Equal(t, expected, got, "limit %d", limit)
+	}
+
+	// orders inserted after the cursor was returned don't shift the next page
+	orders, next, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	order := newOrder("test4")
+	order.CreatedAt = Now.Add(time.Hour)
+	_, err = insertOrder(ctx, inst, order)
+	require.NoError(t, err)
+	orders, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{Limit: 2, Cursor: next})
+	require.NoError(t, err)
+	if assert.Len(t, orders, 2) {
+		assert.Equal(t, "test1", orders[0].ID)
+		assert.Equal(t, "test0", orders[1].ID)
+	}
+
+	// returns invalid cursor
+	_, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{Cursor: "not a cursor"})
+	assertErrorIs(t, err, storage.ErrInvalidCursor)
+}
+
+func testOrderStatuses(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// returns not found
+	err := changeStatus(ctx, inst, "missing", storage.OrderEventChargeAttempted, storage.OrderStatusPending, storage.OrderStatusCharging)
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+
+	order := insert(t, inst, newOrder("test1"))
+
+	// returns a mismatch and doesn't change anything if the status isn't the
+	// event's old status
+	err = changeStatus(ctx, inst, order.ID, storage.OrderEventFulfilled, storage.OrderStatusCharged, storage.OrderStatusFulfilled)
+	assertErrorIs(t, err, storage.ErrOrderStatusMismatch)
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	from := storage.OrderStatusPending
+	for _, test := range []struct {
+		typ    storage.OrderEventType
+		status storage.OrderStatus
+	}{
+		{storage.OrderEventChargeAttempted, storage.OrderStatusCharging},
+		{storage.OrderEventCharged, storage.OrderStatusCharged},
+		{storage.OrderEventPartiallyFulfilled, storage.OrderStatusPartiallyFulfilled},
+		{storage.OrderEventFulfilled, storage.OrderStatusFulfilled},
+		{storage.OrderEventCancelled, storage.OrderStatusCancelled},
+	} {
+		require.NoError(t, changeStatus(ctx, inst, order.ID, test.typ, from, test.status))
+		got, err := inst.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		assert.Equal(t, test.status, got.Status)
+		from = test.status
+	}
+
+	// every change bumped the version and each status with a timestamp got one
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), got.Version)
+	if assert.NotNil(t, got.ChargedAt) && assert.NotNil(t, got.FulfilledAt) && assert.NotNil(t, got.CancelledAt) {
+		assert.Equal(t, Now, *got.ChargedAt)
+		assert.Equal(t, Now, *got.FulfilledAt)
+		assert.Equal(t, Now, *got.CancelledAt)
+	}
+}
+
+func testOrderVersions(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+	charging := storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventChargeAttempted,
+			OldStatus: storage.OrderStatusPending,
+			NewStatus: storage.OrderStatusCharging,
+		},
+	}
+
+	// the version is checked before the status
+	charging.Version = 2
+	_, err := inst.ApplyOrderChange(ctx, charging)
+	assertErrorIs(t, err, storage.ErrOrderVersionMismatch)
+	charging.Version = 1
+	charging.Event.OldStatus = storage.OrderStatusCharged
+	_, err = inst.ApplyOrderChange(ctx, charging)
+	assertErrorIs(t, err, storage.ErrOrderStatusMismatch)
+
+	charging.Event.OldStatus = storage.OrderStatusPending
+	_, err = inst.ApplyOrderChange(ctx, charging)
+	require.NoError(t, err)
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusCharging, got.Status)
+	assert.Equal(t, int64(2), got.Version)
+
+	// a change that only records its event doesn't bump the version but is
+	// still checked against it
+	failed := storage.OrderChange{
+		Version: 1,
+		Event:   storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventChargeFailed},
+	}
+	_, err = inst.ApplyOrderChange(ctx, failed)
+	assertErrorIs(t, err, storage.ErrOrderVersionMismatch)
+	failed.Version = 2
+	_, err = inst.ApplyOrderChange(ctx, failed)
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got.Version)
+}
+
+func testChangeLineItems(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+	edit := func(version int64, status storage.OrderStatus, lineItems []storage.LineItem) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			LineItems:     lineItems,
+			RequireStatus: true,
+			Version:       version,
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventEdited,
+				OldStatus: status,
+				NewStatus: status,
+			},
+		})
+		return err
+	}
+
+	// replaces the line items
+	lineItems := []storage.LineItem{{Description: "item 3", Quantity: 3, PriceCents: 100}}
+	require.NoError(t, edit(1, storage.OrderStatusPending, lineItems))
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	order.LineItems = lineItems
+	order.Version = 2
+	assert.Equal(t, order, got)
+
+	// returns a version mismatch if the version is stale
+	err = edit(1, storage.OrderStatusPending, lineItems)
+	assertErrorIs(t, err, storage.ErrOrderVersionMismatch)
+
+	// returns a status mismatch if the order doesn't have the status
+	err = edit(2, storage.OrderStatusCharged, lineItems)
+	assertErrorIs(t, err, storage.ErrOrderStatusMismatch)
+
+	// a version of 0 skips the version check and empty line items are allowed
+	require.NoError(t, edit(0, storage.OrderStatusPending, []storage.LineItem{}))
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.LineItem{}, got.LineItems)
+	assert.Equal(t, int64(3), got.Version)
+}
+
+func testOrderPayment(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	payment := storage.Payment{
+		CardToken:   "token",
+		ChargeID:    "charge1",
+		AmountCents: 51000,
+		ChargedAt:   Now.Add(-time.Second),
+	}
+
+	order := insert(t, inst, newOrder("test1"))
+	_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Payment: &payment,
+		Event:   storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventCharged},
+	})
+	require.NoError(t, err)
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	if assert.NotNil(t, got.Payment) {
+		assert.Equal(t, payment, *got.Payment)
+	}
+	assert.Equal(t, int64(2), got.Version)
+}
+
+func testOrderRefunds(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	refund1 := storage.Refund{
+		ID:          "refund1",
+		AmountCents: 600,
+		LineItems:   []storage.RefundLineItem{{LineItem: 0, Quantity: 1}},
+		Reason:      "damaged",
+		CreatedAt:   Now,
+	}
+	refund2 := storage.Refund{
+		ID:          "refund2",
+		AmountCents: 400,
+		CreatedAt:   Now,
+	}
+
+	order := insert(t, inst, newOrder("test1"))
+	refund := func(refund storage.Refund, limitCents int64) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Refund:           &refund,
+			RefundLimitCents: limitCents,
+			Event:            storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefunded, RefundID: refund.ID},
+		})
+		return err
+	}
+	deleteRefund := func(id string) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			DeleteRefundID: id,
+			Event:          storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefundFailed, RefundID: id},
+		})
+		return err
+	}
+	require.NoError(t, refund(refund1, 1000))
+
+	// refunds can't exceed the limit, but can reach it
+	err := refund(storage.Refund{ID: "refund3", AmountCents: 401, CreatedAt: Now}, 1000)
+	assertErrorIs(t, err, storage.ErrRefundExceedsCharge)
+	require.NoError(t, refund(refund2, 1000))
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Refund{refund1, refund2}, got.Refunds)
+	assert.Equal(t, int64(3), got.Version)
+
+	// returns refund not found
+	err = deleteRefund("refund3")
+	assertErrorIs(t, err, storage.ErrRefundNotFound)
+
+	require.NoError(t, deleteRefund(refund1.ID))
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Refund{refund2}, got.Refunds)
+
+	// deleting every refund leaves a nil slice just like an order that never
+	// had any
+	require.NoError(t, deleteRefund(refund2.ID))
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.Refunds)
+	assert.Equal(t, int64(5), got.Version)
+}
+
+func testPendingRefunds(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+	insert(t, inst, newOrder("test2"))
+	change := func(change storage.OrderChange) error {
+		change.Event = storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefundFailed}
+		_, err := inst.ApplyOrderChange(ctx, change)
+		return err
+	}
+	pending := func() []string {
+		orders, _, err := inst.GetOrders(ctx, storage.OrderQuery{PendingRefunds: true}, storage.Page{})
+		require.NoError(t, err)
+		ids := []string{}
+		for _, o := range orders {
+			ids = append(ids, o.ID)
+		}
+		return ids
+	}
+
+	require.NoError(t, change(storage.OrderChange{
+		Refund:           &storage.Refund{ID: "refund1", AmountCents: 100, CreatedAt: Now},
+		RefundLimitCents: 1000,
+	}))
+	require.NoError(t, change(storage.OrderChange{
+		Refund:           &storage.Refund{ID: "refund2", AmountCents: 100, CreatedAt: Now},
+		RefundLimitCents: 1000,
+	}))
+	assert.Equal(t, []string{}, pending())
+
+	// returns refund not found
+	err := change(storage.OrderChange{PendingRefundID: "refund3"})
+	assertErrorIs(t, err, storage.ErrRefundNotFound)
+	err = change(storage.OrderChange{ResolveRefundID: "refund3"})
+	assertErrorIs(t, err, storage.ErrRefundNotFound)
+
+	require.NoError(t, change(storage.OrderChange{PendingRefundID: "refund2"}))
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Refund{
+		{ID: "refund1", AmountCents: 100, CreatedAt: Now},
+		{ID: "refund2", AmountCents: 100, CreatedAt: Now, Pending: true},
+	}, got.Refunds)
+	assert.Equal(t, []string{order.ID}, pending())
+
+	require.NoError(t, change(storage.OrderChange{ResolveRefundID: "refund2"}))
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.False(t, got.Refunds[1].Pending)
+	assert.Equal(t, int64(5), got.Version)
+	assert.Equal(t, []string{}, pending())
+}
+
+func testLineItemFulfillments(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+	fulfill := func(fulfillments ...storage.LineItemFulfillment) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Fulfillments: fulfillments,
+			Event:        storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventPartiallyFulfilled},
+		})
+		return err
+	}
+
+	// returns line item not found for indexes out of range
+	for _, idx := range []int{-1, 2} {
+		err := fulfill(storage.LineItemFulfillment{LineItem: idx, Quantity: 1})
+		assertErrorIs(t, err, storage.ErrLineItemNotFound)
+	}
+
+	// the second line item has a quantity of 10
+	var from int64
+	for _, test := range []struct {
+		quantity int64
+		status   storage.LineItemStatus
+	}{
+		{4, storage.LineItemStatusPartiallyFulfilled},
+		{10, storage.LineItemStatusFulfilled},
+		{0, storage.LineItemStatusUnfulfilled},
+	} {
+		// returns a mismatch if the line item isn't at the expected quantity
+		err := fulfill(storage.LineItemFulfillment{LineItem: 1, From: from + 1, Quantity: test.quantity})
+		assertErrorIs(t, err, storage.ErrLineItemFulfillmentMismatch)
+
+		require.NoError(t, fulfill(storage.LineItemFulfillment{LineItem: 1, From: from, Quantity: test.quantity}))
+		got, err := inst.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		assert.Equal(t, test.quantity, got.LineItems[1].FulfilledQuantity)
+		assert.Equal(t, test.status, got.LineItems[1].FulfillmentStatus)
+		// the other line item wasn't touched
+		assert.Equal(t, order.LineItems[0], got.LineItems[0])
+		from = test.quantity
+	}
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), got.Version)
+}
+
+func testIdempotencyKeys(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	key := storage.IdempotencyKey{
+		Key:         "abc",
+		Route:       "POST /orders",
+		RequestHash: "hash",
+		// these are ignored when inserting
+		Completed:  true,
+		StatusCode: 200,
+		Body:       []byte("ignored"),
+	}
+	pending := key
+	pending.Completed = false
+	pending.StatusCode = 0
+	pending.Body = nil
+
+	got, err := inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, pending, got)
+
+	// returns the existing key
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, pending, got)
+
+	// the same key on another route is separate
+	other := pending
+	other.Route = "POST /orders/:id/charge"
+	got, err = inst.InsertIdempotencyKey(ctx, other)
+	require.NoError(t, err)
+	assert.Equal(t, other, got)
+
+	// completing records the response
+	require.NoError(t, inst.CompleteIdempotencyKey(ctx, key.Key, key.Route, 201, []byte("body"), time.Time{}))
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, storage.IdempotencyKey{
+		Key:         key.Key,
+		Route:       key.Route,
+		RequestHash: key.RequestHash,
+		Completed:   true,
+		StatusCode:  201,
+		Body:        []byte("body"),
+	}, got)
+
+	// deleting lets the key be used again
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, key.Key, key.Route))
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, pending, got)
+
+	// completing or deleting a key that doesn't exist isn't an error
+	assert.NoError(t, inst.CompleteIdempotencyKey(ctx, "missing", key.Route, 201, nil, time.Time{}))
+	assert.NoError(t, inst.DeleteIdempotencyKey(ctx, "missing", key.Route))
+
+	// keys that never expire are never deleted
+	n, err := inst.DeleteExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func testIdempotencyKeyExpiry(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	key := storage.IdempotencyKey{
+		Key:         "abc",
+		Route:       "POST /orders",
+		RequestHash: "hash",
+		ExpiresAt:   Now.Add(time.Minute),
+	}
+	got, err := inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	// the key is still in use until its lock expires
+	retry := key
+	retry.RequestHash = "other"
+	retry.ExpiresAt = Now.Add(2 * time.Minute)
+	got, err = inst.InsertIdempotencyKey(ctx, retry)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, key, got)
+
+	// and then it's taken over by the next request
+	inst.SetClock(func() time.Time {
+		return key.ExpiresAt
+	})
+	got, err = inst.InsertIdempotencyKey(ctx, retry)
+	require.NoError(t, err)
+	assert.Equal(t, retry, got)
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, retry, got)
+
+	// completing the key sets when its response expires
+	expiresAt := Now.Add(time.Hour)
+	require.NoError(t, inst.CompleteIdempotencyKey(ctx, key.Key, key.Route, 201, []byte("body"), expiresAt))
+	completed := storage.IdempotencyKey{
+		Key:         key.Key,
+		Route:       key.Route,
+		RequestHash: retry.RequestHash,
+		Completed:   true,
+		StatusCode:  201,
+		Body:        []byte("body"),
+		ExpiresAt:   expiresAt,
+	}
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, completed, got)
+
+	// a key that never expires and one that hasn't expired yet aren't deleted
+	forever := storage.IdempotencyKey{Key: "forever", Route: key.Route, RequestHash: "hash"}
+	_, err = inst.InsertIdempotencyKey(ctx, forever)
+	require.NoError(t, err)
+	later := storage.IdempotencyKey{Key: "later", Route: key.Route, RequestHash: "hash", ExpiresAt: Now.Add(2 * time.Hour)}
+	_, err = inst.InsertIdempotencyKey(ctx, later)
+	require.NoError(t, err)
+	n, err := inst.DeleteExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// once the response expires it's deleted
+	inst.SetClock(func() time.Time {
+		return expiresAt
+	})
+	n, err = inst.DeleteExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	got, err = inst.InsertIdempotencyKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+	_, err = inst.InsertIdempotencyKey(ctx, forever)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+	_, err = inst.InsertIdempotencyKey(ctx, later)
+	assertErrorIs(t, err, storage.ErrIdempotencyKeyExists)
+}
+
+func testOrderEvents(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// inserting an order records its created event
+	order := newOrder("test1")
+	created, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Insert: &order,
+		Event: storage.OrderEvent{
+			Type:        storage.OrderEventCreated,
+			Actor:       "alice",
+			RequestID:   "req1",
+			AmountCents: order.TotalCents(),
+		},
+	})
+	require.NoError(t, err)
+	assert.NotZero(t, created.ID)
+	// the clock fills in the time if it isn't set
+	assert.Equal(t, storage.OrderEvent{
+		ID:          created.ID,
+		OrderID:     order.ID,
+		Type:        storage.OrderEventCreated,
+		Actor:       "alice",
+		RequestID:   "req1",
+		OldStatus:   storage.OrderStatusPending,
+		NewStatus:   storage.OrderStatusPending,
+		AmountCents: order.TotalCents(),
+		CreatedAt:   Now,
+	}, created)
+
+	// every field is stored
+	charging := storage.OrderEvent{
+		OrderID:     order.ID,
+		Type:        storage.OrderEventChargeAttempted,
+		Actor:       "bob",
+		RequestID:   "req2",
+		OldStatus:   storage.OrderStatusPending,
+		NewStatus:   storage.OrderStatusCharging,
+		AmountCents: order.TotalCents(),
+		ChargeID:    "ch_1",
+		RefundID:    "refund1",
+		Detail:      "detail",
+		CreatedAt:   Now.Add(time.Hour),
+	}
+	got, err := inst.ApplyOrderChange(ctx, storage.OrderChange{Event: charging})
+	require.NoError(t, err)
+	assert.Greater(t, got.ID, created.ID)
+	charging.ID = got.ID
+	assert.Equal(t, charging, got)
+
+	// another order's events are separate but still get a larger ID
+	other := newOrder("test2")
+	otherEvent, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Insert: &other,
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	assert.Greater(t, otherEvent.ID, charging.ID)
+
+	events, err := inst.GetOrderEvents(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.OrderEvent{created, charging}, events)
+
+	events, err = inst.GetOrderEvents(ctx, other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.OrderEvent{otherEvent}, events)
+
+	// changing the returned events doesn't change the stored ones
+	events[0].Actor = "mallory"
+	events, err = inst.GetOrderEvents(ctx, other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", events[0].Actor)
+
+	// events can only be added to orders that exist and an order that doesn't
+	// exist has an empty slice of them
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{OrderID: "missing", Type: storage.OrderEventEdited},
+	})
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+	events, err = inst.GetOrderEvents(ctx, "missing")
+	require.NoError(t, err)
+	assert.NotNil(t, events)
+	assert.Empty(t, events)
+}
+
+func testApplyOrderChange(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	_, err := inst.InsertWebhookSubscription(ctx, storage.WebhookSubscription{URL: "http://localhost"})
+	require.NoError(t, err)
+
+	// apply applies the change and asserts that it returned its event with the
+	// ID, time and statuses filled in
+	apply := func(change storage.OrderChange) storage.OrderEvent {
+		t.Helper()
+		event, err := inst.ApplyOrderChange(ctx, change)
+		require.NoError(t, err)
+		assert.NotZero(t, event.ID)
+		assert.Equal(t, Now, event.CreatedAt)
+		return event
+	}
+	// assertEvents asserts the types of the order's events and that every event
+	// has a webhook delivery
+	assertEvents := func(id string, types ...storage.OrderEventType) []storage.OrderEvent {
+		t.Helper()
+		events, err := inst.GetOrderEvents(ctx, id)
+		require.NoError(t, err)
+		got := make([]storage.OrderEventType, len(events))
+		for idx, event := range events {
+			got[idx] = event.Type
+		}
+		assert.Equal(t, types, got)
+		return events
+	}
+
+	// an order can be inserted along with its event
+	order := newOrder("test1")
+	created := apply(storage.OrderChange{
+		Insert: &order,
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated, Actor: "alice"},
+	})
+	assert.Equal(t, order.ID, created.OrderID)
+	assert.Equal(t, storage.OrderStatusPending, created.NewStatus)
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, inserted(order), got)
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Insert: &order,
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated},
+	})
+	assertErrorIs(t, err, storage.ErrOrderExists)
+	assertEvents(order.ID, storage.OrderEventCreated)
+
+	// a new order gets a generated ID
+	generated := newOrder("")
+	event := apply(storage.OrderChange{
+		Insert: &generated,
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated},
+	})
+	assert.NotEmpty(t, event.OrderID)
+	_, err = inst.GetOrder(ctx, event.OrderID)
+	require.NoError(t, err)
+
+	// nothing is changed or recorded if a condition isn't met
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{OrderID: "missing", Type: storage.OrderEventEdited},
+	})
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Version: 2,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventChargeAttempted,
+			OldStatus: storage.OrderStatusPending,
+			NewStatus: storage.OrderStatusCharging,
+		},
+	})
+	assertErrorIs(t, err, storage.ErrOrderVersionMismatch)
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventCharged,
+			OldStatus: storage.OrderStatusCharging,
+			NewStatus: storage.OrderStatusCharged,
+		},
+	})
+	assertErrorIs(t, err, storage.ErrOrderStatusMismatch)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, inserted(order), got)
+	assertEvents(order.ID, storage.OrderEventCreated)
+
+	// the line items can be replaced as long as the order has the status
+	lineItems := []storage.LineItem{{Description: "item 3", Quantity: 2, PriceCents: 100}}
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		LineItems:     lineItems,
+		RequireStatus: true,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventEdited,
+			OldStatus: storage.OrderStatusCharged,
+			NewStatus: storage.OrderStatusCharged,
+		},
+	})
+	assertErrorIs(t, err, storage.ErrOrderStatusMismatch)
+	apply(storage.OrderChange{
+		LineItems:     lineItems,
+		RequireStatus: true,
+		Version:       1,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventEdited,
+			OldStatus: storage.OrderStatusPending,
+			NewStatus: storage.OrderStatusPending,
+		},
+	})
+
+	// the status only changes if the event's statuses are different
+	charging := apply(storage.OrderChange{
+		Version: 2,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventChargeAttempted,
+			OldStatus: storage.OrderStatusPending,
+			NewStatus: storage.OrderStatusCharging,
+		},
+	})
+	assert.Equal(t, storage.OrderStatusPending, charging.OldStatus)
+	assert.Equal(t, storage.OrderStatusCharging, charging.NewStatus)
+
+	// an event that doesn't change the order only records the event and gets the
+	// order's current status
+	failed := apply(storage.OrderChange{
+		Event: storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventChargeFailed},
+	})
+	assert.Equal(t, storage.OrderStatusCharging, failed.OldStatus)
+	assert.Equal(t, storage.OrderStatusCharging, failed.NewStatus)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), got.Version)
+
+	payment := storage.Payment{
+		CardToken:   "card",
+		ChargeID:    "ch_1",
+		AmountCents: 200,
+		ChargedAt:   Now,
+	}
+	apply(storage.OrderChange{
+		Payment: &payment,
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventCharged,
+			OldStatus: storage.OrderStatusCharging,
+			NewStatus: storage.OrderStatusCharged,
+		},
+	})
+
+	// refunds can't exceed the limit and only existing ones can be deleted
+	refund := storage.Refund{ID: "refund1", AmountCents: 150, CreatedAt: Now}
+	refunded := storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefunded}
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{Refund: &refund, RefundLimitCents: 100, Event: refunded})
+	assertErrorIs(t, err, storage.ErrRefundExceedsCharge)
+	apply(storage.OrderChange{Refund: &refund, RefundLimitCents: 200, Event: refunded})
+	refundFailed := storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefundFailed}
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{DeleteRefundID: "missing", Event: refundFailed})
+	assertErrorIs(t, err, storage.ErrRefundNotFound)
+
+	// line items can only be fulfilled if they exist
+	fulfilled := storage.OrderEvent{
+		OrderID:   order.ID,
+		Type:      storage.OrderEventFulfilled,
+		OldStatus: storage.OrderStatusCharged,
+		NewStatus: storage.OrderStatusFulfilled,
+	}
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Fulfillments: []storage.LineItemFulfillment{{LineItem: 1, Quantity: 2}},
+		Event:        fulfilled,
+	})
+	assertErrorIs(t, err, storage.ErrLineItemNotFound)
+	// and only if they're still at the fulfilled quantity the change expects
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Fulfillments: []storage.LineItemFulfillment{{LineItem: 0, From: 1, Quantity: 2}},
+		Event:        fulfilled,
+	})
+	assertErrorIs(t, err, storage.ErrLineItemFulfillmentMismatch)
+	apply(storage.OrderChange{
+		Fulfillments: []storage.LineItemFulfillment{{LineItem: 0, Quantity: 2}},
+		Event:        fulfilled,
+	})
+
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	want := inserted(order)
+	want.LineItems = []storage.LineItem{{
+		Description:       "item 3",
+		Quantity:          2,
+		PriceCents:        100,
+		FulfilledQuantity: 2,
+		FulfillmentStatus: storage.LineItemStatusFulfilled,
+	}}
+	want.Status = storage.OrderStatusFulfilled
+	want.Payment = &payment
+	want.Refunds = []storage.Refund{refund}
+	want.Version = 6
+	now := Now
+	want.ChargedAt = &now
+	want.FulfilledAt = &now
+	assert.Equal(t, want, got)
+
+	events := assertEvents(order.ID,
+		storage.OrderEventCreated,
+		storage.OrderEventEdited,
+		storage.OrderEventChargeAttempted,
+		storage.OrderEventChargeFailed,
+		storage.OrderEventCharged,
+		storage.OrderEventRefunded,
+		storage.OrderEventFulfilled,
+	)
+	assert.Equal(t, created, events[0])
+
+	// every event that was recorded has a webhook delivery
+	deliveries, err := inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	assert.Len(t, deliveries, len(events)+1)
+}
+
+func testWebhookSubscriptions(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// there's an empty slice of subscriptions before any are inserted
+	subs, err := inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, subs)
+	assert.Empty(t, subs)
+
+	all, err := inst.InsertWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:    "http://localhost/all",
+		Secret: "secret1",
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, all.ID)
+	// a subscription to every event type always has an empty slice of them and
+	// the clock fills in the time if it isn't set
+	assert.Equal(t, storage.WebhookSubscription{
+		ID:         all.ID,
+		URL:        "http://localhost/all",
+		Secret:     "secret1",
+		EventTypes: []storage.OrderEventType{},
+		CreatedAt:  Now,
+	}, all)
+
+	charged := storage.WebhookSubscription{
+		URL:        "http://localhost/charged",
+		Secret:     "secret2",
+		EventTypes: []storage.OrderEventType{storage.OrderEventCharged, storage.OrderEventChargeFailed},
+		CreatedAt:  Now.Add(time.Hour),
+	}
+	got, err := inst.InsertWebhookSubscription(ctx, charged)
+	require.NoError(t, err)
+	assert.NotEqual(t, all.ID, got.ID)
+	charged.ID = got.ID
+	assert.Equal(t, charged, got)
+
+	// changing the inserted subscription doesn't change the stored one
+	charged.EventTypes[0] = storage.OrderEventCreated
+
+	subs, err = inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookSubscription{all, got}, subs)
+
+	// changing the returned subscriptions doesn't change the stored ones
+	subs[1].EventTypes[0] = storage.OrderEventCreated
+	subs, err = inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderEventCharged, subs[1].EventTypes[0])
+
+	require.NoError(t, inst.DeleteWebhookSubscription(ctx, all.ID))
+	subs, err = inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookSubscription{got}, subs)
+
+	err = inst.DeleteWebhookSubscription(ctx, all.ID)
+	assertErrorIs(t, err, storage.ErrWebhookSubscriptionNotFound)
+}
+
+func testWebhookDeliveries(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// events recorded before there are any subscriptions, like this order's
+	// created event, aren't delivered
+	order := insert(t, inst, newOrder("test1"))
+	deliveries, err := inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	assert.NotNil(t, deliveries)
+	assert.Empty(t, deliveries)
+
+	all, err := inst.InsertWebhookSubscription(ctx, storage.WebhookSubscription{URL: "http://localhost/all"})
+	require.NoError(t, err)
+	// the deliveries of an event are created in the order the subscriptions were
+	charged, err := inst.InsertWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:        "http://localhost/charged",
+		EventTypes: []storage.OrderEventType{storage.OrderEventCharged},
+		CreatedAt:  Now.Add(time.Second),
+	})
+	require.NoError(t, err)
+
+	// every event is delivered to the subscriptions that match its type
+	edited, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:   order.ID,
+			Type:      storage.OrderEventEdited,
+			Actor:     "alice",
+			CreatedAt: Now.Add(-time.Minute),
+		},
+	})
+	require.NoError(t, err)
+	chargedEvent, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{
+			OrderID:     order.ID,
+			Type:        storage.OrderEventCharged,
+			Actor:       "bob",
+			AmountCents: order.TotalCents(),
+			ChargeID:    "ch_1",
+		},
+	})
+	require.NoError(t, err)
+
+	// failing to record an event doesn't create any deliveries
+	_, err = inst.ApplyOrderChange(ctx, storage.OrderChange{
+		Event: storage.OrderEvent{OrderID: "missing", Type: storage.OrderEventCharged},
+	})
+	assertErrorIs(t, err, storage.ErrOrderNotFound)
+
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	if !assert.Len(t, deliveries, 3) {
+		return
+	}
+	// the deliveries are pending and due as soon as they're created and they're
+	// returned in the order they were created
+	for n, d := range deliveries {
+		if n > 0 {
+			assert.Greater(t, d.ID, deliveries[n-1].ID)
+		}
+		assert.Equal(t, storage.WebhookDeliveryPending, d.Status)
+		assert.Zero(t, d.Attempts)
+		assert.Equal(t, Now, d.NextAttemptAt)
+		assert.Empty(t, d.LastError)
+		assert.Equal(t, Now, d.CreatedAt)
+		assert.Nil(t, d.DeliveredAt)
+	}
+	assert.Equal(t, all.ID, deliveries[0].SubscriptionID)
+	assert.Equal(t, edited, deliveries[0].Event)
+	assert.Equal(t, all.ID, deliveries[1].SubscriptionID)
+	assert.Equal(t, chargedEvent, deliveries[1].Event)
+	assert.Equal(t, charged.ID, deliveries[2].SubscriptionID)
+	assert.Equal(t, chargedEvent, deliveries[2].Event)
+
+	// the first is delivered and the second is retried later
+	deliveredAt := Now.Add(time.Second)
+	delivered := deliveries[0]
+	delivered.Status = storage.WebhookDeliveryDelivered
+	delivered.Attempts = 1
+	delivered.DeliveredAt = &deliveredAt
+	require.NoError(t, inst.UpdateWebhookDelivery(ctx, delivered, storage.WebhookDeliveryPending))
+	retried := deliveries[1]
+	retried.Attempts = 1
+	retried.NextAttemptAt = Now.Add(time.Minute)
+	retried.LastError = "connection refused"
+	require.NoError(t, inst.UpdateWebhookDelivery(ctx, retried, storage.WebhookDeliveryPending))
+
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	if assert.Len(t, deliveries, 3) {
+		assert.Equal(t, delivered, deliveries[0])
+		assert.Equal(t, retried, deliveries[1])
+	}
+	pending := deliveries[2]
+
+	// the query filters by status and when the deliveries are due
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{
+		Status: storage.WebhookDeliveryPending,
+		DueBy:  Now,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookDelivery{pending}, deliveries)
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{
+		Status: storage.WebhookDeliveryPending,
+		DueBy:  Now.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookDelivery{retried, pending}, deliveries)
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{
+		Status: storage.WebhookDeliveryPending,
+		Limit:  1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookDelivery{retried}, deliveries)
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{Status: storage.WebhookDeliveryDead})
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	// updates are conditional on the current status
+	err = inst.UpdateWebhookDelivery(ctx, delivered, storage.WebhookDeliveryPending)
+	assertErrorIs(t, err, storage.ErrWebhookDeliveryStatusMismatch)
+	missing := pending
+	missing.ID = pending.ID + 1000
+	err = inst.UpdateWebhookDelivery(ctx, missing, storage.WebhookDeliveryPending)
+	assertErrorIs(t, err, storage.ErrWebhookDeliveryNotFound)
+
+	// a dead delivery can be made pending again
+	dead := pending
+	dead.Status = storage.WebhookDeliveryDead
+	dead.Attempts = 5
+	dead.LastError = "500 Internal Server Error"
+	require.NoError(t, inst.UpdateWebhookDelivery(ctx, dead, storage.WebhookDeliveryPending))
+	revived := dead
+	revived.Status = storage.WebhookDeliveryPending
+	revived.Attempts = 0
+	revived.LastError = ""
+	require.NoError(t, inst.UpdateWebhookDelivery(ctx, revived, storage.WebhookDeliveryDead))
+
+	// deleting a subscription deletes its deliveries
+	require.NoError(t, inst.DeleteWebhookSubscription(ctx, all.ID))
+	deliveries, err = inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookDelivery{revived}, deliveries)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testConcurrentInsertOrder(t *testing.T, inst Instance) {
+	ctx := context.Background()
+
+	// only one insert of the same ID wins
+	errs := runConcurrently(func(n int) error {
+		_, err := insertOrder(ctx, inst, newOrder("test1"))
+		return err
+	})
+	succeeded, exists := countErrors(t, errs, storage.ErrOrderExists)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, exists)
+
+	// every insert of a different ID wins
+	errs = runConcurrently(func(n int) error {
+		_, err := insertOrder(ctx, inst, newOrder(""))
+		return err
+	})
+	succeeded, _ = countErrors(t, errs, storage.ErrOrderExists)
+	assert.Equal(t, concurrency, succeeded)
+
+	orders, _, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.Page{})
+	require.NoError(t, err)
+	assert.Len(t, orders, concurrency+1)
+	for _, o := range orders {
+		assert.Len(t, o.LineItems, 2)
+	}
+}
+
+func testConcurrentOrderVersions(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+
+	// only one caller with the current version wins
+	errs := runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Version: 1,
+			Payment: &storage.Payment{ChargeID: fmt.Sprintf("ch_%d", n), AmountCents: 100, ChargedAt: Now},
+			Event:   storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventCharged},
+		})
+		return err
+	})
+	succeeded, mismatched := countErrors(t, errs, storage.ErrOrderVersionMismatch)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, mismatched)
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got.Version)
+	events, err := inst.GetOrderEvents(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func testConcurrentLineItemFulfillments(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := newOrder("test1")
+	order.LineItems = nil
+	for n := 0; n < concurrency; n++ {
+		order.LineItems = append(order.LineItems, storage.LineItem{
+			Description: fmt.Sprintf("item %d", n),
+			Quantity:    int64(n + 1),
+			PriceCents:  100,
+		})
+	}
+	insert(t, inst, order)
+
+	// fulfilling different line items at the same time doesn't lose any of them
+	errs := runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Fulfillments: []storage.LineItemFulfillment{{LineItem: n, Quantity: int64(n + 1)}},
+			Event:        storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventPartiallyFulfilled},
+		})
+		return err
+	})
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// but only one caller gets to fulfill the same line item from the same
+	// quantity
+	errs = runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Fulfillments: []storage.LineItemFulfillment{{LineItem: 0, From: 1, Quantity: 0}},
+			Event:        storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventFulfillmentFailed},
+		})
+		return err
+	})
+	succeeded, mismatched := countErrors(t, errs, storage.ErrLineItemFulfillmentMismatch)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, mismatched)
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	for n, li := range got.LineItems[1:] {
+		assert.Equal(t, int64(n+2), li.FulfilledQuantity)
+		assert.Equal(t, storage.LineItemStatusFulfilled, li.FulfillmentStatus)
+	}
+	assert.Equal(t, int64(0), got.LineItems[0].FulfilledQuantity)
+	assert.Equal(t, int64(2+concurrency), got.Version)
+}
+
+func testConcurrentIdempotencyKeys(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	key := storage.IdempotencyKey{Key: "abc", Route: "POST /orders", RequestHash: "hash"}
+
+	// only one request gets to use the key
+	errs := runConcurrently(func(n int) error {
+		_, err := inst.InsertIdempotencyKey(ctx, key)
+		return err
+	})
+	succeeded, exists := countErrors(t, errs, storage.ErrIdempotencyKeyExists)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, exists)
+}
+
+func testConcurrentOrderEvents(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+
+	// events recorded at the same time all get stored with different IDs
+	errs := runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:     order.ID,
+				Type:        storage.OrderEventEdited,
+				Actor:       fmt.Sprintf("actor%d", n),
+				AmountCents: int64(n),
+			},
+		})
+		return err
+	})
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// along with the order's created event
+	events, err := inst.GetOrderEvents(ctx, order.ID)
+	require.NoError(t, err)
+	if assert.Len(t, events, 1+concurrency) {
+		for n := 1; n < len(events); n++ {
+			assert.Greater(t, events[n].ID, events[n-1].ID)
+		}
+	}
+}
+
+func testConcurrentApplyOrderChange(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	order := insert(t, inst, newOrder("test1"))
+
+	// only one caller gets to start charging the order and only its event is
+	// recorded
+	errs := runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Event: storage.OrderEvent{
+				OrderID:   order.ID,
+				Type:      storage.OrderEventChargeAttempted,
+				Actor:     fmt.Sprintf("actor%d", n),
+				OldStatus: storage.OrderStatusPending,
+				NewStatus: storage.OrderStatusCharging,
+			},
+		})
+		return err
+	})
+	succeeded, mismatched := countErrors(t, errs, storage.ErrOrderStatusMismatch)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, mismatched)
+
+	// only half of the refunds fit in the limit and only their events are
+	// recorded
+	errs = runConcurrently(func(n int) error {
+		_, err := inst.ApplyOrderChange(ctx, storage.OrderChange{
+			Refund: &storage.Refund{
+				ID:          fmt.Sprintf("refund%d", n),
+				AmountCents: 100,
+				CreatedAt:   Now,
+			},
+			RefundLimitCents: 100 * concurrency / 2,
+			Event:            storage.OrderEvent{OrderID: order.ID, Type: storage.OrderEventRefunded},
+		})
+		return err
+	})
+	succeeded, exceeded := countErrors(t, errs, storage.ErrRefundExceedsCharge)
+	assert.Equal(t, concurrency/2, succeeded)
+	assert.Equal(t, concurrency/2, exceeded)
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Len(t, got.Refunds, concurrency/2)
+	assert.Equal(t, int64(2+concurrency/2), got.Version)
+	// along with the order's created event
+	events, err := inst.GetOrderEvents(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Len(t, events, 2+concurrency/2)
+}
+
+func testConcurrentUpdateWebhookDelivery(t *testing.T, inst Instance) {
+	ctx := context.Background()
+	_, err := inst.InsertWebhookSubscription(ctx, storage.WebhookSubscription{URL: "http://localhost"})
+	require.NoError(t, err)
+	// the order's created event is delivered to the subscription
+	insert(t, inst, newOrder("test1"))
+	deliveries, err := inst.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	// only one dispatcher gets to finish the delivery
+	errs := runConcurrently(func(n int) error {
+		d := deliveries[0]
+		d.Status = storage.WebhookDeliveryDelivered
+		d.Attempts = n + 1
+		return inst.UpdateWebhookDelivery(ctx, d, storage.WebhookDeliveryPending)
+	})
+	succeeded, mismatched := countErrors(t, errs, storage.ErrWebhookDeliveryStatusMismatch)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, concurrency-1, mismatched)
+}
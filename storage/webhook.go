@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrWebhookSubscriptionNotFound is returned when the specified webhook
+	// subscription cannot be found
+	ErrWebhookSubscriptionNotFound = errors.New("webhook subscription not found")
+
+	// ErrWebhookDeliveryNotFound is returned when the specified webhook delivery
+	// cannot be found
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+	// ErrWebhookDeliveryStatusMismatch is returned when a webhook delivery is
+	// being updated conditionally but its current status isn't the expected one
+	ErrWebhookDeliveryStatusMismatch = errors.New("webhook delivery status mismatch")
+)
+
+// WebhookSubscription is a URL that's sent a webhook for every order event of
+// the subscribed types
+type WebhookSubscription struct {
+	// ID uniquely identifies the subscription
+	ID string `json:"id"`
+	// URL is where the webhooks are POSTed
+	URL string `json:"url"`
+	// Secret is used to sign the webhooks so the receiver can verify they came
+	// from us. It's never returned to API callers after the subscription is
+	// created.
+	Secret string `json:"-"`
+	// EventTypes are the order events that are sent to the URL and if it's empty
+	// then every event is sent
+	EventTypes []OrderEventType `json:"eventTypes"`
+	// CreatedAt is when the subscription was created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Matches returns true if events of the type should be sent to the subscription
+func (s WebhookSubscription) Matches(typ OrderEventType) bool {
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range s.EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the subscription that doesn't share its event types
+// with the original. The copy always has a non-nil slice of event types, which
+// is also how the SQL instances return subscriptions.
+func (s WebhookSubscription) clone() WebhookSubscription {
+	s.EventTypes = append(make([]OrderEventType, 0, len(s.EventTypes)), s.EventTypes...)
+	return s
+}
+
+// WebhookDeliveryStatus describes where a webhook delivery is in its lifecycle
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryPending means the webhook hasn't been delivered yet and will
+	// be attempted at the delivery's NextAttemptAt
+	WebhookDeliveryPending WebhookDeliveryStatus = "pending"
+
+	// WebhookDeliveryDelivered means the receiver accepted the webhook
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+
+	// WebhookDeliveryDead means every attempt to deliver the webhook failed and
+	// it won't be attempted again unless it's retried
+	WebhookDeliveryDead WebhookDeliveryStatus = "dead"
+)
+
+// WebhookDelivery is a single order event that needs to be, or was, sent to a
+// single subscription. Deliveries are created in the same transaction as their
+// event so that every event is delivered at least once.
+type WebhookDelivery struct {
+	// ID is assigned when the delivery is created
+	ID int64 `json:"id"`
+	// SubscriptionID is the ID of the subscription the event is sent to
+	SubscriptionID string `json:"subscriptionId"`
+	// Event is the order event that's sent
+	Event OrderEvent `json:"event"`
+	// Status is where the delivery is in its lifecycle
+	Status WebhookDeliveryStatus `json:"status"`
+	// Attempts is how many times sending the webhook was attempted
+	Attempts int `json:"attempts"`
+	// NextAttemptAt is when a pending delivery should next be attempted
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	// LastError is why the last attempt failed and is empty if it didn't
+	LastError string `json:"lastError,omitempty"`
+	// CreatedAt is when the delivery was created
+	CreatedAt time.Time `json:"createdAt"`
+	// DeliveredAt is when the receiver accepted the webhook and is nil until then
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// clone returns a copy of the delivery that doesn't share its delivered time
+// with the original
+func (d WebhookDelivery) clone() WebhookDelivery {
+	if d.DeliveredAt != nil {
+		t := *d.DeliveredAt
+		d.DeliveredAt = &t
+	}
+	return d
+}
+
+// newWebhookDelivery returns the pending delivery of the event to the
+// subscription created at now
+func newWebhookDelivery(sub WebhookSubscription, event OrderEvent, now time.Time) WebhookDelivery {
+	return WebhookDelivery{
+		SubscriptionID: sub.ID,
+		Event:          event,
+		Status:         WebhookDeliveryPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+}
+
+// WebhookDeliveryQuery limits which deliveries GetWebhookDeliveries returns
+type WebhookDeliveryQuery struct {
+	// Status limits the deliveries to those with the status and if it's empty
+	// deliveries with any status are returned
+	Status WebhookDeliveryStatus
+	// DueBy limits the deliveries to those whose NextAttemptAt isn't after it and
+	// if it's the zero time it's ignored
+	DueBy time.Time
+	// Limit is the most deliveries to return and if it's 0 they're all returned
+	Limit int
+}
+
+// matches returns true if the delivery should be returned for the query
+func (q WebhookDeliveryQuery) matches(d WebhookDelivery) bool {
+	if q.Status != "" && d.Status != q.Status {
+		return false
+	}
+	if !q.DueBy.IsZero() && d.NextAttemptAt.After(q.DueBy) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+// Package stream is an in-process pub/sub of order changes. The API handlers
+// publish to a Broker after every change they make and the subscribers, like the
+// GET /orders/stream handler, receive them as they happen. The most recent
+// messages are kept in a bounded buffer so a subscriber that disconnected can
+// resume from the last message it saw.
+package stream
+
+import (
+	"sync"
+
+	"github.com/levenlabs/order-up/storage"
+)
+
+const (
+	// DefaultBufferSize is how many of the most recent messages a Broker keeps
+	// for subscribers that are resuming
+	DefaultBufferSize = 1000
+	// subscriptionBuffer is how many messages can be waiting for a subscriber
+	// before it's considered too slow and closed
+	subscriptionBuffer = 64
+)
+
+// Message is a single order change that was published
+type Message struct {
+	// ID is assigned when the message is published and is one larger than the ID
+	// of the message published before it. IDs start over at 1 when the process
+	// restarts.
+	ID uint64
+	// Event describes the change
+	Event storage.OrderEvent
+}
+
+// Broker fans out published messages to every subscription
+type Broker struct {
+	m      sync.Mutex
+	size   int
+	buf    []Message
+	lastID uint64
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewBroker returns a Broker that keeps the size most recent messages for
+// subscribers that are resuming
+func NewBroker(size int) *Broker {
+	return &Broker{
+		size: size,
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the event the next ID and sends it to every subscription.
+// Publish never blocks on a subscriber, one that's too far behind is closed
+// instead and can resume with the ID of the last message it received.
+func (b *Broker) Publish(event storage.OrderEvent) Message {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.lastID++
+	msg := Message{ID: b.lastID, Event: event}
+	if b.size > 0 {
+		if len(b.buf) >= b.size {
+			// shift rather than reslice so the oldest messages can be freed
+			copy(b.buf, b.buf[1:])
+			b.buf = b.buf[:len(b.buf)-1]
+		}
+		b.buf = append(b.buf, msg)
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.c <- msg:
+		default:
+			b.unsubscribe(sub)
+		}
+	}
+	return msg
+}
+
+// Subscribe returns a subscription that receives every message published after
+// it. If after isn't 0 then the buffered messages published after the message
+// with that ID are returned as well so the subscriber doesn't miss anything.
+// complete is false if some of those messages are no longer buffered, or after
+// isn't an ID this Broker published, in which case the subscriber should reload
+// whatever it's tracking.
+func (b *Broker) Subscribe(after uint64) (sub *Subscription, backlog []Message, complete bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	sub = &Subscription{
+		b: b,
+		c: make(chan Message, subscriptionBuffer),
+	}
+	if b.closed {
+		close(sub.c)
+		return sub, nil, true
+	}
+	b.subs[sub] = struct{}{}
+
+	if after == 0 {
+		return sub, nil, true
+	}
+	// an ID from the future is from before the process restarted
+	if after > b.lastID {
+		return sub, append([]Message(nil), b.buf...), false
+	}
+	complete = after == b.lastID
+	for idx, msg := range b.buf {
+		if msg.ID > after {
+			// the message right after the last one they saw needs to still be in
+			// the buffer otherwise they missed some
+			complete = idx > 0 || msg.ID == after+1
+			backlog = append([]Message(nil), b.buf[idx:]...)
+			break
+		}
+	}
+	return sub, backlog, complete
+}
+
+// Close closes every subscription, and any made afterwards, so that the
+// subscribers stop. It's meant to be called when the server is shutting down.
+func (b *Broker) Close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.unsubscribe(sub)
+	}
+}
+
+// unsubscribe removes the subscription and closes its channel. The caller must
+// hold the lock.
+func (b *Broker) unsubscribe(sub *Subscription) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.c)
+}
+
+// Subscription receives the messages published to a Broker after it was made
+type Subscription struct {
+	b *Broker
+	c chan Message
+}
+
+// C returns the channel the messages are received on. It's closed once the
+// subscription is closed, by Close or because the subscriber fell too far
+// behind.
+func (s *Subscription) C() <-chan Message {
+	return s.c
+}
+
+// Close stops the subscription from receiving any more messages
+func (s *Subscription) Close() {
+	s.b.m.Lock()
+	defer s.b.m.Unlock()
+	s.b.unsubscribe(s)
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishN publishes n events and returns their messages
+func publishN(b *Broker, n int) []Message {
+	var msgs []Message
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, b.Publish(storage.OrderEvent{OrderID: "order1", Type: storage.OrderEventCharged}))
+	}
+	return msgs
+}
+
+func TestSubscribe(t *testing.T) {
+	b := NewBroker(3)
+
+	// subscribers get every message published after they subscribed
+	sub, backlog, complete := b.Subscribe(0)
+	assert.Empty(t, backlog)
+	assert.True(t, complete)
+	msgs := publishN(b, 2)
+	assert.Equal(t, uint64(1), msgs[0].ID)
+	assert.Equal(t, uint64(2), msgs[1].ID)
+	assert.Equal(t, msgs[0], <-sub.C())
+	assert.Equal(t, msgs[1], <-sub.C())
+
+	// closing the subscription closes its channel
+	sub.Close()
+	_, ok := <-sub.C()
+	assert.False(t, ok)
+	// and publishing afterwards is fine
+	msgs = append(msgs, publishN(b, 3)...)
+
+	// resuming returns the buffered messages after the last one they saw
+	for after, expected := range map[uint64][]Message{
+		2: msgs[2:],
+		3: msgs[3:],
+		5: nil,
+	} {
+		sub, backlog, complete := b.Subscribe(after)
+		assert.Equal(t, expected, backlog, "after %d", after)
+		assert.True(t, complete, "after %d", after)
+		sub.Close()
+	}
+
+	// resuming from a message that was dropped from the buffer, or one that
+	// wasn't published by this broker, returns everything that's buffered but
+	// isn't complete
+	for _, after := range []uint64{1, 6} {
+		sub, backlog, complete := b.Subscribe(after)
+		assert.Equal(t, msgs[2:], backlog, "after %d", after)
+		assert.False(t, complete, "after %d", after)
+		sub.Close()
+	}
+
+	// without a buffer there's nothing to resume from
+	b = NewBroker(0)
+	publishN(b, 2)
+	_, backlog, complete = b.Subscribe(1)
+	assert.Empty(t, backlog)
+	assert.False(t, complete)
+	_, backlog, complete = b.Subscribe(2)
+	assert.Empty(t, backlog)
+	assert.True(t, complete)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	b := NewBroker(DefaultBufferSize)
+	slow, _, _ := b.Subscribe(0)
+	fast, _, _ := b.Subscribe(0)
+
+	// a subscriber that doesn't keep up is closed rather than blocking Publish
+	// and it can resume from the last message it received
+	var last Message
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		msg := b.Publish(storage.OrderEvent{OrderID: "order1"})
+		require.Equal(t, msg, <-fast.C())
+	}
+	for msg := range slow.C() {
+		last = msg
+	}
+	assert.Equal(t, uint64(subscriptionBuffer), last.ID)
+
+	resumed, backlog, complete := b.Subscribe(last.ID)
+	assert.True(t, complete)
+	if assert.Len(t, backlog, 1) {
+		assert.Equal(t, uint64(subscriptionBuffer+1), backlog[0].ID)
+	}
+	resumed.Close()
+	fast.Close()
+}
+
+func TestClose(t *testing.T) {
+	b := NewBroker(DefaultBufferSize)
+	sub, _, _ := b.Subscribe(0)
+	b.Close()
+	_, ok := <-sub.C()
+	assert.False(t, ok)
+	// closing it again is fine
+	sub.Close()
+
+	// subscriptions made after the broker is closed are already closed
+	sub, _, _ = b.Subscribe(0)
+	_, ok = <-sub.C()
+	assert.False(t, ok)
+}
@@ -0,0 +1,98 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the header that holds the signature of every webhook. It
+// looks like "t=1700000000,v1=5257a869..." where t is the Unix time the webhook
+// was signed and v1 is the hex-encoded HMAC-SHA256, keyed with the
+// subscription's secret, of t, a period and the request body.
+const SignatureHeader = "X-Order-Up-Signature"
+
+// ErrInvalidSignature is returned by Verify when the signature header is
+// missing, malformed or doesn't match the body
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ErrSignatureExpired is returned by Verify when the signature is valid but was
+// made too long ago, which could mean the webhook is being replayed
+var ErrSignatureExpired = errors.New("webhook signature expired")
+
+// NewSecret returns a random secret for signing a subscription's webhooks
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating webhook secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sign returns the hex-encoded HMAC of the timestamp and body
+func sign(secret string, timestamp int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	sum := mac.Sum(nil)
+	dst := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(dst, sum)
+	return dst
+}
+
+// Sign returns the value of the SignatureHeader for the body signed at the Unix
+// time timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, sign(secret, timestamp, body))
+}
+
+// Verify checks that header, the value of the SignatureHeader, is a signature
+// of body made with secret. If tolerance isn't 0 then signatures made more than
+// tolerance before or after now are rejected with ErrSignatureExpired.
+// Receivers should use this to make sure webhooks came from us.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp int64
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			t, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return ErrInvalidSignature
+			}
+			timestamp = t
+		case "v1":
+			signatures = append(signatures, []byte(kv[1]))
+		}
+		// unknown keys are ignored so that new signature versions can be sent
+		// alongside v1
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+
+	expected := sign(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			if tolerance > 0 {
+				age := now.Sub(time.Unix(timestamp, 0))
+				if age > tolerance || age < -tolerance {
+					return ErrSignatureExpired
+				}
+			}
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
@@ -0,0 +1,300 @@
+// Package webhooks delivers order events to the URLs that subscribed to them.
+// The storage instance creates a pending delivery for every matching
+// subscription in the same transaction that it inserts an order event, which
+// makes the deliveries table an outbox: an event is never lost because the
+// process crashed before it was sent and it's never sent for a change that was
+// rolled back. The Dispatcher then polls the outbox and POSTs each delivery to
+// its subscription, retrying failures with exponential backoff until they're
+// delivered or run out of attempts, at which point they're dead-lettered.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+)
+
+const (
+	// DeliveryIDHeader is the header that holds the ID of the delivery, which is
+	// the same for every attempt so receivers can ignore duplicates
+	DeliveryIDHeader = "X-Order-Up-Delivery"
+	// EventTypeHeader is the header that holds the type of the delivered event
+	EventTypeHeader = "X-Order-Up-Event"
+
+	// DefaultMaxAttempts is how many times a delivery is attempted before it's
+	// dead-lettered
+	DefaultMaxAttempts = 8
+	// DefaultBaseBackoff is how long the dispatcher waits after the first failed
+	// attempt, which doubles after every following failure
+	DefaultBaseBackoff = 30 * time.Second
+	// DefaultMaxBackoff is the longest the dispatcher waits between attempts
+	DefaultMaxBackoff = time.Hour
+	// DefaultPollInterval is how often Run looks for deliveries that are due
+	DefaultPollInterval = 5 * time.Second
+	// DefaultBatchSize is the most deliveries that are attempted per poll
+	DefaultBatchSize = 100
+	// DefaultTimeout is how long the receiver has to respond to an attempt
+	DefaultTimeout = 10 * time.Second
+
+	// maxErrorBody is how much of a failed response's body is kept in the
+	// delivery's LastError
+	maxErrorBody = 512
+)
+
+// Payload is the JSON body POSTed to a subscription's URL
+type Payload struct {
+	// DeliveryID is the ID of the delivery and the same as the DeliveryIDHeader
+	DeliveryID int64 `json:"deliveryId"`
+	// Event is the order event being delivered
+	Event storage.OrderEvent `json:"event"`
+}
+
+// Dispatcher sends the pending webhook deliveries in storage to their
+// subscriptions
+type Dispatcher struct {
+	stor   mocks.WebhookStorage
+	client *http.Client
+	now    func() time.Time
+
+	maxAttempts  int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	pollInterval time.Duration
+	batchSize    int
+	timeout      time.Duration
+}
+
+// Option changes how a Dispatcher delivers webhooks
+type Option func(*Dispatcher)
+
+// WithClock replaces the clock used to decide which deliveries are due and when
+// they should next be attempted, which is useful for tests.
+func WithClock(now func() time.Time) Option {
+	return func(d *Dispatcher) {
+		d.now = now
+	}
+}
+
+// WithMaxAttempts sets how many times a delivery is attempted before it's
+// dead-lettered. The default is DefaultMaxAttempts.
+func WithMaxAttempts(n int) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = n
+	}
+}
+
+// WithBackoff sets how long to wait after the first failed attempt, which
+// doubles after every following failure, and the longest to ever wait between
+// attempts. The defaults are DefaultBaseBackoff and DefaultMaxBackoff.
+func WithBackoff(base, max time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.baseBackoff = base
+		d.maxBackoff = max
+	}
+}
+
+// WithPollInterval sets how often Run looks for deliveries that are due. The
+// default is DefaultPollInterval.
+func WithPollInterval(interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.pollInterval = interval
+	}
+}
+
+// WithBatchSize sets the most deliveries that are attempted per poll, where 0
+// means every due delivery. The default is DefaultBatchSize.
+func WithBatchSize(n int) Option {
+	return func(d *Dispatcher) {
+		d.batchSize = n
+	}
+}
+
+// WithTimeout sets how long the receiver has to respond to an attempt. The
+// default is DefaultTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.timeout = timeout
+	}
+}
+
+// New returns a Dispatcher that sends the deliveries in stor using client
+func New(stor mocks.WebhookStorage, client *http.Client, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		stor:         stor,
+		client:       client,
+		now:          time.Now,
+		maxAttempts:  DefaultMaxAttempts,
+		baseBackoff:  DefaultBaseBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+		pollInterval: DefaultPollInterval,
+		batchSize:    DefaultBatchSize,
+		timeout:      DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Run delivers the deliveries that are due every poll interval until ctx is
+// cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		// a full batch means there are probably more deliveries due so we keep
+		// going rather than waiting for the next tick
+		n, err := d.DeliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			llog.Error("failed to deliver webhooks", llog.ErrKV(err))
+		}
+		if err == nil && d.batchSize > 0 && n >= d.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts every pending delivery that's due, up to the batch size,
+// and returns how many were attempted. Failing to deliver a webhook isn't an
+// error, it's retried later, so an error is only returned if storage failed.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	deliveries, err := d.stor.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{
+		Status: storage.WebhookDeliveryPending,
+		DueBy:  d.now(),
+		Limit:  d.batchSize,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting due webhook deliveries: %w", err)
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	subs, err := d.stor.GetWebhookSubscriptions(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting webhook subscriptions: %w", err)
+	}
+	byID := make(map[string]storage.WebhookSubscription, len(subs))
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+
+	var attempted int
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return attempted, ctx.Err()
+		}
+		sub, ok := byID[delivery.SubscriptionID]
+		if !ok {
+			// the subscription was deleted after we got the deliveries which also
+			// deleted the delivery
+			continue
+		}
+		attempted++
+		sendErr := d.send(ctx, sub, delivery)
+		if err := d.finish(ctx, delivery, sendErr); err != nil {
+			return attempted, err
+		}
+	}
+	return attempted, nil
+}
+
+// send makes a single attempt at POSTing the delivery to the subscription's URL
+func (d *Dispatcher) send(ctx context.Context, sub storage.WebhookSubscription, delivery storage.WebhookDelivery) error {
+	body, err := json.Marshal(Payload{DeliveryID: delivery.ID, Event: delivery.Event})
+	if err != nil {
+		return fmt.Errorf("error encoding webhook: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryIDHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(EventTypeHeader, string(delivery.Event.Type))
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, d.now().Unix(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making webhook request: %w", err)
+	}
+	// we need to make sure we close the body otherwise this will leak memory
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("webhook rejected: %d %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// finish records the result of an attempt at the delivery. A failed delivery is
+// retried after a backoff unless it's out of attempts, in which case it's
+// dead-lettered.
+func (d *Dispatcher) finish(ctx context.Context, delivery storage.WebhookDelivery, sendErr error) error {
+	now := d.now()
+	delivery.Attempts++
+	kv := llog.KV{
+		"delivery_id":     delivery.ID,
+		"subscription_id": delivery.SubscriptionID,
+		"event_id":        delivery.Event.ID,
+		"attempts":        delivery.Attempts,
+	}
+	switch {
+	case sendErr == nil:
+		delivery.Status = storage.WebhookDeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		llog.Info("delivered webhook", kv)
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = storage.WebhookDeliveryDead
+		delivery.LastError = sendErr.Error()
+		llog.Error("webhook dead-lettered after too many attempts", kv, llog.ErrKV(sendErr))
+	default:
+		delivery.LastError = sendErr.Error()
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+		llog.Warn("failed to deliver webhook", kv, llog.KV{"next_attempt_at": delivery.NextAttemptAt}, llog.ErrKV(sendErr))
+	}
+
+	err := d.stor.UpdateWebhookDelivery(ctx, delivery, storage.WebhookDeliveryPending)
+	switch {
+	case errors.Is(err, storage.ErrWebhookDeliveryNotFound),
+		errors.Is(err, storage.ErrWebhookDeliveryStatusMismatch):
+		// the subscription was deleted or another dispatcher already finished
+		// the delivery, either way there's nothing left for us to do
+		llog.Warn("webhook delivery changed while it was being attempted", kv, llog.ErrKV(err))
+		return nil
+	case err != nil:
+		return fmt.Errorf("error updating webhook delivery %d: %w", delivery.ID, err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.baseBackoff
+	for n := 1; n < attempts && wait < d.maxBackoff; n++ {
+		wait *= 2
+	}
+	if wait > d.maxBackoff {
+		wait = d.maxBackoff
+	}
+	return wait
+}
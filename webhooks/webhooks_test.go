@@ -0,0 +1,243 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver records the webhooks sent to it after verifying their signatures and
+// responds with status
+type receiver struct {
+	t      *testing.T
+	secret string
+	status int
+
+	m        sync.Mutex
+	payloads []Payload
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(r.t, err)
+	assert.Equal(r.t, "application/json", req.Header.Get("Content-Type"))
+	assert.NoError(r.t, Verify(r.secret, req.Header.Get(SignatureHeader), body, 0, time.Time{}))
+
+	var payload Payload
+	require.NoError(r.t, json.Unmarshal(body, &payload))
+	assert.Equal(r.t, strconv.FormatInt(payload.DeliveryID, 10), req.Header.Get(DeliveryIDHeader))
+	assert.Equal(r.t, string(payload.Event.Type), req.Header.Get(EventTypeHeader))
+
+	r.m.Lock()
+	r.payloads = append(r.payloads, payload)
+	r.m.Unlock()
+	w.WriteHeader(r.status)
+}
+
+// setup returns a memory storage instance with an order and a subscription, and
+// the event that was inserted for the order, whose clock is the returned
+// pointer
+func setup(t *testing.T) (*storage.MemoryInstance, storage.WebhookSubscription, storage.OrderEvent, *time.Time) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	stor := storage.NewMemory()
+	stor.SetClock(func() time.Time { return now })
+
+	sub, err := stor.InsertWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:    "http://receiver/hook",
+		Secret: "secret",
+	})
+	require.NoError(t, err)
+	event, err := stor.ApplyOrderChange(ctx, storage.OrderChange{
+		Insert: &storage.Order{ID: "order1", CustomerEmail: "test@test"},
+		Event:  storage.OrderEvent{Type: storage.OrderEventCreated, Actor: "alice"},
+	})
+	require.NoError(t, err)
+	return stor, sub, event, &now
+}
+
+func TestSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"deliveryId":1}`)
+	header := Sign("secret", now.Unix(), body)
+
+	assert.NoError(t, Verify("secret", header, body, time.Minute, now))
+	assert.NoError(t, Verify("secret", header, body, 0, now.Add(time.Hour)))
+	// other signature versions are ignored
+	assert.NoError(t, Verify("secret", header+",v0=abc", body, 0, now))
+
+	assert.True(t, errors.Is(Verify("other", header, body, 0, now), ErrInvalidSignature))
+	assert.True(t, errors.Is(Verify("secret", header, []byte(`{"deliveryId":2}`), 0, now), ErrInvalidSignature))
+	// the timestamp is signed too so it can't be changed
+	retimed := "t=1700000001" + header[len("t=1700000000"):]
+	assert.True(t, errors.Is(Verify("secret", retimed, body, 0, now), ErrInvalidSignature))
+	assert.True(t, errors.Is(Verify("secret", header, body, time.Minute, now.Add(2*time.Minute)), ErrSignatureExpired))
+	for _, bad := range []string{"", "t=1", "v1=abc", "t=abc,v1=abc", "garbage"} {
+		assert.True(t, errors.Is(Verify("secret", bad, body, 0, now), ErrInvalidSignature), bad)
+	}
+
+	secret1, err := NewSecret()
+	require.NoError(t, err)
+	secret2, err := NewSecret()
+	require.NoError(t, err)
+	assert.Len(t, secret1, 64)
+	assert.NotEqual(t, secret1, secret2)
+}
+
+func TestDeliverDue(t *testing.T) {
+	ctx := context.Background()
+	stor, sub, event, now := setup(t)
+	recv := &receiver{t: t, secret: sub.Secret, status: http.StatusNoContent}
+	d := New(stor, mocks.NewMockedService(recv), WithClock(func() time.Time { return *now }))
+
+	n, err := d.DeliverDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	if assert.Len(t, recv.payloads, 1) {
+		assert.Equal(t, event, recv.payloads[0].Event)
+	}
+
+	deliveries, err := stor.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, recv.payloads[0].DeliveryID, deliveries[0].ID)
+	assert.Equal(t, storage.WebhookDeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	if assert.NotNil(t, deliveries[0].DeliveredAt) {
+		assert.Equal(t, *now, *deliveries[0].DeliveredAt)
+	}
+
+	// delivered webhooks aren't sent again
+	n, err = d.DeliverDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Len(t, recv.payloads, 1)
+}
+
+func TestDeliverDueRetries(t *testing.T) {
+	ctx := context.Background()
+	stor, sub, _, now := setup(t)
+	recv := &receiver{t: t, secret: sub.Secret, status: http.StatusInternalServerError}
+	d := New(stor, mocks.NewMockedService(recv),
+		WithClock(func() time.Time { return *now }),
+		WithMaxAttempts(4),
+		WithBackoff(time.Minute, 3*time.Minute),
+	)
+
+	// the wait doubles after every failure but never goes over the max
+	for attempt, wait := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		n, err := d.DeliverDue(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		deliveries, err := stor.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{})
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, storage.WebhookDeliveryPending, deliveries[0].Status)
+		assert.Equal(t, attempt+1, deliveries[0].Attempts)
+		assert.Equal(t, now.Add(wait), deliveries[0].NextAttemptAt)
+		assert.Contains(t, deliveries[0].LastError, "500")
+
+		// the delivery isn't attempted again until it's due
+		*now = now.Add(wait - time.Second)
+		n, err = d.DeliverDue(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		*now = now.Add(time.Second)
+	}
+
+	// the last attempt dead-letters the delivery
+	n, err := d.DeliverDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, recv.payloads, 4)
+	deliveries, err := stor.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{Status: storage.WebhookDeliveryDead})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, 4, deliveries[0].Attempts)
+	assert.Nil(t, deliveries[0].DeliveredAt)
+
+	*now = now.Add(time.Hour)
+	n, err = d.DeliverDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// once it's retried it's delivered like any other pending delivery
+	recv.status = http.StatusOK
+	retried := deliveries[0]
+	retried.Status = storage.WebhookDeliveryPending
+	retried.Attempts = 0
+	retried.NextAttemptAt = *now
+	require.NoError(t, stor.UpdateWebhookDelivery(ctx, retried, storage.WebhookDeliveryDead))
+	n, err = d.DeliverDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	deliveries, err = stor.GetWebhookDeliveries(ctx, storage.WebhookDeliveryQuery{Status: storage.WebhookDeliveryDelivered})
+	require.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
+
+func TestDeliverDueBatches(t *testing.T) {
+	ctx := context.Background()
+	stor, sub, _, now := setup(t)
+	for n := 0; n < 4; n++ {
+		_, err := stor.ApplyOrderChange(ctx, storage.OrderChange{Event: storage.OrderEvent{OrderID: "order1", Type: storage.OrderEventEdited}})
+		require.NoError(t, err)
+	}
+	recv := &receiver{t: t, secret: sub.Secret, status: http.StatusOK}
+	d := New(stor, mocks.NewMockedService(recv), WithClock(func() time.Time { return *now }), WithBatchSize(2))
+
+	// deliveries are sent in the order they were created
+	for _, expected := range []int{2, 2, 1, 0} {
+		n, err := d.DeliverDue(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+	if assert.Len(t, recv.payloads, 5) {
+		for n := 1; n < len(recv.payloads); n++ {
+			assert.Greater(t, recv.payloads[n].Event.ID, recv.payloads[n-1].Event.ID)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	stor, sub, _, _ := setup(t)
+	recv := &receiver{t: t, secret: sub.Secret, status: http.StatusOK}
+	d := New(stor, mocks.NewMockedService(recv), WithPollInterval(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	// events inserted while the dispatcher is running are picked up by a later
+	// poll
+	_, err := stor.ApplyOrderChange(context.Background(), storage.OrderChange{Event: storage.OrderEvent{OrderID: "order1", Type: storage.OrderEventEdited}})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		recv.m.Lock()
+		defer recv.m.Unlock()
+		return len(recv.payloads) == 2
+	}, time.Second, time.Millisecond)
+
+	// Run returns once the context is cancelled
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+}